@@ -7,6 +7,7 @@ import (
 	"net/http"
 	"os"
 	"strings"
+	"sync"
 	"unicode"
 
 	"github.com/retutils/gomitmproxy/proxy"
@@ -17,6 +18,10 @@ type Dumper struct {
 	proxy.BaseAddon
 	out   io.Writer
 	level int // 0: header 1: header + body
+
+	dumps   sync.WaitGroup // dumps of the flows in flight, waited for by Flush
+	dumpsMu sync.Mutex
+	flushed bool // set by Flush, the flows after it are not dumped
 }
 
 func NewDumper(out io.Writer, level int) *Dumper {
@@ -35,12 +40,27 @@ func NewDumperWithFilename(filename string, level int) *Dumper {
 }
 
 func (d *Dumper) Requestheaders(f *proxy.Flow) {
+	d.dumpsMu.Lock()
+	defer d.dumpsMu.Unlock()
+	if d.flushed {
+		return
+	}
+	d.dumps.Add(1)
 	go func() {
+		defer d.dumps.Done()
 		<-f.Done()
 		d.dump(f)
 	}()
 }
 
+// Flush stops dumping new flows and waits for the dumps of the flows, called by Proxy.Shutdown once the flows are done
+func (d *Dumper) Flush() {
+	d.dumpsMu.Lock()
+	d.flushed = true
+	d.dumpsMu.Unlock()
+	d.dumps.Wait()
+}
+
 // call when <-f.Done()
 func (d *Dumper) dump(f *proxy.Flow) {
 	// 参考 httputil.DumpRequest
@@ -61,9 +81,16 @@ func (d *Dumper) dump(f *proxy.Flow) {
 	}
 	buf.WriteString("\r\n")
 
-	if d.level == 1 && f.Request.Body != nil && len(f.Request.Body) > 0 && canPrint(f.Request.Body) {
-		buf.Write(f.Request.Body)
-		buf.WriteString("\r\n\r\n")
+	if d.level == 1 && f.Request.Body != nil && len(f.Request.Body) > 0 {
+		if f.Request.IsGrpc() {
+			if body, err := f.DecodedGrpcRequest(); err == nil {
+				buf.Write(body)
+				buf.WriteString("\r\n\r\n")
+			}
+		} else if canPrint(f.Request.Body) {
+			buf.Write(f.Request.Body)
+			buf.WriteString("\r\n\r\n")
+		}
 	}
 
 	if f.Response != nil {
@@ -74,7 +101,12 @@ func (d *Dumper) dump(f *proxy.Flow) {
 		}
 		buf.WriteString("\r\n")
 
-		if d.level == 1 && f.Response.Body != nil && len(f.Response.Body) > 0 && f.Response.IsTextContentType() {
+		if d.level == 1 && f.Response.Body != nil && len(f.Response.Body) > 0 && f.Response.IsGrpc() {
+			if body, err := f.DecodedGrpcResponse(); err == nil {
+				buf.Write(body)
+				buf.WriteString("\r\n\r\n")
+			}
+		} else if d.level == 1 && f.Response.Body != nil && len(f.Response.Body) > 0 && f.Response.IsTextContentType() {
 			body, err := f.Response.DecodedBody()
 			if err == nil && body != nil && len(body) > 0 {
 				buf.Write(body)
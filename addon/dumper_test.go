@@ -52,6 +52,26 @@ func TestDumper(t *testing.T) {
 		}
 	})
 
+	t.Run("Grpc", func(t *testing.T) {
+		var buf bytes.Buffer
+		dumper := NewDumper(&buf, 1)
+		f := createTestFlow()
+		// field 1 = "ping", length-prefixed
+		msg := []byte{0, 0, 0, 0, 6, 0x0a, 4, 'p', 'i', 'n', 'g'}
+		f.Request.Header.Set("Content-Type", "application/grpc")
+		f.Request.Body = msg
+		f.Response.Header.Set("Content-Type", "application/grpc")
+		f.Response.Body = msg
+		dumper.Requestheaders(f)
+		f.Finish()
+		dumper.Flush()
+
+		output := buf.String()
+		if !contains(output, `[{"1":"ping"}]`) {
+			t.Errorf("Grpc dump should contain decoded messages: %s", output)
+		}
+	})
+
 	t.Run("Binary", func(t *testing.T) {
 		buf.Reset()
 		f := createTestFlow()
@@ -0,0 +1,194 @@
+package addon
+
+import (
+	"fmt"
+	"io"
+	"math/rand"
+	"net/http"
+	"time"
+
+	"github.com/retutils/gomitmproxy/httpql"
+	"github.com/retutils/gomitmproxy/internal/helper"
+	"github.com/retutils/gomitmproxy/proxy"
+	uuid "github.com/satori/go.uuid"
+	log "github.com/sirupsen/logrus"
+)
+
+// Faults a FaultRule injects, besides the kinds of proxy.ResponseFault
+const (
+	FaultStatus = "status" // the request is answered by a synthetic error response instead of the server
+	FaultDelay  = "delay"  // the request is held before it is sent to the server
+)
+
+// FaultRule injects a fault into a share of the flows matching its query and from
+type FaultRule struct {
+	Query       string   `json:"query"`       // HTTPQL query the flows must match, all if empty
+	From        *MapFrom `json:"from"`        // criteria of map remote the requests must match, all if nil
+	Probability float64  `json:"probability"` // share of the matching flows the fault is injected into, from 0 to 1
+	Fault       string   `json:"fault"`       // status, delay, truncate, reset, malformed_chunked or trickle
+	Status      int      `json:"status"`      // status: the response status, 503 if not set
+	Delay       int      `json:"delay"`       // delay: ms the request is held
+	After       int      `json:"after"`       // truncate, reset, malformed_chunked and trickle: bytes of the body sent before the fault
+	Chunk       int      `json:"chunk"`       // trickle: bytes sent at once, 1 if not set
+	Interval    int      `json:"interval"`    // trickle: ms between chunks
+}
+
+// NewFaultRulesFromFile reads a json array of FaultRule
+func NewFaultRulesFromFile(filename string) ([]*FaultRule, error) {
+	var rules []*FaultRule
+	if err := helper.NewStructFromFile(filename, &rules); err != nil {
+		return nil, err
+	}
+	return rules, nil
+}
+
+type faultRule struct {
+	*FaultRule
+	query *httpql.Query
+}
+
+func newFaultRule(rule *FaultRule) (*faultRule, error) {
+	r := &faultRule{FaultRule: rule}
+	if rule.Query != "" {
+		query, err := httpql.NewParser(httpql.NewLexer(rule.Query)).ParseQuery()
+		if err != nil {
+			return nil, fmt.Errorf("invalid query %v: %w", rule.Query, err)
+		}
+		r.query = query
+	}
+	if rule.From != nil {
+		if err := rule.From.Validate(); err != nil {
+			return nil, err
+		}
+	}
+	if rule.Probability <= 0 || rule.Probability > 1 {
+		return nil, fmt.Errorf("invalid probability %v, want more than 0 up to 1", rule.Probability)
+	}
+	switch rule.Fault {
+	case FaultStatus:
+		if rule.Status != 0 && (rule.Status < 100 || rule.Status > 999) {
+			return nil, fmt.Errorf("invalid status %v", rule.Status)
+		}
+	case FaultDelay, proxy.FaultTruncate, proxy.FaultReset, proxy.FaultMalformedChunked, proxy.FaultTrickle:
+	default:
+		return nil, fmt.Errorf("unknown fault %q", rule.Fault)
+	}
+	if rule.Delay < 0 || rule.After < 0 || rule.Chunk < 0 || rule.Interval < 0 {
+		return nil, fmt.Errorf("invalid %v fault %+v", rule.Fault, *rule)
+	}
+	return r, nil
+}
+
+// onRequest reports whether the fault is injected before the server is asked, the others break the response
+func (r *faultRule) onRequest() bool {
+	return r.Fault == FaultStatus || r.Fault == FaultDelay
+}
+
+func (r *faultRule) match(f *proxy.Flow) bool {
+	if r.From != nil && !r.From.Match(f.Request) {
+		return false
+	}
+	return r.query.Eval(f)
+}
+
+// FaultInjection injects faults into the flows its rules match, to test the retries and timeouts of clients
+// against the real server. Status and delay faults apply once the request body is read, or before it is sent if it is
+// streamed, the others once the response headers arrive, so their queries may test the response.
+// A flow gets the fault of the first rule matching it whose dice roll hits, recorded in Metadata["fault"].
+// Replays have no client and get no faults.
+type FaultInjection struct {
+	proxy.BaseAddon
+	rules []*faultRule
+}
+
+// NewFaultInjection returns the addon injecting the faults of rules
+func NewFaultInjection(rules []*FaultRule) (*FaultInjection, error) {
+	fi := &FaultInjection{}
+	for i, rule := range rules {
+		r, err := newFaultRule(rule)
+		if err != nil {
+			return nil, fmt.Errorf("fault rule %v: %w", i, err)
+		}
+		fi.rules = append(fi.rules, r)
+	}
+	return fi, nil
+}
+
+func (fi *FaultInjection) Request(f *proxy.Flow) {
+	fi.injectRequest(f)
+}
+
+// StreamRequestModifier injects into the streamed requests, set to stream by an addon or once their body was found
+// too large to read, Request is skipped for them
+func (fi *FaultInjection) StreamRequestModifier(f *proxy.Flow, in io.Reader) io.Reader {
+	if f.Stream {
+		fi.injectRequest(f)
+	}
+	return in
+}
+
+func (fi *FaultInjection) Responseheaders(f *proxy.Flow) {
+	r := fi.roll(f, false)
+	if r == nil {
+		return
+	}
+	fault := &proxy.ResponseFault{
+		Kind:     r.Fault,
+		After:    r.After,
+		Chunk:    r.Chunk,
+		Interval: time.Duration(r.Interval) * time.Millisecond,
+	}
+	f.Response.Fault = fault
+	fi.record(f, fault.String())
+}
+
+func (fi *FaultInjection) injectRequest(f *proxy.Flow) {
+	r := fi.roll(f, true)
+	if r == nil {
+		return
+	}
+	if r.Fault == FaultDelay {
+		delay := time.Duration(r.Delay) * time.Millisecond
+		fi.record(f, fmt.Sprintf("%v %v", r.Fault, delay))
+		select {
+		case <-time.After(delay):
+		case <-f.Killed():
+		}
+		return
+	}
+
+	status := r.Status
+	if status == 0 {
+		status = http.StatusServiceUnavailable
+	}
+	fi.record(f, fmt.Sprintf("%v %d", r.Fault, status))
+	f.Response = &proxy.Response{
+		StatusCode: status,
+		Header:     http.Header{"Content-Type": {"text/plain; charset=utf-8"}},
+		Body:       []byte(fmt.Sprintf("injected fault: %d %v\n", status, http.StatusText(status))),
+	}
+}
+
+// roll returns the rule whose fault is injected into f, nil for none
+func (fi *FaultInjection) roll(f *proxy.Flow, onRequest bool) *faultRule {
+	if f.ReplayOf != uuid.Nil {
+		return nil
+	}
+	if _, ok := f.Metadata["fault"]; ok {
+		return nil
+	}
+	for _, r := range fi.rules {
+		if r.onRequest() != onRequest || !r.match(f) {
+			continue
+		}
+		if rand.Float64() < r.Probability {
+			return r
+		}
+	}
+	return nil
+}
+
+func (fi *FaultInjection) record(f *proxy.Flow, fault string) {
+	f.Metadata["fault"] = fault
+	log.Infof("fault injection: %v into %v %v", fault, f.Request.Method, f.Request.URL)
+}
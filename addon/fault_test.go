@@ -0,0 +1,150 @@
+package addon
+
+import (
+	"bytes"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/retutils/gomitmproxy/proxy"
+	uuid "github.com/satori/go.uuid"
+)
+
+func TestFaultInjection(t *testing.T) {
+	newFaults := func(t *testing.T, rules ...*FaultRule) *FaultInjection {
+		t.Helper()
+		fi, err := NewFaultInjection(rules)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return fi
+	}
+	// inject sends a flow through the hooks of fi like the proxy, the response is nil if the request reaches the server
+	inject := func(fi *FaultInjection, f *proxy.Flow) *proxy.Response {
+		if !f.Stream {
+			fi.Request(f)
+		}
+		if f.Response == nil {
+			fi.StreamRequestModifier(f, bytes.NewReader(f.Request.Body))
+		}
+		if f.Response != nil {
+			return f.Response
+		}
+		f.Response = &proxy.Response{StatusCode: 200, Header: http.Header{}, Body: []byte("ok")}
+		fi.Responseheaders(f)
+		return nil
+	}
+
+	t.Run("status", func(t *testing.T) {
+		fi := newFaults(t, &FaultRule{Query: `req.path.eq:"/users"`, Probability: 1, Fault: FaultStatus})
+		res := inject(fi, newPlaybackFlow(t, "GET", "https://example.com/users", ""))
+		if res == nil || res.StatusCode != 503 {
+			t.Fatalf("want a synthetic 503, got %+v", res)
+		}
+		f := newPlaybackFlow(t, "GET", "https://example.com/other", "")
+		if res := inject(fi, f); res != nil || f.Metadata["fault"] != nil {
+			t.Errorf("want an unmatched flow untouched, got %+v %v", res, f.Metadata["fault"])
+		}
+	})
+
+	t.Run("from", func(t *testing.T) {
+		fi := newFaults(t, &FaultRule{From: &MapFrom{Method: []string{"POST"}}, Probability: 1, Fault: FaultStatus, Status: 502})
+		f := newPlaybackFlow(t, "POST", "https://example.com/login", `{"user":"a"}`)
+		if res := inject(fi, f); res == nil || res.StatusCode != 502 || f.Metadata["fault"] != "status 502" {
+			t.Errorf("want a synthetic 502, got %+v %v", res, f.Metadata["fault"])
+		}
+		if res := inject(fi, newPlaybackFlow(t, "GET", "https://example.com/login", "")); res != nil {
+			t.Errorf("want a GET untouched, got %+v", res)
+		}
+	})
+
+	t.Run("delay", func(t *testing.T) {
+		fi := newFaults(t, &FaultRule{Probability: 1, Fault: FaultDelay, Delay: 100})
+		f := newPlaybackFlow(t, "GET", "https://example.com/users", "")
+		start := time.Now()
+		if res := inject(fi, f); res != nil {
+			t.Errorf("want the request sent on, got %+v", res)
+		}
+		if elapsed := time.Since(start); elapsed < 100*time.Millisecond {
+			t.Errorf("want the request held, took %v", elapsed)
+		}
+		if f.Metadata["fault"] != "delay 100ms" {
+			t.Errorf("unexpected fault %v", f.Metadata["fault"])
+		}
+	})
+
+	t.Run("streamed", func(t *testing.T) {
+		fi := newFaults(t, &FaultRule{Query: `req.path.eq:"/upload"`, Probability: 1, Fault: FaultStatus, Status: 500})
+		// the body is over Options.StreamLargeBodies, the proxy streams it without Request
+		f := newPlaybackFlow(t, "PUT", "https://example.com/upload", "")
+		f.Stream = true
+		if res := inject(fi, f); res == nil || res.StatusCode != 500 || f.Metadata["fault"] != "status 500" {
+			t.Errorf("want a synthetic 500, got %+v %v", res, f.Metadata["fault"])
+		}
+
+		fi = newFaults(t, &FaultRule{Probability: 1, Fault: FaultDelay, Delay: 100})
+		f = newPlaybackFlow(t, "PUT", "https://example.com/upload", "")
+		f.Stream = true
+		start := time.Now()
+		if res := inject(fi, f); res != nil {
+			t.Errorf("want the request sent on, got %+v", res)
+		}
+		if elapsed := time.Since(start); elapsed < 100*time.Millisecond || f.Metadata["fault"] != "delay 100ms" {
+			t.Errorf("want the request held once, took %v, fault %v", elapsed, f.Metadata["fault"])
+		}
+	})
+
+	t.Run("response", func(t *testing.T) {
+		fi := newFaults(t,
+			&FaultRule{Query: `resp.code.eq:500`, Probability: 1, Fault: proxy.FaultReset},
+			&FaultRule{Query: `resp.code.eq:200`, Probability: 1, Fault: proxy.FaultTrickle, After: 10, Interval: 20},
+		)
+		f := newPlaybackFlow(t, "GET", "https://example.com/users", "")
+		inject(fi, f)
+		want := proxy.ResponseFault{Kind: proxy.FaultTrickle, After: 10, Interval: 20 * time.Millisecond}
+		if f.Response.Fault == nil || *f.Response.Fault != want {
+			t.Fatalf("want %+v, got %+v", want, f.Response.Fault)
+		}
+		if f.Metadata["fault"] != "trickle after 10 bytes, 1 bytes every 20ms" {
+			t.Errorf("unexpected fault %v", f.Metadata["fault"])
+		}
+	})
+
+	t.Run("probability", func(t *testing.T) {
+		fi := newFaults(t, &FaultRule{Probability: 0.5, Fault: FaultStatus})
+		injected := 0
+		for i := 0; i < 1000; i++ {
+			if inject(fi, newPlaybackFlow(t, "GET", "https://example.com/users", "")) != nil {
+				injected++
+			}
+		}
+		if injected < 400 || injected > 600 {
+			t.Errorf("want about half the flows faulted, got %v of 1000", injected)
+		}
+	})
+
+	t.Run("replay", func(t *testing.T) {
+		fi := newFaults(t, &FaultRule{Probability: 1, Fault: FaultStatus})
+		f := newPlaybackFlow(t, "GET", "https://example.com/users", "")
+		f.ReplayOf = uuid.NewV4()
+		if res := inject(fi, f); res != nil || f.Response.Fault != nil {
+			t.Errorf("want a replay untouched, got %+v", res)
+		}
+	})
+
+	t.Run("errors", func(t *testing.T) {
+		for _, rule := range []*FaultRule{
+			{Probability: 1, Fault: "explode"},
+			{Probability: 0, Fault: FaultStatus},
+			{Probability: 1.5, Fault: FaultStatus},
+			{Probability: 1, Fault: FaultStatus, Status: 42},
+			{Probability: 1, Fault: FaultDelay, Delay: -1},
+			{Probability: 1, Fault: FaultStatus, Query: `req.nothing.eq:"x"`},
+			{Probability: 1, Fault: FaultStatus, From: &MapFrom{Protocol: "ftp"}},
+		} {
+			if _, err := NewFaultInjection([]*FaultRule{rule}); err == nil {
+				t.Errorf("want error for %+v", rule)
+			}
+		}
+	})
+}
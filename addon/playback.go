@@ -0,0 +1,316 @@
+package addon
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"slices"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/retutils/gomitmproxy/internal/helper"
+	"github.com/retutils/gomitmproxy/proxy"
+	"github.com/retutils/gomitmproxy/storage"
+	log "github.com/sirupsen/logrus"
+)
+
+// PlaybackMatch selects the parts of a request which must equal those of a recorded request to play back its response
+type PlaybackMatch struct {
+	IgnoreMethod  bool     `json:"ignore_method"`
+	IgnoreHost    bool     `json:"ignore_host"` // scheme, host and port
+	IgnorePath    bool     `json:"ignore_path"`
+	Params        []string `json:"params"`         // query params matched, all if empty
+	IgnoreParams  []string `json:"ignore_params"`  // query params not matched, e.g. cache busters
+	IgnoreBody    bool     `json:"ignore_body"`    // the sha256 of the decoded body is matched unless set
+	Headers       []string `json:"headers"`        // request headers matched, "*" for all, none if empty
+	IgnoreHeaders []string `json:"ignore_headers"` // headers not matched by "*"
+}
+
+// ServerPlaybackOptions configures ServerPlayback
+type ServerPlaybackOptions struct {
+	StorageDir  string        `json:"storage_dir"`  // storage dir the flows were recorded in by the storage addon
+	Query       string        `json:"query"`        // HTTPQL query selecting the recorded flows, all if empty
+	Match       PlaybackMatch `json:"match"`        // how requests are matched to recorded ones
+	Repeat      bool          `json:"repeat"`       // the last recorded response of a request is served again when the others are used up
+	PassThrough bool          `json:"pass_through"` // unmatched requests are sent to the server instead of answered with 404
+	Report      string        `json:"report"`       // file the unmatched requests are written to as json, updated on every miss
+}
+
+// NewServerPlaybackOptionsFromFile reads ServerPlaybackOptions of a json file
+func NewServerPlaybackOptionsFromFile(filename string) (*ServerPlaybackOptions, error) {
+	var opts ServerPlaybackOptions
+	if err := helper.NewStructFromFile(filename, &opts); err != nil {
+		return nil, err
+	}
+	return &opts, nil
+}
+
+// PlaybackMiss is a request ServerPlayback had no recorded response for
+type PlaybackMiss struct {
+	Method string `json:"method"`
+	URL    string `json:"url"`
+	Reason string `json:"reason"` // "unmatched", or "used up" if the recorded responses were all served once
+	Count  int    `json:"count"`
+}
+
+// ServerPlayback answers requests with the responses recorded by the storage addon instead of contacting the server,
+// a recorded response is served to a request matching its request. Requests are matched once their body is read,
+// without the body if PlaybackMatch.IgnoreBody is set or the body is streamed. The flow of an unmatched request
+// has the reason in Metadata["playback_miss"].
+type ServerPlayback struct {
+	proxy.BaseAddon
+	opts ServerPlaybackOptions
+
+	mu       sync.Mutex
+	recorded map[string]*playbackQueue
+	misses   []*PlaybackMiss
+	missKeys map[string]*PlaybackMiss
+}
+
+// recorded flows of a match key, served in the order they were recorded
+type playbackQueue struct {
+	flows []*proxy.Flow
+	next  int
+}
+
+// NewServerPlayback loads the flows recorded in opts.StorageDir
+func NewServerPlayback(opts *ServerPlaybackOptions) (*ServerPlayback, error) {
+	if opts.StorageDir == "" {
+		return nil, errors.New("server playback: no storage dir")
+	}
+	if _, err := os.Stat(opts.StorageDir); err != nil {
+		return nil, fmt.Errorf("server playback: %w", err)
+	}
+	svc, err := storage.NewService(opts.StorageDir)
+	if err != nil {
+		return nil, fmt.Errorf("server playback: %w", err)
+	}
+	defer svc.Close()
+
+	var entries []*storage.FlowEntry
+	if opts.Query != "" {
+		entries, err = svc.Search(opts.Query)
+		sort.SliceStable(entries, func(i, j int) bool { return entries[i].StartTime.Before(entries[j].StartTime) })
+	} else {
+		entries, err = svc.All()
+	}
+	if err != nil {
+		return nil, fmt.Errorf("server playback: %w", err)
+	}
+
+	sp := &ServerPlayback{
+		opts:     *opts,
+		recorded: make(map[string]*playbackQueue),
+		missKeys: make(map[string]*PlaybackMiss),
+	}
+	count := 0
+	for _, entry := range entries {
+		if entry.StatusCode == 0 || entry.Killed {
+			continue
+		}
+		f, err := entry.ToProxyFlow()
+		if err != nil {
+			log.Warnf("server playback: skip flow %v: %v", entry.ID, err)
+			continue
+		}
+		key := sp.key(f.Request)
+		q, ok := sp.recorded[key]
+		if !ok {
+			q = &playbackQueue{}
+			sp.recorded[key] = q
+		}
+		q.flows = append(q.flows, f)
+		count++
+	}
+	log.Infof("server playback: %v recorded flows loaded from %v", count, opts.StorageDir)
+	return sp, nil
+}
+
+func (sp *ServerPlayback) Requestheaders(f *proxy.Flow) {
+	if sp.opts.Match.IgnoreBody || f.Stream {
+		sp.serve(f)
+	}
+}
+
+func (sp *ServerPlayback) Request(f *proxy.Flow) {
+	if !sp.opts.Match.IgnoreBody {
+		sp.serve(f)
+	}
+}
+
+// StreamRequestModifier serves the requests streamed once their body was found too large to read,
+// Request is skipped for them, so they are matched without the body
+func (sp *ServerPlayback) StreamRequestModifier(f *proxy.Flow, in io.Reader) io.Reader {
+	_, served := f.Metadata["playback"]
+	_, missed := f.Metadata["playback_miss"]
+	if !served && !missed {
+		sp.serve(f)
+	}
+	return in
+}
+
+// Unmatched returns the requests no recorded response was served to, in the order they were first seen
+func (sp *ServerPlayback) Unmatched() []PlaybackMiss {
+	sp.mu.Lock()
+	defer sp.mu.Unlock()
+	misses := make([]PlaybackMiss, 0, len(sp.misses))
+	for _, m := range sp.misses {
+		misses = append(misses, *m)
+	}
+	return misses
+}
+
+func (sp *ServerPlayback) serve(f *proxy.Flow) {
+	key := sp.key(f.Request)
+
+	sp.mu.Lock()
+	var recorded *proxy.Flow
+	reason := "unmatched"
+	if q, ok := sp.recorded[key]; ok {
+		if q.next < len(q.flows) {
+			recorded = q.flows[q.next]
+			q.next++
+		} else if sp.opts.Repeat {
+			recorded = q.flows[len(q.flows)-1]
+		} else {
+			reason = "used up"
+		}
+	}
+	if recorded == nil {
+		sp.miss(f.Request, key, reason)
+	}
+	sp.mu.Unlock()
+
+	if recorded == nil {
+		f.Metadata["playback_miss"] = reason
+		log.Warnf("server playback: no recorded response for %v %v (%v)", f.Request.Method, f.Request.URL, reason)
+		if sp.opts.PassThrough {
+			return
+		}
+		f.Response = &proxy.Response{
+			StatusCode: 404,
+			Header:     http.Header{"Content-Type": {"text/plain; charset=utf-8"}},
+			Body:       []byte(fmt.Sprintf("server playback: no recorded response for %v %v\n", f.Request.Method, f.Request.URL)),
+		}
+		return
+	}
+
+	log.Debugf("server playback: %v %v from %v", f.Request.Method, f.Request.URL, recorded.Id)
+	resp := recorded.Response
+	f.Response = &proxy.Response{
+		StatusCode: resp.StatusCode,
+		Header:     resp.Header.Clone(),
+		Body:       resp.Body,
+		Trailer:    resp.Trailer.Clone(),
+	}
+	f.Metadata["playback"] = recorded.Id.String()
+}
+
+// miss records an unmatched request and rewrites the report, sp.mu is held
+func (sp *ServerPlayback) miss(req *proxy.Request, key string, reason string) {
+	m, ok := sp.missKeys[key]
+	if !ok {
+		m = &PlaybackMiss{Method: req.Method, URL: req.URL.String()}
+		sp.missKeys[key] = m
+		sp.misses = append(sp.misses, m)
+	}
+	m.Reason = reason
+	m.Count++
+
+	if sp.opts.Report == "" {
+		return
+	}
+	content, err := json.MarshalIndent(sp.misses, "", "  ")
+	if err != nil {
+		log.Errorf("server playback: %v", err)
+		return
+	}
+	if err := os.WriteFile(sp.opts.Report, content, 0644); err != nil {
+		log.Errorf("server playback: write report: %v", err)
+	}
+}
+
+// key of req, requests with equal keys match
+func (sp *ServerPlayback) key(req *proxy.Request) string {
+	m := &sp.opts.Match
+	var b strings.Builder
+	if !m.IgnoreMethod {
+		b.WriteString(req.Method)
+	}
+	b.WriteByte('\n')
+	if !m.IgnoreHost {
+		b.WriteString(req.URL.Scheme + "://" + strings.ToLower(helper.CanonicalAddr(req.URL)))
+	}
+	b.WriteByte('\n')
+	if !m.IgnorePath {
+		b.WriteString(req.URL.Path)
+	}
+	b.WriteByte('\n')
+
+	query := req.URL.Query()
+	names := make([]string, 0, len(query))
+	for name := range query {
+		if (len(m.Params) == 0 || slices.Contains(m.Params, name)) && !slices.Contains(m.IgnoreParams, name) {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		for _, v := range query[name] {
+			b.WriteString("&" + name + "=" + v)
+		}
+	}
+	b.WriteByte('\n')
+
+	for _, name := range sp.headerNames(req.Header) {
+		for _, v := range req.Header.Values(name) {
+			b.WriteString(name + ": " + v + "\n")
+		}
+	}
+	b.WriteByte('\n')
+
+	if !m.IgnoreBody {
+		// recorded bodies are stored decoded, without their Content-Encoding
+		body, err := req.DecodedBody()
+		if err != nil {
+			body = req.Body
+		}
+		sum := sha256.Sum256(body)
+		b.WriteString(hex.EncodeToString(sum[:]))
+	}
+	return b.String()
+}
+
+// headerNames returns the sorted names of the matched headers
+func (sp *ServerPlayback) headerNames(header http.Header) []string {
+	m := &sp.opts.Match
+	ignored := func(name string) bool {
+		for _, h := range m.IgnoreHeaders {
+			if http.CanonicalHeaderKey(h) == name {
+				return true
+			}
+		}
+		return false
+	}
+	var names []string
+	if slices.Contains(m.Headers, "*") {
+		for name := range header {
+			// the body is matched decoded, whatever its encoding
+			if !ignored(name) && name != "Content-Encoding" && name != "Content-Length" {
+				names = append(names, name)
+			}
+		}
+	} else {
+		for _, h := range m.Headers {
+			names = append(names, http.CanonicalHeaderKey(h))
+		}
+	}
+	sort.Strings(names)
+	return slices.Compact(names)
+}
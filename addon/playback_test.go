@@ -0,0 +1,255 @@
+package addon
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/retutils/gomitmproxy/proxy"
+	"github.com/retutils/gomitmproxy/storage"
+)
+
+func newPlaybackFlow(t *testing.T, method, rawUrl, body string) *proxy.Flow {
+	t.Helper()
+	u, err := url.Parse(rawUrl)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f := proxy.NewFlow()
+	f.ConnContext = &proxy.ConnContext{ClientConn: &proxy.ClientConn{}}
+	f.Request = &proxy.Request{
+		Method: method,
+		URL:    u,
+		Proto:  "HTTP/1.1",
+		Header: http.Header{"Accept": {"application/json"}, "X-Request-Id": {"1"}},
+		Body:   []byte(body),
+	}
+	return f
+}
+
+// newGzipPlaybackFlow is newPlaybackFlow with the body sent gzip encoded
+func newGzipPlaybackFlow(t *testing.T, method, rawUrl, body string) *proxy.Flow {
+	t.Helper()
+	var buf bytes.Buffer
+	gw := gzip.NewWriter(&buf)
+	gw.Write([]byte(body))
+	gw.Close()
+	f := newPlaybackFlow(t, method, rawUrl, "")
+	f.Request.Header.Set("Content-Encoding", "gzip")
+	f.Request.Header.Set("Content-Length", strconv.Itoa(buf.Len()))
+	f.Request.Body = buf.Bytes()
+	return f
+}
+
+func recordPlaybackFlows(t *testing.T) string {
+	t.Helper()
+	dir := filepath.Join(t.TempDir(), "storage")
+	svc, err := storage.NewService(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer svc.Close()
+
+	start := time.Now()
+	record := func(f *proxy.Flow, status int, body string) {
+		f.Response = &proxy.Response{
+			StatusCode: status,
+			Header:     http.Header{"Content-Type": {"application/json"}},
+			Body:       []byte(body),
+		}
+		f.Timing.Start = start
+		start = start.Add(time.Second)
+		entry, err := storage.NewFlowEntry(f)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := svc.SaveEntry(entry, nil); err != nil {
+			t.Fatal(err)
+		}
+	}
+	record(newPlaybackFlow(t, "GET", "https://example.com/users?page=1&_=123", ""), 200, `["first"]`)
+	record(newPlaybackFlow(t, "GET", "https://example.com/users?page=1&_=456", ""), 200, `["second"]`)
+	record(newPlaybackFlow(t, "GET", "https://example.com/users?page=2", ""), 200, `["page2"]`)
+	record(newPlaybackFlow(t, "POST", "https://example.com/login", `{"user":"a"}`), 201, `{"token":"a"}`)
+	record(newPlaybackFlow(t, "GET", "http://other.com/status", ""), 204, "")
+	record(newGzipPlaybackFlow(t, "POST", "https://example.com/events", `{"event":"a"}`), 202, `{"queued":1}`)
+	// a streamed request is recorded without its body
+	record(newPlaybackFlow(t, "PUT", "https://example.com/upload", ""), 200, `{"uploaded":true}`)
+	return dir
+}
+
+func TestServerPlayback(t *testing.T) {
+	dir := recordPlaybackFlows(t)
+
+	newPlayback := func(t *testing.T, opts ServerPlaybackOptions) *ServerPlayback {
+		t.Helper()
+		opts.StorageDir = dir
+		sp, err := NewServerPlayback(&opts)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return sp
+	}
+	// play sends a request through the hooks of sp like the proxy, the response is nil if it passes through
+	play := func(sp *ServerPlayback, method, rawUrl, body string) *proxy.Response {
+		f := newPlaybackFlow(t, method, rawUrl, body)
+		sp.Requestheaders(f)
+		if f.Response == nil {
+			sp.Request(f)
+		}
+		if f.Response == nil {
+			sp.StreamRequestModifier(f, bytes.NewReader(f.Request.Body))
+		}
+		if f.Response != nil && f.Response.StatusCode != 404 && f.Metadata["playback"] == nil {
+			t.Error("want the recorded flow id in the metadata")
+		}
+		return f.Response
+	}
+	expect := func(t *testing.T, resp *proxy.Response, status int, body string) {
+		t.Helper()
+		if resp == nil {
+			t.Fatalf("want %v response, got none", status)
+		}
+		if resp.StatusCode != status || (body != "" && string(resp.Body) != body) {
+			t.Errorf("want %v %q, got %v %q", status, body, resp.StatusCode, resp.Body)
+		}
+	}
+
+	t.Run("once", func(t *testing.T) {
+		sp := newPlayback(t, ServerPlaybackOptions{})
+		expect(t, play(sp, "GET", "https://example.com/users?_=123&page=1", ""), 200, `["first"]`)
+		expect(t, play(sp, "GET", "https://example.com/users?_=123&page=1", ""), 404, "")
+		expect(t, play(sp, "POST", "https://example.com/login", `{"user":"a"}`), 201, `{"token":"a"}`)
+		expect(t, play(sp, "POST", "https://example.com/login", `{"user":"b"}`), 404, "")
+		expect(t, play(sp, "GET", "http://other.com:80/status", ""), 204, "")
+		expect(t, play(sp, "GET", "https://other.com/status", ""), 404, "")
+
+		misses := sp.Unmatched()
+		if len(misses) != 3 {
+			t.Fatalf("want 3 unmatched requests, got %+v", misses)
+		}
+		if misses[0].Reason != "used up" || misses[1].Reason != "unmatched" || misses[1].Method != "POST" {
+			t.Errorf("unexpected unmatched requests %+v", misses)
+		}
+	})
+
+	t.Run("repeat", func(t *testing.T) {
+		sp := newPlayback(t, ServerPlaybackOptions{
+			Repeat: true,
+			Match:  PlaybackMatch{IgnoreParams: []string{"_"}},
+		})
+		expect(t, play(sp, "GET", "https://example.com/users?page=1&_=789", ""), 200, `["first"]`)
+		expect(t, play(sp, "GET", "https://example.com/users?page=1", ""), 200, `["second"]`)
+		expect(t, play(sp, "GET", "https://example.com/users?page=1", ""), 200, `["second"]`)
+		expect(t, play(sp, "GET", "https://example.com/users?page=2", ""), 200, `["page2"]`)
+	})
+
+	t.Run("match", func(t *testing.T) {
+		sp := newPlayback(t, ServerPlaybackOptions{
+			Match: PlaybackMatch{IgnoreHost: true, Params: []string{"page"}, IgnoreBody: true},
+		})
+		expect(t, play(sp, "GET", "http://localhost:3000/users?page=2&_=1", ""), 200, `["page2"]`)
+		expect(t, play(sp, "POST", "http://localhost:3000/login", `{"user":"b"}`), 201, `{"token":"a"}`)
+
+		sp = newPlayback(t, ServerPlaybackOptions{
+			Match: PlaybackMatch{IgnoreMethod: true, IgnorePath: true, Headers: []string{"accept"}},
+		})
+		expect(t, play(sp, "HEAD", "http://other.com/", ""), 204, "")
+
+		sp = newPlayback(t, ServerPlaybackOptions{
+			Match: PlaybackMatch{Headers: []string{"*"}, IgnoreHeaders: []string{"x-request-id"}},
+		})
+		f := newPlaybackFlow(t, "GET", "http://other.com/status", "")
+		f.Request.Header.Set("X-Request-Id", "2")
+		sp.Request(f)
+		expect(t, f.Response, 204, "")
+		f = newPlaybackFlow(t, "GET", "http://other.com/status", "")
+		f.Request.Header.Set("Accept", "text/html")
+		sp.Request(f)
+		expect(t, f.Response, 404, "")
+	})
+
+	t.Run("gzip", func(t *testing.T) {
+		for _, match := range []PlaybackMatch{{}, {Headers: []string{"*"}}} {
+			sp := newPlayback(t, ServerPlaybackOptions{Match: match})
+			f := newGzipPlaybackFlow(t, "POST", "https://example.com/events", `{"event":"a"}`)
+			sp.Request(f)
+			expect(t, f.Response, 202, `{"queued":1}`)
+			f = newGzipPlaybackFlow(t, "POST", "https://example.com/events", `{"event":"b"}`)
+			sp.Request(f)
+			expect(t, f.Response, 404, "")
+		}
+	})
+
+	t.Run("query", func(t *testing.T) {
+		sp := newPlayback(t, ServerPlaybackOptions{Query: `req.method.eq:"POST"`})
+		expect(t, play(sp, "POST", "https://example.com/login", `{"user":"a"}`), 201, "")
+		expect(t, play(sp, "GET", "http://other.com/status", ""), 404, "")
+	})
+
+	t.Run("pass through", func(t *testing.T) {
+		report := filepath.Join(t.TempDir(), "unmatched.json")
+		sp := newPlayback(t, ServerPlaybackOptions{PassThrough: true, Report: report})
+		if resp := play(sp, "GET", "https://example.com/missing", ""); resp != nil {
+			t.Errorf("want the request passed through, got %v", resp.StatusCode)
+		}
+		play(sp, "GET", "https://example.com/missing", "")
+		content, err := os.ReadFile(report)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var misses []PlaybackMiss
+		if err := json.Unmarshal(content, &misses); err != nil {
+			t.Fatal(err)
+		}
+		if len(misses) != 1 || misses[0].URL != "https://example.com/missing" || misses[0].Count != 2 {
+			t.Errorf("unexpected report %s", content)
+		}
+	})
+
+	// the body of a request is found too large to read after Requestheaders, Request is skipped
+	t.Run("streamed", func(t *testing.T) {
+		stream := func(sp *ServerPlayback, method, rawUrl string) *proxy.Flow {
+			f := newPlaybackFlow(t, method, rawUrl, "")
+			f.Request.Body = nil
+			sp.Requestheaders(f)
+			f.Stream = true
+			if f.Response == nil {
+				sp.StreamRequestModifier(f, strings.NewReader("a large body"))
+			}
+			return f
+		}
+		sp := newPlayback(t, ServerPlaybackOptions{})
+		expect(t, stream(sp, "PUT", "https://example.com/upload").Response, 200, `{"uploaded":true}`)
+		f := stream(sp, "PUT", "https://example.com/upload")
+		expect(t, f.Response, 404, "")
+		if f.Metadata["playback_miss"] != "used up" {
+			t.Errorf("want the miss in the metadata, got %v", f.Metadata)
+		}
+
+		sp = newPlayback(t, ServerPlaybackOptions{PassThrough: true})
+		if f := stream(sp, "PUT", "https://example.com/other"); f.Response != nil {
+			t.Errorf("want the request passed through, got %v", f.Response.StatusCode)
+		}
+		if misses := sp.Unmatched(); len(misses) != 1 || misses[0].URL != "https://example.com/other" {
+			t.Errorf("want the streamed request recorded as a miss, got %+v", misses)
+		}
+	})
+
+	t.Run("errors", func(t *testing.T) {
+		if _, err := NewServerPlayback(&ServerPlaybackOptions{}); err == nil {
+			t.Error("want error without storage dir")
+		}
+		if _, err := NewServerPlayback(&ServerPlaybackOptions{StorageDir: filepath.Join(t.TempDir(), "missing")}); err == nil {
+			t.Error("want error for a missing storage dir")
+		}
+	})
+}
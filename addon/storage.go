@@ -1,6 +1,8 @@
 package addon
 
 import (
+	"sync"
+
 	"github.com/retutils/gomitmproxy/proxy"
 	"github.com/retutils/gomitmproxy/storage"
 	log "github.com/sirupsen/logrus"
@@ -9,6 +11,19 @@ import (
 type StorageAddon struct {
 	proxy.BaseAddon
 	Service *storage.Service
+
+	sessions   map[string]*sync.WaitGroup // websocket or event stream flow id -> pending message saves
+	sessionsMu sync.Mutex
+
+	saved   map[string]chan struct{} // flow id -> closed once its entry is saved, kept until the flow is done
+	savedMu sync.Mutex
+
+	unanswered   map[string]struct{} // ids of the flows without a response from the server yet
+	unansweredMu sync.Mutex
+
+	writes   sync.WaitGroup // saves in the background, waited for by Flush
+	writesMu sync.Mutex
+	flushed  bool // set by Flush, the saves after it are dropped
 }
 
 func NewStorageAddon(storageDir string) (*StorageAddon, error) {
@@ -17,7 +32,8 @@ func NewStorageAddon(storageDir string) (*StorageAddon, error) {
 		return nil, err
 	}
 	return &StorageAddon{
-		Service: svc,
+		Service:  svc,
+		sessions: make(map[string]*sync.WaitGroup),
 	}, nil
 }
 
@@ -31,14 +47,238 @@ func (s *StorageAddon) Response(f *proxy.Flow) {
 	piiData := f.Metadata["pii"]
 
 	// Save flow entry asynchronously
-	go func() {
+	saved := s.saving(f)
+	if !s.async(func() {
+		defer saved()
 		if err := s.Service.SaveEntry(entry, piiData); err != nil {
 			log.Errorf("StorageAddon: failed to save flow %s: %v", entry.ID, err)
 		}
+	}) {
+		saved()
+	}
+}
+
+func (s *StorageAddon) TcpEnd(f *proxy.TcpFlow) {
+	entry, err := storage.NewTcpFlowEntry(f)
+	if err != nil {
+		log.Errorf("StorageAddon: failed to create tcp flow entry %s: %v", f.Id, err)
+		return
+	}
+
+	s.async(func() {
+		if err := s.Service.SaveTcpEntry(entry); err != nil {
+			log.Errorf("StorageAddon: failed to save tcp flow %s: %v", entry.ID, err)
+		}
+	})
+}
+
+func (s *StorageAddon) WebsocketHandshake(f *proxy.Flow) {
+	// index the messages together with the handshake flow when the session ends
+	s.startSession(f, s.Service.IndexWebSocketSession)
+}
+
+func (s *StorageAddon) WebsocketMessage(f *proxy.Flow, msg *proxy.WebSocketMessage) {
+	entry, err := storage.NewWebSocketMessageEntry(f, msg)
+	if err != nil {
+		log.Errorf("StorageAddon: failed to create websocket message entry %s: %v", f.Id, err)
+		return
+	}
+	s.saveInSession(f, func() error {
+		// the addons after this one may still drop the message
+		<-msg.Decided()
+		entry.Dropped = msg.Drop
+		return s.Service.SaveWebSocketMessage(entry)
+	})
+}
+
+// Requestheaders watches the flow until it is done, the response of an addon added after the storage addon,
+// e.g. an injected fault, is replied before the server is asked and fires no Response
+func (s *StorageAddon) Requestheaders(f *proxy.Flow) {
+	id := f.Id.String()
+	s.unansweredMu.Lock()
+	if s.unanswered == nil {
+		s.unanswered = make(map[string]struct{})
+	}
+	s.unanswered[id] = struct{}{}
+	s.unansweredMu.Unlock()
+
+	go func() {
+		<-f.Done()
+		s.unansweredMu.Lock()
+		_, unanswered := s.unanswered[id]
+		delete(s.unanswered, id)
+		s.unansweredMu.Unlock()
+		// killed flows are saved by FlowKilled
+		if !unanswered || f.Response == nil || f.IsKilled() {
+			return
+		}
+		s.Response(f)
+	}()
+}
+
+func (s *StorageAddon) Responseheaders(f *proxy.Flow) {
+	s.unansweredMu.Lock()
+	delete(s.unanswered, f.Id.String())
+	s.unansweredMu.Unlock()
+
+	if !f.Response.IsEventStream() {
+		return
+	}
+	// event streams never reach Response, index the events together with the flow when the stream ends
+	s.startSession(f, s.Service.IndexEventStream)
+}
+
+func (s *StorageAddon) ServerSentEvent(f *proxy.Flow, ev *proxy.ServerSentEvent) {
+	entry, err := storage.NewServerSentEventEntry(f, ev)
+	if err != nil {
+		log.Errorf("StorageAddon: failed to create sse event entry %s: %v", f.Id, err)
+		return
+	}
+	s.saveInSession(f, func() error {
+		return s.Service.SaveServerSentEvent(entry)
+	})
+}
+
+// startSession saves a long-lived flow now and calls index when it is done,
+// after the pending saves of its messages have completed
+func (s *StorageAddon) startSession(f *proxy.Flow, index func(*storage.FlowEntry) error) {
+	entry, err := storage.NewFlowEntry(f)
+	if err != nil {
+		log.Errorf("StorageAddon: failed to create flow entry %s: %v", f.Id, err)
+		return
+	}
+
+	pending := new(sync.WaitGroup)
+	pending.Add(1)
+	s.sessionsMu.Lock()
+	if s.sessions == nil {
+		s.sessions = make(map[string]*sync.WaitGroup)
+	}
+	s.sessions[entry.ID] = pending
+	s.sessionsMu.Unlock()
+
+	saved := s.saving(f)
+	if !s.async(func() {
+		defer pending.Done()
+		defer saved()
+		if err := s.Service.SaveEntry(entry, nil); err != nil {
+			log.Errorf("StorageAddon: failed to save flow %s: %v", entry.ID, err)
+		}
+	}) {
+		pending.Done()
+		saved()
+	}
+
+	go func() {
+		<-f.Done()
+		s.sessionsMu.Lock()
+		delete(s.sessions, entry.ID)
+		s.sessionsMu.Unlock()
+
+		pending.Wait()
+		if err := index(entry); err != nil {
+			log.Errorf("StorageAddon: failed to index session %s: %v", entry.ID, err)
+		}
+	}()
+}
+
+func (s *StorageAddon) FlowKilled(f *proxy.Flow) {
+	id := f.Id.String()
+	s.savedMu.Lock()
+	saved, ok := s.saved[id]
+	s.savedMu.Unlock()
+	if ok {
+		// killed after it was saved
+		s.async(func() {
+			<-saved
+			if err := s.Service.MarkKilled(id); err != nil {
+				log.Errorf("StorageAddon: failed to mark flow %s killed: %v", id, err)
+			}
+		})
+		return
+	}
+
+	entry, err := storage.NewFlowEntry(f)
+	if err != nil {
+		log.Errorf("StorageAddon: failed to create flow entry %s: %v", f.Id, err)
+		return
+	}
+	s.async(func() {
+		if err := s.Service.SaveEntry(entry, nil); err != nil {
+			log.Errorf("StorageAddon: failed to save flow %s: %v", entry.ID, err)
+		}
+	})
+}
+
+// saving registers the save of the entry of f, the returned func is called once it is saved
+func (s *StorageAddon) saving(f *proxy.Flow) func() {
+	id := f.Id.String()
+	ch := make(chan struct{})
+	s.savedMu.Lock()
+	if s.saved == nil {
+		s.saved = make(map[string]chan struct{})
+	}
+	s.saved[id] = ch
+	s.savedMu.Unlock()
+
+	go func() {
+		<-f.Done()
+		s.savedMu.Lock()
+		delete(s.saved, id)
+		s.savedMu.Unlock()
+	}()
+	return func() { close(ch) }
+}
+
+// saveInSession runs save asynchronously if the flow has a session
+func (s *StorageAddon) saveInSession(f *proxy.Flow, save func() error) {
+	s.sessionsMu.Lock()
+	pending, ok := s.sessions[f.Id.String()]
+	if ok {
+		pending.Add(1)
+	}
+	s.sessionsMu.Unlock()
+	if !ok {
+		return
+	}
+
+	if !s.async(func() {
+		defer pending.Done()
+		if err := save(); err != nil {
+			log.Errorf("StorageAddon: failed to save message of %s: %v", f.Id, err)
+		}
+	}) {
+		pending.Done()
+	}
+}
+
+// async runs save in the background, false if it is dropped because the addon was flushed
+func (s *StorageAddon) async(save func()) bool {
+	s.writesMu.Lock()
+	defer s.writesMu.Unlock()
+	if s.flushed {
+		log.Warnf("StorageAddon: flushed, dropping a save")
+		return false
+	}
+	s.writes.Add(1)
+	go func() {
+		defer s.writes.Done()
+		save()
 	}()
+	return true
+}
+
+// Flush stops accepting saves and waits for the pending ones, called by Proxy.Shutdown once the flows are done
+func (s *StorageAddon) Flush() {
+	s.writesMu.Lock()
+	s.flushed = true
+	s.writesMu.Unlock()
+	s.writes.Wait()
 }
 
+// Close closes the storage once the pending saves are done
 func (s *StorageAddon) Close() {
+	s.Flush()
 	if s.Service != nil {
 		s.Service.Close()
 	}
@@ -8,6 +8,7 @@ import (
 	"time"
 	
 	"github.com/retutils/gomitmproxy/proxy"
+	"github.com/retutils/gomitmproxy/storage"
 	uuid "github.com/satori/go.uuid"
 )
 
@@ -93,3 +94,219 @@ func TestStorageAddon_Response_Error(t *testing.T) {
 	addon.Response(flow)
 	// Should log error and return
 }
+
+func TestStorageAddon_WebSocket(t *testing.T) {
+	addon, err := NewStorageAddon(t.TempDir())
+	if err != nil {
+		t.Fatalf("Failed to create storage addon: %v", err)
+	}
+	defer addon.Close()
+
+	f := proxy.NewFlow()
+	f.ConnContext = &proxy.ConnContext{ClientConn: &proxy.ClientConn{}}
+	f.Request = &proxy.Request{
+		Method: "GET",
+		URL:    &url.URL{Scheme: "ws", Host: "chat.example.com", Path: "/socket"},
+		Header: http.Header{},
+	}
+	f.Response = &proxy.Response{StatusCode: 101, Header: http.Header{}}
+
+	addon.WebsocketHandshake(f)
+	addon.WebsocketMessage(f, &proxy.WebSocketMessage{Type: 1, Data: []byte("order pizza"), FromClient: true})
+	addon.WebsocketMessage(f, &proxy.WebSocketMessage{Type: 1, Data: []byte("pizza on its way"), FromClient: false})
+	addon.WebsocketMessage(f, &proxy.WebSocketMessage{Type: 1, Data: []byte("no anchovies"), FromClient: true, Drop: true})
+	f.Finish()
+
+	// wait for async save and index
+	var results []*storage.FlowEntry
+	for i := 0; i < 20 && len(results) == 0; i++ {
+		time.Sleep(50 * time.Millisecond)
+		results, _ = addon.Service.Search(`ws.msg.cont:"on its way"`)
+	}
+	if len(results) != 1 || results[0].ID != f.Id.String() {
+		t.Fatalf("Expected websocket flow, got %v", results)
+	}
+
+	msgs, err := addon.Service.ListWebSocketMessages(f.Id.String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(msgs) != 3 {
+		t.Fatalf("Expected 3 messages, got %d", len(msgs))
+	}
+	for _, msg := range msgs {
+		if want := string(msg.Payload) == "no anchovies"; msg.Dropped != want {
+			t.Errorf("Expected message %q dropped %v, got %v", msg.Payload, want, msg.Dropped)
+		}
+	}
+
+	// messages of unknown sessions are ignored
+	addon.WebsocketMessage(proxy.NewFlow(), &proxy.WebSocketMessage{Type: 1, Data: []byte("x")})
+}
+
+func TestStorageAddon_ServerSentEvents(t *testing.T) {
+	addon, err := NewStorageAddon(t.TempDir())
+	if err != nil {
+		t.Fatalf("Failed to create storage addon: %v", err)
+	}
+	defer addon.Close()
+
+	f := proxy.NewFlow()
+	f.ConnContext = &proxy.ConnContext{ClientConn: &proxy.ClientConn{}}
+	f.Request = &proxy.Request{
+		Method: "GET",
+		URL:    &url.URL{Scheme: "https", Host: "example.com", Path: "/events"},
+		Header: http.Header{},
+	}
+	f.Response = &proxy.Response{StatusCode: 200, Header: http.Header{"Content-Type": {"text/event-stream"}}}
+
+	addon.Responseheaders(f)
+	addon.ServerSentEvent(f, &proxy.ServerSentEvent{Id: "1", Data: "price update"})
+	f.Finish()
+
+	var results []*storage.FlowEntry
+	for i := 0; i < 20 && len(results) == 0; i++ {
+		time.Sleep(50 * time.Millisecond)
+		results, _ = addon.Service.Search(`resp.body.cont:"price update"`)
+	}
+	if len(results) != 1 || results[0].ID != f.Id.String() {
+		t.Fatalf("Expected event stream flow, got %v", results)
+	}
+
+	// plain responses are not tracked as sessions
+	plain := proxy.NewFlow()
+	plain.Response = &proxy.Response{StatusCode: 200, Header: http.Header{}}
+	addon.Responseheaders(plain)
+}
+
+func TestStorageAddon_FlowKilled(t *testing.T) {
+	addon, err := NewStorageAddon(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer addon.Close()
+
+	newFlow := func(path string) *proxy.Flow {
+		f := proxy.NewFlow()
+		f.ConnContext = &proxy.ConnContext{ClientConn: &proxy.ClientConn{}}
+		f.Request = &proxy.Request{Method: "GET", URL: &url.URL{Scheme: "https", Host: "kill.example.com", Path: path}, Header: http.Header{}}
+		return f
+	}
+
+	// killed before the response
+	before := newFlow("/killedbefore")
+	before.Kill()
+	addon.FlowKilled(before)
+	before.Finish()
+
+	// killed while the saved response is sent to the client
+	after := newFlow("/killedafter")
+	after.Response = &proxy.Response{StatusCode: 200, Header: http.Header{}, Body: []byte("ok")}
+	addon.Response(after)
+	after.Kill()
+	addon.FlowKilled(after)
+	defer after.Finish()
+
+	for _, path := range []string{"/killedbefore", "/killedafter"} {
+		var results []*storage.FlowEntry
+		for i := 0; i < 50; i++ {
+			results, err = addon.Service.Search(`req.path.eq:"` + path + `"`)
+			if err == nil && len(results) == 1 && results[0].Killed {
+				break
+			}
+			time.Sleep(20 * time.Millisecond)
+		}
+		if len(results) != 1 || !results[0].Killed {
+			t.Errorf("%v: want the stored flow killed, got %v %v", path, results, err)
+		}
+	}
+}
+
+func TestStorageAddon_AnsweredByAddon(t *testing.T) {
+	addon, err := NewStorageAddon(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer addon.Close()
+
+	newFlow := func(path string) *proxy.Flow {
+		f := proxy.NewFlow()
+		f.ConnContext = &proxy.ConnContext{ClientConn: &proxy.ClientConn{}}
+		f.Request = &proxy.Request{Method: "GET", URL: &url.URL{Scheme: "https", Host: "fault.example.com", Path: path}, Header: http.Header{}}
+		return f
+	}
+
+	// answered by an addon after the storage addon, no Response fires
+	answered := newFlow("/answered")
+	addon.Requestheaders(answered)
+	answered.Response = &proxy.Response{StatusCode: 503, Header: http.Header{}, Body: []byte("injected")}
+	answered.Metadata["fault"] = "status 503"
+	answered.Finish()
+
+	// answered by the server, saved once by Response
+	served := newFlow("/served")
+	addon.Requestheaders(served)
+	served.Response = &proxy.Response{StatusCode: 200, Header: http.Header{}, Body: []byte("ok")}
+	addon.Responseheaders(served)
+	addon.Response(served)
+	served.Finish()
+
+	for _, tc := range []struct {
+		path   string
+		status int
+		fault  string
+	}{
+		{"/answered", 503, "status 503"},
+		{"/served", 200, ""},
+	} {
+		var results []*storage.FlowEntry
+		for i := 0; i < 50; i++ {
+			results, err = addon.Service.Search(`req.path.eq:"` + tc.path + `"`)
+			if err == nil && len(results) > 0 {
+				break
+			}
+			time.Sleep(20 * time.Millisecond)
+		}
+		if len(results) != 1 || results[0].StatusCode != tc.status || results[0].Fault != tc.fault {
+			t.Errorf("%v: want a stored flow %v %q, got %v %v", tc.path, tc.status, tc.fault, results, err)
+		}
+	}
+}
+
+func TestStorageAddon_Flush(t *testing.T) {
+	addon, err := NewStorageAddon(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer addon.Close()
+
+	newFlow := func(path string) *proxy.Flow {
+		f := proxy.NewFlow()
+		f.ConnContext = &proxy.ConnContext{ClientConn: &proxy.ClientConn{}}
+		f.Request = &proxy.Request{Method: "GET", URL: &url.URL{Scheme: "https", Host: "flush.example.com", Path: path}, Header: http.Header{}}
+		f.Response = &proxy.Response{StatusCode: 200, Header: http.Header{}, Body: []byte("ok")}
+		return f
+	}
+
+	// flows still finishing while the addon is flushed
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for i := 0; i < 20; i++ {
+			f := newFlow("/during")
+			addon.Requestheaders(f)
+			f.Finish()
+		}
+	}()
+	addon.Flush()
+	<-done
+
+	// the saves after Flush are dropped, their flows are not waited for
+	after := newFlow("/after")
+	addon.Response(after)
+	after.Finish()
+	addon.Flush()
+	if results, err := addon.Service.Search(`req.path.eq:"/after"`); err != nil || len(results) != 0 {
+		t.Errorf("want the flow after Flush dropped, got %v %v", results, err)
+	}
+}
@@ -38,6 +38,9 @@ func defineFlags(fs *flag.FlagSet, config *Config) {
 	fs.BoolVar(&config.SslInsecure, "ssl_insecure", config.SslInsecure, "not verify upstream server SSL/TLS certificates.")
 	fs.Var((*arrayValue)(&config.IgnoreHosts), "ignore_hosts", "a list of ignore hosts")
 	fs.Var((*arrayValue)(&config.AllowHosts), "allow_hosts", "a list of allow hosts")
+	fs.IntVar(&config.AddonMaxFailures, "addon_max_failures", config.AddonMaxFailures, "disable an addon once its hooks panicked this many times, 0 to keep failing addons enabled")
+	fs.IntVar(&config.ShutdownTimeout, "shutdown_timeout", config.ShutdownTimeout, "seconds the flows in flight get to finish on SIGINT or SIGTERM, default 10")
+	fs.Var((*arrayValue)(&config.DisableAddons), "disable_addons", "a list of addons registered disabled, e.g. StorageAddon, the web interface enables them")
 	fs.StringVar(&config.CertPath, "cert_path", config.CertPath, "path of generate cert files")
 	fs.IntVar(&config.Debug, "debug", config.Debug, "debug mode: 1 - print debug log, 2 - show debug from")
 	fs.StringVar(&config.Dump, "dump", config.Dump, "dump filename")
@@ -57,11 +60,37 @@ func defineFlags(fs *flag.FlagSet, config *Config) {
 	fs.BoolVar(&config.ScanTech, "scan_tech", config.ScanTech, "Enable technology and framework scanning (Wappalyzer)")
 	fs.StringVar(&config.StorageDir, "storage_dir", config.StorageDir, "Directory to store captured flows (DuckDB + Bleve)")
 	fs.StringVar(&config.Search, "search", config.Search, "Search query for stored flows (requires -storage_dir)")
+	fs.Var((*arrayValue)(&config.Replay), "replay", "id of a stored flow to replay through the proxy, then exit (requires -storage_dir, repeatable)")
+	fs.StringVar(&config.ReplayQuery, "replay_query", config.ReplayQuery, "HTTPQL query of stored flows to replay through the proxy in capture order, then exit (requires -storage_dir)")
+	fs.StringVar(&config.ReplayTarget, "replay_target", config.ReplayTarget, "replay to this scheme://host[:port] instead of the original targets")
+	fs.BoolVar(&config.ReplayKeepTiming, "replay_keep_timing", config.ReplayKeepTiming, "start the replays with the time between the original requests")
+	fs.IntVar(&config.ReplayConcurrency, "replay_concurrency", config.ReplayConcurrency, "number of replays in flight at once, default 1")
+	fs.StringVar(&config.ReplaySession, "replay_session", config.ReplaySession, "storage dir the replays are stored in, separate from the replayed flows of -storage_dir, default a timestamped <storage_dir>-replay-<time> dir")
 	fs.Var((*arrayValue)(&config.DnsResolvers), "dns_resolvers", "a list of DNS resolvers")
 	fs.IntVar(&config.DnsRetries, "dns_retries", config.DnsRetries, "number of DNS resolution retries")
 	if config.DnsRetries == 0 {
 		config.DnsRetries = 2
 	}
+	fs.Var((*arrayValue)(&config.Reverse), "reverse", "reverse proxy mode: a list of backend urls, e.g. http://127.0.0.1:8000")
+	fs.BoolVar(&config.ReverseTls, "reverse_tls", config.ReverseTls, "reverse proxy mode: terminate TLS on the listen addr")
+	fs.Var((*arrayValue)(&config.GrpcDescriptors), "grpc_descriptors", "FileDescriptorSet files to decode grpc messages, e.g. generated by protoc --include_imports --descriptor_set_out")
+	fs.BoolVar(&config.ConnPool, "conn_pool", config.ConnPool, "share upstream connections across client connections")
+	fs.IntVar(&config.ConnPoolIdleTimeout, "conn_pool_idle_timeout", config.ConnPoolIdleTimeout, "seconds a pooled upstream connection is kept idle, default 90")
+	fs.IntVar(&config.ConnPoolMaxPerHost, "conn_pool_max_per_host", config.ConnPoolMaxPerHost, "max pooled upstream connections per host, 0 for no limit")
+	fs.StringVar(&config.UpstreamRules, "upstream_rules", config.UpstreamRules, "upstream routing rules config filename, rules route hosts, cidrs and schemes to an upstream proxy or DIRECT")
+	fs.StringVar(&config.UpstreamPac, "upstream_pac", config.UpstreamPac, "proxy auto-config file path or url, chooses the upstream proxy of requests no upstream rule matches")
+	fs.Var((*arrayValue)(&config.UpstreamPool), "upstream_pool", "a list of upstream proxies requests are spread over, used instead of -upstream")
+	fs.StringVar(&config.UpstreamStrategy, "upstream_strategy", config.UpstreamStrategy, "upstream pool strategy: round-robin, random, sticky-conn, sticky-host or least-errors")
+	fs.IntVar(&config.UpstreamHealthCheck, "upstream_health_check", config.UpstreamHealthCheck, "seconds between upstream pool health checks, 0 to disable")
+	fs.StringVar(&config.UpstreamHealthCheckTarget, "upstream_health_check_target", config.UpstreamHealthCheckTarget, "host:port health checks connect to through each upstream, the upstream itself if empty")
+	fs.StringVar(&config.ClientCerts, "client_certs", config.ClientCerts, "client certificates config filename, certificates are presented to upstream servers requesting one")
+	fs.BoolVar(&config.RequestClientCert, "request_client_cert", config.RequestClientCert, "request a certificate from downstream clients, the client_certs entry holding its key is preferred upstream")
+	fs.BoolVar(&config.KillRst, "kill_rst", config.KillRst, "killed flows reset the http/1 client connection with a TCP RST instead of closing it")
+	fs.StringVar(&config.ServerPlayback, "server_playback", config.ServerPlayback, "answer requests with the responses recorded in this storage dir instead of contacting the servers")
+	fs.StringVar(&config.Network, "network", config.Network, "emulate a network for all clients: edge, 3g, 4g or lossy-wifi")
+	fs.StringVar(&config.NetworkRules, "network_rules", config.NetworkRules, "network condition rules config filename, rules throttle and delay the traffic of hosts and clients")
+	fs.StringVar(&config.FaultRules, "fault_rules", config.FaultRules, "fault injection rules config filename, rules inject errors, delays and broken responses into matching flows")
+	fs.StringVar(&config.ServerPlaybackConfig, "server_playback_config", config.ServerPlaybackConfig, "server playback config filename: matching, repeat, pass through and unmatched report")
 }
 
 func mergeConfigs(fileConfig, cliConfig *Config) *Config {
@@ -133,6 +162,75 @@ func mergeConfigs(fileConfig, cliConfig *Config) *Config {
 	if cliConfig.ScanTech {
 		config.ScanTech = cliConfig.ScanTech
 	}
+	if len(cliConfig.Reverse) > 0 {
+		config.Reverse = cliConfig.Reverse
+	}
+	if cliConfig.ReverseTls {
+		config.ReverseTls = cliConfig.ReverseTls
+	}
+	if len(cliConfig.GrpcDescriptors) > 0 {
+		config.GrpcDescriptors = cliConfig.GrpcDescriptors
+	}
+	if cliConfig.ConnPool {
+		config.ConnPool = cliConfig.ConnPool
+	}
+	if cliConfig.ConnPoolIdleTimeout != 0 {
+		config.ConnPoolIdleTimeout = cliConfig.ConnPoolIdleTimeout
+	}
+	if cliConfig.ConnPoolMaxPerHost != 0 {
+		config.ConnPoolMaxPerHost = cliConfig.ConnPoolMaxPerHost
+	}
+	if cliConfig.UpstreamRules != "" {
+		config.UpstreamRules = cliConfig.UpstreamRules
+	}
+	if cliConfig.UpstreamPac != "" {
+		config.UpstreamPac = cliConfig.UpstreamPac
+	}
+	if len(cliConfig.UpstreamPool) > 0 {
+		config.UpstreamPool = cliConfig.UpstreamPool
+	}
+	if cliConfig.UpstreamStrategy != "" {
+		config.UpstreamStrategy = cliConfig.UpstreamStrategy
+	}
+	if cliConfig.UpstreamHealthCheck != 0 {
+		config.UpstreamHealthCheck = cliConfig.UpstreamHealthCheck
+	}
+	if cliConfig.UpstreamHealthCheckTarget != "" {
+		config.UpstreamHealthCheckTarget = cliConfig.UpstreamHealthCheckTarget
+	}
+	if cliConfig.ClientCerts != "" {
+		config.ClientCerts = cliConfig.ClientCerts
+	}
+	if cliConfig.RequestClientCert {
+		config.RequestClientCert = cliConfig.RequestClientCert
+	}
+	if cliConfig.KillRst {
+		config.KillRst = cliConfig.KillRst
+	}
+	if cliConfig.ServerPlayback != "" {
+		config.ServerPlayback = cliConfig.ServerPlayback
+	}
+	if cliConfig.ServerPlaybackConfig != "" {
+		config.ServerPlaybackConfig = cliConfig.ServerPlaybackConfig
+	}
+	if cliConfig.Network != "" {
+		config.Network = cliConfig.Network
+	}
+	if cliConfig.NetworkRules != "" {
+		config.NetworkRules = cliConfig.NetworkRules
+	}
+	if cliConfig.FaultRules != "" {
+		config.FaultRules = cliConfig.FaultRules
+	}
+	if len(cliConfig.DisableAddons) > 0 {
+		config.DisableAddons = cliConfig.DisableAddons
+	}
+	if cliConfig.AddonMaxFailures != 0 {
+		config.AddonMaxFailures = cliConfig.AddonMaxFailures
+	}
+	if cliConfig.ShutdownTimeout != 0 {
+		config.ShutdownTimeout = cliConfig.ShutdownTimeout
+	}
 	return config
 }
 
@@ -110,6 +110,106 @@ func TestMergeConfigs_Dns(t *testing.T) {
     if merged.DnsRetries != 5 { t.Error("DnsRetries") }
 }
 
+func TestMergeConfigs_UpstreamRouting(t *testing.T) {
+	fileConfig := &Config{UpstreamRules: "rules1.json", UpstreamPac: "http://wpad/proxy.pac"}
+	merged := mergeConfigs(fileConfig, &Config{UpstreamPac: "proxy.pac"})
+	if merged.UpstreamRules != "rules1.json" {
+		t.Error("UpstreamRules should be kept from file")
+	}
+	if merged.UpstreamPac != "proxy.pac" {
+		t.Error("UpstreamPac")
+	}
+}
+
+func TestMergeConfigs_UpstreamPool(t *testing.T) {
+	fileConfig := &Config{UpstreamPool: []string{"http://a:3128"}, UpstreamStrategy: "random", UpstreamHealthCheck: 30}
+	cliConfig := &Config{UpstreamPool: []string{"http://b:3128", "socks5://c:1080"}, UpstreamHealthCheckTarget: "example.com:443"}
+	merged := mergeConfigs(fileConfig, cliConfig)
+	if len(merged.UpstreamPool) != 2 || merged.UpstreamPool[0] != "http://b:3128" {
+		t.Error("UpstreamPool")
+	}
+	if merged.UpstreamStrategy != "random" || merged.UpstreamHealthCheck != 30 {
+		t.Error("UpstreamStrategy and UpstreamHealthCheck should be kept from file")
+	}
+	if merged.UpstreamHealthCheckTarget != "example.com:443" {
+		t.Error("UpstreamHealthCheckTarget")
+	}
+}
+
+func TestMergeConfigs_ClientCerts(t *testing.T) {
+	if merged := mergeConfigs(&Config{ClientCerts: "certs1.json"}, &Config{}); merged.ClientCerts != "certs1.json" {
+		t.Error("ClientCerts should be kept from file")
+	}
+	if merged := mergeConfigs(&Config{ClientCerts: "certs1.json"}, &Config{ClientCerts: "certs2.json"}); merged.ClientCerts != "certs2.json" {
+		t.Error("ClientCerts")
+	}
+	if merged := mergeConfigs(&Config{}, &Config{RequestClientCert: true}); !merged.RequestClientCert {
+		t.Error("RequestClientCert")
+	}
+	if merged := mergeConfigs(&Config{}, &Config{KillRst: true}); !merged.KillRst {
+		t.Error("KillRst")
+	}
+}
+
+func TestMergeConfigs_ServerPlayback(t *testing.T) {
+	file := &Config{ServerPlayback: "recorded1", ServerPlaybackConfig: "playback1.json"}
+	if merged := mergeConfigs(file, &Config{}); merged.ServerPlayback != "recorded1" || merged.ServerPlaybackConfig != "playback1.json" {
+		t.Error("ServerPlayback should be kept from file")
+	}
+	merged := mergeConfigs(file, &Config{ServerPlayback: "recorded2", ServerPlaybackConfig: "playback2.json"})
+	if merged.ServerPlayback != "recorded2" || merged.ServerPlaybackConfig != "playback2.json" {
+		t.Error("ServerPlayback")
+	}
+}
+
+func TestMergeConfigs_Network(t *testing.T) {
+	file := &Config{Network: "3g", NetworkRules: "network1.json"}
+	if merged := mergeConfigs(file, &Config{}); merged.Network != "3g" || merged.NetworkRules != "network1.json" {
+		t.Error("Network should be kept from file")
+	}
+	if merged := mergeConfigs(file, &Config{Network: "edge", NetworkRules: "network2.json"}); merged.Network != "edge" || merged.NetworkRules != "network2.json" {
+		t.Error("Network")
+	}
+}
+
+func TestMergeConfigs_FaultRules(t *testing.T) {
+	file := &Config{FaultRules: "faults1.json"}
+	if merged := mergeConfigs(file, &Config{}); merged.FaultRules != "faults1.json" {
+		t.Error("FaultRules should be kept from file")
+	}
+	if merged := mergeConfigs(file, &Config{FaultRules: "faults2.json"}); merged.FaultRules != "faults2.json" {
+		t.Error("FaultRules")
+	}
+}
+
+func TestMergeConfigs_DisableAddons(t *testing.T) {
+	file := &Config{DisableAddons: []string{"StorageAddon"}}
+	if merged := mergeConfigs(file, &Config{}); len(merged.DisableAddons) != 1 || merged.DisableAddons[0] != "StorageAddon" {
+		t.Error("DisableAddons should be kept from file")
+	}
+	if merged := mergeConfigs(file, &Config{DisableAddons: []string{"LogAddon"}}); len(merged.DisableAddons) != 1 || merged.DisableAddons[0] != "LogAddon" {
+		t.Error("DisableAddons")
+	}
+}
+
+func TestMergeConfigs_AddonMaxFailures(t *testing.T) {
+	if merged := mergeConfigs(&Config{AddonMaxFailures: 5}, &Config{}); merged.AddonMaxFailures != 5 {
+		t.Error("AddonMaxFailures should be kept from file")
+	}
+	if merged := mergeConfigs(&Config{AddonMaxFailures: 5}, &Config{AddonMaxFailures: 10}); merged.AddonMaxFailures != 10 {
+		t.Error("AddonMaxFailures")
+	}
+}
+
+func TestMergeConfigs_ShutdownTimeout(t *testing.T) {
+	if merged := mergeConfigs(&Config{ShutdownTimeout: 5}, &Config{}); merged.ShutdownTimeout != 5 {
+		t.Error("ShutdownTimeout should be kept from file")
+	}
+	if merged := mergeConfigs(&Config{ShutdownTimeout: 5}, &Config{ShutdownTimeout: 30}); merged.ShutdownTimeout != 30 {
+		t.Error("ShutdownTimeout")
+	}
+}
+
 func TestLoadConfig_Error(t *testing.T) {
     _, err := loadConfigFromFile("non_existent.json")
     if err == nil {
@@ -230,3 +330,15 @@ func TestLoadConfig_FileNotFound(t *testing.T) {
 		t.Errorf("Expected default addr, got %s", config.Addr)
 	}
 }
+
+func TestMergeConfigs_Reverse(t *testing.T) {
+	fileConfig := &Config{Reverse: []string{"http://127.0.0.1:8000"}}
+	cliConfig := &Config{Reverse: []string{"https://127.0.0.1:8443"}, ReverseTls: true}
+	merged := mergeConfigs(fileConfig, cliConfig)
+	if len(merged.Reverse) != 1 || merged.Reverse[0] != "https://127.0.0.1:8443" {
+		t.Errorf("Reverse = %v", merged.Reverse)
+	}
+	if !merged.ReverseTls {
+		t.Error("ReverseTls should be true from cli")
+	}
+}
@@ -1,12 +1,17 @@
 package main
 
 import (
+	"context"
 	"fmt"
 	rawLog "log"
 	"net/http"
 	"net/url"
 	"os"
+	"os/signal"
+	"path/filepath"
 	"strings"
+	"syscall"
+	"time"
 
 	"github.com/retutils/gomitmproxy/addon"
 	"github.com/retutils/gomitmproxy/internal/helper"
@@ -42,10 +47,49 @@ type Config struct {
 	FingerprintList bool     `json:"fingerprint_list"` // List saved fingerprints
 	StorageDir      string   `json:"storage_dir"`      // Directory to store captured flows (DuckDB + Bleve)
 	Search          string   `json:"search"`           // Search query for stored flows
+	Replay          []string `json:"replay"`           // ids of stored flows to replay, then exit
+	ReplayQuery     string   `json:"replay_query"`     // HTTPQL query of stored flows to replay, then exit
 	ScanPII         bool     `json:"scan_pii"`         // Enable PII scanning (regex + AC)
 	ScanTech        bool     `json:"scan_tech"`        // Enable technology scanning (Wappalyzer)
 	DnsResolvers    []string `json:"dns_resolvers"`
 	DnsRetries      int      `json:"dns_retries"`
+	Reverse         []string `json:"reverse"`          // Reverse proxy mode: backend urls
+	ReverseTls      bool     `json:"reverse_tls"`      // Reverse proxy mode: terminate TLS on the listener
+	GrpcDescriptors []string `json:"grpc_descriptors"` // FileDescriptorSet files to decode grpc messages
+
+	ConnPool            bool `json:"conn_pool"`              // share upstream connections across client connections
+	ConnPoolIdleTimeout int  `json:"conn_pool_idle_timeout"` // seconds a pooled connection is kept idle
+	ConnPoolMaxPerHost  int  `json:"conn_pool_max_per_host"` // max pooled connections per upstream host
+
+	UpstreamRules string `json:"upstream_rules"` // upstream routing rules config filename
+	UpstreamPac   string `json:"upstream_pac"`   // proxy auto-config file path or url
+
+	UpstreamPool              []string `json:"upstream_pool"`                // upstream proxies requests are spread over
+	UpstreamStrategy          string   `json:"upstream_strategy"`            // round-robin, random, sticky-conn, sticky-host or least-errors
+	UpstreamHealthCheck       int      `json:"upstream_health_check"`        // seconds between upstream pool health checks, 0 to disable
+	UpstreamHealthCheckTarget string   `json:"upstream_health_check_target"` // host:port health checks connect to through each upstream
+
+	ClientCerts       string `json:"client_certs"`        // upstream client certificates config filename
+	RequestClientCert bool   `json:"request_client_cert"` // request a certificate from downstream clients
+	KillRst           bool   `json:"kill_rst"`            // killed flows reset the client connection
+
+	ReplayTarget      string `json:"replay_target"`      // scheme://host[:port] replays are sent to instead of the original target
+	ReplayKeepTiming  bool   `json:"replay_keep_timing"` // start replays with the time between the original requests
+	ReplayConcurrency int    `json:"replay_concurrency"` // replays in flight at once, default 1
+	ReplaySession     string `json:"replay_session"`     // storage dir the replays are stored in instead of -storage_dir
+
+	ServerPlayback       string `json:"server_playback"`        // storage dir of recorded flows requests are answered from
+	ServerPlaybackConfig string `json:"server_playback_config"` // server playback config filename
+
+	Network      string `json:"network"`       // network condition preset all clients get
+	NetworkRules string `json:"network_rules"` // network condition rules config filename
+
+	FaultRules string `json:"fault_rules"` // fault injection rules config filename
+
+	DisableAddons    []string `json:"disable_addons"`     // names of the addons registered disabled, the web interface enables them
+	AddonMaxFailures int      `json:"addon_max_failures"` // an addon is disabled once its hooks panicked this many times, 0 for never
+
+	ShutdownTimeout int `json:"shutdown_timeout"` // seconds the flows in flight get to finish on SIGINT or SIGTERM
 }
 
 func main() {
@@ -118,6 +162,21 @@ func Run(config *Config) error {
 		return nil
 	}
 
+	replaying := len(config.Replay) > 0 || config.ReplayQuery != ""
+	if replaying && config.StorageDir == "" {
+		return fmt.Errorf("-storage_dir is required for replay")
+	}
+	if config.ReplaySession != "" && filepath.Clean(config.ReplaySession) == filepath.Clean(config.StorageDir) {
+		return fmt.Errorf("-replay_session must differ from -storage_dir")
+	}
+	var replayOpts *replayOptions
+	if replaying {
+		var err error
+		if replayOpts, err = newReplayOptions(config); err != nil {
+			return err
+		}
+	}
+
 	if config.Debug > 0 {
 		rawLog.SetFlags(rawLog.LstdFlags | rawLog.Lshortfile)
 		log.SetLevel(log.DebugLevel)
@@ -132,6 +191,24 @@ func Run(config *Config) error {
 		FullTimestamp: true,
 	})
 
+	var upstreamRules []*proxy.UpstreamRule
+	if config.UpstreamRules != "" {
+		rules, err := proxy.NewUpstreamRulesFromFile(config.UpstreamRules)
+		if err != nil {
+			return fmt.Errorf("load upstream rules: %w", err)
+		}
+		upstreamRules = rules
+	}
+
+	var clientCerts []*proxy.ClientCert
+	if config.ClientCerts != "" {
+		certs, err := proxy.NewClientCertsFromFile(config.ClientCerts)
+		if err != nil {
+			return fmt.Errorf("load client certs: %w", err)
+		}
+		clientCerts = certs
+	}
+
 	opts := &proxy.Options{
 		Debug:             config.Debug,
 		Addr:              config.Addr,
@@ -144,6 +221,26 @@ func Run(config *Config) error {
 		FingerprintSave:   config.FingerprintSave,
 		DnsResolvers:      config.DnsResolvers,
 		DnsRetries:        config.DnsRetries,
+		Reverse:           config.Reverse,
+		ReverseTls:        config.ReverseTls,
+		GrpcDescriptors:   config.GrpcDescriptors,
+
+		ConnPool:            config.ConnPool,
+		ConnPoolIdleTimeout: time.Duration(config.ConnPoolIdleTimeout) * time.Second,
+		ConnPoolMaxPerHost:  config.ConnPoolMaxPerHost,
+
+		UpstreamRules: upstreamRules,
+		UpstreamPac:   config.UpstreamPac,
+
+		UpstreamPool:              config.UpstreamPool,
+		UpstreamStrategy:          config.UpstreamStrategy,
+		UpstreamHealthCheck:       time.Duration(config.UpstreamHealthCheck) * time.Second,
+		UpstreamHealthCheckTarget: config.UpstreamHealthCheckTarget,
+
+		ClientCerts:       clientCerts,
+		RequestClientCert: config.RequestClientCert,
+		KillRst:           config.KillRst,
+		AddonMaxFailures:  config.AddonMaxFailures,
 	}
 
 	p, err := proxy.NewProxy(opts)
@@ -183,6 +280,22 @@ func Run(config *Config) error {
 		p.SetAuthProxy(auth.EntryAuth)
 	}
 
+	// the network conditions shape the flows answered by the other addons too, the web client changes them at runtime
+	var networkRules []*proxy.NetworkRule
+	if config.NetworkRules != "" {
+		if networkRules, err = proxy.NewNetworkRulesFromFile(config.NetworkRules); err != nil {
+			return fmt.Errorf("load network rules: %w", err)
+		}
+	}
+	if config.Network != "" {
+		networkRules = append(networkRules, &proxy.NetworkRule{Preset: config.Network})
+	}
+	network, err := proxy.NewNetworkConditions(networkRules)
+	if err != nil {
+		return err
+	}
+	p.AddAddon(network)
+
 	if config.LogFile != "" {
 		// Use instance logger with file output
 		p.AddAddon(proxy.NewInstanceLogAddonWithFile(config.Addr, "", config.LogFile))
@@ -191,7 +304,10 @@ func Run(config *Config) error {
 		// Use default logger
 		p.AddAddon(&proxy.LogAddon{})
 	}
-	p.AddAddon(web.NewWebAddon(config.WebAddr))
+	webAddon := web.NewWebAddon(config.WebAddr)
+	webAddon.Proxy = p
+	webAddon.Network = network
+	p.AddAddon(webAddon)
 
 	if config.MapRemote != "" {
 		mapRemote, err := addon.NewMapRemoteFromFile(config.MapRemote)
@@ -211,26 +327,55 @@ func Run(config *Config) error {
 		}
 	}
 
+	if config.ServerPlayback != "" || config.ServerPlaybackConfig != "" {
+		opts := new(addon.ServerPlaybackOptions)
+		if config.ServerPlaybackConfig != "" {
+			if opts, err = addon.NewServerPlaybackOptionsFromFile(config.ServerPlaybackConfig); err != nil {
+				return fmt.Errorf("load server playback config: %w", err)
+			}
+		}
+		if config.ServerPlayback != "" {
+			opts.StorageDir = config.ServerPlayback
+		}
+		// a playback missing its recording would let the requests through to the servers
+		serverPlayback, err := addon.NewServerPlayback(opts)
+		if err != nil {
+			return err
+		}
+		p.AddAddon(serverPlayback)
+	}
+
 	if config.Dump != "" {
 		dumper := addon.NewDumperWithFilename(config.Dump, config.DumpLevel)
 		p.AddAddon(dumper)
 	}
 
+	// registered without -scan_pii too, disabled, so the web interface can switch it on
+	p.AddAddon(addon.NewPIIAddon())
 	if config.ScanPII {
-		p.AddAddon(addon.NewPIIAddon())
 		log.Infoln("PII scanning enabled")
+	} else {
+		p.Registry.SetEnabled("PIIAddon", false)
 	}
 
+	storageDir := config.StorageDir
+	if replaying {
+		// the replays are stored in a session of their own, the replayed flows are read from -storage_dir
+		storageDir = config.ReplaySession
+		if storageDir == "" {
+			storageDir = defaultReplaySession(config.StorageDir, time.Now())
+		}
+	}
 	var storageSvc *storage.Service
-	if config.StorageDir != "" {
-		storageAddon, err := addon.NewStorageAddon(config.StorageDir)
+	if storageDir != "" {
+		storageAddon, err := addon.NewStorageAddon(storageDir)
 		if err != nil {
 			return fmt.Errorf("failed to init storage: %w", err)
 		}
 		p.AddAddon(storageAddon)
 		storageSvc = storageAddon.Service
 		defer storageAddon.Close()
-		log.Infof("Flow storage enabled in: %s", config.StorageDir)
+		log.Infof("Flow storage enabled in: %s", storageDir)
 	}
 
 	if config.ScanTech {
@@ -238,5 +383,64 @@ func Run(config *Config) error {
 		log.Infoln("Technology scanning enabled")
 	}
 
-	return p.Start()
+	if config.FaultRules != "" {
+		rules, err := addon.NewFaultRulesFromFile(config.FaultRules)
+		if err != nil {
+			return fmt.Errorf("failed to load fault rules: %w", err)
+		}
+		// added after the storage addon, which saves the flows answered by injected errors
+		faults, err := addon.NewFaultInjection(rules)
+		if err != nil {
+			return fmt.Errorf("invalid fault rules: %w", err)
+		}
+		p.AddAddon(faults)
+		log.Infof("Fault injection enabled with %d rules", len(rules))
+	}
+
+	for _, name := range config.DisableAddons {
+		if err := p.Registry.SetEnabled(name, false); err != nil {
+			return fmt.Errorf("disable addon: %w", err)
+		}
+	}
+
+	if replaying {
+		source := storageSvc
+		if storageDir != config.StorageDir {
+			if source, err = storage.NewService(config.StorageDir); err != nil {
+				return fmt.Errorf("failed to open storage: %w", err)
+			}
+			defer source.Close()
+		}
+		return replayStored(p, source, config.Replay, config.ReplayQuery, replayOpts)
+	}
+
+	return serve(p, time.Duration(config.ShutdownTimeout)*time.Second)
+}
+
+// serve runs p until SIGINT or SIGTERM, then shuts it down gracefully, the flows in flight get timeout to finish
+func serve(p *proxy.Proxy, timeout time.Duration) error {
+	if timeout <= 0 {
+		timeout = 10 * time.Second
+	}
+	errc := make(chan error, 1)
+	go func() { errc <- p.Start() }()
+
+	sigc := make(chan os.Signal, 1)
+	signal.Notify(sigc, os.Interrupt, syscall.SIGTERM)
+	defer signal.Stop(sigc)
+	select {
+	case err := <-errc:
+		return err
+	case sig := <-sigc:
+		log.Infof("Received %v, shutting down", sig)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	// flows cut at the deadline are logged by the proxy
+	p.Shutdown(ctx)
+	if err := <-errc; err != http.ErrServerClosed {
+		return err
+	}
+	return nil
 }
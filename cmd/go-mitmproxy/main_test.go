@@ -1,8 +1,13 @@
 package main
 
 import (
+	"net/http"
+	"net/http/httptest"
 	"net/url"
+	"os"
+	"os/signal"
 	"path/filepath"
+	"syscall"
 	"testing"
 	"time"
 
@@ -117,6 +122,34 @@ func TestRun_ProxyAuthError(t *testing.T) {
 	}
 }
 
+func TestRun_UpstreamRoutingError(t *testing.T) {
+	config := &Config{
+		Addr:          ":0",
+		UpstreamRules: "non-existent.json",
+	}
+	if err := Run(config); err == nil {
+		t.Error("Expected error for missing upstream rules file")
+	}
+
+	config = &Config{
+		Addr:        ":0",
+		UpstreamPac: "non-existent.pac",
+	}
+	if err := Run(config); err == nil {
+		t.Error("Expected error for missing pac file")
+	}
+}
+
+func TestRun_ClientCertsError(t *testing.T) {
+	config := &Config{
+		Addr:        ":0",
+		ClientCerts: "non-existent.json",
+	}
+	if err := Run(config); err == nil {
+		t.Error("Expected error for missing client certs file")
+	}
+}
+
 func TestRun_MapErrors(t *testing.T) {
 	// These should log warning but not return error
 	config := &Config{
@@ -162,3 +195,141 @@ func TestRun_Dumping(t *testing.T) {
 func TestRun_InterceptRules(t *testing.T) {
     // Already covered in TestRun_Full by setting IgnoreHosts and AllowHosts
 }
+
+func TestRun_Replay(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("replayed"))
+	}))
+	defer server.Close()
+
+	tmpDir := t.TempDir()
+	svc, err := storage.NewService(tmpDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	u, _ := url.Parse(server.URL + "/replayme")
+	flow := proxy.NewFlow()
+	flow.Request = &proxy.Request{Method: "GET", URL: u, Header: http.Header{}}
+	flow.ConnContext = &proxy.ConnContext{ClientConn: &proxy.ClientConn{}}
+	entry, _ := storage.NewFlowEntry(flow)
+	if err := svc.SaveEntry(entry, nil); err != nil {
+		t.Fatal(err)
+	}
+	svc.Close()
+
+	if err := Run(&Config{Replay: []string{entry.ID}}); err == nil {
+		t.Error("Expected error for replay without storage_dir")
+	}
+	config := &Config{
+		Addr:       "127.0.0.1:0",
+		WebAddr:    "127.0.0.1:0",
+		StorageDir: tmpDir,
+		Replay:     []string{entry.ID, proxy.NewFlow().Id.String()},
+	}
+	if err := Run(config); err == nil {
+		t.Error("Expected error for replay of an unknown flow")
+	}
+
+	svc, err = storage.NewService(tmpDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	all, err := svc.All()
+	svc.Close()
+	if err != nil || len(all) != 1 {
+		t.Fatalf("Expected the replayed storage unchanged, got %v flows %v", len(all), err)
+	}
+
+	// without -replay_session the replays go to a timestamped session next to -storage_dir
+	sessions, _ := filepath.Glob(tmpDir + "-replay-*")
+	if len(sessions) != 1 {
+		t.Fatalf("Expected one replay session, got %v", sessions)
+	}
+	svc, err = storage.NewService(sessions[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer svc.Close()
+	results, err := svc.Search(`req.path.eq:"/replayme"`)
+	if err != nil || len(results) != 1 {
+		t.Fatalf("Expected the replay in the session, got %v %v", len(results), err)
+	}
+	if e := results[0]; e.ReplayOf != entry.ID || e.StatusCode != 200 || string(e.ResponseBody) != "replayed" {
+		t.Errorf("unexpected replay %+v", e)
+	}
+}
+
+func TestRun_ServerPlayback(t *testing.T) {
+	config := &Config{
+		Addr:           "127.0.0.1:0",
+		WebAddr:        "127.0.0.1:0",
+		ServerPlayback: filepath.Join(t.TempDir(), "missing"),
+	}
+	if err := Run(config); err == nil {
+		t.Error("Expected error for a missing server playback dir")
+	}
+	config.ServerPlayback = ""
+	config.ServerPlaybackConfig = "non_existent.json"
+	if err := Run(config); err == nil {
+		t.Error("Expected error for a missing server playback config")
+	}
+}
+
+func TestRun_Network(t *testing.T) {
+	config := &Config{Addr: "127.0.0.1:0", WebAddr: "127.0.0.1:0", Network: "dialup"}
+	if err := Run(config); err == nil {
+		t.Error("Expected error for an unknown network preset")
+	}
+	config.Network = ""
+	config.NetworkRules = "non_existent.json"
+	if err := Run(config); err == nil {
+		t.Error("Expected error for missing network rules")
+	}
+}
+
+func TestRun_FaultRules(t *testing.T) {
+	config := &Config{Addr: "127.0.0.1:0", WebAddr: "127.0.0.1:0", FaultRules: "non_existent.json"}
+	if err := Run(config); err == nil {
+		t.Error("Expected error for missing fault rules")
+	}
+	config.FaultRules = filepath.Join(t.TempDir(), "faults.json")
+	if err := os.WriteFile(config.FaultRules, []byte(`[{"fault": "status", "probability": 2}]`), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := Run(config); err == nil {
+		t.Error("Expected error for an invalid fault rule")
+	}
+}
+
+func TestRun_DisableAddons(t *testing.T) {
+	config := &Config{Addr: "127.0.0.1:0", WebAddr: "127.0.0.1:0", DisableAddons: []string{"NoSuchAddon"}}
+	if err := Run(config); err == nil {
+		t.Error("Expected error for an unknown addon")
+	}
+}
+
+func TestRun_Shutdown(t *testing.T) {
+	// keep SIGINT from killing the test binary before Run listens for it
+	sigc := make(chan os.Signal, 1)
+	signal.Notify(sigc, os.Interrupt)
+	defer signal.Stop(sigc)
+
+	config := &Config{Addr: "127.0.0.1:0", WebAddr: "127.0.0.1:0", StorageDir: t.TempDir(), ShutdownTimeout: 1}
+	errc := make(chan error, 1)
+	go func() { errc <- Run(config) }()
+
+	deadline := time.After(10 * time.Second)
+	for {
+		syscall.Kill(os.Getpid(), syscall.SIGINT)
+		select {
+		case err := <-errc:
+			if err != nil {
+				t.Errorf("want a clean shutdown, got %v", err)
+			}
+			return
+		case <-deadline:
+			t.Fatal("want Run to return on SIGINT")
+		case <-time.After(100 * time.Millisecond):
+		}
+	}
+}
@@ -0,0 +1,133 @@
+package main
+
+import (
+	"fmt"
+	"net/url"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/retutils/gomitmproxy/proxy"
+	"github.com/retutils/gomitmproxy/storage"
+)
+
+// replayOptions of the stored flows replayed by -replay and -replay_query
+type replayOptions struct {
+	target      *url.URL // scheme and host the requests are sent to instead of their own, nil to keep them
+	keepTiming  bool     // start the replays with the time between the original requests
+	concurrency int      // replays in flight at once
+}
+
+func newReplayOptions(config *Config) (*replayOptions, error) {
+	opts := &replayOptions{
+		keepTiming:  config.ReplayKeepTiming,
+		concurrency: config.ReplayConcurrency,
+	}
+	if opts.concurrency < 1 {
+		opts.concurrency = 1
+	}
+	if config.ReplayTarget != "" {
+		target, err := url.Parse(config.ReplayTarget)
+		if err != nil {
+			return nil, fmt.Errorf("invalid -replay_target: %w", err)
+		}
+		if (target.Scheme != "http" && target.Scheme != "https") || target.Host == "" {
+			return nil, fmt.Errorf("invalid -replay_target %v: want scheme://host[:port]", config.ReplayTarget)
+		}
+		opts.target = target
+	}
+	return opts, nil
+}
+
+// defaultReplaySession is the storage dir of the replays when -replay_session is not set,
+// a timestamped sibling of storageDir, e.g. flows-replay-20240102-150405 for flows
+func defaultReplaySession(storageDir string, now time.Time) string {
+	return filepath.Clean(storageDir) + "-replay-" + now.Format("20060102-150405")
+}
+
+// replayStored replays the stored flows of ids and of query through the proxy, the storage addon stores the replays as new flows
+func replayStored(p *proxy.Proxy, svc *storage.Service, ids []string, query string, opts *replayOptions) error {
+	var entries []*storage.FlowEntry
+	total, failed := len(ids), 0
+	for _, id := range ids {
+		entry, err := svc.Get(id)
+		if err != nil {
+			failed++
+			fmt.Printf("[%s] replay failed: %v\n", id, err)
+			continue
+		}
+		entries = append(entries, entry)
+	}
+	if query != "" {
+		results, err := svc.Search(query)
+		if err != nil {
+			return fmt.Errorf("search failed: %w", err)
+		}
+		entries = append(entries, results...)
+		total += len(results)
+		if len(results) == 0 {
+			fmt.Println("No flows match the replay query.")
+		}
+	}
+	// the search orders by relevance, replays go in the order of the capture, which -replay_keep_timing relies on
+	sort.SliceStable(entries, func(i, j int) bool { return entries[i].StartTime.Before(entries[j].StartTime) })
+
+	failed += replayEntries(p, entries, opts)
+	if failed > 0 {
+		return fmt.Errorf("%d of %d replays failed", failed, total)
+	}
+	return nil
+}
+
+// replayEntries replays entries with opts.concurrency replays in flight, it returns the number of failed replays
+func replayEntries(p *proxy.Proxy, entries []*storage.FlowEntry, opts *replayOptions) int {
+	var (
+		wg     sync.WaitGroup
+		mu     sync.Mutex
+		failed int
+	)
+	slots := make(chan struct{}, opts.concurrency)
+	start := time.Now()
+	for _, entry := range entries {
+		if opts.keepTiming {
+			// a replay is late when the replays before it hold all slots
+			time.Sleep(time.Until(start.Add(entry.StartTime.Sub(entries[0].StartTime))))
+		}
+		slots <- struct{}{}
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			defer func() { <-slots }()
+			replay, err := replayEntry(p, entry, opts.target)
+
+			mu.Lock()
+			defer mu.Unlock()
+			if err != nil {
+				failed++
+				fmt.Printf("[%s] replay failed: %v\n", entry.ID, err)
+				return
+			}
+			changed := ""
+			if entry.StatusCode != 0 && entry.StatusCode != replay.Response.StatusCode {
+				changed = fmt.Sprintf(", was %d", entry.StatusCode)
+			}
+			fmt.Printf("[%s] replay of [%s] %s %s (Status: %d%s, %v)\n", replay.Id, entry.ID, replay.Request.Method, replay.Request.URL,
+				replay.Response.StatusCode, changed, replay.Timing.Duration().Round(time.Millisecond))
+		}()
+	}
+	wg.Wait()
+	return failed
+}
+
+func replayEntry(p *proxy.Proxy, entry *storage.FlowEntry, target *url.URL) (*proxy.Flow, error) {
+	f, err := entry.ToProxyFlow()
+	if err != nil {
+		return nil, err
+	}
+	if target != nil {
+		f.Request.URL.Scheme = target.Scheme
+		f.Request.URL.Host = target.Host
+	}
+	return p.Replay(f)
+}
@@ -0,0 +1,184 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/retutils/gomitmproxy/proxy"
+	"github.com/retutils/gomitmproxy/storage"
+)
+
+func TestNewReplayOptions(t *testing.T) {
+	opts, err := newReplayOptions(&Config{ReplayTarget: "https://staging.example.com:8443"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if opts.concurrency != 1 || opts.target.Host != "staging.example.com:8443" {
+		t.Errorf("unexpected options %+v", opts)
+	}
+	for _, target := range []string{"staging.example.com", "ftp://example.com", "http://", "http://%zz"} {
+		if _, err := newReplayOptions(&Config{ReplayTarget: target}); err == nil {
+			t.Errorf("Expected error for target %v", target)
+		}
+	}
+}
+
+func TestRun_ReplayQuery(t *testing.T) {
+	original := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(500)
+	}))
+	defer original.Close()
+	var inFlight, maxInFlight atomic.Int32
+	target := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		n := inFlight.Add(1)
+		defer inFlight.Add(-1)
+		for {
+			max := maxInFlight.Load()
+			if n <= max || maxInFlight.CompareAndSwap(max, n) {
+				break
+			}
+		}
+		time.Sleep(50 * time.Millisecond)
+		w.Write([]byte("deployed " + r.URL.Path))
+	}))
+	defer target.Close()
+
+	storageDir := t.TempDir()
+	svc, err := storage.NewService(storageDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	start := time.Now().Add(-time.Hour)
+	var ids []string
+	for i, path := range []string{"/incident/1", "/incident/2", "/incident/3", "/unrelated"} {
+		u, _ := url.Parse(original.URL + path)
+		flow := proxy.NewFlow()
+		flow.Request = &proxy.Request{Method: "GET", URL: u, Header: http.Header{}}
+		flow.Response = &proxy.Response{StatusCode: 500, Header: http.Header{}}
+		flow.ConnContext = &proxy.ConnContext{ClientConn: &proxy.ClientConn{}}
+		flow.Timing.Start = start.Add(time.Duration(i) * 100 * time.Millisecond)
+		entry, _ := storage.NewFlowEntry(flow)
+		if err := svc.SaveEntry(entry, nil); err != nil {
+			t.Fatal(err)
+		}
+		ids = append(ids, entry.ID)
+	}
+	svc.Close()
+
+	sessionDir := filepath.Join(t.TempDir(), "session")
+	config := &Config{
+		Addr:              "127.0.0.1:0",
+		WebAddr:           "127.0.0.1:0",
+		StorageDir:        storageDir,
+		ReplayQuery:       `req.path.cont:"incident"`,
+		ReplayTarget:      target.URL,
+		ReplayKeepTiming:  true,
+		ReplayConcurrency: 2,
+		ReplaySession:     sessionDir,
+	}
+	began := time.Now()
+	if err := Run(config); err != nil {
+		t.Fatal(err)
+	}
+	if elapsed := time.Since(began); elapsed < 200*time.Millisecond {
+		t.Errorf("Expected the original timing kept, replayed in %v", elapsed)
+	}
+	if max := maxInFlight.Load(); max > 2 {
+		t.Errorf("Expected at most 2 replays in flight, got %v", max)
+	}
+
+	svc, err = storage.NewService(sessionDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	replays, err := svc.All()
+	svc.Close()
+	if err != nil || len(replays) != 3 {
+		t.Fatalf("Expected 3 replays in the session, got %v %v", len(replays), err)
+	}
+	for i, e := range replays {
+		if e.ReplayOf != ids[i] || e.StatusCode != 200 || string(e.ResponseBody) != "deployed /incident/"+string(rune('1'+i)) {
+			t.Errorf("unexpected replay %v of %v: %v %q", e.URL, e.ReplayOf, e.StatusCode, e.ResponseBody)
+		}
+	}
+
+	svc, err = storage.NewService(storageDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer svc.Close()
+	if all, _ := svc.All(); len(all) != 4 {
+		t.Errorf("Expected the replayed storage unchanged, got %v flows", len(all))
+	}
+
+	config.ReplaySession = storageDir
+	if err := Run(config); err == nil {
+		t.Error("Expected error for a session in the replayed storage dir")
+	}
+}
+
+func TestDefaultReplaySession(t *testing.T) {
+	now := time.Date(2024, 1, 2, 15, 4, 5, 0, time.UTC)
+	if dir := defaultReplaySession("./flows/", now); dir != "flows-replay-20240102-150405" {
+		t.Errorf("unexpected session dir %v", dir)
+	}
+}
+
+func TestRun_ReplayCaptureOrder(t *testing.T) {
+	var mu sync.Mutex
+	var paths []string
+	target := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		paths = append(paths, r.URL.Path)
+		mu.Unlock()
+	}))
+	defer target.Close()
+
+	storageDir := t.TempDir()
+	svc, err := storage.NewService(storageDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	start := time.Now().Add(-time.Hour)
+	var ids []string
+	for i, path := range []string{"/1", "/2", "/3"} {
+		u, _ := url.Parse(target.URL + path)
+		flow := proxy.NewFlow()
+		flow.Request = &proxy.Request{Method: "GET", URL: u, Header: http.Header{}}
+		flow.ConnContext = &proxy.ConnContext{ClientConn: &proxy.ClientConn{}}
+		flow.Timing.Start = start.Add(time.Duration(i) * 50 * time.Millisecond)
+		entry, _ := storage.NewFlowEntry(flow)
+		if err := svc.SaveEntry(entry, nil); err != nil {
+			t.Fatal(err)
+		}
+		ids = append(ids, entry.ID)
+	}
+	svc.Close()
+
+	// the ids come before the query results and out of order, the replays still go in capture order
+	config := &Config{
+		Addr:             "127.0.0.1:0",
+		WebAddr:          "127.0.0.1:0",
+		StorageDir:       storageDir,
+		Replay:           []string{ids[2]},
+		ReplayQuery:      `req.path.eq:"/1"`,
+		ReplayKeepTiming: true,
+		ReplaySession:    filepath.Join(t.TempDir(), "session"),
+	}
+	began := time.Now()
+	if err := Run(config); err != nil {
+		t.Fatal(err)
+	}
+	if elapsed := time.Since(began); elapsed < 100*time.Millisecond {
+		t.Errorf("Expected the original timing kept, replayed in %v", elapsed)
+	}
+	if len(paths) != 2 || paths[0] != "/1" || paths[1] != "/3" {
+		t.Errorf("Expected the replays in capture order, got %v", paths)
+	}
+}
@@ -7,6 +7,7 @@ import "fmt"
 type Query struct {
 	Req  *RequestClause
 	Resp *ResponseClause
+	Ws   *WebSocketClause
 	// Logical operations
 	And []*Query
 	Or  []*Query
@@ -20,6 +21,9 @@ func (q *Query) String() string {
 	if q.Resp != nil {
 		return q.Resp.String()
 	}
+	if q.Ws != nil {
+		return q.Ws.String()
+	}
 	if len(q.And) == 2 {
 		return fmt.Sprintf("(%s AND %s)", q.And[0].String(), q.And[1].String())
 	}
@@ -69,6 +73,8 @@ type ResponseClause struct {
 	StatusCode *IntExpr
 	Body       *StringExpr // Alias: raw
 	Length     *IntExpr
+	TTFB       *IntExpr // milliseconds from request sent to first response byte
+	Duration   *IntExpr // milliseconds from request received to response complete
 }
 
 func (r *ResponseClause) String() string {
@@ -81,6 +87,36 @@ func (r *ResponseClause) String() string {
 	if r.Length != nil {
 		return fmt.Sprintf("resp.len.%s", r.Length.String())
 	}
+	if r.TTFB != nil {
+		return fmt.Sprintf("resp.ttfb.%s", r.TTFB.String())
+	}
+	if r.Duration != nil {
+		return fmt.Sprintf("resp.duration.%s", r.Duration.String())
+	}
+	return ""
+}
+
+// WebSocketClause matches the messages of a websocket session
+type WebSocketClause struct {
+	Message       *StringExpr // payload of a message
+	Direction     *StringExpr // sender of a message: client or server
+	ClientMessage *StringExpr // payload of a message sent by the client
+	ServerMessage *StringExpr // payload of a message sent by the server
+}
+
+func (w *WebSocketClause) String() string {
+	if w.Message != nil {
+		return fmt.Sprintf("ws.msg.%s", w.Message.String())
+	}
+	if w.ClientMessage != nil {
+		return fmt.Sprintf("ws.client_msg.%s", w.ClientMessage.String())
+	}
+	if w.ServerMessage != nil {
+		return fmt.Sprintf("ws.server_msg.%s", w.ServerMessage.String())
+	}
+	if w.Direction != nil {
+		return fmt.Sprintf("ws.direction.%s", w.Direction.String())
+	}
 	return ""
 }
 
@@ -34,6 +34,10 @@ func (q *Query) Eval(f *proxy.Flow) bool {
 	if q.Resp != nil {
 		return q.Resp.Eval(f)
 	}
+	if q.Ws != nil {
+		// messages are not kept on the flow, ws clauses are only searchable in storage
+		return false
+	}
 	return true
 }
 
@@ -100,9 +104,47 @@ func (r *ResponseClause) Eval(f *proxy.Flow) bool {
 			return false
 		}
 	}
+	// timings are not matched until measured
+	if r.TTFB != nil {
+		ttfb := f.Timing.TTFB()
+		if ttfb == 0 || !r.TTFB.Eval(int(ttfb.Milliseconds())) {
+			return false
+		}
+	}
+	if r.Duration != nil {
+		duration := f.Timing.Duration()
+		if duration == 0 || !r.Duration.Eval(int(duration.Milliseconds())) {
+			return false
+		}
+	}
+	return true
+}
+
+// EvalMessage matches a single websocket message, e.g. from Addon.WebsocketMessage
+func (w *WebSocketClause) EvalMessage(msg *proxy.WebSocketMessage) bool {
+	if w.Message != nil && !w.Message.Eval(string(msg.Data)) {
+		return false
+	}
+	if w.Direction != nil && !w.Direction.Eval(WebSocketDirection(msg.FromClient)) {
+		return false
+	}
+	if w.ClientMessage != nil && (!msg.FromClient || !w.ClientMessage.Eval(string(msg.Data))) {
+		return false
+	}
+	if w.ServerMessage != nil && (msg.FromClient || !w.ServerMessage.Eval(string(msg.Data))) {
+		return false
+	}
 	return true
 }
 
+// WebSocketDirection names the sender of a websocket message: client or server
+func WebSocketDirection(fromClient bool) string {
+	if fromClient {
+		return "client"
+	}
+	return "server"
+}
+
 func (s *StringExpr) Eval(val string) bool {
 	switch s.Operator {
 	case OpEq:
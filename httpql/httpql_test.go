@@ -3,6 +3,7 @@ package httpql
 import (
 	"net/url"
 	"testing"
+	"time"
 
 	"github.com/retutils/gomitmproxy/proxy"
 	uuid "github.com/satori/go.uuid"
@@ -123,6 +124,27 @@ func TestParser(t *testing.T) {
 				return q.Req != nil && q.Req.Method != nil && q.Req.Method.Value == "GET" && q.Req.Method.Operator == OpEq
 			},
 		},
+		{
+			name:  "WebSocket Message",
+			input: `ws.msg.cont:"hello" AND ws.direction.eq:server`,
+			check: func(q *Query) bool {
+				return len(q.And) == 2 && q.And[0].Ws != nil && q.And[0].Ws.Message.Value == "hello" && q.And[0].Ws.Message.Operator == OpCont &&
+					q.And[1].Ws != nil && q.And[1].Ws.Direction.Value == "server"
+			},
+		},
+		{
+			name:  "WebSocket Message By Direction",
+			input: `ws.client_msg.cont:"hello" OR ws.server_msg.eq:"bye"`,
+			check: func(q *Query) bool {
+				return len(q.Or) == 2 && q.Or[0].Ws != nil && q.Or[0].Ws.ClientMessage.Value == "hello" &&
+					q.Or[1].Ws != nil && q.Or[1].Ws.ServerMessage.Value == "bye" && q.Or[1].Ws.ServerMessage.Operator == OpEq
+			},
+		},
+		{
+			name:      "Unknown WebSocket Field",
+			input:     `ws.foo.eq:1`,
+			shouldErr: true,
+		},
 		{
 			name:  "Simple Response",
 			input: `resp.code.ne:200`,
@@ -137,6 +159,20 @@ func TestParser(t *testing.T) {
 				return q.Resp != nil && q.Resp.Length != nil && q.Resp.Length.Value == 100
 			},
 		},
+		{
+			name:  "Response TTFB",
+			input: `resp.ttfb.gt:500`,
+			check: func(q *Query) bool {
+				return q.Resp != nil && q.Resp.TTFB != nil && q.Resp.TTFB.Value == 500 && q.Resp.TTFB.Operator == OpIntGt
+			},
+		},
+		{
+			name:  "Response Duration",
+			input: `resp.duration.lte:1000`,
+			check: func(q *Query) bool {
+				return q.Resp != nil && q.Resp.Duration != nil && q.Resp.Duration.Value == 1000
+			},
+		},
         {
 			name:  "Response Body",
 			input: `resp.body.cont:"error"`,
@@ -202,6 +238,7 @@ func TestParser(t *testing.T) {
 }
 
 func TestEvaluator(t *testing.T) {
+	start := time.Now()
 	flow := &proxy.Flow{
 		Id: uuid.NewV4(),
 		Request: &proxy.Request{
@@ -218,6 +255,12 @@ func TestEvaluator(t *testing.T) {
 			StatusCode: 201,
 			Body:       []byte(`{"status": "created", "id": 123}`),
 		},
+		Timing: proxy.FlowTiming{
+			Start:             start,
+			RequestSent:       start.Add(100 * time.Millisecond),
+			FirstResponseByte: start.Add(700 * time.Millisecond),
+			ResponseComplete:  start.Add(900 * time.Millisecond),
+		},
 	}
 
 	tests := []struct {
@@ -277,6 +320,12 @@ func TestEvaluator(t *testing.T) {
 
 		// Response Length
 		{"Resp Len Gt", `resp.len.gt:10`, true},
+
+		// Timing
+		{"TTFB Gt", `resp.ttfb.gt:500`, true},
+		{"TTFB Lt False", `resp.ttfb.lt:500`, false},
+		{"Duration Eq", `resp.duration.eq:900`, true},
+		{"Duration Gt False", `resp.duration.gt:1000`, false},
 	}
 
 	for _, tt := range tests {
@@ -344,3 +393,53 @@ func TestParser_Errors(t *testing.T) {
 		}
 	}
 }
+
+func TestWebSocketClause(t *testing.T) {
+	clause := &WebSocketClause{
+		Message:   &StringExpr{Value: "ping", Operator: OpCont},
+		Direction: &StringExpr{Value: "client", Operator: OpEq},
+	}
+	if !clause.EvalMessage(&proxy.WebSocketMessage{Data: []byte("ping 1"), FromClient: true}) {
+		t.Error("expected client message to match")
+	}
+	if clause.EvalMessage(&proxy.WebSocketMessage{Data: []byte("ping 1"), FromClient: false}) {
+		t.Error("expected server message not to match")
+	}
+	if (&Query{Ws: clause}).Eval(proxy.NewFlow()) {
+		t.Error("ws clauses should not match flows")
+	}
+	if got := (&WebSocketClause{Direction: &StringExpr{Value: "server", Operator: OpEq}}).String(); got != `ws.direction.eq:"server"` {
+		t.Errorf("unexpected String %s", got)
+	}
+
+	clause = &WebSocketClause{ClientMessage: &StringExpr{Value: "ping", Operator: OpCont}}
+	if !clause.EvalMessage(&proxy.WebSocketMessage{Data: []byte("ping 1"), FromClient: true}) {
+		t.Error("expected client message to match")
+	}
+	if clause.EvalMessage(&proxy.WebSocketMessage{Data: []byte("ping 1"), FromClient: false}) {
+		t.Error("expected server message not to match")
+	}
+	if got := clause.String(); got != `ws.client_msg.cont:"ping"` {
+		t.Errorf("unexpected String %s", got)
+	}
+}
+
+func TestEvaluator_TimingNotMeasured(t *testing.T) {
+	flow := &proxy.Flow{
+		Request: &proxy.Request{
+			Method: "GET",
+			URL:    &url.URL{Host: "example.com"},
+		},
+		Response: &proxy.Response{StatusCode: 200},
+	}
+
+	for _, query := range []string{`resp.ttfb.gte:0`, `resp.duration.lt:100`} {
+		q, err := NewParser(NewLexer(query)).ParseQuery()
+		if err != nil {
+			t.Fatalf("Parse error: %v", err)
+		}
+		if q.Eval(flow) {
+			t.Errorf("Eval(%s) should be false when the timing was not measured", query)
+		}
+	}
+}
@@ -92,11 +92,11 @@ func (p *Parser) parseFactor() (*Query, error) {
 }
 
 func (p *Parser) parseClause() (*Query, error) {
-	// Expect: req/resp . field . op : val
+	// Expect: req/resp/ws . field . op : val
 
 	namespace := p.curTok.Literal
-	if namespace != "req" && namespace != "resp" {
-		return nil, fmt.Errorf("expected req/resp, got %s", namespace)
+	if namespace != "req" && namespace != "resp" && namespace != "ws" {
+		return nil, fmt.Errorf("expected req/resp/ws, got %s", namespace)
 	}
 	p.nextToken()
 
@@ -126,6 +126,8 @@ func (p *Parser) parseClause() (*Query, error) {
 
 	if namespace == "req" {
 		return p.buildReqClause(field, op, val)
+	} else if namespace == "ws" {
+		return p.buildWsClause(field, op, val)
 	} else {
 		return p.buildRespClause(field, op, val)
 	}
@@ -177,6 +179,18 @@ func (p *Parser) buildRespClause(field, op, val string) (*Query, error) {
 			return nil, err
 		}
 		clause.Length = expr
+	case "ttfb":
+		expr, err := parseIntExpr(val, op)
+		if err != nil {
+			return nil, err
+		}
+		clause.TTFB = expr
+	case "duration", "time":
+		expr, err := parseIntExpr(val, op)
+		if err != nil {
+			return nil, err
+		}
+		clause.Duration = expr
 	case "body", "raw":
 		clause.Body = &StringExpr{Value: val, Operator: StringOp(op)}
 	default:
@@ -186,6 +200,25 @@ func (p *Parser) buildRespClause(field, op, val string) (*Query, error) {
 	return &Query{Resp: clause}, nil
 }
 
+func (p *Parser) buildWsClause(field, op, val string) (*Query, error) {
+	clause := &WebSocketClause{}
+
+	switch field {
+	case "msg", "body", "raw":
+		clause.Message = &StringExpr{Value: val, Operator: StringOp(op)}
+	case "direction", "dir":
+		clause.Direction = &StringExpr{Value: val, Operator: StringOp(op)}
+	case "client_msg":
+		clause.ClientMessage = &StringExpr{Value: val, Operator: StringOp(op)}
+	case "server_msg":
+		clause.ServerMessage = &StringExpr{Value: val, Operator: StringOp(op)}
+	default:
+		return nil, fmt.Errorf("unknown ws field: %s", field)
+	}
+
+	return &Query{Ws: clause}, nil
+}
+
 func parseIntExpr(val, op string) (*IntExpr, error) {
 	v, err := strconv.Atoi(val)
 	if err != nil {
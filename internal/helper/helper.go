@@ -74,6 +74,9 @@ func CanonicalAddr(url *url.URL) string {
 
 // https://github.com/mitmproxy/mitmproxy/blob/main/mitmproxy/net/tls.py is_tls_record_magic
 func IsTls(buf []byte) bool {
+	if len(buf) < 3 {
+		return false
+	}
 	if buf[0] == 0x16 && buf[1] == 0x03 && buf[2] <= 0x03 {
 		return true
 	} else {
@@ -81,6 +84,28 @@ func IsTls(buf []byte) bool {
 	}
 }
 
+// first 3 bytes of http/1.x request methods, and of the http/2 client preface
+var httpMethodPrefixes = []string{"GET", "HEA", "POS", "PUT", "DEL", "CON", "OPT", "TRA", "PAT", "PRI"}
+
+// IsHttp reports whether buf looks like the start of a http/1.x request or of h2c with prior knowledge
+func IsHttp(buf []byte) bool {
+	if len(buf) < 3 {
+		return false
+	}
+	for _, prefix := range httpMethodPrefixes {
+		if string(buf[:3]) == prefix {
+			return true
+		}
+	}
+	return false
+}
+
+// IsH2cPreface reports whether buf looks like the start of the http/2 client preface, sent first by h2c clients
+// with prior knowledge
+func IsH2cPreface(buf []byte) bool {
+	return len(buf) >= 3 && string(buf[:3]) == "PRI"
+}
+
 type ResponseCheck struct {
 	http.ResponseWriter
 	Wrote bool
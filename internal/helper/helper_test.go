@@ -137,6 +137,8 @@ func TestIsTls(t *testing.T) {
 		{[]byte{0x16, 0x03, 0x04}, false},
 		{[]byte{0x15, 0x03, 0x01}, false},
 		{[]byte{0x16, 0x02, 0x01}, false},
+		{[]byte{0x16, 0x03}, false},
+		{nil, false},
 	}
 	for _, tt := range tests {
 		if got := IsTls(tt.buf); got != tt.expected {
@@ -145,6 +147,25 @@ func TestIsTls(t *testing.T) {
 	}
 }
 
+func TestIsHttp(t *testing.T) {
+	tests := []struct {
+		buf      []byte
+		expected bool
+	}{
+		{[]byte("GET / HTTP/1.1"), true},
+		{[]byte("POST"), true},
+		{[]byte("OPTIONS"), true},
+		{[]byte("SSH-2.0"), false},
+		{[]byte("PRI * HTTP/2.0"), true},
+		{[]byte("GE"), false},
+	}
+	for _, tt := range tests {
+		if got := IsHttp(tt.buf); got != tt.expected {
+			t.Errorf("IsHttp(%q) = %v, want %v", tt.buf, got, tt.expected)
+		}
+	}
+}
+
 func TestResponseCheck(t *testing.T) {
 	recorder := httptest.NewRecorder()
 	rc := NewResponseCheck(recorder)
@@ -36,7 +36,7 @@ type Addon interface {
 	// The full HTTP response has been read.
 	Response(*Flow)
 
-	// Stream request body modifier
+	// Stream request body modifier, a response set on the flow answers the request instead of the server.
 	StreamRequestModifier(*Flow, io.Reader) io.Reader
 
 	// Stream response body modifier
@@ -50,6 +50,27 @@ type Addon interface {
 
 	// WebSocket message received from client
 	WebsocketMessage(*Flow, *WebSocketMessage)
+
+	// An event of a text/event-stream response has been read, the response is streamed.
+	ServerSentEvent(*Flow, *ServerSentEvent)
+
+	// A raw TCP stream has started.
+	TcpStart(*TcpFlow)
+
+	// A TCP chunk has been received, set Drop to not forward it.
+	TcpMessage(*TcpFlow, *TcpMessage)
+
+	// A raw TCP stream has ended.
+	TcpEnd(*TcpFlow)
+
+	// A flow has been killed, its connection to the client is torn down.
+	FlowKilled(*Flow)
+}
+
+// AddonFlusher is implemented by addons working in the background, e.g. saving flows.
+// Proxy.Shutdown calls Flush once the flows are done and waits for it to return.
+type AddonFlusher interface {
+	Flush()
 }
 
 // BaseAddon do nothing
@@ -69,6 +90,11 @@ func (addon *BaseAddon) StreamResponseModifier(f *Flow, in io.Reader) io.Reader
 func (addon *BaseAddon) AccessProxyServer(req *http.Request, res http.ResponseWriter) { _ = 1 }
 func (addon *BaseAddon) WebsocketHandshake(f *Flow)                                   { _ = 1 }
 func (addon *BaseAddon) WebsocketMessage(f *Flow, msg *WebSocketMessage)              { _ = 1 }
+func (addon *BaseAddon) ServerSentEvent(f *Flow, ev *ServerSentEvent)                 { _ = 1 }
+func (addon *BaseAddon) TcpStart(f *TcpFlow)                                          { _ = 1 }
+func (addon *BaseAddon) TcpMessage(f *TcpFlow, msg *TcpMessage)                       { _ = 1 }
+func (addon *BaseAddon) TcpEnd(f *TcpFlow)                                            { _ = 1 }
+func (addon *BaseAddon) FlowKilled(f *Flow)                                           { _ = 1 }
 
 // LogAddon log connection and flow
 type LogAddon struct {
@@ -116,6 +142,22 @@ func (addon *LogAddon) WebsocketMessage(f *Flow, msg *WebSocketMessage) {
 	log.Debugf("%v websocket msg %v %v %v\n", f.ConnContext.ClientConn.Conn.RemoteAddr(), msg.FromClient, msg.Type, len(msg.Data))
 }
 
+func (addon *LogAddon) ServerSentEvent(f *Flow, ev *ServerSentEvent) {
+	log.Debugf("%v sse event %v %v %v\n", f.ConnContext.ClientConn.Conn.RemoteAddr(), ev.Id, ev.Event, len(ev.Data))
+}
+
+func (addon *LogAddon) TcpStart(f *TcpFlow) {
+	log.Infof("%v tcp start %v\n", f.ConnContext.ClientConn.Conn.RemoteAddr(), f.Address)
+}
+
+func (addon *LogAddon) FlowKilled(f *Flow) {
+	log.Infof("%v flow killed %v %v\n", f.ConnContext.ClientConn.Conn.RemoteAddr(), f.Request.Method, f.Request.URL.String())
+}
+
+func (addon *LogAddon) TcpEnd(f *TcpFlow) {
+	log.Infof("%v tcp end %v, client %v bytes, server %v bytes - %v ms\n", f.ConnContext.ClientConn.Conn.RemoteAddr(), f.Address, f.ClientBytes.Load(), f.ServerBytes.Load(), f.EndTime.Sub(f.StartTime).Milliseconds())
+}
+
 type UpstreamCertAddon struct {
 	BaseAddon
 	UpstreamCert bool // Connect to upstream server to look up certificate details.
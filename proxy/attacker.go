@@ -4,11 +4,13 @@ import (
 	"bytes"
 	"context"
 	"crypto/tls"
+	"crypto/x509"
 	"io"
 	"net"
 	"net/http"
 	"strings"
 	"sync"
+	"time"
 
 	"github.com/retutils/gomitmproxy/cert"
 	"github.com/retutils/gomitmproxy/internal/helper"
@@ -18,23 +20,37 @@ import (
 
 type attackerListener struct {
 	connChan chan net.Conn
+	closed   chan struct{}
 	once     sync.Once
 }
 
+func newAttackerListener() *attackerListener {
+	return &attackerListener{
+		connChan: make(chan net.Conn),
+		closed:   make(chan struct{}),
+	}
+}
+
+// accept hands conn to the server, conn is closed if the server is shut down
 func (l *attackerListener) accept(conn net.Conn) {
-	l.connChan <- conn
+	select {
+	case l.connChan <- conn:
+	case <-l.closed:
+		conn.Close()
+	}
 }
 
 func (l *attackerListener) Accept() (net.Conn, error) {
-	c, ok := <-l.connChan
-	if !ok {
+	select {
+	case c := <-l.connChan:
+		return c, nil
+	case <-l.closed:
 		return nil, net.ErrClosed
 	}
-	return c, nil
 }
 func (l *attackerListener) Close() error {
 	l.once.Do(func() {
-		close(l.connChan)
+		close(l.closed)
 	})
 	return nil
 }
@@ -78,9 +94,11 @@ func newAttacker(proxy *Proxy) (*attacker, error) {
 				return http.ErrUseLastResponse
 			},
 		},
-		listener: &attackerListener{
-			connChan: make(chan net.Conn),
-		},
+		listener: newAttackerListener(),
+	}
+
+	if proxy.connPool != nil {
+		a.client.Transport = &connPoolTransport{pool: proxy.connPool}
 	}
 
 	a.server = &http.Server{
@@ -94,6 +112,11 @@ func newAttacker(proxy *Proxy) (*attacker, error) {
 		MaxConcurrentStreams: 100, // todo: wait for remote server setting
 		NewWriteScheduler:    func() http2.WriteScheduler { return http2.NewPriorityWriteScheduler(nil) },
 	}
+	// the http/2 connections served with a.server as BaseConfig are sent GOAWAY when a.server shuts down,
+	// the server itself only serves http/1 from a.listener
+	if err := http2.ConfigureServer(a.server, a.h2Server); err != nil {
+		return nil, err
+	}
 
 	return a, nil
 }
@@ -110,36 +133,50 @@ func (a *attacker) start() error {
 	return a.server.Serve(a.listener)
 }
 
+func (a *attacker) close() error {
+	err := a.server.Close()
+	a.listener.Close()
+	return err
+}
+
+func (a *attacker) shutdown(ctx context.Context) error {
+	err := a.server.Shutdown(ctx)
+	// the listener is closed by the server only once it serves
+	a.listener.Close()
+	return err
+}
+
+// clientAuth of the tls servers facing the client, the certificate is requested but not verified
+func (a *attacker) clientAuth() tls.ClientAuthType {
+	if a.proxy.Opts.RequestClientCert {
+		return tls.RequestClientCert
+	}
+	return tls.NoClientCert
+}
+
 func (a *attacker) serveConn(clientTlsConn *tls.Conn, connCtx *ConnContext) {
-	connCtx.ClientConn.NegotiatedProtocol = clientTlsConn.ConnectionState().NegotiatedProtocol
+	clientTlsState := clientTlsConn.ConnectionState()
+	connCtx.ClientConn.NegotiatedProtocol = clientTlsState.NegotiatedProtocol
+	connCtx.ClientConn.PeerCertificates = clientTlsState.PeerCertificates
 
 	if connCtx.ClientConn.NegotiatedProtocol == "h2" && connCtx.ServerConn != nil {
-		connCtx.ServerConn.client = &http.Client{
-			Transport: &http2.Transport{
-				DialTLSContext: func(ctx context.Context, network, addr string, cfg *tls.Config) (net.Conn, error) {
-					return connCtx.ServerConn.tlsConn, nil
+		// a pooled server connection is shared through the transport of its key, which speaks http/2 over it
+		if !connCtx.ServerConn.pooled {
+			connCtx.ServerConn.client = &http.Client{
+				Transport: &http2.Transport{
+					DialTLSContext: func(ctx context.Context, network, addr string, cfg *tls.Config) (net.Conn, error) {
+						return connCtx.ServerConn.tlsConn, nil
+					},
+					DisableCompression: true,
 				},
-				DisableCompression: true,
-			},
-			CheckRedirect: func(req *http.Request, via []*http.Request) error {
-				// 禁止自动重定向
-				return http.ErrUseLastResponse
-			},
+				CheckRedirect: func(req *http.Request, via []*http.Request) error {
+					// 禁止自动重定向
+					return http.ErrUseLastResponse
+				},
+			}
 		}
 
-		ctx := context.WithValue(context.Background(), connContextKey, connCtx)
-		ctx, cancel := context.WithCancel(ctx)
-		go func() {
-			<-connCtx.ClientConn.Conn.(*wrapClientConn).closeChan
-			cancel()
-		}()
-		go func() {
-			a.h2Server.ServeConn(clientTlsConn, &http2.ServeConnOpts{
-				Context:    ctx,
-				Handler:    a,
-				BaseConfig: a.server,
-			})
-		}()
+		a.serveH2(clientTlsConn, connCtx)
 		return
 	}
 
@@ -149,21 +186,43 @@ func (a *attacker) serveConn(clientTlsConn *tls.Conn, connCtx *ConnContext) {
 	})
 }
 
-func (a *attacker) ServeHTTP(res http.ResponseWriter, req *http.Request) {
-	if strings.EqualFold(req.Header.Get("Connection"), "Upgrade") && strings.EqualFold(req.Header.Get("Upgrade"), "websocket") {
-		// wss
-		defaultWebSocket.wss(res, req, &tls.Config{
-			InsecureSkipVerify: a.proxy.Opts.SslInsecure,
-		}, a.proxy.Addons)
-		return
-	}
+// serveH2 serves the http/2 client connection conn until the client disconnects
+func (a *attacker) serveH2(conn net.Conn, connCtx *ConnContext) {
+	ctx := context.WithValue(context.Background(), connContextKey, connCtx)
+	ctx, cancel := context.WithCancel(ctx)
+	go func() {
+		<-connCtx.ClientConn.Conn.(*wrapClientConn).closeChan
+		cancel()
+	}()
+	go func() {
+		a.h2Server.ServeConn(conn, &http2.ServeConnOpts{
+			Context:    ctx,
+			Handler:    a,
+			BaseConfig: a.server,
+		})
+	}()
+}
 
+func (a *attacker) ServeHTTP(res http.ResponseWriter, req *http.Request) {
 	if req.URL.Scheme == "" {
 		req.URL.Scheme = "https"
+		// plain http inside a CONNECT tunnel
+		if connCtx, ok := req.Context().Value(connContextKey).(*ConnContext); ok && connCtx.ClientConn != nil && !connCtx.ClientConn.Tls {
+			req.URL.Scheme = "http"
+		}
 	}
 	if req.URL.Host == "" {
 		req.URL.Host = req.Host
 	}
+
+	if isWebSocketUpgrade(req) {
+		// ws or wss, by req.URL.Scheme
+		defaultWebSocket.relay(res, req, &tls.Config{
+			InsecureSkipVerify: a.proxy.Opts.SslInsecure,
+		}, a.proxy.addons())
+		return
+	}
+
 	a.attack(res, req)
 }
 
@@ -171,6 +230,10 @@ func (a *attacker) initHttpDialFn(req *http.Request) {
 	connCtx := req.Context().Value(connContextKey).(*ConnContext)
 	connCtx.dialFn = func(ctx context.Context) error {
 		addr := helper.CanonicalAddr(req.URL)
+		if a.proxy.connPool != nil {
+			connCtx.ServerConn = a.proxy.connPool.newServerConn(addr, "")
+			return nil
+		}
 		c, err := a.proxy.getUpstreamConn(ctx, req)
 		if err != nil {
 			return err
@@ -185,22 +248,11 @@ func (a *attacker) initHttpDialFn(req *http.Request) {
 		serverConn := newServerConn()
 		serverConn.Conn = cw
 		serverConn.Address = addr
-		serverConn.client = &http.Client{
-			Transport: &http.Transport{
-				DialContext: func(ctx context.Context, network, addr string) (net.Conn, error) {
-					return cw, nil
-				},
-				ForceAttemptHTTP2:  false, // disable http2
-				DisableCompression: true,  // To get the original response from the server, set Transport.DisableCompression to true.
-			},
-			CheckRedirect: func(req *http.Request, via []*http.Request) error {
-				// 禁止自动重定向
-				return http.ErrUseLastResponse
-			},
-		}
+		serverConn.Upstream = connUpstream(c)
+		serverConn.client = newPlainServerClient(cw)
 
 		connCtx.ServerConn = serverConn
-		for _, addon := range proxy.Addons {
+		for _, addon := range proxy.addons() {
 			addon.ServerConnected(connCtx)
 		}
 
@@ -208,15 +260,60 @@ func (a *attacker) initHttpDialFn(req *http.Request) {
 	}
 }
 
+// http/2 client with prior knowledge (h2c) over an established plain server connection
+func newH2cServerClient(conn net.Conn) *http.Client {
+	return &http.Client{
+		Transport: &http2.Transport{
+			AllowHTTP: true,
+			DialTLSContext: func(ctx context.Context, network, addr string, cfg *tls.Config) (net.Conn, error) {
+				return conn, nil
+			},
+			DisableCompression: true,
+		},
+		CheckRedirect: func(req *http.Request, via []*http.Request) error {
+			// 禁止自动重定向
+			return http.ErrUseLastResponse
+		},
+	}
+}
+
+// http/1.x client over an established plain server connection
+func newPlainServerClient(conn net.Conn) *http.Client {
+	return &http.Client{
+		Transport: &http.Transport{
+			DialContext: func(ctx context.Context, network, addr string) (net.Conn, error) {
+				return conn, nil
+			},
+			ForceAttemptHTTP2:  false, // disable http2
+			DisableCompression: true,  // To get the original response from the server, set Transport.DisableCompression to true.
+		},
+		CheckRedirect: func(req *http.Request, via []*http.Request) error {
+			// 禁止自动重定向
+			return http.ErrUseLastResponse
+		},
+	}
+}
+
 // send clientHello to server, server handshake
 func (a *attacker) serverTlsHandshake(ctx context.Context, connCtx *ConnContext) error {
+	return a.serverTlsHandshakeHello(ctx, connCtx, connCtx.ClientConn.clientHello)
+}
+
+// server handshake with clientHello instead of the hello of the client
+func (a *attacker) serverTlsHandshakeHello(ctx context.Context, connCtx *ConnContext, clientHello *tls.ClientHelloInfo) error {
 	proxy := a.proxy
-	clientHello := connCtx.ClientConn.clientHello
 	serverConn := connCtx.ServerConn
 
+	connCtx.Timing.ServerTlsStart = time.Now()
+
+	clientCert := proxy.clientCertFor(serverConn.Address, clientHello.ServerName, connCtx.ClientConn.peerCertificate())
+	clientCertUsed := func(cert *x509.Certificate) {
+		serverConn.ClientCert = cert
+	}
+
 	// Handle utls fingerprint if configured
 	if proxy.Opts.TlsFingerprint != "" {
-		uConn, err := NewUtlsConn(serverConn.Conn, proxy.Opts, clientHello)
+		uConn, err := newUtlsConnAlpn(serverConn.Conn, proxy.Opts, clientHello, getUtlsClientCertificate(clientCert, clientCertUsed), connCtx.serverAlpn)
 		if err != nil {
 			return err
 		}
@@ -235,7 +332,8 @@ func (a *attacker) serverTlsHandshake(ctx context.Context, connCtx *ConnContext)
 			ServerName:         clientHello.ServerName,
 			NextProtos:         clientHello.SupportedProtos,
 			// CurvePreferences:   clientHello.SupportedCurves, // todo: 如果打开会出错
-			CipherSuites: clientHello.CipherSuites,
+			CipherSuites:         clientHello.CipherSuites,
+			GetClientCertificate: getClientCertificate(clientCert, clientCertUsed),
 		}
 		if len(clientHello.SupportedVersions) > 0 {
 			minVersion := clientHello.SupportedVersions[0]
@@ -259,8 +357,9 @@ func (a *attacker) serverTlsHandshake(ctx context.Context, connCtx *ConnContext)
 		serverTlsState := serverTlsConn.ConnectionState()
 		serverConn.tlsState = &serverTlsState
 	}
+	connCtx.Timing.ServerTlsDone = time.Now()
 
-	for _, addon := range proxy.Addons {
+	for _, addon := range proxy.addons() {
 		addon.TlsEstablishedServer(connCtx)
 	}
 
@@ -285,6 +384,10 @@ func (a *attacker) initHttpsDialFn(req *http.Request) {
 	connCtx := req.Context().Value(connContextKey).(*ConnContext)
 
 	connCtx.dialFn = func(ctx context.Context) error {
+		if a.proxy.connPool != nil {
+			connCtx.ServerConn = a.proxy.connPool.newServerConn(req.Host, connCtx.ClientConn.clientHello.ServerName)
+			return nil
+		}
 		_, err := a.httpsDial(ctx, req)
 		if err != nil {
 			return err
@@ -307,13 +410,14 @@ func (a *attacker) httpsDial(ctx context.Context, req *http.Request) (net.Conn,
 
 	serverConn := newServerConn()
 	serverConn.Address = req.Host
+	serverConn.Upstream = connUpstream(plainConn)
 	serverConn.Conn = &wrapServerConn{
 		Conn:    plainConn,
 		proxy:   proxy,
 		connCtx: connCtx,
 	}
 	connCtx.ServerConn = serverConn
-	for _, addon := range connCtx.proxy.Addons {
+	for _, addon := range connCtx.proxy.addons() {
 		addon.ServerConnected(connCtx)
 	}
 
@@ -368,10 +472,12 @@ func (a *attacker) httpsTlsDial(ctx context.Context, cconn net.Conn, conn net.Co
 				SessionTicketsDisabled: true,
 				Certificates:           []tls.Certificate{*c},
 				NextProtos:             nextProtos,
+				ClientAuth:             a.clientAuth(),
 			}, nil
 
 		},
 	})
+	connCtx.Timing.ClientTlsStart = time.Now()
 	go func() {
 		if err := clientTlsConn.HandshakeContext(ctx); err != nil {
 			errChan1 <- err
@@ -409,6 +515,11 @@ func (a *attacker) httpsTlsDial(ctx context.Context, cconn net.Conn, conn net.Co
 		return
 	case <-clientHandshakeDoneChan:
 	}
+	connCtx.Timing.ClientTlsDone = time.Now()
+
+	if a.proxy.connPool != nil {
+		a.proxy.connPool.adopt(connCtx)
+	}
 
 	// will go to attacker.ServeHTTP
 	a.serveConn(clientTlsConn, connCtx)
@@ -433,21 +544,70 @@ func (a *attacker) httpsLazyAttack(ctx context.Context, cconn net.Conn, req *htt
 				SessionTicketsDisabled: true,
 				Certificates:           []tls.Certificate{*c},
 				NextProtos:             []string{"http/1.1"}, // only support http/1.1
+				ClientAuth:             a.clientAuth(),
 			}, nil
 		},
 	})
+	connCtx.Timing.ClientTlsStart = time.Now()
 	if err := clientTlsConn.HandshakeContext(ctx); err != nil {
 		cconn.Close()
 		log.Error(err)
 		return
 	}
+	connCtx.Timing.ClientTlsDone = time.Now()
 
 	// will go to attacker.ServeHTTP
 	a.initHttpsDialFn(req)
 	a.serveConn(clientTlsConn, connCtx)
 }
 
+// plain http inside a CONNECT tunnel, conn is the server connection when it was dialed first
+func (a *attacker) httpTunnelAttack(cconn net.Conn, conn net.Conn, req *http.Request) {
+	wc := cconn.(*wrapClientConn)
+	connCtx := wc.connCtx
+	peek, _ := wc.Peek(3)
+	// h2c with prior knowledge, the server is expected to speak it too
+	h2c := helper.IsH2cPreface(peek)
+	if conn != nil {
+		if h2c {
+			connCtx.ServerConn.client = newH2cServerClient(conn)
+		} else {
+			connCtx.ServerConn.client = newPlainServerClient(conn)
+		}
+	} else {
+		a.initHttpDialFn(req)
+		if h2c {
+			dial := connCtx.dialFn
+			connCtx.dialFn = func(ctx context.Context) error {
+				if err := dial(ctx); err != nil {
+					return err
+				}
+				if serverConn := connCtx.ServerConn; !serverConn.pooled {
+					serverConn.client = newH2cServerClient(serverConn.Conn)
+				}
+				return nil
+			}
+		}
+	}
+
+	if h2c {
+		a.serveH2(cconn, connCtx)
+		return
+	}
+
+	// will go to attacker.ServeHTTP
+	a.listener.accept(&attackerConn{
+		Conn:    cconn,
+		connCtx: connCtx,
+	})
+}
+
 func (a *attacker) attack(res http.ResponseWriter, req *http.Request) {
+	a.attackFlow(res, req, NewFlow())
+}
+
+// attackFlow handles req as the flow f
+func (a *attacker) attackFlow(res http.ResponseWriter, req *http.Request, f *Flow) {
 	proxy := a.proxy
 
 	log := log.WithFields(log.Fields{
@@ -456,28 +616,41 @@ func (a *attacker) attack(res http.ResponseWriter, req *http.Request) {
 		"method": req.Method,
 	})
 
-	// when addons panic
+	// when the flow panics, the hooks of addons recover their own panics
 	defer func() {
 		if err := recover(); err != nil {
+			if err == http.ErrAbortHandler {
+				// a killed flow, net/http tears down the connection or the http/2 stream
+				panic(err)
+			}
 			log.Warnf("Recovered: %v\n", err)
 		}
 	}()
 
-	f := NewFlow()
 	f.Request = NewRequest(req)
 	f.ConnContext = req.Context().Value(connContextKey).(*ConnContext)
 	defer f.Finish()
+	defer proxy.conns.flow(f)()
 
-	f.ConnContext.FlowCount.Add(1)
+	// canceled by Flow.Kill
+	ctx, cancel := context.WithCancel(req.Context())
+	defer cancel()
+	f.setCancel(cancel)
+
+	f.Timing.ConnReused = f.ConnContext.FlowCount.Add(1) > 1
+
+	// the addons enabled when the flow starts see all of its hooks
+	addons := proxy.addons()
 
 	rawReqUrlHost := f.Request.URL.Host
 	rawReqUrlScheme := f.Request.URL.Scheme
 
 	// trigger addon event Requestheaders
-	for _, addon := range proxy.Addons {
+	for _, addon := range addons {
 		addon.Requestheaders(f)
+		a.abortIfKilled(f)
 		if f.Response != nil {
-			a.reply(res, log, f.Response, nil)
+			a.replyFlow(res, log, f, nil)
 			return
 		}
 	}
@@ -488,6 +661,7 @@ func (a *attacker) attack(res http.ResponseWriter, req *http.Request) {
 		reqBuf, r, err := helper.ReaderToBuffer(req.Body, proxy.Opts.StreamLargeBodies)
 		reqBody = r
 		if err != nil {
+			a.abortIfKilled(f)
 			log.Error(err)
 			res.WriteHeader(502)
 			return
@@ -500,10 +674,11 @@ func (a *attacker) attack(res http.ResponseWriter, req *http.Request) {
 			f.Request.Body = reqBuf
 
 			// trigger addon event Request
-			for _, addon := range proxy.Addons {
+			for _, addon := range addons {
 				addon.Request(f)
+				a.abortIfKilled(f)
 				if f.Response != nil {
-					a.reply(res, log, f.Response, nil)
+					a.replyFlow(res, log, f, nil)
 					return
 				}
 			}
@@ -511,11 +686,19 @@ func (a *attacker) attack(res http.ResponseWriter, req *http.Request) {
 		}
 	}
 
-	for _, addon := range proxy.Addons {
+	for _, addon := range addons {
 		reqBody = addon.StreamRequestModifier(f, reqBody)
+		a.abortIfKilled(f)
+		if f.Response != nil {
+			a.replyFlow(res, log, f, nil)
+			return
+		}
 	}
 
-	proxyReqCtx := context.WithValue(req.Context(), proxyReqCtxKey, req)
+	proxyReqCtx := context.WithValue(ctx, proxyReqCtxKey, req)
+	proxyReqCtx = context.WithValue(proxyReqCtx, flowCtxKey, f)
+	proxyReqCtx, trace := withFlowTrace(proxyReqCtx)
+	defer trace.apply(f)
 	proxyReq, err := http.NewRequestWithContext(proxyReqCtx, f.Request.Method, f.Request.URL.String(), reqBody)
 	if err != nil {
 		log.Error(err)
@@ -531,6 +714,11 @@ func (a *attacker) attack(res http.ResponseWriter, req *http.Request) {
 			proxyReq.Header.Add(key, v)
 		}
 	}
+	if len(f.Request.Trailer) > 0 {
+		// trailers are only sent with a chunked body in h1
+		proxyReq.Trailer = f.Request.Trailer
+		proxyReq.ContentLength = -1
+	}
 
 	useSeparateClient := f.UseSeparateClient
 	if !useSeparateClient {
@@ -544,7 +732,8 @@ func (a *attacker) attack(res http.ResponseWriter, req *http.Request) {
 		proxyRes, err = a.client.Do(proxyReq)
 	} else {
 		if f.ConnContext.ServerConn == nil && f.ConnContext.dialFn != nil {
-			if err := f.ConnContext.dialFn(req.Context()); err != nil {
+			if err := f.ConnContext.dialFn(ctx); err != nil {
+				a.abortIfKilled(f)
 				// Check for authentication failure
 				log.Error(err)
 				if strings.Contains(err.Error(), "Proxy Authentication Required") {
@@ -555,9 +744,16 @@ func (a *attacker) attack(res http.ResponseWriter, req *http.Request) {
 				return
 			}
 		}
-		proxyRes, err = f.ConnContext.ServerConn.client.Do(proxyReq)
+		serverConn := f.ConnContext.ServerConn
+		proxyRes, err = serverConn.client.Do(proxyReq)
+		// pooled connections are recorded per request by connPoolTransport
+		if !serverConn.pooled && serverConn.Upstream != nil {
+			f.Metadata["upstream"] = serverConn.Upstream.Redacted()
+		}
 	}
+	trace.apply(f)
 	if err != nil {
+		a.abortIfKilled(f)
 		logErr(log, err)
 		res.WriteHeader(502)
 		return
@@ -573,24 +769,38 @@ func (a *attacker) attack(res http.ResponseWriter, req *http.Request) {
 	f.Response = &Response{
 		StatusCode: proxyRes.StatusCode,
 		Header:     proxyRes.Header,
+		Trailer:    proxyRes.Trailer,
 		close:      proxyRes.Close,
 	}
 
 	// trigger addon event Responseheaders
-	for _, addon := range proxy.Addons {
+	for _, addon := range addons {
 		addon.Responseheaders(f)
+		a.abortIfKilled(f)
 		if f.Response.Body != nil {
-			a.reply(res, log, f.Response, nil)
+			a.replyFlow(res, log, f, nil)
 			return
 		}
 	}
 
-	// Read response body
-	var resBody io.Reader = proxyRes.Body
+	// Read response body, the trailers not declared by the server are only known once it is read
+	var resBody io.Reader = &eofReader{r: proxyRes.Body, onEOF: func() { f.Response.takeTrailer(proxyRes) }}
+	if f.Response.IsEventStream() {
+		// server-sent events are long-lived, stream them through and fire ServerSentEvent per event
+		f.Stream = true
+		if enc := f.Response.Header.Get("Content-Encoding"); enc == "" || enc == "identity" {
+			resBody = newSseReader(resBody, func(ev *ServerSentEvent) {
+				for _, addon := range addons {
+					addon.ServerSentEvent(f, ev)
+				}
+			})
+		}
+	}
 	if !f.Stream {
-		resBuf, r, err := helper.ReaderToBuffer(proxyRes.Body, proxy.Opts.StreamLargeBodies)
+		resBuf, r, err := helper.ReaderToBuffer(resBody, proxy.Opts.StreamLargeBodies)
 		resBody = r
 		if err != nil {
+			a.abortIfKilled(f)
 			log.Error(err)
 			res.WriteHeader(502)
 			return
@@ -600,38 +810,53 @@ func (a *attacker) attack(res http.ResponseWriter, req *http.Request) {
 			f.Stream = true
 		} else {
 			f.Response.Body = resBuf
+			f.Timing.ResponseComplete = time.Now()
 
 			// trigger addon event Response
-			for _, addon := range proxy.Addons {
+			for _, addon := range addons {
 				addon.Response(f)
+				a.abortIfKilled(f)
 			}
 		}
 	}
-	for _, addon := range proxy.Addons {
+	for _, addon := range addons {
 		resBody = addon.StreamResponseModifier(f, resBody)
 	}
 
-	a.reply(res, log, f.Response, resBody)
+	a.replyFlow(res, log, f, resBody)
+	if f.Timing.ResponseComplete.IsZero() {
+		f.Timing.ResponseComplete = time.Now()
+	}
+	a.abortIfKilled(f)
 }
 
-func (a *attacker) reply(res http.ResponseWriter, log *log.Entry, response *Response, body io.Reader) {
-	if response.Header != nil {
-		for key, value := range response.Header {
-			if key == "Content-Length" {
-				continue
-			}
-			for _, v := range value {
-				res.Header().Add(key, v)
-			}
-		}
+// abortIfKilled stops the handler of a killed flow, net/http closes the connection or resets the http/2 stream
+func (a *attacker) abortIfKilled(f *Flow) {
+	if !f.IsKilled() {
+		return
 	}
-	if response.close {
-		res.Header().Add("Connection", "close")
+	for _, addon := range a.proxy.addons() {
+		addon.FlowKilled(f)
 	}
+	panic(http.ErrAbortHandler)
+}
+
+func (a *attacker) reply(res http.ResponseWriter, log *log.Entry, response *Response, body io.Reader) {
+	replyHeader(res, response)
 	res.WriteHeader(response.StatusCode)
 
+	var dst io.Writer = res
+	if flusher, ok := res.(http.Flusher); ok && response.IsEventStream() {
+		flusher.Flush()
+		dst = &flushWriter{w: res, f: flusher}
+	} else if ok && body != nil && response.Header.Get("Content-Length") == "" {
+		// a streamed body of unknown length may end with trailers the server did not declare,
+		// send it chunked so they can follow
+		flusher.Flush()
+	}
+
 	if body != nil {
-		_, err := helper.Copy(res, body)
+		_, err := helper.Copy(dst, body)
 		if err != nil {
 			logErr(log, err)
 		}
@@ -648,6 +873,38 @@ func (a *attacker) reply(res http.ResponseWriter, log *log.Entry, response *Resp
 			logErr(log, err)
 		}
 	}
+
+	replyTrailer(res, response)
+}
+
+// replyHeader sets the header of response to res, Content-Length is left to net/http
+func replyHeader(res http.ResponseWriter, response *Response) {
+	if response.Header != nil {
+		for key, value := range response.Header {
+			if key == "Content-Length" {
+				continue
+			}
+			for _, v := range value {
+				res.Header().Add(key, v)
+			}
+		}
+	}
+	if response.close {
+		res.Header().Add("Connection", "close")
+	}
+	// declare the trailers known before the body, values are set after it
+	for key := range response.Trailer {
+		res.Header().Add("Trailer", key)
+	}
+}
+
+// replyTrailer sets the trailers of response to res once the body is written
+func replyTrailer(res http.ResponseWriter, response *Response) {
+	for key, values := range response.Trailer {
+		for _, v := range values {
+			res.Header().Add(http.TrailerPrefix+key, v)
+		}
+	}
 }
 
 
@@ -234,6 +234,33 @@ func TestAttacker_Attack_StreamLargeBody(t *testing.T) {
 	}
 }
 
+func TestAttacker_Attack_StreamRequestAnswered(t *testing.T) {
+	p, _ := NewProxy(&Options{Addr: ":0", StreamLargeBodies: 1})
+	p.AddAddon(&MockHookAddon{
+		OnStreamRequestMod: func(f *Flow, r io.Reader) io.Reader {
+			f.Response = &Response{StatusCode: 200, Header: http.Header{}, Body: []byte("answered")}
+			return r
+		},
+	})
+	a, _ := newAttacker(p)
+
+	req := httptest.NewRequest(http.MethodPost, "http://example.com", bytes.NewReader([]byte("large body")))
+	dialed := false
+	connCtx := &ConnContext{proxy: p}
+	connCtx.dialFn = func(ctx context.Context) error {
+		dialed = true
+		return errors.New("dial")
+	}
+	req = req.WithContext(context.WithValue(req.Context(), connContextKey, connCtx))
+
+	// a response set on a streamed flow answers it instead of the server
+	rec := httptest.NewRecorder()
+	a.attack(rec, req)
+	if dialed || rec.Code != 200 || rec.Body.String() != "answered" {
+		t.Errorf("Expected the addon's response, dialed %v, got %d %q", dialed, rec.Code, rec.Body.String())
+	}
+}
+
 func TestAttacker_Attack_RequestBodyReadError(t *testing.T) {
 	opts := &Options{Addr: ":0"}
 	p, _ := NewProxy(opts)
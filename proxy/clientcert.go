@@ -0,0 +1,161 @@
+package proxy
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"net"
+	"os"
+
+	utls "github.com/refraction-networking/utls"
+	"github.com/retutils/gomitmproxy/internal/helper"
+	"software.sslmate.com/src/go-pkcs12"
+)
+
+// ClientCert is presented to upstream servers matching Hosts when they request a client certificate
+type ClientCert struct {
+	Hosts    []string `json:"hosts"`    // host globs with optional port, e.g. *.internal.example.com, empty for all hosts
+	Cert     string   `json:"cert"`     // PEM certificate (chain) file, or PKCS#12 (.p12, .pfx) file holding the key too
+	Key      string   `json:"key"`      // PEM private key file, empty if Cert holds the key
+	Password string   `json:"password"` // PKCS#12 password
+}
+
+// NewClientCertsFromFile reads a json array of ClientCert
+func NewClientCertsFromFile(filename string) ([]*ClientCert, error) {
+	var certs []*ClientCert
+	if err := helper.NewStructFromFile(filename, &certs); err != nil {
+		return nil, err
+	}
+	return certs, nil
+}
+
+type clientCert struct {
+	hosts []string
+	cert  *tls.Certificate // Leaf is set
+}
+
+func loadClientCerts(configs []*ClientCert) ([]*clientCert, error) {
+	certs := make([]*clientCert, 0, len(configs))
+	for i, c := range configs {
+		cert, err := loadClientCert(c)
+		if err != nil {
+			return nil, fmt.Errorf("client cert %v %v: %w", i, c.Cert, err)
+		}
+		certs = append(certs, &clientCert{hosts: c.Hosts, cert: cert})
+	}
+	return certs, nil
+}
+
+func loadClientCert(c *ClientCert) (*tls.Certificate, error) {
+	certData, err := os.ReadFile(c.Cert)
+	if err != nil {
+		return nil, err
+	}
+
+	var cert tls.Certificate
+	if bytes.Contains(certData, []byte("-----BEGIN")) {
+		keyData := certData
+		if c.Key != "" {
+			if keyData, err = os.ReadFile(c.Key); err != nil {
+				return nil, err
+			}
+		}
+		if cert, err = tls.X509KeyPair(certData, keyData); err != nil {
+			return nil, err
+		}
+	} else {
+		key, leaf, chain, err := pkcs12.DecodeChain(certData, c.Password)
+		if err != nil {
+			return nil, err
+		}
+		cert.PrivateKey = key
+		cert.Certificate = append(cert.Certificate, leaf.Raw)
+		for _, ca := range chain {
+			cert.Certificate = append(cert.Certificate, ca.Raw)
+		}
+	}
+	if cert.Leaf == nil {
+		if cert.Leaf, err = x509.ParseCertificate(cert.Certificate[0]); err != nil {
+			return nil, err
+		}
+	}
+	return &cert, nil
+}
+
+// clientCertFor returns the client certificate of the server at address reached with sni, nil if none is configured.
+// Among the certificates matching the host, the one holding the key of peer, the certificate of the downstream client, is preferred.
+func (proxy *Proxy) clientCertFor(address string, sni string, peer *x509.Certificate) *tls.Certificate {
+	if len(proxy.clientCerts) == 0 {
+		return nil
+	}
+	hostname, port, err := net.SplitHostPort(address)
+	if err != nil {
+		hostname, port = address, "443"
+	}
+	if sni != "" {
+		hostname = sni
+	}
+	var first *tls.Certificate
+	for _, c := range proxy.clientCerts {
+		if !c.match(hostname, port) {
+			continue
+		}
+		if peer == nil {
+			return c.cert
+		}
+		if c.holdsKeyOf(peer) {
+			return c.cert
+		}
+		if first == nil {
+			first = c.cert
+		}
+	}
+	return first
+}
+
+func (c *clientCert) match(hostname, port string) bool {
+	if len(c.hosts) == 0 {
+		return true
+	}
+	for _, host := range c.hosts {
+		if matchHostGlob(hostname, port, host) {
+			return true
+		}
+	}
+	return false
+}
+
+// holdsKeyOf reports whether the private key of c belongs to the public key of cert
+func (c *clientCert) holdsKeyOf(cert *x509.Certificate) bool {
+	pub, ok := c.cert.Leaf.PublicKey.(interface{ Equal(crypto.PublicKey) bool })
+	return ok && pub.Equal(cert.PublicKey)
+}
+
+// getClientCertificate for crypto/tls presents cert, used is called when the server requested it
+func getClientCertificate(cert *tls.Certificate, used func(*x509.Certificate)) func(*tls.CertificateRequestInfo) (*tls.Certificate, error) {
+	return func(*tls.CertificateRequestInfo) (*tls.Certificate, error) {
+		if cert == nil {
+			// no certificate is sent, the server decides whether to continue
+			return &tls.Certificate{}, nil
+		}
+		used(cert.Leaf)
+		return cert, nil
+	}
+}
+
+// getUtlsClientCertificate is getClientCertificate for uTLS
+func getUtlsClientCertificate(cert *tls.Certificate, used func(*x509.Certificate)) func(*utls.CertificateRequestInfo) (*utls.Certificate, error) {
+	return func(*utls.CertificateRequestInfo) (*utls.Certificate, error) {
+		if cert == nil {
+			return &utls.Certificate{}, nil
+		}
+		used(cert.Leaf)
+		return &utls.Certificate{
+			Certificate: cert.Certificate,
+			PrivateKey:  cert.PrivateKey,
+			Leaf:        cert.Leaf,
+		}, nil
+	}
+}
@@ -0,0 +1,306 @@
+package proxy
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io"
+	"math/big"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"software.sslmate.com/src/go-pkcs12"
+)
+
+// writeTestClientCert writes a self-signed client certificate with common name cn as cert.pem, key.pem, combined.pem and cert.p12 into dir
+func writeTestClientCert(t *testing.T, dir, cn, password string) {
+	t.Helper()
+	priv, err := rsa.GenerateKey(rand.Reader, 2048)
+	handleError(t, err)
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(2),
+		Subject:      pkix.Name{CommonName: cn},
+		NotBefore:    time.Now(),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &priv.PublicKey, priv)
+	handleError(t, err)
+	leaf, err := x509.ParseCertificate(der)
+	handleError(t, err)
+
+	certPem := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})
+	keyPem := pem.EncodeToMemory(&pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(priv)})
+	p12, err := pkcs12.Modern.Encode(priv, leaf, nil, password)
+	handleError(t, err)
+
+	handleError(t, os.WriteFile(filepath.Join(dir, "cert.pem"), certPem, 0644))
+	handleError(t, os.WriteFile(filepath.Join(dir, "key.pem"), keyPem, 0600))
+	handleError(t, os.WriteFile(filepath.Join(dir, "combined.pem"), append(certPem, keyPem...), 0600))
+	handleError(t, os.WriteFile(filepath.Join(dir, "cert.p12"), p12, 0600))
+}
+
+func TestLoadClientCerts(t *testing.T) {
+	dir := t.TempDir()
+	writeTestClientCert(t, dir, "test-client", "secret")
+
+	certs, err := loadClientCerts([]*ClientCert{
+		{Cert: filepath.Join(dir, "cert.pem"), Key: filepath.Join(dir, "key.pem")},
+		{Cert: filepath.Join(dir, "combined.pem")},
+		{Cert: filepath.Join(dir, "cert.p12"), Password: "secret"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i, c := range certs {
+		if c.cert.Leaf == nil || c.cert.Leaf.Subject.CommonName != "test-client" || c.cert.PrivateKey == nil {
+			t.Errorf("%v: unexpected certificate %+v", i, c.cert)
+		}
+	}
+
+	for _, c := range []*ClientCert{
+		{Cert: filepath.Join(dir, "missing.pem")},
+		{Cert: filepath.Join(dir, "cert.pem")},
+		{Cert: filepath.Join(dir, "cert.pem"), Key: filepath.Join(dir, "missing.pem")},
+		{Cert: filepath.Join(dir, "cert.p12"), Password: "wrong"},
+	} {
+		if _, err := loadClientCerts([]*ClientCert{c}); err == nil {
+			t.Errorf("%+v: want error", c)
+		}
+	}
+}
+
+func TestNewClientCertsFromFile(t *testing.T) {
+	filename := filepath.Join(t.TempDir(), "client_certs.json")
+	data := `[
+		{"hosts": ["*.example.com"], "cert": "client.pem", "key": "client-key.pem"},
+		{"cert": "client.p12", "password": "secret"}
+	]`
+	handleError(t, os.WriteFile(filename, []byte(data), 0644))
+	certs, err := NewClientCertsFromFile(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(certs) != 2 || certs[0].Hosts[0] != "*.example.com" || certs[0].Key != "client-key.pem" || certs[1].Password != "secret" {
+		t.Errorf("unexpected certs %+v %+v", certs[0], certs[1])
+	}
+}
+
+func TestProxy_ClientCertFor(t *testing.T) {
+	a, b := &tls.Certificate{}, &tls.Certificate{}
+	proxy := &Proxy{clientCerts: []*clientCert{
+		{hosts: []string{"*.a.com", "b.com:8443"}, cert: a},
+		{cert: b},
+	}}
+	cases := []struct {
+		address, sni string
+		want         *tls.Certificate
+	}{
+		{"api.a.com:443", "", a},
+		{"10.0.0.1:443", "api.a.com", a},
+		{"b.com:8443", "", a},
+		{"b.com:443", "", b},
+		{"other.com:443", "", b},
+	}
+	for _, c := range cases {
+		if got := proxy.clientCertFor(c.address, c.sni, nil); got != c.want {
+			t.Errorf("%v %v: unexpected certificate", c.address, c.sni)
+		}
+	}
+
+	proxy.clientCerts = proxy.clientCerts[:1]
+	if got := proxy.clientCertFor("other.com:443", "", nil); got != nil {
+		t.Error("want no certificate when no host matches")
+	}
+}
+
+type clientCertRecorderAddon struct {
+	BaseAddon
+	certs chan *x509.Certificate
+	lazy  bool
+}
+
+func (a *clientCertRecorderAddon) ClientConnected(client *ClientConn) {
+	// dial lazily, so requests draw from the pool
+	client.UpstreamCert = !a.lazy
+}
+
+func (a *clientCertRecorderAddon) Response(f *Flow) {
+	a.certs <- f.ConnContext.ServerConn.ClientCert
+}
+
+// listenTestProxy serves p on an ephemeral port and returns its address
+func listenTestProxy(t *testing.T, p *Proxy) string {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	handleError(t, err)
+	go p.serve(ln)
+	t.Cleanup(func() {
+		p.Close()
+	})
+	return ln.Addr().String()
+}
+
+// serveTestProxy serves p on an ephemeral port and returns a client going through it
+func serveTestProxy(t *testing.T, p *Proxy) *http.Client {
+	t.Helper()
+	proxyUrl, _ := url.Parse("http://" + listenTestProxy(t, p))
+	return &http.Client{
+		Transport: &http.Transport{
+			Proxy:           http.ProxyURL(proxyUrl),
+			TLSClientConfig: &tls.Config{InsecureSkipVerify: true},
+		},
+	}
+}
+
+func TestClientCert(t *testing.T) {
+	helper := &testProxyHelper{
+		server: &http.Server{
+			Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				w.Write([]byte(r.TLS.PeerCertificates[0].Subject.CommonName))
+			}),
+			// the uTLS hello offers h2, which the upstream client does not speak
+			TLSConfig:    &tls.Config{ClientAuth: tls.RequireAnyClientCert, NextProtos: []string{"http/1.1"}},
+			TLSNextProto: map[string]func(*http.Server, *tls.Conn, http.Handler){},
+		},
+	}
+	helper.init(t)
+	dir := t.TempDir()
+	writeTestClientCert(t, dir, "test-client", "")
+	defer helper.tlsPlainLn.Close()
+	go helper.server.ServeTLS(helper.tlsPlainLn, "", "")
+
+	for _, tc := range []struct {
+		name        string
+		fingerprint string
+		connPool    bool
+	}{
+		{"crypto/tls", "", false},
+		{"utls", "chrome", false},
+		{"conn pool", "", true},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			testProxy, err := NewProxy(&Options{
+				StreamLargeBodies: 1024 * 1024,
+				SslInsecure:       true,
+				TlsFingerprint:    tc.fingerprint,
+				ConnPool:          tc.connPool,
+				ClientCerts:       []*ClientCert{{Hosts: []string{"127.0.0.1"}, Cert: filepath.Join(dir, "combined.pem")}},
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+			addon := &clientCertRecorderAddon{certs: make(chan *x509.Certificate, 1), lazy: tc.connPool}
+			testProxy.AddAddon(addon)
+			client := serveTestProxy(t, testProxy)
+
+			resp, err := client.Get(helper.httpsEndpoint)
+			if err != nil {
+				t.Fatal(err)
+			}
+			body, _ := io.ReadAll(resp.Body)
+			resp.Body.Close()
+			client.CloseIdleConnections()
+			if string(body) != "test-client" {
+				t.Errorf("want server to see the client certificate, got %v %q", resp.StatusCode, body)
+			}
+			if got := <-addon.certs; got == nil || got.Subject.CommonName != "test-client" {
+				t.Errorf("want ServerConn.ClientCert recorded, got %v", got)
+			}
+		})
+	}
+}
+
+type peerCertRecorderAddon struct {
+	BaseAddon
+	peers chan []*x509.Certificate
+}
+
+func (a *peerCertRecorderAddon) ClientConnected(client *ClientConn) {
+	client.UpstreamCert = false
+}
+
+func (a *peerCertRecorderAddon) Response(f *Flow) {
+	a.peers <- f.ConnContext.ClientConn.PeerCertificates
+}
+
+func TestRequestClientCert(t *testing.T) {
+	helper := &testProxyHelper{
+		server: &http.Server{
+			Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				w.Write([]byte(r.TLS.PeerCertificates[0].Subject.CommonName))
+			}),
+			TLSConfig: &tls.Config{ClientAuth: tls.RequireAnyClientCert},
+		},
+	}
+	helper.init(t)
+	defaultDir, peerDir := t.TempDir(), t.TempDir()
+	writeTestClientCert(t, defaultDir, "proxy-default", "")
+	writeTestClientCert(t, peerDir, "test-client", "")
+	peerCert, err := tls.LoadX509KeyPair(filepath.Join(peerDir, "cert.pem"), filepath.Join(peerDir, "key.pem"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer helper.tlsPlainLn.Close()
+	go helper.server.ServeTLS(helper.tlsPlainLn, "", "")
+
+	for _, tc := range []struct {
+		name     string
+		connPool bool
+		present  bool
+		want     string
+	}{
+		{"peer", false, true, "test-client"},
+		{"no peer", false, false, "proxy-default"},
+		{"conn pool peer", true, true, "test-client"},
+		{"conn pool no peer", true, false, "proxy-default"},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			testProxy, err := NewProxy(&Options{
+				StreamLargeBodies: 1024 * 1024,
+				SslInsecure:       true,
+				RequestClientCert: true,
+				ConnPool:          tc.connPool,
+				ClientCerts: []*ClientCert{
+					{Cert: filepath.Join(defaultDir, "combined.pem")},
+					{Cert: filepath.Join(peerDir, "combined.pem")},
+				},
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+			addon := &peerCertRecorderAddon{peers: make(chan []*x509.Certificate, 1)}
+			testProxy.AddAddon(addon)
+			client := serveTestProxy(t, testProxy)
+			if tc.present {
+				client.Transport.(*http.Transport).TLSClientConfig.Certificates = []tls.Certificate{peerCert}
+			}
+			resp, err := client.Get(helper.httpsEndpoint)
+			if err != nil {
+				t.Fatal(err)
+			}
+			body, _ := io.ReadAll(resp.Body)
+			resp.Body.Close()
+			client.CloseIdleConnections()
+			if string(body) != tc.want {
+				t.Errorf("want server to see %v, got %v %q", tc.want, resp.StatusCode, body)
+			}
+			peers := <-addon.peers
+			if tc.present && (len(peers) != 1 || peers[0].Subject.CommonName != "test-client") {
+				t.Errorf("want ClientConn.PeerCertificates of the client, got %v", peers)
+			}
+			if !tc.present && len(peers) != 0 {
+				t.Errorf("want no ClientConn.PeerCertificates, got %v", peers)
+			}
+		})
+	}
+}
@@ -3,9 +3,13 @@ package proxy
 import (
 	"context"
 	"crypto/tls"
+	"crypto/x509"
 	"encoding/json"
 	"net"
 	"net/http"
+	"net/url"
+	"sync"
+	"time"
 
 	uuid "github.com/satori/go.uuid"
 	"go.uber.org/atomic"
@@ -18,7 +22,9 @@ type ClientConn struct {
 	Tls                bool
 	NegotiatedProtocol string
 	UpstreamCert       bool // Connect to upstream server to look up certificate details. Default: True
-	clientHello        *tls.ClientHelloInfo
+	// certificate chain the client presented when Options.RequestClientCert is set, empty if it sent none
+	PeerCertificates []*x509.Certificate
+	clientHello      *tls.ClientHelloInfo
 }
 
 func newClientConn(c net.Conn) *ClientConn {
@@ -35,18 +41,34 @@ func (c *ClientConn) MarshalJSON() ([]byte, error) {
 	m["id"] = c.Id
 	m["tls"] = c.Tls
 	m["address"] = c.Conn.RemoteAddr().String()
+	if cert := c.peerCertificate(); cert != nil {
+		m["clientCert"] = cert.Subject.String()
+	}
 	return json.Marshal(m)
 }
 
+// peerCertificate returns the leaf of PeerCertificates, nil if the client presented none
+func (c *ClientConn) peerCertificate() *x509.Certificate {
+	if len(c.PeerCertificates) == 0 {
+		return nil
+	}
+	return c.PeerCertificates[0]
+}
+
 // server connection
 type ServerConn struct {
-	Id      uuid.UUID
-	Address string
-	Conn    net.Conn
+	Id       uuid.UUID
+	Address  string
+	Conn     net.Conn
+	Upstream *url.URL // upstream proxy the connection goes through, nil if direct
+	// client certificate presented to the server, nil if the server requested none or none is configured
+	ClientCert *x509.Certificate
 
 	client   *http.Client
 	tlsConn  net.Conn
 	tlsState *tls.ConnectionState
+	pooled   bool       // requests are sent through the shared upstream pool, Conn is the connection of the first request
+	mu       sync.Mutex // guards the fields a pooled connection sets when its first request gets a connection
 }
 
 func newServerConn() *ServerConn {
@@ -56,6 +78,8 @@ func newServerConn() *ServerConn {
 }
 
 func (c *ServerConn) MarshalJSON() ([]byte, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
 	m := make(map[string]interface{})
 	m["id"] = c.Id
 	m["address"] = c.Address
@@ -64,15 +88,33 @@ func (c *ServerConn) MarshalJSON() ([]byte, error) {
 		peername = c.Conn.RemoteAddr().String()
 	}
 	m["peername"] = peername
+	if c.Upstream != nil {
+		m["upstream"] = c.Upstream.Redacted()
+	}
+	if c.ClientCert != nil {
+		m["clientCert"] = c.ClientCert.Subject.String()
+	}
 	return json.Marshal(m)
 }
 
+// Conn, set by the first request of a pooled connection
+func (c *ServerConn) conn() net.Conn {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.Conn
+}
+
 func (c *ServerConn) TlsState() *tls.ConnectionState {
+	c.mu.Lock()
+	defer c.mu.Unlock()
 	return c.tlsState
 }
 
+// context keys are of their own type, pointers to zero-size values such as new(struct{}) may all be equal
+type ctxKey string
+
 // connection context ctx key
-var connContextKey = new(struct{})
+var connContextKey = ctxKey("connContext")
 
 // connection context
 type ConnContext struct {
@@ -80,16 +122,20 @@ type ConnContext struct {
 	ServerConn *ServerConn   `json:"serverConn"`
 	Intercept  bool          `json:"intercept"` // Indicates whether to parse HTTPS
 	FlowCount  atomic.Uint32 `json:"-"`         // Number of HTTP requests made on the same connection
+	Timing     ConnTiming    `json:"-"`
 
 	proxy              *Proxy
 	closeAfterResponse bool                        // after http response, http server will close the connection
 	dialFn             func(context.Context) error // when begin request, if there no ServerConn, use this func to dial
+	reverseBackend     *url.URL                    // reverse proxy mode: backend of this connection
+	serverAlpn         []string                    // protocols offered to the server instead of those of Options.TlsFingerprint if not nil
 }
 
 func newConnContext(c net.Conn, proxy *Proxy) *ConnContext {
 	clientConn := newClientConn(c)
 	return &ConnContext{
 		ClientConn: clientConn,
+		Timing:     ConnTiming{ClientConnected: time.Now()},
 		proxy:      proxy,
 	}
 }
@@ -97,3 +143,24 @@ func newConnContext(c net.Conn, proxy *Proxy) *ConnContext {
 func (connCtx *ConnContext) Id() uuid.UUID {
 	return connCtx.ClientConn.Id
 }
+
+// abortClientConn closes the client connection, with a TCP RST if Options.KillRst is set
+func (connCtx *ConnContext) abortClientConn() {
+	connCtx.closeClientConn(connCtx.proxy != nil && connCtx.proxy.Opts.KillRst)
+}
+
+// closeClientConn closes the client connection, with a TCP RST if rst is set
+func (connCtx *ConnContext) closeClientConn(rst bool) {
+	if connCtx.ClientConn == nil || connCtx.ClientConn.Conn == nil {
+		return
+	}
+	conn := connCtx.ClientConn.Conn
+	if rst {
+		if wc, ok := conn.(*wrapClientConn); ok {
+			if tcpConn, ok := wc.Conn.(*net.TCPConn); ok {
+				tcpConn.SetLinger(0)
+			}
+		}
+	}
+	conn.Close()
+}
@@ -3,11 +3,15 @@ package proxy
 import (
 	"bufio"
 	"context"
+	"crypto/tls"
+	"errors"
 	"fmt"
 	"io"
 	"net"
 	"net/http"
+	"os"
 	"sync"
+	"time"
 
 	"github.com/retutils/gomitmproxy/internal/helper"
 	log "github.com/sirupsen/logrus"
@@ -20,18 +24,24 @@ type wrapListener struct {
 }
 
 func (l *wrapListener) Accept() (net.Conn, error) {
-	c, err := l.Listener.Accept()
-	if err != nil {
-		return nil, err
-	}
-
 	proxy := l.proxy
-	wc := newWrapClientConn(c, proxy)
-	connCtx := newConnContext(wc, proxy)
-	wc.connCtx = connCtx
+	var wc *wrapClientConn
+	for wc == nil {
+		c, err := l.Listener.Accept()
+		if err != nil {
+			return nil, err
+		}
+		wc = newWrapClientConn(c, proxy)
+		wc.connCtx = newConnContext(wc, proxy)
+		if !proxy.conns.addConn(wc) {
+			// the proxy shuts down, its server closes the listener next
+			c.Close()
+			wc = nil
+		}
+	}
 
-	for _, addon := range proxy.Addons {
-		addon.ClientConnected(connCtx.ClientConn)
+	for _, addon := range proxy.addons() {
+		addon.ClientConnected(wc.connCtx.ClientConn)
 	}
 
 	return wc, nil
@@ -43,6 +53,7 @@ type wrapClientConn struct {
 	r       *bufio.Reader
 	proxy   *Proxy
 	connCtx *ConnContext
+	link    netLink // shaped by NetworkConditions, the server side is not
 
 	closeMu   sync.Mutex
 	closed    bool
@@ -64,7 +75,11 @@ func (c *wrapClientConn) Peek(n int) ([]byte, error) {
 }
 
 func (c *wrapClientConn) Read(data []byte) (int, error) {
-	return c.r.Read(data)
+	return c.link.read(c.r, data)
+}
+
+func (c *wrapClientConn) Write(data []byte) (int, error) {
+	return c.link.write(c.Conn, data)
 }
 
 func (c *wrapClientConn) Close() error {
@@ -79,13 +94,21 @@ func (c *wrapClientConn) Close() error {
 	c.closeErr = c.Conn.Close()
 	c.closeMu.Unlock()
 	close(c.closeChan)
+	c.proxy.conns.removeConn(c)
 
-	for _, addon := range c.proxy.Addons {
+	for _, addon := range c.proxy.addons() {
 		addon.ClientDisconnected(c.connCtx.ClientConn)
 	}
 
-	if c.connCtx.ServerConn != nil && c.connCtx.ServerConn.Conn != nil {
-		c.connCtx.ServerConn.Conn.Close()
+	if serverConn := c.connCtx.ServerConn; serverConn != nil && serverConn.conn() != nil {
+		if serverConn.pooled {
+			// the connection stays open in the pool, it is only released by this client connection
+			for _, addon := range c.proxy.addons() {
+				addon.ServerDisconnected(c.connCtx)
+			}
+		} else {
+			serverConn.Conn.Close()
+		}
 	}
 
 	return c.closeErr
@@ -100,6 +123,13 @@ type wrapServerConn struct {
 	closeMu  sync.Mutex
 	closed   bool
 	closeErr error
+	released bool // handed to the connection pool, closing it no longer ends the client connection
+}
+
+func (c *wrapServerConn) release() {
+	c.closeMu.Lock()
+	c.released = true
+	c.closeMu.Unlock()
 }
 
 func (c *wrapServerConn) Close() error {
@@ -112,14 +142,21 @@ func (c *wrapServerConn) Close() error {
 
 	c.closed = true
 	c.closeErr = c.Conn.Close()
+	released := c.released
 	c.closeMu.Unlock()
+	if released {
+		return c.closeErr
+	}
 
-	for _, addon := range c.proxy.Addons {
+	for _, addon := range c.proxy.addons() {
 		addon.ServerDisconnected(c.connCtx)
 	}
 
 	if !c.connCtx.ClientConn.Tls {
-		c.connCtx.ClientConn.Conn.(*wrapClientConn).Conn.(*net.TCPConn).CloseRead()
+		// the client connection of a replayed flow is no tcp connection
+		if tcpConn, ok := c.connCtx.ClientConn.Conn.(*wrapClientConn).Conn.(*net.TCPConn); ok {
+			tcpConn.CloseRead()
+		}
 	} else {
 		// if keep-alive connection close
 		if !c.connCtx.closeAfterResponse {
@@ -141,28 +178,31 @@ func newEntry(proxy *Proxy) *entry {
 		Addr:    proxy.Opts.Addr,
 		Handler: e,
 		ConnContext: func(ctx context.Context, c net.Conn) context.Context {
-			return context.WithValue(ctx, connContextKey, c.(*wrapClientConn).connCtx)
+			return context.WithValue(ctx, connContextKey, entryClientConn(c).connCtx)
 		},
 	}
 	return e
 }
 
-func (e *entry) start() error {
+func (e *entry) listen() (net.Listener, error) {
 	addr := e.server.Addr
 	if addr == "" {
 		addr = ":http"
 	}
-	ln, err := net.Listen("tcp", addr)
-	if err != nil {
-		return err
-	}
+	return net.Listen("tcp", addr)
+}
+
+func (e *entry) serve(ln net.Listener) error {
 	e.server.Addr = ln.Addr().String()
 
 	log.Infof("Proxy start listen at %v\n", e.server.Addr)
-	pln := &wrapListener{
+	var pln net.Listener = &wrapListener{
 		Listener: ln,
 		proxy:    e.proxy,
 	}
+	if e.proxy.isReverse() && e.proxy.Opts.ReverseTls {
+		pln = tls.NewListener(pln, e.reverseTlsConfig())
+	}
 	return e.server.Serve(pln)
 }
 
@@ -181,6 +221,22 @@ func (e *entry) ServeHTTP(res http.ResponseWriter, req *http.Request) {
 		"in":   "Proxy.entry.ServeHTTP",
 		"host": req.Host,
 	})
+
+	// reverse proxy mode, clients send origin-form requests without proxy authentication,
+	// the requests of a forward proxy client are refused so the proxy is not open to any host
+	if proxy.isReverse() {
+		if req.Method == "CONNECT" {
+			http.Error(res, "reverse proxy: CONNECT is not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		if req.URL.IsAbs() && req.URL.Host != "" {
+			http.Error(res, "reverse proxy: only origin-form requests are allowed", http.StatusBadRequest)
+			return
+		}
+		e.serveReverse(res, req)
+		return
+	}
+
 	// Add entry proxy authentication
 	if e.proxy.authProxy != nil {
 		b, err := e.proxy.authProxy(res, req)
@@ -202,7 +258,7 @@ func (e *entry) ServeHTTP(res http.ResponseWriter, req *http.Request) {
 
 	if !req.URL.IsAbs() || req.URL.Host == "" {
 		res = helper.NewResponseCheck(res)
-		for _, addon := range proxy.Addons {
+		for _, addon := range proxy.addons() {
 			addon.AccessProxyServer(req, res)
 		}
 		if res, ok := res.(*helper.ResponseCheck); ok {
@@ -214,6 +270,14 @@ func (e *entry) ServeHTTP(res http.ResponseWriter, req *http.Request) {
 		return
 	}
 
+	// ws via http proxy
+	if isWebSocketUpgrade(req) {
+		defaultWebSocket.relay(res, req, &tls.Config{
+			InsecureSkipVerify: proxy.Opts.SslInsecure,
+		}, proxy.addons())
+		return
+	}
+
 	// http proxy
 	proxy.attacker.initHttpDialFn(req)
 	proxy.attacker.attack(res, req)
@@ -235,7 +299,7 @@ func (e *entry) handleConnect(res http.ResponseWriter, req *http.Request) {
 	defer f.Finish()
 
 	// trigger addon event Requestheaders
-	for _, addon := range proxy.Addons {
+	for _, addon := range proxy.addons() {
 		addon.Requestheaders(f)
 	}
 
@@ -277,7 +341,7 @@ func (e *entry) establishConnection(res http.ResponseWriter, f *Flow) (net.Conn,
 	}
 
 	// trigger addon event Responseheaders
-	for _, addon := range e.proxy.Addons {
+	for _, addon := range e.proxy.addons() {
 		addon.Responseheaders(f)
 	}
 
@@ -298,6 +362,11 @@ func (e *entry) directTransfer(res http.ResponseWriter, req *http.Request, f *Fl
 		return
 	}
 	defer conn.Close()
+	tcpFlow := newTcpFlow(f.ConnContext, req.Host)
+	if upstream := connUpstream(conn); upstream != nil {
+		f.Metadata["upstream"] = upstream.Redacted()
+		tcpFlow.Metadata["upstream"] = upstream.Redacted()
+	}
 
 	cconn, err := e.establishConnection(res, f)
 	if err != nil {
@@ -306,7 +375,7 @@ func (e *entry) directTransfer(res http.ResponseWriter, req *http.Request, f *Fl
 	}
 	defer cconn.Close()
 
-	transfer(log, conn, cconn)
+	proxy.tcpRelay(tcpFlow, conn, cconn)
 }
 
 func (e *entry) httpsDialFirstAttack(res http.ResponseWriter, req *http.Request, f *Flow) {
@@ -339,18 +408,20 @@ func (e *entry) httpsDialFirstAttack(res http.ResponseWriter, req *http.Request,
 		return
 	}
 
-	peek, err := wc.Peek(3)
+	peek, err := peekTunnel(wc)
 	if err != nil {
 		cconn.Close()
 		conn.Close()
 		log.Error(err)
 		return
 	}
+	if helper.IsHttp(peek) {
+		// http, ws
+		proxy.attacker.httpTunnelAttack(cconn, conn, req)
+		return
+	}
 	if !helper.IsTls(peek) {
-		// todo: http, ws
-		transfer(log, conn, cconn)
-		cconn.Close()
-		conn.Close()
+		proxy.tcpRelay(newTcpFlow(f.ConnContext, req.Host), conn, cconn)
 		return
 	}
 
@@ -359,6 +430,25 @@ func (e *entry) httpsDialFirstAttack(res http.ResponseWriter, req *http.Request,
 	proxy.attacker.httpsTlsDial(req.Context(), cconn, conn)
 }
 
+// the client of a server-speaks-first protocol such as smtp sends nothing until the server greets it
+var serverFirstTimeout = time.Second
+
+// peekTunnel peeks the first bytes the client sends in a CONNECT tunnel,
+// nil if it sends none within serverFirstTimeout and the tunnel is relayed as is
+func peekTunnel(wc *wrapClientConn) ([]byte, error) {
+	if err := wc.SetReadDeadline(time.Now().Add(serverFirstTimeout)); err != nil {
+		return nil, err
+	}
+	peek, err := wc.Peek(3)
+	if err := wc.SetReadDeadline(time.Time{}); err != nil {
+		return nil, err
+	}
+	if errors.Is(err, os.ErrDeadlineExceeded) {
+		return nil, nil
+	}
+	return peek, err
+}
+
 func (e *entry) httpsDialLazyAttack(res http.ResponseWriter, req *http.Request, f *Flow) {
 	proxy := e.proxy
 	log := log.WithFields(log.Fields{
@@ -386,24 +476,26 @@ func (e *entry) httpsDialLazyAttack(res http.ResponseWriter, req *http.Request,
 		return
 	}
 
-	peek, err := wc.Peek(3)
+	peek, err := peekTunnel(wc)
 	if err != nil {
 		cconn.Close()
 		log.Error(err)
 		return
 	}
 
+	if helper.IsHttp(peek) {
+		// http, ws
+		proxy.attacker.httpTunnelAttack(cconn, nil, req)
+		return
+	}
 	if !helper.IsTls(peek) {
-		// todo: http, ws
 		conn, err := proxy.attacker.httpsDial(req.Context(), req)
 		if err != nil {
 			cconn.Close()
 			log.Error(err)
 			return
 		}
-		transfer(log, conn, cconn)
-		conn.Close()
-		cconn.Close()
+		proxy.tcpRelay(newTcpFlow(f.ConnContext, req.Host), conn, cconn)
 		return
 	}
 
@@ -501,6 +501,9 @@ func TestEntry_HttpsDialFirstAttack_NotTLS(t *testing.T) {
 	opts := &Options{Addr: ":0"}
 	p, _ := NewProxy(opts)
 	e := newEntry(p)
+	// plain http in the tunnel is served by the attacker
+	go p.attacker.start()
+	defer p.attacker.server.Close()
 	f := NewFlow()
 
 	ln, _ := net.Listen("tcp", "127.0.0.1:0")
@@ -580,6 +583,9 @@ func TestEntry_HttpsDialLazyAttack_NotTLS_Success(t *testing.T) {
 	opts := &Options{Addr: ":0"}
 	p, _ := NewProxy(opts)
 	e := newEntry(p)
+	// plain http in the tunnel is served by the attacker
+	go p.attacker.start()
+	defer p.attacker.server.Close()
 	f := NewFlow()
 
 	ln, _ := net.Listen("tcp", "127.0.0.1:0")
@@ -650,6 +656,9 @@ func TestEntry_HttpsDialLazyAttack_NotTLS_Fail(t *testing.T) {
 	opts := &Options{Addr: ":0"}
 	p, _ := NewProxy(opts)
 	e := newEntry(p)
+	// plain http in the tunnel is served by the attacker
+	go p.attacker.start()
+	defer p.attacker.server.Close()
 	f := NewFlow()
 
 	req := httptest.NewRequest("CONNECT", "http://example.com:443", nil)
@@ -0,0 +1,161 @@
+package proxy
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// Kinds of ResponseFault
+const (
+	FaultTruncate         = "truncate"          // the connection is closed after After bytes of the body, short of its Content-Length
+	FaultReset            = "reset"             // the connection is reset after After bytes of the body
+	FaultMalformedChunked = "malformed_chunked" // an invalid chunk follows After bytes of a chunked body
+	FaultTrickle          = "trickle"           // the body after After bytes is sent Chunk bytes every Interval
+)
+
+// ResponseFault breaks the reply of a response to the client, set by an addon on Response.Fault.
+// A http/2 stream cannot break the http/1 framing, it is reset on truncate, reset and malformed_chunked.
+type ResponseFault struct {
+	Kind     string
+	After    int           // bytes of the body sent before the fault
+	Chunk    int           // trickle: bytes sent at once, 1 if not set
+	Interval time.Duration // trickle: pause between chunks
+}
+
+func (fault *ResponseFault) String() string {
+	if fault.Kind == FaultTrickle {
+		return fmt.Sprintf("%v after %d bytes, %d bytes every %v", fault.Kind, fault.After, max(fault.Chunk, 1), fault.Interval)
+	}
+	return fmt.Sprintf("%v after %d bytes", fault.Kind, fault.After)
+}
+
+// replyFlow replies the response of f to the client, breaking it by its fault if any
+func (a *attacker) replyFlow(res http.ResponseWriter, log *log.Entry, f *Flow, body io.Reader) {
+	fault := f.Response.Fault
+	if fault == nil {
+		a.reply(res, log, f.Response, body)
+		return
+	}
+
+	http1 := f.Request.raw == nil || f.Request.raw.ProtoMajor < 2
+	if fault.Kind == FaultMalformedChunked && http1 {
+		if hijacker, ok := res.(http.Hijacker); ok {
+			a.replyMalformedChunked(hijacker, log, f.Response, body)
+			return
+		}
+	}
+
+	response := f.Response
+	content := responseContent(response, body)
+	replyHeader(res, response)
+	if body == nil && response.BodyReader == nil && fault.Kind != FaultTrickle {
+		// the client learns the body is short of its length
+		res.Header().Set("Content-Length", strconv.Itoa(len(response.Body)))
+	}
+	res.WriteHeader(response.StatusCode)
+	flusher, _ := res.(http.Flusher)
+	if _, err := io.CopyN(res, content, int64(fault.After)); err != nil && err != io.EOF {
+		logErr(log, err)
+	}
+	if flusher != nil {
+		flusher.Flush()
+	}
+
+	switch fault.Kind {
+	case FaultTrickle:
+		a.trickle(res, flusher, log, f, content)
+		replyTrailer(res, response)
+		return
+	case FaultReset:
+		if http1 {
+			f.ConnContext.closeClientConn(true)
+		}
+	}
+	// net/http closes the connection or resets the http/2 stream
+	panic(http.ErrAbortHandler)
+}
+
+// trickle sends the rest of content by the trickle fault of f
+func (a *attacker) trickle(res http.ResponseWriter, flusher http.Flusher, log *log.Entry, f *Flow, content io.Reader) {
+	fault := f.Response.Fault
+	buf := make([]byte, max(fault.Chunk, 1))
+	for {
+		n, err := io.ReadFull(content, buf)
+		if n > 0 {
+			if _, err := res.Write(buf[:n]); err != nil {
+				logErr(log, err)
+				return
+			}
+			if flusher != nil {
+				flusher.Flush()
+			}
+		}
+		if err != nil {
+			if err != io.EOF && err != io.ErrUnexpectedEOF {
+				logErr(log, err)
+			}
+			return
+		}
+		select {
+		case <-time.After(fault.Interval):
+		case <-f.Killed():
+			return
+		}
+	}
+}
+
+// replyMalformedChunked writes the response on the hijacked http/1 connection, with an invalid chunk after fault.After bytes
+func (a *attacker) replyMalformedChunked(hijacker http.Hijacker, log *log.Entry, response *Response, body io.Reader) {
+	conn, rw, err := hijacker.Hijack()
+	if err != nil {
+		logErr(log, err)
+		return
+	}
+	defer conn.Close()
+
+	header := response.Header.Clone()
+	if header == nil {
+		header = make(http.Header)
+	}
+	header.Del("Content-Length")
+	header.Del("Trailer")
+	header.Set("Transfer-Encoding", "chunked")
+	header.Set("Connection", "close")
+	fmt.Fprintf(rw, "HTTP/1.1 %d %s\r\n", response.StatusCode, http.StatusText(response.StatusCode))
+	header.Write(rw)
+	rw.WriteString("\r\n")
+
+	head, err := io.ReadAll(io.LimitReader(responseContent(response, body), int64(response.Fault.After)))
+	if err != nil {
+		logErr(log, err)
+	}
+	if len(head) > 0 {
+		fmt.Fprintf(rw, "%x\r\n%s\r\n", len(head), head)
+	}
+	// not a hex chunk size
+	rw.WriteString("zz\r\nmalformed chunk\r\n")
+	if err := rw.Flush(); err != nil {
+		logErr(log, err)
+	}
+}
+
+// responseContent reads the body of response in the order reply writes it
+func responseContent(response *Response, body io.Reader) io.Reader {
+	var readers []io.Reader
+	if body != nil {
+		readers = append(readers, body)
+	}
+	if response.BodyReader != nil {
+		readers = append(readers, response.BodyReader)
+	}
+	if len(response.Body) > 0 {
+		readers = append(readers, bytes.NewReader(response.Body))
+	}
+	return io.MultiReader(readers...)
+}
@@ -0,0 +1,105 @@
+package proxy
+
+import (
+	"crypto/tls"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestResponseFault(t *testing.T) {
+	body := strings.Repeat("x", 1000)
+	helper := &testProxyHelper{
+		server: &http.Server{
+			Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				w.Write([]byte(body))
+			}),
+		},
+		proxyAddr: ":29098",
+	}
+	helper.init(t)
+	helper.server.TLSConfig.NextProtos = []string{"h2", "http/1.1"}
+	testProxy := helper.testProxy
+	faults := &faultSetter{}
+	testProxy.AddAddon(faults)
+	defer helper.ln.Close()
+	go helper.server.Serve(helper.ln)
+	defer helper.tlsPlainLn.Close()
+	go helper.server.ServeTLS(helper.tlsPlainLn, "", "")
+	go testProxy.Start()
+	defer testProxy.Close()
+	time.Sleep(time.Millisecond * 10) // wait for test proxy startup
+
+	get := func(client *http.Client, endpoint string) (string, error) {
+		resp, err := client.Get(endpoint + "/")
+		if err != nil {
+			return "", err
+		}
+		defer resp.Body.Close()
+		got, err := io.ReadAll(resp.Body)
+		return string(got), err
+	}
+
+	for _, tc := range []struct {
+		name    string
+		fault   *ResponseFault
+		wantErr string
+		want    string
+	}{
+		{"truncate", &ResponseFault{Kind: FaultTruncate, After: 100}, "unexpected EOF", body[:100]},
+		{"reset", &ResponseFault{Kind: FaultReset, After: 100}, "connection reset", body[:100]},
+		{"malformed chunked", &ResponseFault{Kind: FaultMalformedChunked, After: 100}, "invalid byte in chunk length", body[:100]},
+		{"malformed chunked tls", &ResponseFault{Kind: FaultMalformedChunked, After: 100}, "invalid byte in chunk length", body[:100]},
+		{"trickle", &ResponseFault{Kind: FaultTrickle, After: 900, Chunk: 20, Interval: 50 * time.Millisecond}, "", body},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			faults.fault = tc.fault
+			client := helper.getProxyClient()
+			defer client.CloseIdleConnections()
+			start := time.Now()
+			endpoint := helper.httpEndpoint
+			if strings.HasSuffix(tc.name, "tls") {
+				endpoint = helper.httpsEndpoint
+			}
+			got, err := get(client, endpoint)
+			if tc.wantErr == "" && err != nil || tc.wantErr != "" && (err == nil || !strings.Contains(err.Error(), tc.wantErr)) {
+				t.Errorf("want error %q, got %v", tc.wantErr, err)
+			}
+			if got != tc.want {
+				t.Errorf("want %v bytes of the body, got %v", len(tc.want), len(got))
+			}
+			if tc.fault.Kind == FaultTrickle && time.Since(start) < 200*time.Millisecond {
+				t.Errorf("want the body trickled, took %v", time.Since(start))
+			}
+		})
+	}
+
+	t.Run("h2 stream", func(t *testing.T) {
+		faults.fault = &ResponseFault{Kind: FaultMalformedChunked, After: 100}
+		h2Client := &http.Client{
+			Transport: &http.Transport{
+				ForceAttemptHTTP2: true,
+				TLSClientConfig:   &tls.Config{InsecureSkipVerify: true},
+				Proxy: func(r *http.Request) (*url.URL, error) {
+					return url.Parse("http://127.0.0.1" + helper.proxyAddr)
+				},
+			},
+		}
+		defer h2Client.CloseIdleConnections()
+		if _, err := get(h2Client, helper.httpsEndpoint); err == nil || !strings.Contains(err.Error(), "stream error") {
+			t.Errorf("want a reset stream, got %v", err)
+		}
+	})
+}
+
+type faultSetter struct {
+	BaseAddon
+	fault *ResponseFault
+}
+
+func (a *faultSetter) Response(f *Flow) {
+	f.Response.Fault = a.fault
+}
@@ -1,15 +1,32 @@
 package proxy
 
 import (
+	"context"
 	"encoding/json"
 	"errors"
 	"io"
 	"net/http"
 	"net/url"
+	"sync"
+	"time"
 
 	uuid "github.com/satori/go.uuid"
 )
 
+// takeTrailer adds the trailers of res which are not in r.Trailer yet, the server may send
+// trailers it did not declare, net/http sets them to res.Trailer once the body is read
+func (r *Response) takeTrailer(res *http.Response) {
+	for key, values := range res.Trailer {
+		if _, ok := r.Trailer[key]; ok {
+			continue
+		}
+		if r.Trailer == nil {
+			r.Trailer = make(http.Header)
+		}
+		r.Trailer[key] = values
+	}
+}
+
 // flow http request
 type Request struct {
 	Method string
@@ -18,16 +35,20 @@ type Request struct {
 	Header http.Header
 	Body   []byte
 
+	// Trailer holds the trailers of a chunked or h2 request body, values are set once the body has been read
+	Trailer http.Header
+
 	raw *http.Request
 }
 
 func NewRequest(req *http.Request) *Request {
 	return &Request{
-		Method: req.Method,
-		URL:    req.URL,
-		Proto:  req.Proto,
-		Header: req.Header,
-		raw:    req,
+		Method:  req.Method,
+		URL:     req.URL,
+		Proto:   req.Proto,
+		Header:  req.Header,
+		Trailer: req.Trailer,
+		raw:     req,
 	}
 }
 
@@ -41,20 +62,22 @@ func (r *Request) Raw() *http.Request {
 
 func (req *Request) MarshalJSON() ([]byte, error) {
 	type requestJSON struct {
-		Method string      `json:"method"`
-		URL    string      `json:"url"`
-		Proto  string      `json:"proto"`
-		Header http.Header `json:"header"`
+		Method  string      `json:"method"`
+		URL     string      `json:"url"`
+		Proto   string      `json:"proto"`
+		Header  http.Header `json:"header"`
+		Trailer http.Header `json:"trailer,omitempty"`
 	}
 	urlStr := ""
 	if req.URL != nil {
 		urlStr = req.URL.String()
 	}
 	return json.Marshal(&requestJSON{
-		Method: req.Method,
-		URL:    urlStr,
-		Proto:  req.Proto,
-		Header: req.Header,
+		Method:  req.Method,
+		URL:     urlStr,
+		Proto:   req.Proto,
+		Header:  req.Header,
+		Trailer: req.Trailer,
 	})
 }
 
@@ -120,6 +143,12 @@ type Response struct {
 	Body       []byte      `json:"-"`
 	BodyReader io.Reader
 
+	// Trailer holds the trailers of the response, e.g. grpc-status, values are set once the body has been read
+	Trailer http.Header `json:"trailer,omitempty"`
+
+	// Fault breaks the reply of the response to the client, nil for none
+	Fault *ResponseFault `json:"-"`
+
 	close bool // connection close
 }
 
@@ -132,22 +161,60 @@ type Flow struct {
 
 	// https://docs.mitmproxy.org/stable/overview-features/#streaming
 	// 如果为 true，则不缓冲 Request.Body 和 Response.Body，且不进入之后的 Addon.Request 和 Addon.Response
-	Stream            bool                   `json:"-"`
-	UseSeparateClient bool                   `json:"-"` // use separate http client to send http request
-	done              chan struct{}          `json:"-"`
+	Stream            bool              `json:"-"`
+	UseSeparateClient bool              `json:"-"` // use separate http client to send http request
+	WebSocket         *WebSocketSession `json:"-"` // set when the flow is a relayed websocket connection
+	Timing            FlowTiming        `json:"timing"`
+	ConnPoolHit       bool              `json:"-"` // the request was sent over a reused connection of the shared upstream pool
+	ReplayOf          uuid.UUID         `json:"-"` // id of the flow this flow replays, uuid.Nil if it is no replay
+	done              chan struct{}     `json:"-"`
+
+	killMu sync.Mutex
+	killed chan struct{}      // closed by Kill
+	cancel context.CancelFunc // cancels the upstream request
 
 	// Metadata to pass data between addons. Not persisted by default unless handled by storage addon.
 	Metadata map[string]interface{} `json:"-"`
+
+	failedMu     sync.Mutex
+	failedAddons []string // names of the addons whose hooks panicked on the flow
+
+	dialTimingMu sync.Mutex
+	dialTiming   *ConnTiming // timing of the pooled server connection dialed for the flow
 }
 
 func NewFlow() *Flow {
 	return &Flow{
 		Id:       uuid.NewV4(),
+		Timing:   FlowTiming{Start: time.Now()},
 		done:     make(chan struct{}),
 		Metadata: make(map[string]interface{}),
 	}
 }
 
+// ConnTiming returns the timing of the connections of the flow. The server phases are those of the pooled
+// server connection dialed for the flow if there is one, else those of the server connection of ConnContext.
+func (f *Flow) ConnTiming() ConnTiming {
+	var timing ConnTiming
+	if f.ConnContext != nil {
+		timing = f.ConnContext.Timing
+	}
+	f.dialTimingMu.Lock()
+	defer f.dialTimingMu.Unlock()
+	if d := f.dialTiming; d != nil {
+		timing.DnsStart, timing.DnsDone = d.DnsStart, d.DnsDone
+		timing.TcpConnectStart, timing.TcpConnectDone = d.TcpConnectStart, d.TcpConnectDone
+		timing.ServerTlsStart, timing.ServerTlsDone = d.ServerTlsStart, d.ServerTlsDone
+	}
+	return timing
+}
+
+func (f *Flow) setDialTiming(timing *ConnTiming) {
+	f.dialTimingMu.Lock()
+	f.dialTiming = timing
+	f.dialTimingMu.Unlock()
+}
+
 func (f *Flow) Done() <-chan struct{} {
 	return f.done
 }
@@ -156,8 +223,88 @@ func (f *Flow) Finish() {
 	close(f.done)
 }
 
+// Kill aborts the flow: the upstream request is canceled and the client connection is torn down,
+// closed or reset by Options.KillRst. A http/2 flow only resets its stream.
+func (f *Flow) Kill() {
+	f.killMu.Lock()
+	killed := f.killedChan()
+	if isClosed(killed) {
+		f.killMu.Unlock()
+		return
+	}
+	close(killed)
+	cancel := f.cancel
+	f.killMu.Unlock()
+
+	if cancel != nil {
+		cancel()
+	}
+	// the handler of the flow may be blocked, http/1 connections are torn down right away
+	if f.ConnContext != nil && f.Request != nil && f.Request.raw != nil && f.Request.raw.ProtoMajor < 2 {
+		f.ConnContext.abortClientConn()
+	}
+}
+
+// FailedAddons returns the names of the addons whose hooks panicked on the flow, the flow went on without them
+func (f *Flow) FailedAddons() []string {
+	f.failedMu.Lock()
+	defer f.failedMu.Unlock()
+	return append([]string(nil), f.failedAddons...)
+}
+
+func (f *Flow) addonFailed(name string) {
+	f.failedMu.Lock()
+	defer f.failedMu.Unlock()
+	for _, failed := range f.failedAddons {
+		if failed == name {
+			return
+		}
+	}
+	f.failedAddons = append(f.failedAddons, name)
+}
+
+// Killed is closed when the flow is killed
+func (f *Flow) Killed() <-chan struct{} {
+	f.killMu.Lock()
+	defer f.killMu.Unlock()
+	return f.killedChan()
+}
+
+func (f *Flow) IsKilled() bool {
+	f.killMu.Lock()
+	defer f.killMu.Unlock()
+	return f.killed != nil && isClosed(f.killed)
+}
+
+// killedChan requires killMu
+func (f *Flow) killedChan() chan struct{} {
+	if f.killed == nil {
+		f.killed = make(chan struct{})
+	}
+	return f.killed
+}
+
+// setCancel sets the cancel func of the upstream request, it is called at once if the flow is killed
+func (f *Flow) setCancel(cancel context.CancelFunc) {
+	f.killMu.Lock()
+	f.cancel = cancel
+	killed := f.killed != nil && isClosed(f.killed)
+	f.killMu.Unlock()
+	if killed {
+		cancel()
+	}
+}
+
+func isClosed(ch chan struct{}) bool {
+	select {
+	case <-ch:
+		return true
+	default:
+		return false
+	}
+}
+
 func (f *Flow) MarshalJSON() ([]byte, error) {
 	type Alias Flow
 	return json.Marshal((*Alias)(f))
 }
-
@@ -0,0 +1,328 @@
+package proxy
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"unicode"
+	"unicode/utf8"
+
+	"google.golang.org/protobuf/encoding/protojson"
+	"google.golang.org/protobuf/encoding/protowire"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/reflect/protodesc"
+	"google.golang.org/protobuf/reflect/protoreflect"
+	"google.golang.org/protobuf/reflect/protoregistry"
+	"google.golang.org/protobuf/types/descriptorpb"
+	"google.golang.org/protobuf/types/dynamicpb"
+)
+
+var errGrpcFrame = errors.New("invalid grpc message frame")
+
+// descriptors loaded from FileDescriptorSet files, used to decode the grpc messages of the flows of a proxy
+type grpcDescriptors struct {
+	mu    sync.RWMutex
+	files []*protoregistry.Files
+}
+
+// LoadGrpcDescriptorSets loads FileDescriptorSet files, e.g. generated by
+// protoc --include_imports --descriptor_set_out, to decode the grpc messages of the flows of the proxy.
+// Messages of methods which are not found in the loaded descriptors are decoded schemaless.
+func (proxy *Proxy) LoadGrpcDescriptorSets(paths ...string) error {
+	return proxy.grpc.load(paths...)
+}
+
+func (d *grpcDescriptors) load(paths ...string) error {
+	for _, path := range paths {
+		content, err := os.ReadFile(path)
+		if err != nil {
+			return err
+		}
+		set := new(descriptorpb.FileDescriptorSet)
+		if err := proto.Unmarshal(content, set); err != nil {
+			return fmt.Errorf("parse descriptor set %v: %w", path, err)
+		}
+		files, err := protodesc.NewFiles(set)
+		if err != nil {
+			return fmt.Errorf("load descriptor set %v: %w", path, err)
+		}
+		d.mu.Lock()
+		d.files = append(d.files, files)
+		d.mu.Unlock()
+	}
+	return nil
+}
+
+// find the method of path /package.Service/Method in the loaded descriptors, nil if d is nil
+func (d *grpcDescriptors) findMethod(path string) protoreflect.MethodDescriptor {
+	if d == nil {
+		return nil
+	}
+	service, method, ok := strings.Cut(strings.TrimPrefix(path, "/"), "/")
+	if !ok {
+		return nil
+	}
+
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+	for _, files := range d.files {
+		desc, err := files.FindDescriptorByName(protoreflect.FullName(service))
+		if err != nil {
+			continue
+		}
+		if sd, ok := desc.(protoreflect.ServiceDescriptor); ok {
+			if md := sd.Methods().ByName(protoreflect.Name(method)); md != nil {
+				return md
+			}
+		}
+	}
+	return nil
+}
+
+func isGrpcContentType(header http.Header) bool {
+	contentType := header.Get("Content-Type")
+	// grpc-web-text is base64 encoded
+	return strings.HasPrefix(contentType, "application/grpc") && !strings.HasPrefix(contentType, "application/grpc-web-text")
+}
+
+// IsGrpc reports whether the request is a grpc or grpc-web call
+func (req *Request) IsGrpc() bool {
+	return req.Header != nil && isGrpcContentType(req.Header)
+}
+
+// GrpcMethod returns the called method as /package.Service/Method, or "" if the request is not grpc
+func (req *Request) GrpcMethod() string {
+	if !req.IsGrpc() || req.URL == nil {
+		return ""
+	}
+	return req.URL.Path
+}
+
+// DecodedGrpc decodes the request messages to a json array schemaless,
+// Flow.DecodedGrpcRequest decodes them with the descriptors loaded by the proxy
+func (req *Request) DecodedGrpc() ([]byte, error) {
+	return req.decodeGrpc(nil)
+}
+
+func (req *Request) decodeGrpc(descs *grpcDescriptors) ([]byte, error) {
+	if !req.IsGrpc() {
+		return nil, errors.New("not a grpc request")
+	}
+	return decodeGrpcBody(descs, req.Header, req.Body, req.GrpcMethod(), true)
+}
+
+// IsGrpc reports whether the response is a grpc or grpc-web response
+func (r *Response) IsGrpc() bool {
+	return r.Header != nil && isGrpcContentType(r.Header)
+}
+
+// DecodedGrpc decodes the response messages to a json array schemaless, method is Request.GrpcMethod().
+// Flow.DecodedGrpcResponse decodes them with the descriptors loaded by the proxy
+func (r *Response) DecodedGrpc(method string) ([]byte, error) {
+	return r.decodeGrpc(nil, method)
+}
+
+func (r *Response) decodeGrpc(descs *grpcDescriptors, method string) ([]byte, error) {
+	if !r.IsGrpc() {
+		return nil, errors.New("not a grpc response")
+	}
+	return decodeGrpcBody(descs, r.Header, r.Body, method, false)
+}
+
+// DecodedGrpcRequest decodes the request messages to a json array,
+// with the descriptors loaded by Proxy.LoadGrpcDescriptorSets
+func (f *Flow) DecodedGrpcRequest() ([]byte, error) {
+	if f.Request == nil {
+		return nil, errors.New("no request")
+	}
+	return f.Request.decodeGrpc(f.grpcDescriptors())
+}
+
+// DecodedGrpcResponse decodes the response messages to a json array,
+// with the descriptors loaded by Proxy.LoadGrpcDescriptorSets
+func (f *Flow) DecodedGrpcResponse() ([]byte, error) {
+	if f.Response == nil {
+		return nil, errors.New("no response")
+	}
+	method := ""
+	if f.Request != nil {
+		method = f.Request.GrpcMethod()
+	}
+	return f.Response.decodeGrpc(f.grpcDescriptors(), method)
+}
+
+// descriptors of the proxy of the flow, nil for a flow not captured by a proxy
+func (f *Flow) grpcDescriptors() *grpcDescriptors {
+	if f.ConnContext == nil || f.ConnContext.proxy == nil {
+		return nil
+	}
+	return f.ConnContext.proxy.grpc
+}
+
+// a length-prefixed message of a grpc body
+type grpcMessage struct {
+	compressed bool
+	data       []byte
+}
+
+// 1 byte compressed flag + 4 bytes big endian length + message
+func splitGrpcMessages(body []byte) ([]*grpcMessage, error) {
+	msgs := make([]*grpcMessage, 0)
+	for len(body) > 0 {
+		if len(body) < 5 {
+			return nil, errGrpcFrame
+		}
+		// grpc-web trailers frame
+		if body[0]&0x80 != 0 {
+			break
+		}
+		n := binary.BigEndian.Uint32(body[1:5])
+		if uint64(len(body)-5) < uint64(n) {
+			return nil, errGrpcFrame
+		}
+		msgs = append(msgs, &grpcMessage{compressed: body[0]&1 == 1, data: body[5 : 5+n]})
+		body = body[5+n:]
+	}
+	return msgs, nil
+}
+
+func decodeGrpcBody(descs *grpcDescriptors, header http.Header, body []byte, method string, input bool) ([]byte, error) {
+	msgs, err := splitGrpcMessages(body)
+	if err != nil {
+		return nil, err
+	}
+
+	var desc protoreflect.MessageDescriptor
+	if md := descs.findMethod(method); md != nil {
+		if input {
+			desc = md.Input()
+		} else {
+			desc = md.Output()
+		}
+	}
+
+	decoded := make([]json.RawMessage, 0, len(msgs))
+	for _, msg := range msgs {
+		data := msg.data
+		if msg.compressed {
+			enc := header.Get("Grpc-Encoding")
+			if enc == "" || enc == "identity" {
+				return nil, errors.New("compressed grpc message without grpc-encoding")
+			}
+			data, err = decode(enc, data)
+			if err != nil {
+				return nil, err
+			}
+		}
+
+		content, err := decodeGrpcMessage(desc, data)
+		if err != nil {
+			return nil, err
+		}
+		decoded = append(decoded, content)
+	}
+	return json.Marshal(decoded)
+}
+
+// decode with the descriptor if known, otherwise schemaless
+func decodeGrpcMessage(desc protoreflect.MessageDescriptor, data []byte) ([]byte, error) {
+	if desc != nil {
+		msg := dynamicpb.NewMessage(desc)
+		if err := proto.Unmarshal(data, msg); err == nil {
+			if content, err := protojson.Marshal(msg); err == nil {
+				return content, nil
+			}
+		}
+	}
+
+	fields, ok := decodeWireMessage(data)
+	if !ok {
+		return nil, errors.New("invalid protobuf message")
+	}
+	return json.Marshal(fields)
+}
+
+// decodeWireMessage decodes protobuf wire format without schema, keys are field numbers.
+// Length-delimited fields are decoded as printable strings, nested messages or bytes in that order.
+func decodeWireMessage(b []byte) (map[string]interface{}, bool) {
+	fields := make(map[string]interface{})
+	for len(b) > 0 {
+		num, typ, n := protowire.ConsumeTag(b)
+		if n < 0 {
+			return nil, false
+		}
+		b = b[n:]
+
+		var value interface{}
+		switch typ {
+		case protowire.VarintType:
+			v, n := protowire.ConsumeVarint(b)
+			if n < 0 {
+				return nil, false
+			}
+			value, b = v, b[n:]
+		case protowire.Fixed32Type:
+			v, n := protowire.ConsumeFixed32(b)
+			if n < 0 {
+				return nil, false
+			}
+			value, b = v, b[n:]
+		case protowire.Fixed64Type:
+			v, n := protowire.ConsumeFixed64(b)
+			if n < 0 {
+				return nil, false
+			}
+			value, b = v, b[n:]
+		case protowire.BytesType:
+			v, n := protowire.ConsumeBytes(b)
+			if n < 0 {
+				return nil, false
+			}
+			value, b = decodeWireBytes(v), b[n:]
+		case protowire.StartGroupType:
+			v, n := protowire.ConsumeGroup(num, b)
+			if n < 0 {
+				return nil, false
+			}
+			value, b = v, b[n:]
+		default:
+			return nil, false
+		}
+
+		key := strconv.Itoa(int(num))
+		switch prev := fields[key].(type) {
+		case nil:
+			fields[key] = value
+		case []interface{}:
+			fields[key] = append(prev, value)
+		default:
+			fields[key] = []interface{}{prev, value}
+		}
+	}
+	return fields, true
+}
+
+func decodeWireBytes(b []byte) interface{} {
+	if utf8.Valid(b) && isPrintable(string(b)) {
+		return string(b)
+	}
+	if fields, ok := decodeWireMessage(b); ok {
+		return fields
+	}
+	return b
+}
+
+func isPrintable(s string) bool {
+	for _, c := range s {
+		if !unicode.IsPrint(c) && !unicode.IsSpace(c) {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,186 @@
+package proxy
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/binary"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"google.golang.org/protobuf/encoding/protowire"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/types/descriptorpb"
+)
+
+// message test.Hello { string name = 1; int32 count = 2; } service test.Greeter { rpc SayHello(Hello) returns (Hello); }
+func writeTestDescriptorSet(t *testing.T) string {
+	set := &descriptorpb.FileDescriptorSet{
+		File: []*descriptorpb.FileDescriptorProto{{
+			Name:    proto.String("test.proto"),
+			Package: proto.String("test"),
+			Syntax:  proto.String("proto3"),
+			MessageType: []*descriptorpb.DescriptorProto{{
+				Name: proto.String("Hello"),
+				Field: []*descriptorpb.FieldDescriptorProto{
+					{Name: proto.String("name"), JsonName: proto.String("name"), Number: proto.Int32(1), Type: descriptorpb.FieldDescriptorProto_TYPE_STRING.Enum(), Label: descriptorpb.FieldDescriptorProto_LABEL_OPTIONAL.Enum()},
+					{Name: proto.String("count"), JsonName: proto.String("count"), Number: proto.Int32(2), Type: descriptorpb.FieldDescriptorProto_TYPE_INT32.Enum(), Label: descriptorpb.FieldDescriptorProto_LABEL_OPTIONAL.Enum()},
+				},
+			}},
+			Service: []*descriptorpb.ServiceDescriptorProto{{
+				Name: proto.String("Greeter"),
+				Method: []*descriptorpb.MethodDescriptorProto{{
+					Name:       proto.String("SayHello"),
+					InputType:  proto.String(".test.Hello"),
+					OutputType: proto.String(".test.Hello"),
+				}},
+			}},
+		}},
+	}
+	content, err := proto.Marshal(set)
+	if err != nil {
+		t.Fatal(err)
+	}
+	path := filepath.Join(t.TempDir(), "test.pb")
+	if err := os.WriteFile(path, content, 0644); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func testHelloMessage(name string, count uint64) []byte {
+	var b []byte
+	b = protowire.AppendTag(b, 1, protowire.BytesType)
+	b = protowire.AppendString(b, name)
+	b = protowire.AppendTag(b, 2, protowire.VarintType)
+	b = protowire.AppendVarint(b, count)
+	return b
+}
+
+func grpcFrame(compressed bool, msg []byte) []byte {
+	frame := make([]byte, 5, 5+len(msg))
+	if compressed {
+		frame[0] = 1
+	}
+	binary.BigEndian.PutUint32(frame[1:], uint32(len(msg)))
+	return append(frame, msg...)
+}
+
+func TestGrpc_Decode(t *testing.T) {
+	proxy := &Proxy{grpc: new(grpcDescriptors)}
+	if err := proxy.LoadGrpcDescriptorSets(writeTestDescriptorSet(t)); err != nil {
+		t.Fatal(err)
+	}
+
+	var gz bytes.Buffer
+	w := gzip.NewWriter(&gz)
+	w.Write(testHelloMessage("bob", 2))
+	w.Close()
+
+	body := append(grpcFrame(false, testHelloMessage("alice", 1)), grpcFrame(true, gz.Bytes())...)
+	req := &Request{
+		Method: "POST",
+		URL:    &url.URL{Scheme: "https", Host: "api.example.com", Path: "/test.Greeter/SayHello"},
+		Header: http.Header{"Content-Type": {"application/grpc+proto"}, "Grpc-Encoding": {"gzip"}},
+		Body:   body,
+	}
+	if req.GrpcMethod() != "/test.Greeter/SayHello" {
+		t.Errorf("unexpected method %q", req.GrpcMethod())
+	}
+	f := NewFlow()
+	f.ConnContext = &ConnContext{proxy: proxy}
+	f.Request = req
+	got, err := f.DecodedGrpcRequest()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(got) != `[{"name":"alice","count":1},{"name":"bob","count":2}]` {
+		t.Errorf("unexpected decoded request %s", got)
+	}
+
+	// the descriptors are loaded for the flows of the proxy only
+	other := NewFlow()
+	other.ConnContext = &ConnContext{proxy: &Proxy{grpc: new(grpcDescriptors)}}
+	other.Request = req
+	for _, decode := range []func() ([]byte, error){other.DecodedGrpcRequest, req.DecodedGrpc} {
+		got, err = decode()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(got) != `[{"1":"alice","2":1},{"1":"bob","2":2}]` {
+			t.Errorf("unexpected schemaless request %s", got)
+		}
+	}
+
+	// unknown method, schemaless
+	f.Request = &Request{URL: &url.URL{Path: "/other.Service/Call"}, Header: req.Header}
+	f.Response = &Response{
+		Header: http.Header{"Content-Type": {"application/grpc"}},
+		Body:   grpcFrame(false, testHelloMessage("carol", 3)),
+	}
+	got, err = f.DecodedGrpcResponse()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(got) != `[{"1":"carol","2":3}]` {
+		t.Errorf("unexpected schemaless response %s", got)
+	}
+}
+
+func TestGrpc_Errors(t *testing.T) {
+	req := &Request{URL: &url.URL{Path: "/a.B/C"}, Header: http.Header{"Content-Type": {"application/json"}}}
+	if req.GrpcMethod() != "" {
+		t.Error("not a grpc request")
+	}
+	if _, err := req.DecodedGrpc(); err == nil {
+		t.Error("expected error for non grpc request")
+	}
+
+	req.Header.Set("Content-Type", "application/grpc")
+	for _, body := range [][]byte{
+		{0, 0, 0},                  // short frame
+		{0, 0, 0, 0, 9, 1},         // truncated message
+		grpcFrame(true, []byte{1}), // compressed without grpc-encoding
+	} {
+		req.Body = body
+		if _, err := req.DecodedGrpc(); err == nil {
+			t.Errorf("expected error for body %v", body)
+		}
+	}
+
+	proxy := &Proxy{grpc: new(grpcDescriptors)}
+	if err := proxy.LoadGrpcDescriptorSets(filepath.Join(t.TempDir(), "missing.pb")); err == nil {
+		t.Error("expected error for missing descriptor set")
+	}
+}
+
+func TestDecodeWireMessage(t *testing.T) {
+	var nested []byte
+	nested = protowire.AppendTag(nested, 1, protowire.VarintType)
+	nested = protowire.AppendVarint(nested, 150)
+
+	var b []byte
+	b = protowire.AppendTag(b, 1, protowire.BytesType)
+	b = protowire.AppendBytes(b, nested)
+	b = protowire.AppendTag(b, 2, protowire.Fixed32Type)
+	b = protowire.AppendFixed32(b, 7)
+	b = protowire.AppendTag(b, 2, protowire.Fixed32Type)
+	b = protowire.AppendFixed32(b, 8)
+
+	fields, ok := decodeWireMessage(b)
+	if !ok {
+		t.Fatal("expected valid message")
+	}
+	if m, ok := fields["1"].(map[string]interface{}); !ok || m["1"] != uint64(150) {
+		t.Errorf("unexpected nested message %v", fields["1"])
+	}
+	if list, ok := fields["2"].([]interface{}); !ok || len(list) != 2 {
+		t.Errorf("expected repeated field, got %v", fields["2"])
+	}
+
+	if _, ok := decodeWireMessage([]byte{0xff}); ok {
+		t.Error("expected invalid message")
+	}
+}
@@ -0,0 +1,142 @@
+package proxy
+
+import (
+	"io"
+	"net/http"
+	"runtime/debug"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// guardedAddon runs the hooks of a registered addon, a panicking hook is recovered and counted against the addon
+// instead of tearing down the flow or the connection
+type guardedAddon struct {
+	addon    Addon
+	entry    *registeredAddon
+	registry *AddonRegistry
+}
+
+// recover is deferred by each hook, f is the flow of the hook, nil for none
+func (g *guardedAddon) recover(hook string, f *Flow) {
+	v := recover()
+	if v == nil {
+		return
+	}
+	if v == http.ErrAbortHandler {
+		// a killed flow, net/http tears down the connection or the http/2 stream
+		panic(v)
+	}
+	log.Errorf("addon %v panicked in %v: %v", g.entry.Name, hook, v)
+	log.Debugf("addon %v panic stack: %s", g.entry.Name, debug.Stack())
+	if f != nil {
+		f.addonFailed(g.entry.Name)
+	}
+	g.registry.failed(g.entry, v)
+}
+
+func (g *guardedAddon) ClientConnected(client *ClientConn) {
+	defer g.recover("ClientConnected", nil)
+	g.addon.ClientConnected(client)
+}
+
+func (g *guardedAddon) ClientDisconnected(client *ClientConn) {
+	defer g.recover("ClientDisconnected", nil)
+	g.addon.ClientDisconnected(client)
+}
+
+func (g *guardedAddon) ServerConnected(connCtx *ConnContext) {
+	defer g.recover("ServerConnected", nil)
+	g.addon.ServerConnected(connCtx)
+}
+
+func (g *guardedAddon) ServerDisconnected(connCtx *ConnContext) {
+	defer g.recover("ServerDisconnected", nil)
+	g.addon.ServerDisconnected(connCtx)
+}
+
+func (g *guardedAddon) TlsEstablishedServer(connCtx *ConnContext) {
+	defer g.recover("TlsEstablishedServer", nil)
+	g.addon.TlsEstablishedServer(connCtx)
+}
+
+func (g *guardedAddon) Requestheaders(f *Flow) {
+	defer g.recover("Requestheaders", f)
+	g.addon.Requestheaders(f)
+}
+
+func (g *guardedAddon) Request(f *Flow) {
+	defer g.recover("Request", f)
+	g.addon.Request(f)
+}
+
+func (g *guardedAddon) Responseheaders(f *Flow) {
+	defer g.recover("Responseheaders", f)
+	g.addon.Responseheaders(f)
+}
+
+func (g *guardedAddon) Response(f *Flow) {
+	defer g.recover("Response", f)
+	g.addon.Response(f)
+}
+
+// StreamRequestModifier returns in unmodified if the addon panics
+func (g *guardedAddon) StreamRequestModifier(f *Flow, in io.Reader) (out io.Reader) {
+	out = in
+	defer g.recover("StreamRequestModifier", f)
+	return g.addon.StreamRequestModifier(f, in)
+}
+
+// StreamResponseModifier returns in unmodified if the addon panics
+func (g *guardedAddon) StreamResponseModifier(f *Flow, in io.Reader) (out io.Reader) {
+	out = in
+	defer g.recover("StreamResponseModifier", f)
+	return g.addon.StreamResponseModifier(f, in)
+}
+
+func (g *guardedAddon) AccessProxyServer(req *http.Request, res http.ResponseWriter) {
+	defer g.recover("AccessProxyServer", nil)
+	g.addon.AccessProxyServer(req, res)
+}
+
+func (g *guardedAddon) WebsocketHandshake(f *Flow) {
+	defer g.recover("WebsocketHandshake", f)
+	g.addon.WebsocketHandshake(f)
+}
+
+func (g *guardedAddon) WebsocketMessage(f *Flow, msg *WebSocketMessage) {
+	defer g.recover("WebsocketMessage", f)
+	g.addon.WebsocketMessage(f, msg)
+}
+
+func (g *guardedAddon) ServerSentEvent(f *Flow, ev *ServerSentEvent) {
+	defer g.recover("ServerSentEvent", f)
+	g.addon.ServerSentEvent(f, ev)
+}
+
+func (g *guardedAddon) TcpStart(f *TcpFlow) {
+	defer g.recover("TcpStart", nil)
+	g.addon.TcpStart(f)
+}
+
+func (g *guardedAddon) TcpMessage(f *TcpFlow, msg *TcpMessage) {
+	defer g.recover("TcpMessage", nil)
+	g.addon.TcpMessage(f, msg)
+}
+
+func (g *guardedAddon) TcpEnd(f *TcpFlow) {
+	defer g.recover("TcpEnd", nil)
+	g.addon.TcpEnd(f)
+}
+
+func (g *guardedAddon) FlowKilled(f *Flow) {
+	defer g.recover("FlowKilled", f)
+	g.addon.FlowKilled(f)
+}
+
+// Flush flushes the addon if it implements AddonFlusher
+func (g *guardedAddon) Flush() {
+	if flusher, ok := g.addon.(AddonFlusher); ok {
+		defer g.recover("Flush", nil)
+		flusher.Flush()
+	}
+}
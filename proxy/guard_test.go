@@ -0,0 +1,135 @@
+package proxy
+
+import (
+	"bytes"
+	"io"
+	"net/http"
+	"testing"
+	"time"
+)
+
+type panicAddon struct {
+	BaseAddon
+}
+
+func (a *panicAddon) Requestheaders(f *Flow) {
+	panic("requestheaders")
+}
+
+func (a *panicAddon) StreamResponseModifier(f *Flow, in io.Reader) io.Reader {
+	panic("stream")
+}
+
+func (a *panicAddon) ClientDisconnected(*ClientConn) {
+	panic("disconnected")
+}
+
+func TestGuardedAddon(t *testing.T) {
+	helper := &testProxyHelper{
+		server: &http.Server{
+			Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				w.Write([]byte("ok"))
+			}),
+		},
+		proxyAddr: ":29099",
+	}
+	helper.init(t)
+	testProxy := helper.testProxy
+	if err := testProxy.Registry.Register("panicky", 0, &panicAddon{}); err != nil {
+		t.Fatal(err)
+	}
+	flows := make(chan *Flow, 4)
+	testProxy.AddAddon(&flowCollector{flows: flows})
+	defer helper.ln.Close()
+	go helper.server.Serve(helper.ln)
+	go testProxy.Start()
+	defer testProxy.Close()
+	time.Sleep(time.Millisecond * 10) // wait for test proxy startup
+
+	get := func(t *testing.T) {
+		t.Helper()
+		client := helper.getProxyClient()
+		defer client.CloseIdleConnections()
+		resp, err := client.Get(helper.httpEndpoint + "/")
+		if err != nil {
+			t.Fatal(err)
+		}
+		body, _ := io.ReadAll(resp.Body)
+		resp.Body.Close()
+		if string(body) != "ok" {
+			t.Errorf("want the flow to go on, got %q", body)
+		}
+	}
+
+	get(t)
+	f := <-flows
+	if failed := f.FailedAddons(); len(failed) != 1 || failed[0] != "panicky" {
+		t.Errorf("want the failed addon recorded, got %v", failed)
+	}
+	info := testProxy.Registry.List()[0]
+	if info.Name != "panicky" || info.Failures < 2 || !info.Enabled || info.LastErr == "" {
+		t.Errorf("want the failures counted, got %+v", info)
+	}
+
+	testProxy.Registry.SetMaxFailures(3)
+	get(t)
+	<-flows
+	if info := testProxy.Registry.List()[0]; info.Enabled {
+		t.Errorf("want the addon disabled by the circuit breaker, got %+v", info)
+	}
+	get(t)
+	if failed := (<-flows).FailedAddons(); len(failed) != 0 {
+		t.Errorf("want the disabled addon skipped, got %v", failed)
+	}
+
+	// without the circuit breaker a failing addon stays enabled
+	testProxy.Registry.SetMaxFailures(0)
+	if err := testProxy.Registry.SetEnabled("panicky", true); err != nil {
+		t.Fatal(err)
+	}
+	get(t)
+	<-flows
+	if info := testProxy.Registry.List()[0]; !info.Enabled {
+		t.Errorf("want the addon enabled again, got %+v", info)
+	}
+}
+
+func TestGuardedAddon_Hooks(t *testing.T) {
+	r := newAddonRegistry()
+	if err := r.Register("panicky", 0, &panicAddon{}); err != nil {
+		t.Fatal(err)
+	}
+	g := r.hooks()[0]
+	f := NewFlow()
+	in := bytes.NewReader([]byte("body"))
+	if out := g.StreamResponseModifier(f, in); out != in {
+		t.Error("want the body unmodified")
+	}
+	g.ClientDisconnected(&ClientConn{})
+	if info := r.List()[0]; info.Failures != 2 || info.LastErr != "disconnected" {
+		t.Errorf("unexpected info %+v", info)
+	}
+
+	// enabling resets the circuit breaker
+	r.SetMaxFailures(3)
+	g.Requestheaders(f)
+	if info := r.List()[0]; info.Enabled {
+		t.Errorf("want the addon disabled, got %+v", info)
+	}
+	r.SetEnabled("panicky", true)
+	g.Requestheaders(f)
+	if info := r.List()[0]; !info.Enabled || info.Failures != 4 {
+		t.Errorf("want the addon enabled after one more failure, got %+v", info)
+	}
+	if failed := f.FailedAddons(); len(failed) != 1 || failed[0] != "panicky" {
+		t.Errorf("want the failed addon recorded once, got %v", failed)
+	}
+
+	defer func() {
+		if v := recover(); v != http.ErrAbortHandler {
+			t.Errorf("want http.ErrAbortHandler passed on, got %v", v)
+		}
+	}()
+	r.Register("abort", 0, &MockHookAddon{OnRequestheaders: func(*Flow) { panic(http.ErrAbortHandler) }})
+	r.hooks()[1].Requestheaders(f)
+}
@@ -4,7 +4,6 @@ import (
 	"bytes"
 	"errors"
 	"io"
-	"net"
 	"net/http/httptest"
 	"os"
 	"testing"
@@ -12,45 +11,6 @@ import (
 	"github.com/sirupsen/logrus"
 )
 
-func TestTransfer_Error(t *testing.T) {
-	log := logrus.NewEntry(logrus.New())
-	
-	// Mock connections that fail on read/write
-	server := &mockConn{readErr: errors.New("server read error")}
-	client := &mockConn{}
-	
-	// Should log error and return
-	transfer(log, server, client)
-}
-
-func TestTransfer_WrapClientConn(t *testing.T) {
-	log := logrus.NewEntry(logrus.New())
-	
-	// Create real TCP conns to test TCP-specific branches
-	ln, _ := net.Listen("tcp", "127.0.0.1:0")
-	defer ln.Close()
-	
-	go func() {
-		c, _ := net.Dial("tcp", ln.Addr().String())
-		c.Close()
-	}()
-	
-	conn, _ := ln.Accept()
-	defer conn.Close()
-	
-    p, _ := NewProxy(&Options{Addr: ":0"})
-	client := newWrapClientConn(conn, p)
-	client.connCtx = &ConnContext{
-		ClientConn: &ClientConn{
-			Conn: conn,
-		},
-	}
-	
-	server := &mockConn{}
-	
-	transfer(log, server, client)
-}
-
 func TestLogErr(t *testing.T) {
 	// Capture log output
 	var buf bytes.Buffer
@@ -108,7 +68,3 @@ func TestHttpError(t *testing.T) {
 		t.Errorf("want body 'auth required', got %q", string(body))
 	}
 }
-
-func TestTransfer(t *testing.T) {
-	t.Skip("Skipping complex transfer test for now, focusing on logErr and httpError")
-}
@@ -1,11 +1,14 @@
 package proxy
 
 import (
+	"bufio"
 	"bytes"
 	"context"
 	"crypto/tls"
 	"crypto/x509"
+	"fmt"
 	"io"
+	"net"
 	"net/http"
 	"net/http/httptest"
 	"net/url"
@@ -13,6 +16,7 @@ import (
 	"testing"
 	"time"
 
+	"github.com/gorilla/websocket"
 	"github.com/retutils/gomitmproxy/cert"
 )
 
@@ -385,3 +389,122 @@ func TestIntegration_HttpsFirstAttack(t *testing.T) {
         t.Errorf("Want 'first hello', got '%s'", string(body))
     }
 }
+
+// send a plain http request through a CONNECT tunnel
+func getThroughTunnel(proxyAddr, target string) (*http.Response, error) {
+	conn, err := net.Dial("tcp", proxyAddr)
+	if err != nil {
+		return nil, err
+	}
+	fmt.Fprintf(conn, "CONNECT %v HTTP/1.1\r\nHost: %v\r\n\r\n", target, target)
+	br := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(br, nil)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	if resp.StatusCode != 200 {
+		conn.Close()
+		return nil, fmt.Errorf("connect status %v", resp.StatusCode)
+	}
+	fmt.Fprintf(conn, "GET /tunnel HTTP/1.1\r\nHost: %v\r\nConnection: close\r\n\r\n", target)
+	return http.ReadResponse(br, nil)
+}
+
+func TestIntegration_HttpInConnectTunnel(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("tunnel " + r.URL.Path))
+	}))
+	defer upstream.Close()
+	target := upstream.Listener.Addr().String()
+
+	for i, upstreamCert := range []bool{true, false} {
+		addr := fmt.Sprintf("127.0.0.1:%v", 9094+i)
+		p, err := NewProxy(&Options{Addr: addr, StreamLargeBodies: 1024 * 1024})
+		if err != nil {
+			t.Fatal(err)
+		}
+		p.AddAddon(NewUpstreamCertAddon(upstreamCert))
+		addon := &urlRecorderAddon{urls: make(chan string, 1)}
+		p.AddAddon(addon)
+		go p.Start()
+		time.Sleep(100 * time.Millisecond)
+
+		resp, err := getThroughTunnel(addr, target)
+		if err != nil {
+			p.Close()
+			t.Fatalf("upstreamCert %v: %v", upstreamCert, err)
+		}
+		body, _ := io.ReadAll(resp.Body)
+		resp.Body.Close()
+		if string(body) != "tunnel /tunnel" {
+			t.Errorf("upstreamCert %v: unexpected body %q", upstreamCert, body)
+		}
+
+		select {
+		case u := <-addon.urls:
+			if u != "http://"+target+"/tunnel" {
+				t.Errorf("upstreamCert %v: unexpected flow url %v", upstreamCert, u)
+			}
+		case <-time.After(time.Second):
+			t.Errorf("upstreamCert %v: addon did not see the flow", upstreamCert)
+		}
+		p.Close()
+	}
+}
+
+func TestIntegration_WsInConnectTunnel(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		upgrader := websocket.Upgrader{}
+		c, err := upgrader.Upgrade(w, r, nil)
+		if err != nil {
+			return
+		}
+		defer c.Close()
+		mt, message, err := c.ReadMessage()
+		if err != nil {
+			return
+		}
+		c.WriteMessage(mt, message)
+	}))
+	defer backend.Close()
+
+	p, err := NewProxy(&Options{Addr: "127.0.0.1:9096"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	mockAddon := &MockAddon{}
+	p.AddAddon(mockAddon)
+	go p.Start()
+	defer p.Close()
+	time.Sleep(100 * time.Millisecond)
+
+	// gorilla dials ws:// through a CONNECT tunnel as well
+	proxyUrl, _ := url.Parse("http://127.0.0.1:9096")
+	dialer := websocket.Dialer{Proxy: http.ProxyURL(proxyUrl)}
+	c, _, err := dialer.Dial("ws://"+backend.Listener.Addr().String()+"/ws", nil)
+	if err != nil {
+		t.Fatalf("dial: %v", err)
+	}
+	defer c.Close()
+
+	if err := c.WriteMessage(websocket.TextMessage, []byte("hello ws")); err != nil {
+		t.Fatal(err)
+	}
+	_, recv, err := c.ReadMessage()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(recv) != "hello ws" {
+		t.Errorf("unexpected message %q", recv)
+	}
+
+	mockAddon.mu.Lock()
+	defer mockAddon.mu.Unlock()
+	if len(mockAddon.Handshakes) != 1 || mockAddon.Handshakes[0] != "http://"+backend.Listener.Addr().String()+"/ws" {
+		t.Errorf("unexpected handshakes %v", mockAddon.Handshakes)
+	}
+	if len(mockAddon.Messages) != 2 {
+		t.Errorf("expected 2 messages, got %d", len(mockAddon.Messages))
+	}
+}
@@ -0,0 +1,148 @@
+package proxy
+
+import (
+	"crypto/tls"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+)
+
+type killAddon struct {
+	BaseAddon
+	killed chan *Flow
+}
+
+func (a *killAddon) Requestheaders(f *Flow) {
+	switch f.Request.URL.Path {
+	case "/kill-now":
+		f.Kill()
+	case "/kill-later":
+		time.AfterFunc(100*time.Millisecond, f.Kill)
+	}
+}
+
+func (a *killAddon) FlowKilled(f *Flow) {
+	a.killed <- f
+}
+
+func TestFlowKill(t *testing.T) {
+	upstreamCanceled := make(chan struct{}, 4)
+	requests := make(chan string, 4)
+	helper := &testProxyHelper{
+		server: &http.Server{
+			Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				requests <- r.URL.Path
+				if r.URL.Path != "/kill-later" {
+					w.Write([]byte("ok"))
+					return
+				}
+				select {
+				case <-r.Context().Done():
+					upstreamCanceled <- struct{}{}
+				case <-time.After(5 * time.Second):
+					w.Write([]byte("slow"))
+				}
+			}),
+		},
+		proxyAddr: ":29095",
+	}
+	helper.init(t)
+	helper.server.TLSConfig.NextProtos = []string{"h2", "http/1.1"}
+	testProxy := helper.testProxy
+	addon := &killAddon{killed: make(chan *Flow, 4)}
+	testProxy.AddAddon(addon)
+	defer helper.ln.Close()
+	go helper.server.Serve(helper.ln)
+	defer helper.tlsPlainLn.Close()
+	go helper.server.ServeTLS(helper.tlsPlainLn, "", "")
+	go testProxy.Start()
+	defer testProxy.Close()
+	time.Sleep(time.Millisecond * 10) // wait for test proxy startup
+
+	expectKilled := func(t *testing.T, path string) {
+		t.Helper()
+		select {
+		case f := <-addon.killed:
+			if !f.IsKilled() || f.Request.URL.Path != path {
+				t.Errorf("unexpected killed flow %v %v", f.Request.URL, f.IsKilled())
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatal("FlowKilled not fired")
+		}
+	}
+
+	t.Run("before upstream", func(t *testing.T) {
+		client := helper.getProxyClient()
+		defer client.CloseIdleConnections()
+		if _, err := client.Get(helper.httpEndpoint + "/kill-now"); err == nil {
+			t.Error("want error from a killed flow")
+		}
+		expectKilled(t, "/kill-now")
+		select {
+		case path := <-requests:
+			t.Errorf("want no upstream request, got %v", path)
+		default:
+		}
+	})
+
+	for _, tc := range []struct {
+		name    string
+		rst     bool
+		wantErr string
+	}{
+		{"close", false, "EOF"},
+		{"rst", true, "reset"},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			testProxy.Opts.KillRst = tc.rst
+			client := helper.getProxyClient()
+			defer client.CloseIdleConnections()
+			_, err := client.Get(helper.httpEndpoint + "/kill-later")
+			if err == nil || !strings.Contains(err.Error(), tc.wantErr) {
+				t.Errorf("want %v error, got %v", tc.wantErr, err)
+			}
+			<-requests
+			select {
+			case <-upstreamCanceled:
+			case <-time.After(time.Second):
+				t.Error("want the upstream request canceled")
+			}
+			expectKilled(t, "/kill-later")
+		})
+	}
+	testProxy.Opts.KillRst = false
+
+	t.Run("h2 stream", func(t *testing.T) {
+		h2Client := &http.Client{
+			Transport: &http.Transport{
+				ForceAttemptHTTP2: true,
+				TLSClientConfig:   &tls.Config{InsecureSkipVerify: true},
+				Proxy: func(r *http.Request) (*url.URL, error) {
+					return url.Parse("http://127.0.0.1" + helper.proxyAddr)
+				},
+			},
+		}
+		defer h2Client.CloseIdleConnections()
+		_, err := h2Client.Get(helper.httpsEndpoint + "/kill-later")
+		if err == nil || !strings.Contains(err.Error(), "stream error") {
+			t.Errorf("want a reset stream, got %v", err)
+		}
+		<-requests
+		expectKilled(t, "/kill-later")
+
+		// the other streams of the connection go on
+		resp, err := h2Client.Get(helper.httpsEndpoint + "/")
+		if err != nil {
+			t.Fatal(err)
+		}
+		body, _ := io.ReadAll(resp.Body)
+		resp.Body.Close()
+		<-requests
+		if resp.ProtoMajor != 2 || string(body) != "ok" {
+			t.Errorf("want the connection kept, got %v %q", resp.Proto, body)
+		}
+	})
+}
@@ -0,0 +1,339 @@
+package proxy
+
+import (
+	"fmt"
+	"io"
+	"math"
+	"math/rand"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/retutils/gomitmproxy/internal/helper"
+	"go.uber.org/atomic"
+)
+
+// NetworkCondition of an emulated link between a client and the proxy
+type NetworkCondition struct {
+	Latency int     `json:"latency"` // round trip time in ms added to each exchange of the client and the proxy
+	Jitter  int     `json:"jitter"`  // ms the latency varies by at random
+	Down    int     `json:"down"`    // download bandwidth in kbit/s, 0 for unlimited
+	Up      int     `json:"up"`      // upload bandwidth in kbit/s, 0 for unlimited
+	Loss    float64 `json:"loss"`    // share of packets lost from 0 to 1, a loss stalls the transfer like a tcp retransmission
+}
+
+// NetworkPresets are the conditions of common links by name
+var NetworkPresets = map[string]NetworkCondition{
+	"edge":       {Latency: 840, Down: 240, Up: 200},
+	"3g":         {Latency: 200, Down: 780, Up: 330},
+	"4g":         {Latency: 70, Jitter: 10, Down: 12000, Up: 6000},
+	"lossy-wifi": {Latency: 40, Jitter: 30, Down: 10000, Up: 5000, Loss: 0.05},
+}
+
+// NetworkRule applies a network condition to the clients and hosts it matches.
+// A rule matches if each of its non-empty criteria matches, hosts and clients match if any of them does.
+type NetworkRule struct {
+	Hosts   []string `json:"hosts"`   // host globs with optional port, e.g. *.example.com, api.example.com:8443
+	Clients []string `json:"clients"` // client ip ranges or ips, e.g. 192.168.1.0/24
+	Preset  string   `json:"preset"`  // name of one of NetworkPresets, the non-zero condition fields of the rule override it
+	NetworkCondition
+}
+
+// NewNetworkRulesFromFile reads a json array of NetworkRule
+func NewNetworkRulesFromFile(filename string) ([]*NetworkRule, error) {
+	var rules []*NetworkRule
+	if err := helper.NewStructFromFile(filename, &rules); err != nil {
+		return nil, err
+	}
+	return rules, nil
+}
+
+type networkRule struct {
+	name  string // preset name, or custom
+	hosts []string
+	nets  []*net.IPNet
+	cond  *NetworkCondition
+}
+
+func newNetworkRule(rule *NetworkRule) (*networkRule, error) {
+	r := &networkRule{name: "custom", hosts: rule.Hosts}
+	for _, client := range rule.Clients {
+		ipNet, err := parseCidr(client)
+		if err != nil {
+			return nil, err
+		}
+		r.nets = append(r.nets, ipNet)
+	}
+
+	var cond NetworkCondition
+	if rule.Preset != "" {
+		preset, ok := NetworkPresets[rule.Preset]
+		if !ok {
+			return nil, fmt.Errorf("unknown preset %v", rule.Preset)
+		}
+		cond, r.name = preset, rule.Preset
+	}
+	c := &rule.NetworkCondition
+	if c.Latency < 0 || c.Jitter < 0 || c.Down < 0 || c.Up < 0 || c.Loss < 0 || c.Loss > 1 {
+		return nil, fmt.Errorf("invalid condition %+v", *c)
+	}
+	if c.Latency != 0 {
+		cond.Latency = c.Latency
+	}
+	if c.Jitter != 0 {
+		cond.Jitter = c.Jitter
+	}
+	if c.Down != 0 {
+		cond.Down = c.Down
+	}
+	if c.Up != 0 {
+		cond.Up = c.Up
+	}
+	if c.Loss != 0 {
+		cond.Loss = c.Loss
+	}
+	r.cond = &cond
+	return r, nil
+}
+
+// match reports whether the rule applies to a client at ip, talking to hostname and port if withHost is set
+func (r *networkRule) match(ip net.IP, hostname, port string, withHost bool) bool {
+	if len(r.hosts) > 0 {
+		if !withHost {
+			return false
+		}
+		matched := false
+		for _, host := range r.hosts {
+			if matchHostGlob(hostname, port, host) {
+				matched = true
+				break
+			}
+		}
+		if !matched {
+			return false
+		}
+	}
+	if len(r.nets) > 0 {
+		if ip == nil {
+			return false
+		}
+		matched := false
+		for _, ipNet := range r.nets {
+			if ipNet.Contains(ip) {
+				matched = true
+				break
+			}
+		}
+		if !matched {
+			return false
+		}
+	}
+	return true
+}
+
+// NetworkConditions emulates slow and lossy links, the first rule matching a flow shapes the connection of its client:
+// the bytes from and to the client are delayed and throttled, whether the proxy or the server answers.
+// Only the client side is shaped, the connections to the servers, pooled ones and those of replays too, run at the
+// speed of the real network. Rules without hosts shape a connection from when it is accepted, tunnels too, rules with
+// hosts from the request headers of a matching flow on. Rules changed by SetRules apply to the next flows.
+type NetworkConditions struct {
+	BaseAddon
+
+	mu     sync.RWMutex
+	config []*NetworkRule
+	rules  []*networkRule
+}
+
+// NewNetworkConditions returns the addon shaping connections by rules, none if rules is empty
+func NewNetworkConditions(rules []*NetworkRule) (*NetworkConditions, error) {
+	nc := &NetworkConditions{}
+	if err := nc.SetRules(rules); err != nil {
+		return nil, err
+	}
+	return nc, nil
+}
+
+// SetRules replaces the rules
+func (nc *NetworkConditions) SetRules(rules []*NetworkRule) error {
+	parsed := make([]*networkRule, 0, len(rules))
+	for i, rule := range rules {
+		r, err := newNetworkRule(rule)
+		if err != nil {
+			return fmt.Errorf("network rule %v: %w", i, err)
+		}
+		parsed = append(parsed, r)
+	}
+	nc.mu.Lock()
+	nc.config = rules
+	nc.rules = parsed
+	nc.mu.Unlock()
+	return nil
+}
+
+// Rules returns the rules set
+func (nc *NetworkConditions) Rules() []*NetworkRule {
+	nc.mu.RLock()
+	defer nc.mu.RUnlock()
+	return nc.config
+}
+
+func (nc *NetworkConditions) match(ip net.IP, hostname, port string, withHost bool) *networkRule {
+	nc.mu.RLock()
+	defer nc.mu.RUnlock()
+	for _, r := range nc.rules {
+		if r.match(ip, hostname, port, withHost) {
+			return r
+		}
+	}
+	return nil
+}
+
+func (nc *NetworkConditions) ClientConnected(client *ClientConn) {
+	wc := shapedConn(client)
+	if wc == nil {
+		return
+	}
+	var cond *NetworkCondition
+	if r := nc.match(clientIP(client), "", "", false); r != nil {
+		cond = r.cond
+	}
+	wc.link.cond.Store(cond)
+}
+
+func (nc *NetworkConditions) Requestheaders(f *Flow) {
+	wc := shapedConn(f.ConnContext.ClientConn)
+	if wc == nil {
+		return
+	}
+	hostname, port, err := net.SplitHostPort(helper.CanonicalAddr(f.Request.URL))
+	if err != nil {
+		hostname = f.Request.URL.Hostname()
+	}
+	var cond *NetworkCondition
+	if r := nc.match(clientIP(f.ConnContext.ClientConn), hostname, port, true); r != nil {
+		cond = r.cond
+		f.Metadata["network"] = r.name
+	}
+	if prev := wc.link.cond.Swap(cond); cond != nil && cond != prev {
+		// the request crossed the link before the condition applied
+		wc.link.transfer(cond, linkUp, 0)
+	}
+}
+
+// shapedConn returns the connection of client to shape, nil for a replay which has no client
+func shapedConn(client *ClientConn) *wrapClientConn {
+	wc, ok := client.Conn.(*wrapClientConn)
+	if !ok {
+		return nil
+	}
+	if _, replay := wc.Conn.(replayConn); replay {
+		return nil
+	}
+	return wc
+}
+
+// clientIP returns the ip of client, nil if it has none
+func clientIP(client *ClientConn) net.IP {
+	host, _, err := net.SplitHostPort(client.Conn.RemoteAddr().String())
+	if err != nil {
+		return nil
+	}
+	return net.ParseIP(host)
+}
+
+const (
+	linkIdle = iota
+	linkUp
+	linkDown
+)
+
+// netLink shapes the bytes of a client connection by its network condition, nil for none
+type netLink struct {
+	cond atomic.Pointer[NetworkCondition]
+
+	mu        sync.Mutex
+	direction int       // of the last bytes, the latency is added when it turns
+	upBusy    time.Time // the link is busy sending earlier bytes until then
+	downBusy  time.Time
+}
+
+// read from the client
+func (l *netLink) read(r io.Reader, b []byte) (int, error) {
+	cond := l.cond.Load()
+	if cond == nil {
+		return r.Read(b)
+	}
+	if chunk := linkChunk(cond.Up); len(b) > chunk {
+		b = b[:chunk]
+	}
+	n, err := r.Read(b)
+	if n > 0 {
+		l.transfer(cond, linkUp, n)
+	}
+	return n, err
+}
+
+// write to the client
+func (l *netLink) write(w io.Writer, b []byte) (n int, err error) {
+	cond := l.cond.Load()
+	if cond == nil {
+		return w.Write(b)
+	}
+	chunk := linkChunk(cond.Down)
+	for len(b) > 0 {
+		p := b[:min(len(b), chunk)]
+		l.transfer(cond, linkDown, len(p))
+		m, err := w.Write(p)
+		n += m
+		if err != nil {
+			return n, err
+		}
+		b = b[m:]
+	}
+	return n, nil
+}
+
+// transfer waits until n bytes went through the link in direction
+func (l *netLink) transfer(cond *NetworkCondition, direction int, n int) {
+	now := time.Now()
+	l.mu.Lock()
+	busy, kbps := &l.upBusy, cond.Up
+	if direction == linkDown {
+		busy, kbps = &l.downBusy, cond.Down
+	}
+	if busy.Before(now) {
+		*busy = now
+	}
+	if l.direction != direction {
+		// half a round trip for the bytes to cross the link
+		l.direction = direction
+		delay := time.Duration(cond.Latency) * time.Millisecond / 2
+		if cond.Jitter > 0 {
+			delay += time.Duration(rand.Intn(cond.Jitter+1)-cond.Jitter/2) * time.Millisecond
+		}
+		*busy = busy.Add(max(delay, 0))
+	}
+	if kbps > 0 {
+		*busy = busy.Add(time.Duration(n) * 8 * time.Millisecond / time.Duration(kbps))
+	}
+	if cond.Loss > 0 && rand.Float64() < 1-math.Pow(1-cond.Loss, float64(packets(n))) {
+		// a lost packet is sent again after the retransmission timeout
+		*busy = busy.Add(max(200*time.Millisecond, time.Duration(cond.Latency)*time.Millisecond))
+	}
+	wait := busy.Sub(now)
+	l.mu.Unlock()
+	time.Sleep(wait)
+}
+
+// linkChunk is the number of bytes sent at once, about 20ms at kbps
+func linkChunk(kbps int) int {
+	if kbps <= 0 {
+		return 32 * 1024
+	}
+	return max(kbps*1000/8/50, 512)
+}
+
+// packets of n bytes on the link
+func packets(n int) int {
+	return (n + 1459) / 1460
+}
@@ -0,0 +1,145 @@
+package proxy
+
+import (
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestNetworkRule(t *testing.T) {
+	r, err := newNetworkRule(&NetworkRule{Preset: "3g", NetworkCondition: NetworkCondition{Latency: 500, Loss: 0.1}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := NetworkCondition{Latency: 500, Down: 780, Up: 330, Loss: 0.1}
+	if r.name != "3g" || *r.cond != want {
+		t.Errorf("want %+v, got %v %+v", want, r.name, *r.cond)
+	}
+
+	for _, rule := range []*NetworkRule{
+		{Preset: "5g"},
+		{Clients: []string{"10.0.0.0/33"}},
+		{NetworkCondition: NetworkCondition{Down: -1}},
+		{NetworkCondition: NetworkCondition{Loss: 1.5}},
+	} {
+		if _, err := newNetworkRule(rule); err == nil {
+			t.Errorf("want error for %+v", rule)
+		}
+	}
+
+	r, err = newNetworkRule(&NetworkRule{Hosts: []string{"*.example.com"}, Clients: []string{"10.0.0.0/8", "192.168.1.2"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, tc := range []struct {
+		ip       string
+		hostname string
+		withHost bool
+		want     bool
+	}{
+		{"10.1.2.3", "api.example.com", true, true},
+		{"192.168.1.2", "example.com", true, true},
+		{"192.168.1.3", "api.example.com", true, false},
+		{"10.1.2.3", "example.org", true, false},
+		{"10.1.2.3", "", false, false},
+		{"", "api.example.com", true, false},
+	} {
+		if got := r.match(net.ParseIP(tc.ip), tc.hostname, "443", tc.withHost); got != tc.want {
+			t.Errorf("match %v %v %v: want %v", tc.ip, tc.hostname, tc.withHost, tc.want)
+		}
+	}
+}
+
+func TestNetworkConditions(t *testing.T) {
+	body := strings.Repeat("x", 32*1024)
+	helper := &testProxyHelper{
+		server: &http.Server{
+			Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				w.Write([]byte(body))
+			}),
+		},
+		proxyAddr: ":29097",
+	}
+	helper.init(t)
+	testProxy := helper.testProxy
+	network, err := NewNetworkConditions(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	testProxy.AddAddon(network)
+	flows := make(chan *Flow, 4)
+	testProxy.AddAddon(&flowCollector{flows: flows})
+	defer helper.ln.Close()
+	go helper.server.Serve(helper.ln)
+	defer helper.tlsPlainLn.Close()
+	go helper.server.ServeTLS(helper.tlsPlainLn, "", "")
+	go testProxy.Start()
+	defer testProxy.Close()
+	time.Sleep(time.Millisecond * 10) // wait for test proxy startup
+
+	get := func(t *testing.T, endpoint string) (time.Duration, *Flow) {
+		t.Helper()
+		client := helper.getProxyClient()
+		defer client.CloseIdleConnections()
+		start := time.Now()
+		resp, err := client.Get(endpoint + "/")
+		if err != nil {
+			t.Fatal(err)
+		}
+		got, err := io.ReadAll(resp.Body)
+		resp.Body.Close()
+		if err != nil || string(got) != body {
+			t.Fatalf("want the body, got %v bytes %v", len(got), err)
+		}
+		return time.Since(start), <-flows
+	}
+
+	httpHost := strings.TrimPrefix(helper.httpEndpoint, "http://")
+	for _, tc := range []struct {
+		name     string
+		rules    []*NetworkRule
+		endpoint string
+		min, max time.Duration
+		preset   string
+	}{
+		{"none", nil, helper.httpEndpoint, 0, 300 * time.Millisecond, ""},
+		// 32 KiB at 512 kbit/s
+		{"bandwidth", []*NetworkRule{{NetworkCondition: NetworkCondition{Down: 512}}}, helper.httpEndpoint, 500 * time.Millisecond, 2 * time.Second, "custom"},
+		{"latency", []*NetworkRule{{Hosts: []string{httpHost}, NetworkCondition: NetworkCondition{Latency: 400}}}, helper.httpEndpoint, 400 * time.Millisecond, 2 * time.Second, "custom"},
+		{"tls", []*NetworkRule{{Clients: []string{"127.0.0.1"}, Preset: "4g"}}, helper.httpsEndpoint, 70 * time.Millisecond, 2 * time.Second, "4g"},
+		{"other host", []*NetworkRule{{Hosts: []string{httpHost}, Preset: "edge"}}, helper.httpsEndpoint, 0, 300 * time.Millisecond, ""},
+		{"other client", []*NetworkRule{{Clients: []string{"10.0.0.0/8"}, Preset: "edge"}}, helper.httpEndpoint, 0, 300 * time.Millisecond, ""},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			if err := network.SetRules(tc.rules); err != nil {
+				t.Fatal(err)
+			}
+			elapsed, f := get(t, tc.endpoint)
+			if elapsed < tc.min || elapsed > tc.max {
+				t.Errorf("want %v to %v, took %v", tc.min, tc.max, elapsed)
+			}
+			if preset, _ := f.Metadata["network"].(string); preset != tc.preset {
+				t.Errorf("want network %q, got %q", tc.preset, preset)
+			}
+		})
+	}
+
+	if err := network.SetRules([]*NetworkRule{{Preset: "dialup"}}); err == nil {
+		t.Error("want error for an unknown preset")
+	}
+	if len(network.Rules()) != 1 || network.Rules()[0].Preset != "edge" {
+		t.Error("want the rules kept after an error")
+	}
+}
+
+type flowCollector struct {
+	BaseAddon
+	flows chan *Flow
+}
+
+func (a *flowCollector) Response(f *Flow) {
+	a.flows <- f
+}
@@ -0,0 +1,351 @@
+package proxy
+
+import (
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/dop251/goja"
+	"github.com/tidwall/match"
+)
+
+// a pac taking longer to choose the upstream of a request is interrupted
+const pacTimeout = 5 * time.Second
+
+// loadPac reads a pac file from a path or a http(s) url
+func loadPac(location string) (string, error) {
+	if !strings.HasPrefix(location, "http://") && !strings.HasPrefix(location, "https://") {
+		data, err := os.ReadFile(location)
+		return string(data), err
+	}
+	client := &http.Client{Timeout: 30 * time.Second}
+	res, err := client.Get(location)
+	if err != nil {
+		return "", err
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("status %v", res.StatusCode)
+	}
+	data, err := io.ReadAll(res.Body)
+	return string(data), err
+}
+
+// FindProxyForURL is evaluated in that many runtimes at once, e.g. while some wait for dnsResolve
+const pacRuntimes = 4
+
+// pacScript evaluates FindProxyForURL of a proxy auto-config file,
+// with the standard pac functions (isInNet, shExpMatch, dnsResolve, ...) defined
+type pacScript struct {
+	runtimes chan *pacRuntime // idle runtimes, a call waits for one
+	resolve  func(hostname string) []net.IP
+	now      func() time.Time
+}
+
+// goja.Runtime is not goroutine safe, a runtime evaluates one call at a time
+type pacRuntime struct {
+	vm   *goja.Runtime
+	find goja.Callable
+}
+
+func newPacScript(src string, resolve func(hostname string) []net.IP) (*pacScript, error) {
+	program, err := goja.Compile("pac", src, false)
+	if err != nil {
+		return nil, err
+	}
+	pac := &pacScript{
+		runtimes: make(chan *pacRuntime, pacRuntimes),
+		resolve:  resolve,
+		now:      time.Now,
+	}
+	for i := 0; i < pacRuntimes; i++ {
+		vm := goja.New()
+		pac.define(vm)
+		if _, err := vm.RunProgram(program); err != nil {
+			return nil, err
+		}
+		find, ok := goja.AssertFunction(vm.Get("FindProxyForURL"))
+		if !ok {
+			return nil, fmt.Errorf("no FindProxyForURL function")
+		}
+		pac.runtimes <- &pacRuntime{vm: vm, find: find}
+	}
+	return pac, nil
+}
+
+// findProxy returns the result of FindProxyForURL, e.g. "PROXY a:3128; DIRECT"
+func (pac *pacScript) findProxy(rawUrl, host string) (string, error) {
+	rt := <-pac.runtimes
+	defer func() {
+		pac.runtimes <- rt
+	}()
+
+	timer := time.AfterFunc(pacTimeout, func() {
+		rt.vm.Interrupt(fmt.Errorf("FindProxyForURL timeout"))
+	})
+	defer func() {
+		timer.Stop()
+		rt.vm.ClearInterrupt()
+	}()
+
+	v, err := rt.find(goja.Undefined(), rt.vm.ToValue(rawUrl), rt.vm.ToValue(host))
+	if err != nil {
+		return "", err
+	}
+	if goja.IsUndefined(v) || goja.IsNull(v) {
+		return "", fmt.Errorf("FindProxyForURL returned %v", v)
+	}
+	return v.String(), nil
+}
+
+// parsePacResult returns the upstream of the first supported entry of a pac result, nil for DIRECT
+func parsePacResult(result string) (*url.URL, error) {
+	for _, entry := range strings.Split(result, ";") {
+		fields := strings.Fields(entry)
+		if len(fields) == 0 {
+			continue
+		}
+		var scheme string
+		switch strings.ToUpper(fields[0]) {
+		case "DIRECT":
+			return nil, nil
+		case "PROXY", "HTTP":
+			scheme = "http"
+		case "HTTPS":
+			scheme = "https"
+		case "SOCKS", "SOCKS5":
+			scheme = "socks5"
+		default:
+			continue
+		}
+		if len(fields) < 2 {
+			continue
+		}
+		return &url.URL{Scheme: scheme, Host: fields[1]}, nil
+	}
+	return nil, fmt.Errorf("no supported proxy in pac result %q", result)
+}
+
+func (pac *pacScript) define(vm *goja.Runtime) {
+	vm.Set("isPlainHostName", func(host string) bool {
+		return !strings.Contains(host, ".")
+	})
+	vm.Set("dnsDomainIs", func(host, domain string) bool {
+		return strings.HasSuffix(strings.ToLower(host), strings.ToLower(domain))
+	})
+	vm.Set("localHostOrDomainIs", func(host, hostdom string) bool {
+		host, hostdom = strings.ToLower(host), strings.ToLower(hostdom)
+		if host == hostdom {
+			return true
+		}
+		return !strings.Contains(host, ".") && strings.HasPrefix(hostdom, host+".")
+	})
+	vm.Set("isResolvable", func(host string) bool {
+		return len(pac.resolve(host)) > 0
+	})
+	vm.Set("dnsResolve", func(host string) goja.Value {
+		ip := pac.resolveIPv4(host)
+		if ip == nil {
+			return goja.Null()
+		}
+		return vm.ToValue(ip.String())
+	})
+	vm.Set("isInNet", func(host, pattern, mask string) bool {
+		ip := pac.resolveIPv4(host)
+		patternIP, maskIP := net.ParseIP(pattern).To4(), net.ParseIP(mask).To4()
+		if ip == nil || patternIP == nil || maskIP == nil {
+			return false
+		}
+		m := net.IPMask(maskIP)
+		return ip.Mask(m).Equal(patternIP.Mask(m))
+	})
+	vm.Set("myIpAddress", func() string {
+		// no packet is sent by dialing udp, it only picks the outbound interface
+		conn, err := net.Dial("udp", "192.0.2.1:80")
+		if err != nil {
+			return "127.0.0.1"
+		}
+		defer conn.Close()
+		return conn.LocalAddr().(*net.UDPAddr).IP.String()
+	})
+	vm.Set("dnsDomainLevels", func(host string) int {
+		return strings.Count(host, ".")
+	})
+	vm.Set("shExpMatch", func(str, shexp string) bool {
+		return match.Match(str, shexp)
+	})
+	vm.Set("weekdayRange", func(call goja.FunctionCall) goja.Value {
+		args, now := pac.timeArgs(call)
+		return vm.ToValue(weekdayRange(args, now))
+	})
+	vm.Set("dateRange", func(call goja.FunctionCall) goja.Value {
+		args, now := pac.timeArgs(call)
+		return vm.ToValue(dateRange(args, now))
+	})
+	vm.Set("timeRange", func(call goja.FunctionCall) goja.Value {
+		args, now := pac.timeArgs(call)
+		return vm.ToValue(timeRange(args, now))
+	})
+}
+
+func (pac *pacScript) resolveIPv4(host string) net.IP {
+	for _, ip := range pac.resolve(host) {
+		if ip4 := ip.To4(); ip4 != nil {
+			return ip4
+		}
+	}
+	return nil
+}
+
+// arguments of the time functions without the trailing "GMT", and the time they are evaluated at
+func (pac *pacScript) timeArgs(call goja.FunctionCall) ([]string, time.Time) {
+	args := make([]string, 0, len(call.Arguments))
+	for _, arg := range call.Arguments {
+		args = append(args, strings.ToUpper(arg.String()))
+	}
+	now := pac.now()
+	if len(args) > 0 && args[len(args)-1] == "GMT" {
+		args = args[:len(args)-1]
+		now = now.UTC()
+	}
+	return args, now
+}
+
+var pacWeekdays = []string{"SUN", "MON", "TUE", "WED", "THU", "FRI", "SAT"}
+
+var pacMonths = []string{"JAN", "FEB", "MAR", "APR", "MAY", "JUN", "JUL", "AUG", "SEP", "OCT", "NOV", "DEC"}
+
+func indexOf(list []string, s string) int {
+	for i, item := range list {
+		if item == s {
+			return i
+		}
+	}
+	return -1
+}
+
+// weekdayRange(wd1 [, wd2]), ranges may wrap around, e.g. FRI, MON
+func weekdayRange(args []string, now time.Time) bool {
+	if len(args) == 0 {
+		return false
+	}
+	from := indexOf(pacWeekdays, args[0])
+	to := from
+	if len(args) > 1 {
+		to = indexOf(pacWeekdays, args[1])
+	}
+	if from < 0 || to < 0 {
+		return false
+	}
+	return inRange(from, to, int(now.Weekday()))
+}
+
+// timeRange(hour), timeRange(hour1, hour2), timeRange(h1, m1, h2, m2) or timeRange(h1, m1, s1, h2, m2, s2),
+// the end is exclusive and ranges may wrap around midnight
+func timeRange(args []string, now time.Time) bool {
+	nums := make([]int, 0, len(args))
+	for _, arg := range args {
+		n, err := strconv.Atoi(arg)
+		if err != nil {
+			return false
+		}
+		nums = append(nums, n)
+	}
+	var from, to int // seconds of day
+	switch len(nums) {
+	case 1:
+		from, to = nums[0]*3600, (nums[0]+1)*3600
+	case 2:
+		from, to = nums[0]*3600, nums[1]*3600
+	case 4:
+		from, to = nums[0]*3600+nums[1]*60, nums[2]*3600+nums[3]*60
+	case 6:
+		from, to = nums[0]*3600+nums[1]*60+nums[2], nums[3]*3600+nums[4]*60+nums[5]
+	default:
+		return false
+	}
+	sec := now.Hour()*3600 + now.Minute()*60 + now.Second()
+	if from <= to {
+		return from <= sec && sec < to
+	}
+	return sec >= from || sec < to
+}
+
+// dateRange with one day, month or year, or a range whose halves are made of days, months and years,
+// e.g. dateRange(1, 15), dateRange("JAN", "MAR"), dateRange(1, "JUN", 1995, 15, "AUG", 1995)
+func dateRange(args []string, now time.Time) bool {
+	if len(args) == 1 {
+		if month := indexOf(pacMonths, args[0]); month >= 0 {
+			return int(now.Month())-1 == month
+		}
+		n, err := strconv.Atoi(args[0])
+		if err != nil {
+			return false
+		}
+		if n < 32 {
+			return now.Day() == n
+		}
+		return now.Year() == n
+	}
+	if len(args) == 0 || len(args)%2 != 0 {
+		return false
+	}
+
+	today := time.Date(now.Year(), now.Month(), now.Day(), 0, 0, 0, 0, time.UTC)
+	from := pacDate{year: now.Year(), month: 1, day: 1}
+	to := pacDate{year: now.Year(), month: 12, day: 31}
+	half := len(args) / 2
+	onlyDays := true
+	for i, arg := range args {
+		d := &from
+		if i >= half {
+			d = &to
+		}
+		if month := indexOf(pacMonths, arg); month >= 0 {
+			d.month, onlyDays = month+1, false
+			continue
+		}
+		n, err := strconv.Atoi(arg)
+		if err != nil {
+			return false
+		}
+		if n < 32 {
+			d.day, d.daySet = n, true
+		} else {
+			d.year, onlyDays = n, false
+		}
+	}
+	if onlyDays {
+		from.month, to.month = int(now.Month()), int(now.Month())
+	}
+	if !to.daySet {
+		to.day = daysIn(to.year, to.month)
+	}
+	return !today.Before(from.time()) && !today.After(to.time())
+}
+
+type pacDate struct {
+	year, month, day int
+	daySet           bool
+}
+
+func (d pacDate) time() time.Time {
+	return time.Date(d.year, time.Month(d.month), d.day, 0, 0, 0, 0, time.UTC)
+}
+
+func daysIn(year, month int) int {
+	return time.Date(year, time.Month(month)+1, 0, 0, 0, 0, 0, time.UTC).Day()
+}
+
+func inRange(from, to, v int) bool {
+	if from <= to {
+		return from <= v && v <= to
+	}
+	return v >= from || v <= to
+}
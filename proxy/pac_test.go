@@ -0,0 +1,290 @@
+package proxy
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+const testPac = `
+function FindProxyForURL(url, host) {
+	if (isPlainHostName(host) || dnsDomainIs(host, ".local"))
+		return "DIRECT";
+	if (isInNet(host, "10.0.0.0", "255.0.0.0"))
+		return "DIRECT";
+	if (shExpMatch(host, "*.corp.example.com"))
+		return "PROXY corp:3128; DIRECT";
+	if (shExpMatch(url, "http://*/api/*"))
+		return "SOCKS5 socks:1080";
+	if (url.substring(0, 6) == "https:")
+		return "HTTPS secure:443";
+	return "PROXY default:3128";
+}
+`
+
+func testResolve(hostname string) []net.IP {
+	if ip := net.ParseIP(hostname); ip != nil {
+		return []net.IP{ip}
+	}
+	if hostname == "intranet.example.com" {
+		return []net.IP{net.ParseIP("10.1.1.1")}
+	}
+	return nil
+}
+
+func TestPacScript_FindProxy(t *testing.T) {
+	pac, err := newPacScript(testPac, testResolve)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cases := []struct {
+		url, host, want string
+	}{
+		{"http://printer/", "printer", "DIRECT"},
+		{"http://nas.local/", "nas.local", "DIRECT"},
+		{"https://intranet.example.com/", "intranet.example.com", "DIRECT"},
+		{"https://git.corp.example.com/", "git.corp.example.com", "PROXY corp:3128; DIRECT"},
+		{"http://example.com/api/users", "example.com", "SOCKS5 socks:1080"},
+		{"https://example.com/", "example.com", "HTTPS secure:443"},
+		{"http://example.com/", "example.com", "PROXY default:3128"},
+	}
+	for _, c := range cases {
+		got, err := pac.findProxy(c.url, c.host)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got != c.want {
+			t.Errorf("FindProxyForURL(%v, %v) = %v, want %v", c.url, c.host, got, c.want)
+		}
+	}
+}
+
+func TestPacScript_Errors(t *testing.T) {
+	if _, err := newPacScript("function FindProxyForURL(url, host) {", testResolve); err == nil {
+		t.Error("want syntax error")
+	}
+	if _, err := newPacScript("var a = 1;", testResolve); err == nil {
+		t.Error("want error without FindProxyForURL")
+	}
+
+	pac, err := newPacScript(`function FindProxyForURL(url, host) { throw new Error("boom"); }`, testResolve)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := pac.findProxy("http://a/", "a"); err == nil {
+		t.Error("want error when FindProxyForURL throws")
+	}
+
+	pac, err = newPacScript(`function FindProxyForURL(url, host) {}`, testResolve)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := pac.findProxy("http://a/", "a"); err == nil {
+		t.Error("want error when FindProxyForURL returns undefined")
+	}
+}
+
+func TestPacScript_ConcurrentResolve(t *testing.T) {
+	// each lookup waits for the other one, they only finish if done at the same time
+	started := make(chan struct{}, 2)
+	resolve := func(hostname string) []net.IP {
+		started <- struct{}{}
+		deadline := time.After(time.Second)
+		for len(started) < 2 {
+			select {
+			case <-deadline:
+				return nil
+			case <-time.After(time.Millisecond):
+			}
+		}
+		return []net.IP{net.ParseIP("10.1.1.1")}
+	}
+	pac, err := newPacScript(testPac, resolve)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	results := make(chan string, 2)
+	for _, host := range []string{"a.example.com", "b.example.com"} {
+		go func() {
+			result, err := pac.findProxy("http://"+host+"/", host)
+			if err != nil {
+				t.Error(err)
+			}
+			results <- result
+		}()
+	}
+	for i := 0; i < 2; i++ {
+		if result := <-results; result != "DIRECT" {
+			t.Errorf("unexpected result %q, lookups were not concurrent", result)
+		}
+	}
+}
+
+func TestPacScript_Functions(t *testing.T) {
+	pac, err := newPacScript(`function FindProxyForURL(url, host) { return "DIRECT"; }`, testResolve)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pac.now = func() time.Time {
+		return time.Date(2024, time.June, 12, 14, 30, 0, 0, time.Local) // a wednesday
+	}
+	cases := map[string]bool{
+		`localHostOrDomainIs("www", "www.example.com")`:             true,
+		`localHostOrDomainIs("www.example.com", "www.example.com")`: true,
+		`localHostOrDomainIs("www.other.com", "www.example.com")`:   false,
+		`isResolvable("intranet.example.com")`:                      true,
+		`isResolvable("unknown.example.com")`:                       false,
+		`dnsResolve("intranet.example.com") == "10.1.1.1"`:          true,
+		`dnsResolve("unknown.example.com") === null`:                true,
+		`isInNet("192.168.1.20", "192.168.1.0", "255.255.255.0")`:   true,
+		`isInNet("192.168.2.20", "192.168.1.0", "255.255.255.0")`:   false,
+		`dnsDomainLevels("www.example.com") == 2`:                   true,
+		`shExpMatch("www.example.com", "*.example.*")`:              true,
+		`shExpMatch("example.org", "*.example.*")`:                  false,
+		`typeof myIpAddress() == "string"`:                          true,
+		`weekdayRange("WED")`:                                       true,
+		`weekdayRange("MON", "FRI")`:                                true,
+		`weekdayRange("THU", "TUE")`:                                false,
+		`weekdayRange("FRI", "WED")`:                                true,
+		`timeRange(14)`:                                             true,
+		`timeRange(9, 14)`:                                          false,
+		`timeRange(14, 30, 15, 0)`:                                  true,
+		`timeRange(14, 31, 0, 15, 0, 0)`:                            false,
+		`timeRange(22, 15)`:                                         true,
+		`dateRange(12)`:                                             true,
+		`dateRange("JUN")`:                                          true,
+		`dateRange(2024)`:                                           true,
+		`dateRange(1, 15)`:                                          true,
+		`dateRange(13, 31)`:                                         false,
+		`dateRange("MAY", "JUL")`:                                   true,
+		`dateRange("JUL", "DEC")`:                                   false,
+		`dateRange(1, "JUN", 12, "JUN")`:                            true,
+		`dateRange(1, "JUN", 2023, 11, "JUN", 2024)`:                false,
+		`dateRange(2020, 2024)`:                                     true,
+	}
+	rt := <-pac.runtimes
+	for expr, want := range cases {
+		v, err := rt.vm.RunString(expr)
+		if err != nil {
+			t.Errorf("%v: %v", expr, err)
+			continue
+		}
+		if got := v.ToBoolean(); got != want {
+			t.Errorf("%v = %v, want %v", expr, got, want)
+		}
+	}
+}
+
+func TestParsePacResult(t *testing.T) {
+	cases := []struct {
+		result string
+		want   string // "" for DIRECT
+		err    bool
+	}{
+		{"DIRECT", "", false},
+		{"PROXY a:3128; DIRECT", "http://a:3128", false},
+		{"HTTPS a:443", "https://a:443", false},
+		{"SOCKS a:1080", "socks5://a:1080", false},
+		{"QUIC a:443; PROXY b:3128", "http://b:3128", false},
+		{" ; direct", "", false},
+		{"PROXY", "", true},
+		{"", "", true},
+	}
+	for _, c := range cases {
+		got, err := parsePacResult(c.result)
+		if c.err {
+			if err == nil {
+				t.Errorf("%q: want error", c.result)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%q: %v", c.result, err)
+			continue
+		}
+		if c.want == "" && got != nil || c.want != "" && (got == nil || got.String() != c.want) {
+			t.Errorf("%q: want %q, got %v", c.result, c.want, got)
+		}
+	}
+}
+
+func TestUpstreamPac(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/proxy.pac" {
+			w.WriteHeader(404)
+			return
+		}
+		w.Header().Set("Content-Type", "application/x-ns-proxy-autoconfig")
+		fmt.Fprint(w, testPac)
+	}))
+	defer server.Close()
+
+	filename := filepath.Join(t.TempDir(), "proxy.pac")
+	if err := os.WriteFile(filename, []byte(testPac), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, location := range []string{filename, server.URL + "/proxy.pac"} {
+		p, err := NewProxy(&Options{
+			Addr:          ":0",
+			Upstream:      "http://unused:3128",
+			UpstreamRules: []*UpstreamRule{{Hosts: []string{"*.rule.example.com"}, Upstream: "http://rule:3128"}},
+			UpstreamPac:   location,
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		cases := []struct {
+			req  *http.Request
+			want string // "" for DIRECT
+		}{
+			{&http.Request{Method: "CONNECT", Host: "a.rule.example.com:443"}, "http://rule:3128"},
+			{&http.Request{Method: "CONNECT", Host: "git.corp.example.com:443"}, "http://corp:3128"},
+			{&http.Request{Method: "CONNECT", Host: "10.0.0.1:443"}, ""},
+			{&http.Request{Method: "GET", Host: "example.com", URL: &url.URL{Scheme: "http", Host: "example.com", Path: "/api/x"}}, "socks5://socks:1080"},
+			{&http.Request{Method: "CONNECT", Host: "example.com:443"}, "https://secure:443"},
+			{&http.Request{Method: "GET", Host: "example.com", URL: &url.URL{Scheme: "http", Host: "example.com", Path: "/"}}, "http://default:3128"},
+		}
+		for _, c := range cases {
+			got, err := p.getUpstreamProxyUrl(c.req)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if c.want == "" && got != nil || c.want != "" && (got == nil || got.String() != c.want) {
+				t.Errorf("%v %v: want %q, got %v", location, c.req.Host, c.want, got)
+			}
+		}
+	}
+
+	if _, err := NewProxy(&Options{Addr: ":0", UpstreamPac: server.URL + "/missing.pac"}); err == nil {
+		t.Error("want error for missing pac")
+	}
+	if _, err := NewProxy(&Options{Addr: ":0", UpstreamPac: filepath.Join(t.TempDir(), "missing.pac")}); err == nil {
+		t.Error("want error for missing pac file")
+	}
+}
+
+func TestUpstreamPac_ErrorFallsBack(t *testing.T) {
+	filename := filepath.Join(t.TempDir(), "proxy.pac")
+	if err := os.WriteFile(filename, []byte(`function FindProxyForURL(url, host) { return "QUIC a:443"; }`), 0644); err != nil {
+		t.Fatal(err)
+	}
+	p, err := NewProxy(&Options{Addr: ":0", Upstream: "http://fallback:3128", UpstreamPac: filename})
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, err := p.getUpstreamProxyUrl(&http.Request{Method: "CONNECT", Host: "example.com:443"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got == nil || got.String() != "http://fallback:3128" {
+		t.Errorf("want fallback upstream, got %v", got)
+	}
+}
@@ -0,0 +1,492 @@
+package proxy
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptrace"
+	"net/url"
+	"sync"
+	"time"
+
+	utls "github.com/refraction-networking/utls"
+	"github.com/retutils/gomitmproxy/internal/helper"
+	"go.uber.org/atomic"
+)
+
+const (
+	defaultConnPoolIdleTimeout = 90 * time.Second
+	defaultConnPoolMaxIdle     = 16 // idle connections kept per key when ConnPoolMaxPerHost is not set
+)
+
+// ConnPoolStats counts how requests sent through the shared upstream connection pool got their connection
+type ConnPoolStats struct {
+	Hits   uint64 `json:"hits"`   // an open connection was reused
+	Misses uint64 `json:"misses"` // a new connection was dialed
+}
+
+// upstream connections are only shared between requests of the same key
+type connPoolKey struct {
+	address     string           // host:port
+	fingerprint string           // Options.TlsFingerprint, "" for crypto/tls
+	sni         string           // "" for plain http
+	upstream    string           // upstream proxy url, "" for direct connections
+	clientCert  *tls.Certificate // presented when the server requests a client certificate
+}
+
+// transport of a key, dropped once it was not used for connPool.idleTimeout
+type connPoolTransportEntry struct {
+	transport *http.Transport
+	active    int       // round trips whose response body is not closed yet
+	lastUsed  time.Time // when the last round trip ended
+	evict     *time.Timer
+
+	dialTimings map[net.Conn]*ConnTiming // timing of the dialed connections, until a round trip gets them
+}
+
+// connPool shares upstream connections across client connections,
+// the connections of a key are managed by its own http.Transport
+type connPool struct {
+	proxy       *Proxy
+	idleTimeout time.Duration
+	maxPerHost  int
+
+	mu          sync.Mutex
+	transports  map[connPoolKey]*connPoolTransportEntry
+	clientCerts map[connPoolKey]*x509.Certificate // client certificate presented by the connections of a key
+	seeds       map[connPoolKey][]*connPoolSeed   // adopted connections, taken by the next dials of their key
+	closed      bool                              // set by close, the transports released after it close their idle connections
+
+	hits   atomic.Uint64
+	misses atomic.Uint64
+}
+
+func newConnPool(proxy *Proxy) *connPool {
+	idleTimeout := proxy.Opts.ConnPoolIdleTimeout
+	if idleTimeout <= 0 {
+		idleTimeout = defaultConnPoolIdleTimeout
+	}
+	return &connPool{
+		proxy:       proxy,
+		idleTimeout: idleTimeout,
+		maxPerHost:  proxy.Opts.ConnPoolMaxPerHost,
+		transports:  make(map[connPoolKey]*connPoolTransportEntry),
+		clientCerts: make(map[connPoolKey]*x509.Certificate),
+		seeds:       make(map[connPoolKey][]*connPoolSeed),
+	}
+}
+
+// an adopted connection, closed by expire if no dial of its key took it within idleTimeout
+type connPoolSeed struct {
+	conn   net.Conn
+	expire *time.Timer
+}
+
+// close the idle connections of the pool and the adopted connections not taken, and stop their timers.
+// The connections of the round trips in flight are closed once they are released.
+func (p *connPool) close() {
+	p.mu.Lock()
+	p.closed = true
+	entries := make([]*connPoolTransportEntry, 0, len(p.transports))
+	for _, entry := range p.transports {
+		if entry.evict != nil {
+			entry.evict.Stop()
+		}
+		entries = append(entries, entry)
+	}
+	var seeds []*connPoolSeed
+	for _, s := range p.seeds {
+		seeds = append(seeds, s...)
+	}
+	p.transports = make(map[connPoolKey]*connPoolTransportEntry)
+	p.seeds = make(map[connPoolKey][]*connPoolSeed)
+	p.clientCerts = make(map[connPoolKey]*x509.Certificate)
+	p.mu.Unlock()
+
+	for _, entry := range entries {
+		entry.transport.CloseIdleConnections()
+	}
+	for _, seed := range seeds {
+		seed.expire.Stop()
+		seed.conn.Close()
+	}
+}
+
+func (p *connPool) stats() ConnPoolStats {
+	return ConnPoolStats{
+		Hits:   p.hits.Load(),
+		Misses: p.misses.Load(),
+	}
+}
+
+// key of a request, sni is the server name sent by the client, the request host if empty
+func (p *connPool) key(req *http.Request, sni string) (connPoolKey, error) {
+	// the upstream proxy is chosen by the request received by proxy.server, as for dedicated connections
+	proxyReq := req
+	if r, ok := req.Context().Value(proxyReqCtxKey).(*http.Request); ok {
+		proxyReq = r
+	}
+	proxyUrl, err := p.proxy.getUpstreamProxyUrl(proxyReq)
+	if err != nil {
+		return connPoolKey{}, err
+	}
+
+	var peer *x509.Certificate
+	if connCtx, ok := req.Context().Value(connContextKey).(*ConnContext); ok {
+		peer = connCtx.ClientConn.peerCertificate()
+	}
+	return p.newKey(helper.CanonicalAddr(req.URL), req.URL.Scheme == "https", sni, proxyUrl, peer), nil
+}
+
+// key of a connection to address through upstream, sni is the host of address if empty
+func (p *connPool) newKey(address string, isTls bool, sni string, upstream *url.URL, peer *x509.Certificate) connPoolKey {
+	key := connPoolKey{address: address}
+	if upstream != nil {
+		key.upstream = upstream.String()
+	}
+	if isTls {
+		key.fingerprint = p.proxy.Opts.TlsFingerprint
+		key.sni = sni
+		if key.sni == "" {
+			key.sni, _, _ = net.SplitHostPort(address)
+		}
+		key.clientCert = p.proxy.clientCertFor(key.address, key.sni, peer)
+	}
+	return key
+}
+
+// acquire the transport of key for a round trip, which is released by release
+func (p *connPool) acquire(key connPoolKey) *connPoolTransportEntry {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	entry, ok := p.transports[key]
+	if !ok {
+		entry = &connPoolTransportEntry{dialTimings: make(map[net.Conn]*ConnTiming)}
+		entry.transport = p.newTransport(key, entry)
+		p.transports[key] = entry
+	}
+	entry.active++
+	return entry
+}
+
+// release the transport of key after a round trip, it is dropped when not acquired again within idleTimeout
+func (p *connPool) release(key connPoolKey, entry *connPoolTransportEntry) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	entry.active--
+	entry.lastUsed = time.Now()
+	if entry.active > 0 {
+		return
+	}
+	if p.closed {
+		go entry.transport.CloseIdleConnections() // the connection goes idle once the body is closed
+		return
+	}
+	if entry.evict == nil {
+		entry.evict = time.AfterFunc(p.idleTimeout, func() { p.evict(key, entry) })
+	} else {
+		entry.evict.Reset(p.idleTimeout)
+	}
+}
+
+// evict the transport of key if it was not used for idleTimeout, its idle connections are closed
+func (p *connPool) evict(key connPoolKey, entry *connPoolTransportEntry) {
+	p.mu.Lock()
+	if entry.active > 0 || time.Since(entry.lastUsed) < p.idleTimeout || p.transports[key] != entry {
+		p.mu.Unlock()
+		return
+	}
+	delete(p.transports, key)
+	if len(p.seeds[key]) == 0 {
+		delete(p.clientCerts, key)
+	}
+	p.mu.Unlock()
+	entry.transport.CloseIdleConnections()
+}
+
+// dials of the transport may be shared by the requests of several client connections,
+// so they are timed on their own, instead of on the client connection the request is for
+func (p *connPool) newTransport(key connPoolKey, entry *connPoolTransportEntry) *http.Transport {
+	maxIdle := p.maxPerHost
+	if maxIdle <= 0 {
+		maxIdle = defaultConnPoolMaxIdle
+	}
+	return &http.Transport{
+		DialContext: func(ctx context.Context, network, addr string) (net.Conn, error) {
+			timing := new(ConnTiming)
+			conn, err := p.dial(context.WithValue(ctx, connTimingCtxKey, timing), key)
+			p.dialed(entry, conn, timing)
+			return conn, err
+		},
+		DialTLSContext: func(ctx context.Context, network, addr string) (net.Conn, error) {
+			timing := new(ConnTiming)
+			conn, err := p.dialTls(context.WithValue(ctx, connTimingCtxKey, timing), key)
+			p.dialed(entry, conn, timing)
+			return conn, err
+		},
+		ForceAttemptHTTP2:   true,
+		DisableCompression:  true, // To get the original response from the server, set Transport.DisableCompression to true.
+		IdleConnTimeout:     p.idleTimeout,
+		MaxIdleConnsPerHost: maxIdle,
+		MaxConnsPerHost:     p.maxPerHost,
+	}
+}
+
+// dialed keeps the timing of conn until a round trip gets it, an adopted connection taken by the dial has none
+func (p *connPool) dialed(entry *connPoolTransportEntry, conn net.Conn, timing *ConnTiming) {
+	if conn == nil || *timing == (ConnTiming{}) {
+		return
+	}
+	p.mu.Lock()
+	entry.dialTimings[conn] = timing
+	p.mu.Unlock()
+}
+
+// takeDialTiming returns the timing of conn if it was not taken yet
+func (p *connPool) takeDialTiming(entry *connPoolTransportEntry, conn net.Conn) *ConnTiming {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	timing := entry.dialTimings[conn]
+	delete(entry.dialTimings, conn)
+	return timing
+}
+
+func (p *connPool) dial(ctx context.Context, key connPoolKey) (net.Conn, error) {
+	var proxyUrl *url.URL
+	if key.upstream != "" {
+		var err error
+		if proxyUrl, err = url.Parse(key.upstream); err != nil {
+			return nil, err
+		}
+	}
+	return p.proxy.dialUpstream(ctx, proxyUrl, key.address)
+}
+
+func (p *connPool) dialTls(ctx context.Context, key connPoolKey) (net.Conn, error) {
+	if conn := p.takeSeed(key, nil); conn != nil {
+		return conn, nil
+	}
+
+	conn, err := p.dial(ctx, key)
+	if err != nil {
+		return nil, err
+	}
+
+	timing := connTimingFromContext(ctx)
+	timing.ServerTlsStart = time.Now()
+	defer func() {
+		timing.ServerTlsDone = time.Now()
+	}()
+
+	opts := p.proxy.Opts
+	clientCertUsed := func(cert *x509.Certificate) {
+		p.mu.Lock()
+		p.clientCerts[key] = cert
+		p.mu.Unlock()
+	}
+	if key.fingerprint != "" {
+		// the hello of the client which opened the connection, when mirrored
+		clientHello := &tls.ClientHelloInfo{ServerName: key.sni}
+		if connCtx, ok := ctx.Value(connContextKey).(*ConnContext); ok && connCtx.ClientConn.clientHello != nil {
+			clientHello = connCtx.ClientConn.clientHello
+		}
+		// http.Transport only speaks http/2 over a *tls.Conn
+		uConn, err := newUtlsConnAlpn(conn, opts, clientHello, getUtlsClientCertificate(key.clientCert, clientCertUsed), []string{"http/1.1"})
+		if err != nil {
+			conn.Close()
+			return nil, err
+		}
+		if err := uConn.HandshakeContext(ctx); err != nil {
+			conn.Close()
+			return nil, err
+		}
+		return uConn, nil
+	}
+
+	tlsConn := tls.Client(conn, &tls.Config{
+		InsecureSkipVerify:   opts.SslInsecure,
+		KeyLogWriter:         helper.GetTlsKeyLogWriter(),
+		ServerName:           key.sni,
+		NextProtos:           []string{"h2", "http/1.1"},
+		GetClientCertificate: getClientCertificate(key.clientCert, clientCertUsed),
+	})
+	if err := tlsConn.HandshakeContext(ctx); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return tlsConn, nil
+}
+
+// connPoolTransport sends requests through the pooled transport of their key
+type connPoolTransport struct {
+	pool       *connPool
+	sni        string
+	serverConn *ServerConn // nil for attacker.client
+}
+
+func (t *connPoolTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	key, err := t.pool.key(req, t.sni)
+	if err != nil {
+		return nil, err
+	}
+	entry := t.pool.acquire(key)
+	ctx := httptrace.WithClientTrace(req.Context(), &httptrace.ClientTrace{
+		GotConn: func(info httptrace.GotConnInfo) {
+			if info.Reused {
+				t.pool.hits.Add(1)
+			} else {
+				t.pool.misses.Add(1)
+			}
+			if f, ok := req.Context().Value(flowCtxKey).(*Flow); ok {
+				f.ConnPoolHit = info.Reused
+				if timing := t.pool.takeDialTiming(entry, info.Conn); timing != nil {
+					f.setDialTiming(timing)
+				}
+				if upstream := connUpstream(info.Conn); upstream != nil {
+					f.Metadata["upstream"] = upstream.Redacted()
+				}
+			}
+			if connCtx, ok := req.Context().Value(connContextKey).(*ConnContext); ok && t.serverConn != nil {
+				t.pool.attach(connCtx, t.serverConn, key, info.Conn)
+			}
+		},
+	})
+	resp, err := entry.transport.RoundTrip(req.WithContext(ctx))
+	if err != nil {
+		t.pool.release(key, entry)
+		return nil, err
+	}
+	resp.Body = &connPoolBody{ReadCloser: resp.Body, release: func() { t.pool.release(key, entry) }}
+	return resp, nil
+}
+
+// connPoolBody releases the transport of its round trip once closed
+type connPoolBody struct {
+	io.ReadCloser
+	once    sync.Once
+	release func()
+}
+
+func (b *connPoolBody) Close() error {
+	err := b.ReadCloser.Close()
+	b.once.Do(b.release)
+	return err
+}
+
+// attach a pooled connection to the client connection which first sends a request over it,
+// concurrent requests of the client connection may get their connection at the same time
+func (p *connPool) attach(connCtx *ConnContext, serverConn *ServerConn, key connPoolKey, conn net.Conn) {
+	serverConn.mu.Lock()
+	if serverConn.Conn != nil {
+		serverConn.mu.Unlock()
+		return
+	}
+	serverConn.Conn = conn
+	serverConn.Upstream = connUpstream(conn)
+	p.mu.Lock()
+	serverConn.ClientCert = p.clientCerts[key]
+	p.mu.Unlock()
+	switch c := conn.(type) {
+	case *tls.Conn:
+		state := c.ConnectionState()
+		serverConn.tlsState = &state
+	case *utls.UConn:
+		serverConn.tlsState = UtlsStateToTlsState(c.ConnectionState())
+	}
+	tlsState := serverConn.tlsState
+	serverConn.mu.Unlock()
+
+	for _, addon := range p.proxy.addons() {
+		addon.ServerConnected(connCtx)
+	}
+	if tlsState != nil {
+		for _, addon := range p.proxy.addons() {
+			addon.TlsEstablishedServer(connCtx)
+		}
+	}
+}
+
+// adopt the server connection a client connection dialed before its first request, with ClientConn.UpstreamCert,
+// its requests are then sent through the pool, whose next dial of the key takes the connection
+func (p *connPool) adopt(connCtx *ConnContext) {
+	serverConn := connCtx.ServerConn
+	// http.Transport only speaks http/2 over a *tls.Conn, such utls connections stay dedicated
+	if _, ok := serverConn.tlsConn.(*utls.UConn); ok && serverConn.tlsState.NegotiatedProtocol == "h2" {
+		return
+	}
+	sni := connCtx.ClientConn.clientHello.ServerName
+	key := p.newKey(serverConn.Address, true, sni, serverConn.Upstream, connCtx.ClientConn.peerCertificate())
+	if c, ok := serverConn.Conn.(*wrapServerConn); ok {
+		c.release()
+	}
+
+	conn := serverConn.tlsConn
+	p.mu.Lock()
+	if p.closed {
+		p.mu.Unlock()
+		conn.Close()
+		return
+	}
+	// not taken if the requests found an idle connection of the key
+	seed := &connPoolSeed{conn: conn}
+	seed.expire = time.AfterFunc(p.idleTimeout, func() {
+		if p.takeSeed(key, conn) != nil {
+			conn.Close()
+		}
+		p.mu.Lock()
+		if _, ok := p.transports[key]; !ok && len(p.seeds[key]) == 0 {
+			delete(p.clientCerts, key)
+		}
+		p.mu.Unlock()
+	})
+	p.seeds[key] = append(p.seeds[key], seed)
+	if serverConn.ClientCert != nil {
+		p.clientCerts[key] = serverConn.ClientCert
+	}
+	p.mu.Unlock()
+
+	serverConn.pooled = true
+	serverConn.client = p.newClient(serverConn, sni)
+}
+
+// take an adopted connection of key, any if conn is nil
+func (p *connPool) takeSeed(key connPoolKey, conn net.Conn) net.Conn {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	seeds := p.seeds[key]
+	for i, s := range seeds {
+		if conn != nil && s.conn != conn {
+			continue
+		}
+		if len(seeds) == 1 {
+			delete(p.seeds, key)
+		} else {
+			p.seeds[key] = append(seeds[:i:i], seeds[i+1:]...)
+		}
+		s.expire.Stop()
+		return s.conn
+	}
+	return nil
+}
+
+// server connection of a client connection whose requests are sent through the pool
+func (p *connPool) newServerConn(address string, sni string) *ServerConn {
+	serverConn := newServerConn()
+	serverConn.Address = address
+	serverConn.pooled = true
+	serverConn.client = p.newClient(serverConn, sni)
+	return serverConn
+}
+
+func (p *connPool) newClient(serverConn *ServerConn, sni string) *http.Client {
+	return &http.Client{
+		Transport: &connPoolTransport{pool: p, sni: sni, serverConn: serverConn},
+		CheckRedirect: func(req *http.Request, via []*http.Request) error {
+			// 禁止自动重定向
+			return http.ErrUseLastResponse
+		},
+	}
+}
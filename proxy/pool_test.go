@@ -0,0 +1,352 @@
+package proxy
+
+import (
+	"io"
+	"net/http"
+	"sync"
+	"testing"
+	"time"
+)
+
+type connPoolRecorderAddon struct {
+	BaseAddon
+	hits      chan bool
+	connected chan string
+}
+
+func (a *connPoolRecorderAddon) ClientConnected(client *ClientConn) {
+	// dial lazily, so requests draw from the pool
+	client.UpstreamCert = false
+}
+
+func (a *connPoolRecorderAddon) ServerConnected(connCtx *ConnContext) {
+	a.connected <- connCtx.ServerConn.Conn.LocalAddr().String()
+}
+
+func (a *connPoolRecorderAddon) Response(f *Flow) {
+	a.hits <- f.ConnPoolHit
+}
+
+func TestConnPool(t *testing.T) {
+	helper := &testProxyHelper{
+		server: &http.Server{
+			Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				w.Write([]byte(r.RemoteAddr))
+			}),
+		},
+		proxyAddr: ":29091",
+	}
+	helper.init(t)
+	helper.server.TLSConfig.NextProtos = []string{"h2", "http/1.1"}
+	testProxy := helper.testProxy
+	testProxy.Opts.ConnPool = true
+	testProxy.connPool = newConnPool(testProxy)
+	addon := &connPoolRecorderAddon{hits: make(chan bool, 4), connected: make(chan string, 4)}
+	testProxy.AddAddon(addon)
+	defer helper.ln.Close()
+	go helper.server.Serve(helper.ln)
+	defer helper.tlsPlainLn.Close()
+	go helper.server.ServeTLS(helper.tlsPlainLn, "", "")
+	go testProxy.Start()
+	time.Sleep(time.Millisecond * 10) // wait for test proxy startup
+
+	for _, tc := range []struct {
+		name     string
+		endpoint string
+	}{
+		{"http", helper.httpEndpoint},
+		{"https", helper.httpsEndpoint},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			before := testProxy.ConnPoolStats()
+
+			// each client opens its own connection to the proxy
+			upstreamAddrs := make([]string, 0)
+			for i := 0; i < 2; i++ {
+				client := helper.getProxyClient()
+				resp, err := client.Get(tc.endpoint)
+				if err != nil {
+					t.Fatal(err)
+				}
+				body, _ := io.ReadAll(resp.Body)
+				resp.Body.Close()
+				client.CloseIdleConnections()
+				upstreamAddrs = append(upstreamAddrs, string(body))
+
+				if hit := <-addon.hits; hit != (i == 1) {
+					t.Errorf("request %d: unexpected pool hit %v", i, hit)
+				}
+				select {
+				case local := <-addon.connected:
+					if local != string(body) {
+						t.Errorf("ServerConnected with %v, server saw %v", local, string(body))
+					}
+				case <-time.After(time.Second):
+					t.Fatal("ServerConnected not fired")
+				}
+			}
+
+			if upstreamAddrs[0] != upstreamAddrs[1] {
+				t.Errorf("upstream connection not reused: %v", upstreamAddrs)
+			}
+			stats := testProxy.ConnPoolStats()
+			if stats.Hits-before.Hits != 1 || stats.Misses-before.Misses != 1 {
+				t.Errorf("unexpected stats %+v, before %+v", stats, before)
+			}
+		})
+	}
+}
+
+type connPoolDialFirstAddon struct {
+	BaseAddon
+	hits      chan bool
+	connected chan string
+}
+
+func (a *connPoolDialFirstAddon) ServerConnected(connCtx *ConnContext) {
+	a.connected <- connCtx.ServerConn.Conn.LocalAddr().String()
+}
+
+func (a *connPoolDialFirstAddon) Response(f *Flow) {
+	a.hits <- f.ConnPoolHit
+}
+
+func TestConnPool_DialFirst(t *testing.T) {
+	helper := &testProxyHelper{
+		server: &http.Server{
+			Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				w.Write([]byte(r.RemoteAddr))
+			}),
+		},
+		proxyAddr: ":29103",
+	}
+	helper.init(t)
+	helper.server.TLSConfig.NextProtos = []string{"h2", "http/1.1"}
+	testProxy := helper.testProxy
+	testProxy.Opts.ConnPool = true
+	testProxy.connPool = newConnPool(testProxy)
+	testProxy.connPool.idleTimeout = time.Millisecond * 200
+	addon := &connPoolDialFirstAddon{hits: make(chan bool, 4), connected: make(chan string, 4)}
+	testProxy.AddAddon(addon)
+	defer helper.tlsPlainLn.Close()
+	go helper.server.ServeTLS(helper.tlsPlainLn, "", "")
+	go testProxy.Start()
+	time.Sleep(time.Millisecond * 10) // wait for test proxy startup
+
+	// the upstream connection is dialed on connect, then handed to the pool
+	upstreamAddrs := make([]string, 0)
+	for i := 0; i < 2; i++ {
+		client := helper.getProxyClient()
+		resp, err := client.Get(helper.httpsEndpoint)
+		if err != nil {
+			t.Fatal(err)
+		}
+		body, _ := io.ReadAll(resp.Body)
+		resp.Body.Close()
+		client.CloseIdleConnections()
+		upstreamAddrs = append(upstreamAddrs, string(body))
+
+		if hit := <-addon.hits; hit != (i == 1) {
+			t.Errorf("request %d: unexpected pool hit %v", i, hit)
+		}
+		select {
+		case <-addon.connected:
+		case <-time.After(time.Second):
+			t.Fatal("ServerConnected not fired")
+		}
+	}
+
+	if upstreamAddrs[0] != upstreamAddrs[1] {
+		t.Errorf("upstream connection not reused: %v", upstreamAddrs)
+	}
+	stats := testProxy.ConnPoolStats()
+	if stats.Hits != 1 || stats.Misses != 1 {
+		t.Errorf("unexpected stats %+v", stats)
+	}
+
+	// the connection dialed for the second client was not needed
+	time.Sleep(time.Millisecond * 300)
+	testProxy.connPool.mu.Lock()
+	seeds := len(testProxy.connPool.seeds)
+	testProxy.connPool.mu.Unlock()
+	if seeds != 0 {
+		t.Errorf("%d keys still have adopted connections", seeds)
+	}
+
+	// the requests of a http/2 client connection get their pooled connections concurrently
+	t.Run("concurrent", func(t *testing.T) {
+		client := helper.getProxyClient()
+		client.Transport.(*http.Transport).ForceAttemptHTTP2 = true
+		defer client.CloseIdleConnections()
+		var wg sync.WaitGroup
+		done := make(chan struct{})
+		for i := 0; i < 8; i++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				resp, err := client.Get(helper.httpsEndpoint)
+				if err != nil {
+					t.Error(err)
+					return
+				}
+				if resp.ProtoMajor != 2 {
+					t.Errorf("unexpected proto %v", resp.Proto)
+				}
+				io.ReadAll(resp.Body)
+				resp.Body.Close()
+			}()
+		}
+		go func() {
+			wg.Wait()
+			close(done)
+		}()
+		for hits := 0; hits < 8; {
+			select {
+			case <-addon.hits:
+				hits++
+			case <-addon.connected:
+			}
+		}
+		<-done
+	})
+}
+
+func TestConnPool_H2(t *testing.T) {
+	helper := &testProxyHelper{
+		server: &http.Server{
+			Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				w.Write([]byte(r.RemoteAddr))
+			}),
+		},
+	}
+	helper.init(t)
+	helper.server.TLSConfig.NextProtos = []string{"h2", "http/1.1"}
+	testProxy := helper.testProxy
+	testProxy.Opts.ConnPool = true
+	testProxy.connPool = newConnPool(testProxy)
+	defer helper.tlsPlainLn.Close()
+	go helper.server.ServeTLS(helper.tlsPlainLn, "", "")
+
+	h1Client := serveTestProxy(t, testProxy)
+	h2Transport := h1Client.Transport.(*http.Transport).Clone()
+	h2Transport.ForceAttemptHTTP2 = true
+	h2Client := &http.Client{Transport: h2Transport}
+	defer h1Client.CloseIdleConnections()
+	defer h2Client.CloseIdleConnections()
+
+	get := func(client *http.Client, proto int) string {
+		t.Helper()
+		resp, err := client.Get(helper.httpsEndpoint)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+		if resp.ProtoMajor != proto {
+			t.Errorf("unexpected proto %v", resp.Proto)
+		}
+		body, err := io.ReadAll(resp.Body)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return string(body)
+	}
+
+	// the http/2 client keeps its client connection, whose upstream connection is pooled,
+	// the other client then shares it instead of framing requests over it through a transport of its own
+	first := get(h2Client, 2)
+	if shared := get(h1Client, 1); shared != first {
+		t.Errorf("upstream connection not shared: %v, %v", first, shared)
+	}
+	if again := get(h2Client, 2); again != first {
+		t.Errorf("upstream connection not reused: %v, %v", first, again)
+	}
+}
+
+func TestConnPool_Fingerprint(t *testing.T) {
+	helper := &testProxyHelper{
+		server: &http.Server{
+			Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				w.Write([]byte(r.Proto))
+			}),
+		},
+	}
+	helper.init(t)
+	// the server picks h2 whenever the fingerprint offers it
+	helper.server.TLSConfig.NextProtos = []string{"h2", "http/1.1"}
+	defer helper.tlsPlainLn.Close()
+	go helper.server.ServeTLS(helper.tlsPlainLn, "", "")
+
+	for _, tc := range []struct {
+		name      string
+		dialFirst bool
+		h2        bool
+		wantProto string
+	}{
+		{"lazy", false, false, "HTTP/1.1"},
+		{"dial first", true, true, "HTTP/2.0"},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			testProxy, err := NewProxy(&Options{SslInsecure: true, TlsFingerprint: "chrome", ConnPool: true})
+			handleError(t, err)
+			if !tc.dialFirst {
+				testProxy.AddAddon(&connPoolRecorderAddon{hits: make(chan bool, 4), connected: make(chan string, 4)})
+			}
+			client := serveTestProxy(t, testProxy)
+			client.Transport.(*http.Transport).ForceAttemptHTTP2 = tc.h2
+			defer client.CloseIdleConnections()
+
+			for i := 0; i < 2; i++ {
+				resp, err := client.Get(helper.httpsEndpoint)
+				if err != nil {
+					t.Fatal(err)
+				}
+				body, _ := io.ReadAll(resp.Body)
+				resp.Body.Close()
+				if string(body) != tc.wantProto {
+					t.Errorf("request %d: server saw %v, want %v", i, string(body), tc.wantProto)
+				}
+			}
+		})
+	}
+}
+
+func TestConnPool_EvictTransport(t *testing.T) {
+	helper := &testProxyHelper{
+		server: &http.Server{
+			Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				w.Write([]byte("ok"))
+			}),
+		},
+	}
+	helper.init(t)
+	defer helper.ln.Close()
+	go helper.server.Serve(helper.ln)
+	testProxy := helper.testProxy
+	testProxy.Opts.ConnPool = true
+	testProxy.connPool = newConnPool(testProxy)
+	testProxy.connPool.idleTimeout = time.Millisecond * 100
+	client := serveTestProxy(t, testProxy)
+	defer client.CloseIdleConnections()
+
+	transports := func() int {
+		testProxy.connPool.mu.Lock()
+		defer testProxy.connPool.mu.Unlock()
+		return len(testProxy.connPool.transports)
+	}
+
+	resp, err := client.Get(helper.httpEndpoint)
+	if err != nil {
+		t.Fatal(err)
+	}
+	io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if n := transports(); n != 1 {
+		t.Fatalf("%d transports after the request, want 1", n)
+	}
+
+	// the transport of a key no request used within the idle timeout is dropped
+	time.Sleep(time.Millisecond * 300)
+	if n := transports(); n != 0 {
+		t.Errorf("%d transports left after the idle timeout", n)
+	}
+}
@@ -7,11 +7,14 @@ import (
 	"net"
 	"net/http"
 	"net/url"
+	"sync"
+	"time"
 
 	"github.com/projectdiscovery/fastdialer/fastdialer"
 	"github.com/retutils/gomitmproxy/cert"
 	"github.com/retutils/gomitmproxy/internal/helper"
 	log "github.com/sirupsen/logrus"
+	"go.uber.org/atomic"
 )
 
 type Options struct {
@@ -27,23 +30,65 @@ type Options struct {
 	FingerprintSave   string // Save decoding client hello to file
 	DnsResolvers      []string
 	DnsRetries        int
+	Reverse           []string // Reverse proxy mode: backend urls that origin-form requests are forwarded to
+	ReverseTls        bool     // Reverse proxy mode: terminate TLS on the listener with certificates from the CA
+	GrpcDescriptors   []string // FileDescriptorSet files used to decode grpc messages
+
+	ConnPool            bool          // share upstream connections across client connections, keyed by address, TLS fingerprint and SNI
+	ConnPoolIdleTimeout time.Duration // close pooled connections idle for longer, default: 90s
+	ConnPoolMaxPerHost  int           // max connections per key, 0 for no limit
+
+	UpstreamRules []*UpstreamRule // choose the upstream proxy by host, ip and scheme, the first matching rule wins
+	UpstreamPac   string          // proxy auto-config file path or url, used for requests no UpstreamRules match
+
+	UpstreamPool              []string      // upstream proxy urls requests are spread over, used instead of Upstream
+	UpstreamStrategy          string        // how UpstreamPool is chosen from: round-robin (default), random, sticky-conn, sticky-host or least-errors
+	UpstreamHealthCheck       time.Duration // interval of UpstreamPool health checks, 0 to disable
+	UpstreamHealthCheckTarget string        // host:port health checks connect to through each upstream, the upstream itself if empty
+
+	ClientCerts []*ClientCert // client certificates presented to upstream servers requesting one, the first matching the host is used
+	// request a certificate from downstream clients, kept in ClientConn.PeerCertificates.
+	// The ClientCerts entry holding its key is preferred upstream, when the upstream is dialed after the client handshake.
+	RequestClientCert bool
+
+	KillRst bool // Flow.Kill resets http/1 client connections with a TCP RST instead of closing them
+
+	AddonMaxFailures int // an addon is disabled once its hooks panicked this many times, 0 keeps failing addons enabled
 }
 
 type Proxy struct {
-	Opts    *Options
-	Version string
-	Addons  []Addon
+	Opts     *Options
+	Version  string
+	Registry *AddonRegistry // addons by name, AddAddon registers by type name
+	// Deprecated: use Registry, Addons only lists the addons added by AddAddon, enabled or not.
+	// Addons appended to it directly are registered when the proxy starts.
+	Addons []Addon
 
+	addonsMu        sync.Mutex
+	addonsAdded     int // Addons registered by AddAddon or Start
 	entry           *entry
 	attacker        *attacker
 	fastDialer      *fastdialer.Dialer
+	dnsTrace        *dnsTrace                                 // lookups of fastDialer
+	connPool        *connPool                                 // nil if Options.ConnPool is not set
+	upstreamRouter  *upstreamRouter                           // nil if neither Options.UpstreamRules nor Options.UpstreamPac is set
+	upstreamPool    *upstreamPool                             // nil if Options.UpstreamPool is not set
+	clientCerts     []*clientCert                             // loaded Options.ClientCerts
+	conns           *connTracker                              // client connections and flows, drained by Shutdown
+	grpc            *grpcDescriptors                          // loaded Options.GrpcDescriptors and LoadGrpcDescriptorSets
 	shouldIntercept func(req *http.Request) bool              // req is received by proxy.server
 	upstreamProxy   func(req *http.Request) (*url.URL, error) // req is received by proxy.server, not client request
 	authProxy       func(res http.ResponseWriter, req *http.Request) (bool, error)
+
+	reverseBackends []*url.URL
+	reverseNext     atomic.Uint32
 }
 
 // proxy.server req context key
-var proxyReqCtxKey = new(struct{})
+var proxyReqCtxKey = ctxKey("proxyReq")
+
+// flow of the request sent to the server, proxyReq context key
+var flowCtxKey = ctxKey("flow")
 
 func NewProxy(opts *Options) (*Proxy, error) {
 	if opts.StreamLargeBodies <= 0 {
@@ -51,9 +96,48 @@ func NewProxy(opts *Options) (*Proxy, error) {
 	}
 
 	proxy := &Proxy{
-		Opts:    opts,
-		Version: "1.8.8",
-		Addons:  make([]Addon, 0),
+		Opts:     opts,
+		Version:  "1.8.8",
+		Registry: newAddonRegistry(),
+		conns:    newConnTracker(),
+	}
+	proxy.Registry.SetMaxFailures(opts.AddonMaxFailures)
+
+	reverseBackends, err := parseReverseBackends(opts.Reverse)
+	if err != nil {
+		return nil, err
+	}
+	proxy.reverseBackends = reverseBackends
+
+	proxy.grpc = new(grpcDescriptors)
+	if err := proxy.LoadGrpcDescriptorSets(opts.GrpcDescriptors...); err != nil {
+		return nil, err
+	}
+
+	if opts.ConnPool {
+		proxy.connPool = newConnPool(proxy)
+	}
+
+	clientCerts, err := loadClientCerts(opts.ClientCerts)
+	if err != nil {
+		return nil, err
+	}
+	proxy.clientCerts = clientCerts
+
+	if len(opts.UpstreamRules) > 0 || opts.UpstreamPac != "" {
+		router, err := newUpstreamRouter(proxy)
+		if err != nil {
+			return nil, err
+		}
+		proxy.upstreamRouter = router
+	}
+
+	if len(opts.UpstreamPool) > 0 {
+		pool, err := newUpstreamPool(proxy)
+		if err != nil {
+			return nil, err
+		}
+		proxy.upstreamPool = pool
 	}
 
 	proxy.entry = newEntry(proxy)
@@ -71,6 +155,8 @@ func NewProxy(opts *Options) (*Proxy, error) {
 	// Note: fastdialer doesn't have a direct "retries" in its options that maps easily to Net.Dialer
 	// But it has MaxRetries for some cases or we handle it in getUpstreamConn.
 	
+	proxy.dnsTrace = newDnsTrace()
+	fdOpts.OnBeforeDial = proxy.dnsTrace.onBeforeDial
 	dialer, err := fastdialer.NewDialer(fdOpts)
 	if err != nil {
 		return nil, err
@@ -80,21 +166,74 @@ func NewProxy(opts *Options) (*Proxy, error) {
 	return proxy, nil
 }
 
+// AddAddon registers addon enabled after the addons added before it, named by its type, e.g. StorageAddon,
+// numbered if the name is taken, e.g. StorageAddon#2
 func (proxy *Proxy) AddAddon(addon Addon) {
+	proxy.addonsMu.Lock()
+	defer proxy.addonsMu.Unlock()
 	proxy.Addons = append(proxy.Addons, addon)
+	proxy.registerAppendedAddons()
+}
+
+// registerAppendedAddons registers the addons appended to Proxy.Addons since the last call, requires addonsMu
+func (proxy *Proxy) registerAppendedAddons() {
+	if proxy.Registry == nil {
+		proxy.Registry = newAddonRegistry()
+	}
+	if proxy.addonsAdded > len(proxy.Addons) {
+		proxy.addonsAdded = len(proxy.Addons) // the slice was cut, its addons stay registered
+	}
+	for _, addon := range proxy.Addons[proxy.addonsAdded:] {
+		proxy.Registry.add(addon)
+	}
+	proxy.addonsAdded = len(proxy.Addons)
+}
+
+// addons returns the enabled addons in the order they run, guarded against panics
+func (proxy *Proxy) addons() []Addon {
+	if proxy.Registry == nil {
+		return nil
+	}
+	return proxy.Registry.hooks()
 }
 
 func (proxy *Proxy) Start() error {
+	ln, err := proxy.entry.listen()
+	if err != nil {
+		return err
+	}
+	return proxy.serve(ln)
+}
+
+// serve the client connections accepted by ln
+func (proxy *Proxy) serve(ln net.Listener) error {
+	proxy.addonsMu.Lock()
+	proxy.registerAppendedAddons()
+	proxy.addonsMu.Unlock()
+	if proxy.upstreamPool != nil {
+		proxy.upstreamPool.start()
+	}
 	go func() {
-		if err := proxy.attacker.start(); err != nil {
+		if err := proxy.attacker.start(); err != nil && err != http.ErrServerClosed {
 			log.Error(err)
 		}
 	}()
-	return proxy.entry.start()
+	return proxy.entry.serve(ln)
 }
 
+// Close closes the proxy and its client connections right away, the flows in flight are cut
 func (proxy *Proxy) Close() error {
-	return proxy.entry.close()
+	if proxy.upstreamPool != nil {
+		proxy.upstreamPool.stop()
+	}
+	proxy.conns.stop()
+	err := proxy.entry.close()
+	proxy.attacker.close()
+	proxy.conns.closeConns()
+	if proxy.connPool != nil {
+		proxy.connPool.close()
+	}
+	return err
 }
 
 func (proxy *Proxy) Addr() string {
@@ -104,8 +243,48 @@ func (proxy *Proxy) Addr() string {
 	return ""
 }
 
+// Shutdown gracefully shuts down the proxy: it stops accepting connections and lets the flows in flight finish
+// until ctx is done. The flows left are killed, then the client connections left are closed, tunnels and relays
+// included, which fires ClientDisconnected and ServerDisconnected for each, and the pooled upstream connections
+// are closed. At last the addons implementing AddonFlusher are flushed. Shutdown returns ctx.Err() if flows had
+// to be cut.
 func (proxy *Proxy) Shutdown(ctx context.Context) error {
-	return proxy.entry.shutdown(ctx)
+	if proxy.upstreamPool != nil {
+		proxy.upstreamPool.stop()
+	}
+	proxy.conns.stop()
+
+	// the servers close their listeners and idle connections, http/2 connections are sent GOAWAY
+	errs := make(chan error, 2)
+	go func() { errs <- proxy.entry.shutdown(ctx) }()
+	go func() { errs <- proxy.attacker.shutdown(ctx) }()
+	err := proxy.conns.wait(ctx, false)
+	for i := 0; i < 2; i++ {
+		if serr := <-errs; err == nil {
+			err = serr
+		}
+	}
+
+	if err != nil {
+		log.Warnf("Proxy shutdown: %v, cutting the flows in flight", err)
+		proxy.conns.killFlows()
+	}
+	proxy.conns.closeConns()
+	// the flows and relays unwind once their connections are closed, before the addons are flushed
+	unwindCtx, cancel := context.WithTimeout(context.Background(), shutdownUnwindTimeout)
+	defer cancel()
+	if werr := proxy.conns.wait(unwindCtx, true); werr != nil {
+		log.Warnf("Proxy shutdown: flows or relays still running %v after their connections were closed", shutdownUnwindTimeout)
+	}
+	// the pooled upstream connections outlive the client connections which used them
+	if proxy.connPool != nil {
+		proxy.connPool.close()
+	}
+
+	if proxy.Registry != nil {
+		proxy.Registry.flush()
+	}
+	return err
 }
 
 func (proxy *Proxy) GetCertificate() x509.Certificate {
@@ -127,7 +306,11 @@ func (proxy *Proxy) SetUpstreamProxy(fn func(req *http.Request) (*url.URL, error
 func (proxy *Proxy) realUpstreamProxy() func(*http.Request) (*url.URL, error) {
 	return func(cReq *http.Request) (*url.URL, error) {
 		req := cReq.Context().Value(proxyReqCtxKey).(*http.Request)
-		return proxy.getUpstreamProxyUrl(req)
+		proxyUrl, err := proxy.getUpstreamProxyUrl(req)
+		if f, ok := cReq.Context().Value(flowCtxKey).(*Flow); ok && proxyUrl != nil {
+			f.Metadata["upstream"] = proxyUrl.Redacted()
+		}
+		return proxyUrl, err
 	}
 }
 
@@ -135,6 +318,17 @@ func (proxy *Proxy) getUpstreamProxyUrl(req *http.Request) (*url.URL, error) {
 	if proxy.upstreamProxy != nil {
 		return proxy.upstreamProxy(req)
 	}
+	if proxy.upstreamRouter != nil {
+		proxyUrl, ok, err := proxy.upstreamRouter.route(req)
+		if err != nil {
+			log.Warnf("upstream routing %v: %v", req.Host, err)
+		} else if ok {
+			return proxyUrl, nil
+		}
+	}
+	if proxy.upstreamPool != nil {
+		return proxy.upstreamPool.pick(req).url, nil
+	}
 	if len(proxy.Opts.Upstream) > 0 {
 		return url.Parse(proxy.Opts.Upstream)
 	}
@@ -147,28 +341,79 @@ func (proxy *Proxy) getUpstreamConn(ctx context.Context, req *http.Request) (net
 	if err != nil {
 		return nil, err
 	}
-	var conn net.Conn
-	address := helper.CanonicalAddr(req.URL)
+	return proxy.dialUpstream(ctx, proxyUrl, helper.CanonicalAddr(req.URL))
+}
+
+// dial address directly or through the upstream proxy if proxyUrl is not nil,
+// dials through an upstream of the pool fail over to the others
+func (proxy *Proxy) dialUpstream(ctx context.Context, proxyUrl *url.URL, address string) (net.Conn, error) {
 	if proxyUrl != nil {
-		conn, err = helper.GetProxyConn(ctx, proxyUrl, address, proxy.Opts.SslInsecure)
-	} else {
-		retries := proxy.Opts.DnsRetries
-		if retries <= 0 {
-			retries = 1
-		}
-		for i := 0; i < retries; i++ {
-			conn, err = proxy.fastDialer.Dial(ctx, "tcp", address)
-			if err == nil {
-				break
-			}
-			if i < retries-1 {
-				log.Debugf("DNS resolution/connection failed, retrying (%d/%d): %v", i+1, retries, err)
+		if proxy.upstreamPool != nil {
+			if m := proxy.upstreamPool.member(proxyUrl); m != nil {
+				return proxy.upstreamPool.dial(ctx, m, address)
 			}
 		}
+		return proxy.dialProxy(ctx, proxyUrl, address)
+	}
+
+	var conn net.Conn
+	var err error
+	timing := connTimingFromContext(ctx)
+	retries := proxy.Opts.DnsRetries
+	if retries <= 0 {
+		retries = 1
+	}
+	host, _, _ := net.SplitHostPort(address)
+	for i := 0; i < retries; i++ {
+		// the dialer resolves the host itself, the connect starts once it has the addresses
+		dial := proxy.dnsTrace.start(host)
+		start := time.Now()
+		conn, err = proxy.fastDialer.Dial(ctx, "tcp", address)
+		timing.TcpConnectDone = time.Now()
+		if resolved := proxy.dnsTrace.done(dial); !resolved.IsZero() {
+			timing.DnsStart, timing.DnsDone = start, resolved
+			timing.TcpConnectStart = resolved
+		} else {
+			timing.TcpConnectStart = start
+		}
+		if err == nil {
+			break
+		}
+		if i < retries-1 {
+			log.Debugf("DNS resolution/connection failed, retrying (%d/%d): %v", i+1, retries, err)
+		}
 	}
 	return conn, err
 }
 
+// dial address through the upstream proxy proxyUrl
+func (proxy *Proxy) dialProxy(ctx context.Context, proxyUrl *url.URL, address string) (net.Conn, error) {
+	timing := connTimingFromContext(ctx)
+	timing.TcpConnectStart = time.Now()
+	conn, err := helper.GetProxyConn(ctx, proxyUrl, address, proxy.Opts.SslInsecure)
+	timing.TcpConnectDone = time.Now()
+	if err != nil {
+		return nil, err
+	}
+	return &upstreamConn{Conn: conn, upstream: proxyUrl}, nil
+}
+
+// UpstreamStats returns the state of the upstreams of Options.UpstreamPool, nil if it is not set
+func (proxy *Proxy) UpstreamStats() []UpstreamStats {
+	if proxy.upstreamPool == nil {
+		return nil
+	}
+	return proxy.upstreamPool.stats()
+}
+
+// ConnPoolStats returns the hit and miss counts of the shared upstream connection pool, zero if it is disabled
+func (proxy *Proxy) ConnPoolStats() ConnPoolStats {
+	if proxy.connPool == nil {
+		return ConnPoolStats{}
+	}
+	return proxy.connPool.stats()
+}
+
 func (proxy *Proxy) SetAuthProxy(fn func(res http.ResponseWriter, req *http.Request) (bool, error)) {
 	proxy.authProxy = fn
 }
@@ -0,0 +1,273 @@
+package proxy
+
+import (
+	"fmt"
+	"reflect"
+	"sort"
+	"sync"
+
+	log "github.com/sirupsen/logrus"
+	"go.uber.org/atomic"
+)
+
+// AddonInfo describes an addon of an AddonRegistry
+type AddonInfo struct {
+	Name     string `json:"name"`
+	Type     string `json:"type"`
+	Priority int    `json:"priority"`
+	Enabled  bool   `json:"enabled"`
+	Failures int64  `json:"failures"`             // panics of its hooks
+	LastErr  string `json:"last_error,omitempty"` // of the last panic
+}
+
+type registeredAddon struct {
+	AddonInfo
+	addon Addon
+	guard *guardedAddon
+	seq   int // registration order, breaks priority ties
+
+	failures atomic.Int64
+	tripping atomic.Int64 // failures since the addon was enabled, counted by the circuit breaker
+	lastErr  atomic.String
+}
+
+// AddonRegistry holds the addons of a proxy by name, safe to change while the proxy runs.
+// Enabled addons run by ascending priority, addons of equal priority in the order they were registered.
+// Every change swaps the addons the hooks run in one step: a flow runs the addons enabled when it started,
+// connection hooks the addons enabled when they fire.
+// A panic of a hook is recovered and counted against its addon, the flow goes on without it.
+type AddonRegistry struct {
+	mu      sync.Mutex
+	entries []*registeredAddon
+	seq     int
+
+	active      atomic.Pointer[[]Addon] // enabled addons
+	guards      atomic.Pointer[[]Addon] // enabled addons guarded against panics, run by the hooks
+	maxFailures atomic.Int64
+}
+
+func newAddonRegistry() *AddonRegistry {
+	r := &AddonRegistry{}
+	r.active.Store(&[]Addon{})
+	r.guards.Store(&[]Addon{})
+	return r
+}
+
+// SetMaxFailures sets the circuit breaker: an addon is disabled once its hooks panicked n times since it was enabled,
+// 0 keeps failing addons enabled
+func (r *AddonRegistry) SetMaxFailures(n int) {
+	r.maxFailures.Store(int64(n))
+}
+
+// Addons returns the enabled addons in the order they run, the slice must not be modified
+func (r *AddonRegistry) Addons() []Addon {
+	return *r.active.Load()
+}
+
+// hooks returns the enabled addons in the order they run, guarded against panics
+func (r *AddonRegistry) hooks() []Addon {
+	return *r.guards.Load()
+}
+
+// Register adds an enabled addon by name
+func (r *AddonRegistry) Register(name string, priority int, addon Addon) error {
+	if name == "" {
+		return fmt.Errorf("empty addon name")
+	}
+	if addon == nil {
+		return fmt.Errorf("addon %v is nil", name)
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.find(name) != nil {
+		return fmt.Errorf("addon %v already registered", name)
+	}
+	r.register(name, priority, addon)
+	return nil
+}
+
+// add registers addon by its type name, numbered if the name is taken
+func (r *AddonRegistry) add(addon Addon) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	base := addonType(addon)
+	name := base
+	for i := 2; r.find(name) != nil; i++ {
+		name = fmt.Sprintf("%v#%d", base, i)
+	}
+	r.register(name, 0, addon)
+}
+
+// register requires mu
+func (r *AddonRegistry) register(name string, priority int, addon Addon) {
+	r.seq++
+	e := &registeredAddon{
+		AddonInfo: AddonInfo{Name: name, Type: addonType(addon), Priority: priority, Enabled: true},
+		addon:     addon,
+		seq:       r.seq,
+	}
+	e.guard = &guardedAddon{addon: addon, entry: e, registry: r}
+	r.entries = append(r.entries, e)
+	r.swap()
+}
+
+// Unregister removes the addon name and returns it
+func (r *AddonRegistry) Unregister(name string) (Addon, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for i, e := range r.entries {
+		if e.Name == name {
+			r.entries = append(r.entries[:i:i], r.entries[i+1:]...)
+			r.swap()
+			return e.addon, nil
+		}
+	}
+	return nil, fmt.Errorf("addon %v not registered", name)
+}
+
+// Replace swaps the addon registered as name for addon, keeping its priority and state, and returns the old one
+func (r *AddonRegistry) Replace(name string, addon Addon) (Addon, error) {
+	if addon == nil {
+		return nil, fmt.Errorf("addon %v is nil", name)
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	e := r.find(name)
+	if e == nil {
+		return nil, fmt.Errorf("addon %v not registered", name)
+	}
+	old := e.addon
+	e.addon = addon
+	e.guard = &guardedAddon{addon: addon, entry: e, registry: r}
+	e.Type = addonType(addon)
+	r.swap()
+	return old, nil
+}
+
+// SetEnabled enables or disables the addon name, enabling resets its circuit breaker
+func (r *AddonRegistry) SetEnabled(name string, enabled bool) error {
+	return r.update(name, func(e *registeredAddon) {
+		if enabled && !e.Enabled {
+			e.tripping.Store(0)
+		}
+		e.Enabled = enabled
+	})
+}
+
+// SetPriority moves the addon name to priority
+func (r *AddonRegistry) SetPriority(name string, priority int) error {
+	return r.update(name, func(e *registeredAddon) { e.Priority = priority })
+}
+
+func (r *AddonRegistry) update(name string, change func(*registeredAddon)) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	e := r.find(name)
+	if e == nil {
+		return fmt.Errorf("addon %v not registered", name)
+	}
+	change(e)
+	r.swap()
+	return nil
+}
+
+// Get returns the addon name, nil if it is not registered
+func (r *AddonRegistry) Get(name string) Addon {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if e := r.find(name); e != nil {
+		return e.addon
+	}
+	return nil
+}
+
+// List describes the registered addons, enabled or not, in the order they run
+func (r *AddonRegistry) List() []AddonInfo {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	infos := make([]AddonInfo, 0, len(r.entries))
+	for _, e := range r.sorted() {
+		info := e.AddonInfo
+		info.Failures = e.failures.Load()
+		info.LastErr = e.lastErr.Load()
+		infos = append(infos, info)
+	}
+	return infos
+}
+
+// flush flushes the registered addons implementing AddonFlusher, enabled or not
+func (r *AddonRegistry) flush() {
+	r.mu.Lock()
+	guards := make([]*guardedAddon, 0, len(r.entries))
+	for _, e := range r.entries {
+		guards = append(guards, e.guard)
+	}
+	r.mu.Unlock()
+	for _, g := range guards {
+		g.Flush()
+	}
+}
+
+// failed counts a panic of a hook of e, the circuit breaker disables e after too many
+func (r *AddonRegistry) failed(e *registeredAddon, v interface{}) {
+	e.failures.Inc()
+	e.lastErr.Store(fmt.Sprint(v))
+	max := r.maxFailures.Load()
+	if tripping := e.tripping.Inc(); max <= 0 || tripping < max {
+		return
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	// the addon may have been disabled, replaced or removed meanwhile
+	if !e.Enabled || r.find(e.Name) != e {
+		return
+	}
+	e.Enabled = false
+	r.swap()
+	log.Warnf("addon %v disabled after %d failures", e.Name, e.tripping.Load())
+}
+
+// find requires mu
+func (r *AddonRegistry) find(name string) *registeredAddon {
+	for _, e := range r.entries {
+		if e.Name == name {
+			return e
+		}
+	}
+	return nil
+}
+
+// sorted requires mu
+func (r *AddonRegistry) sorted() []*registeredAddon {
+	entries := append([]*registeredAddon(nil), r.entries...)
+	sort.Slice(entries, func(i, j int) bool {
+		if entries[i].Priority != entries[j].Priority {
+			return entries[i].Priority < entries[j].Priority
+		}
+		return entries[i].seq < entries[j].seq
+	})
+	return entries
+}
+
+// swap publishes the enabled addons, requires mu
+func (r *AddonRegistry) swap() {
+	addons := make([]Addon, 0, len(r.entries))
+	guards := make([]Addon, 0, len(r.entries))
+	for _, e := range r.sorted() {
+		if e.Enabled {
+			addons = append(addons, e.addon)
+			guards = append(guards, e.guard)
+		}
+	}
+	r.active.Store(&addons)
+	r.guards.Store(&guards)
+}
+
+// addonType is the name of the type of addon without its package
+func addonType(addon Addon) string {
+	t := reflect.TypeOf(addon)
+	for t.Kind() == reflect.Pointer {
+		t = t.Elem()
+	}
+	return t.Name()
+}
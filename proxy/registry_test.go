@@ -0,0 +1,138 @@
+package proxy
+
+import (
+	"sync"
+	"testing"
+)
+
+type namedAddon struct {
+	BaseAddon
+	name string
+}
+
+func TestAddonRegistry(t *testing.T) {
+	r := newAddonRegistry()
+	a, b, c := &namedAddon{name: "a"}, &namedAddon{name: "b"}, &namedAddon{name: "c"}
+
+	order := func(t *testing.T) string {
+		t.Helper()
+		s := ""
+		for _, addon := range r.Addons() {
+			s += addon.(*namedAddon).name
+		}
+		return s
+	}
+
+	for _, err := range []error{r.Register("a", 10, a), r.Register("b", 0, b), r.Register("c", 10, c)} {
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	if got := order(t); got != "bac" {
+		t.Errorf("want addons by priority then registration, got %v", got)
+	}
+	if err := r.Register("a", 0, c); err == nil {
+		t.Error("want error for a taken name")
+	}
+	if err := r.Register("", 0, c); err == nil {
+		t.Error("want error for an empty name")
+	}
+
+	if err := r.SetEnabled("a", false); err != nil {
+		t.Fatal(err)
+	}
+	if got := order(t); got != "bc" {
+		t.Errorf("want a disabled, got %v", got)
+	}
+	if err := r.SetPriority("b", 20); err != nil {
+		t.Fatal(err)
+	}
+	if got := order(t); got != "cb" {
+		t.Errorf("want b last, got %v", got)
+	}
+	infos := r.List()
+	if len(infos) != 3 || infos[0].Name != "a" || infos[0].Enabled || infos[0].Type != "namedAddon" || infos[2].Name != "b" {
+		t.Errorf("unexpected list %+v", infos)
+	}
+
+	replacement := &namedAddon{name: "d"}
+	old, err := r.Replace("c", replacement)
+	if err != nil || old != c {
+		t.Fatalf("want c replaced, got %v %v", old, err)
+	}
+	if got := order(t); got != "db" || r.Get("c") != replacement {
+		t.Errorf("want d in place of c, got %v", got)
+	}
+	if removed, err := r.Unregister("b"); err != nil || removed != b {
+		t.Fatalf("want b removed, got %v %v", removed, err)
+	}
+	if got := order(t); got != "d" {
+		t.Errorf("want b gone, got %v", got)
+	}
+
+	for _, err := range []error{r.SetEnabled("x", true), r.SetPriority("x", 1), func() error { _, err := r.Unregister("x"); return err }()} {
+		if err == nil {
+			t.Error("want error for an unknown addon")
+		}
+	}
+}
+
+func TestProxy_AddAddon(t *testing.T) {
+	p := &Proxy{}
+	if len(p.addons()) != 0 {
+		t.Error("want no addons")
+	}
+	p.AddAddon(&LogAddon{})
+	p.AddAddon(&LogAddon{})
+	infos := p.Registry.List()
+	if len(infos) != 2 || infos[0].Name != "LogAddon" || infos[1].Name != "LogAddon#2" || len(p.addons()) != 2 {
+		t.Errorf("unexpected addons %+v", infos)
+	}
+
+	// the registered addons are returned, not their guards
+	if _, ok := p.Registry.Addons()[0].(*LogAddon); !ok {
+		t.Errorf("want *LogAddon, got %T", p.Registry.Addons()[0])
+	}
+	if _, ok := p.Registry.Get("LogAddon").(*LogAddon); !ok {
+		t.Errorf("want *LogAddon, got %T", p.Registry.Get("LogAddon"))
+	}
+
+	// the deprecated field lists the added addons, the ones appended to it are registered on start
+	p.Addons = append(p.Addons, &namedAddon{})
+	if len(p.Addons) != 3 || len(p.addons()) != 2 {
+		t.Errorf("unexpected addons %v %v", p.Addons, p.addons())
+	}
+	p.addonsMu.Lock()
+	p.registerAppendedAddons()
+	p.addonsMu.Unlock()
+	if infos := p.Registry.List(); len(infos) != 3 || infos[2].Name != "namedAddon" {
+		t.Errorf("want the appended addon registered, got %+v", infos)
+	}
+}
+
+func TestAddonRegistry_Concurrent(t *testing.T) {
+	r := newAddonRegistry()
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(2)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 100; j++ {
+				r.add(&namedAddon{})
+				r.SetEnabled("namedAddon", j%2 == 0)
+			}
+		}()
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 100; j++ {
+				for _, addon := range r.hooks() {
+					addon.Requestheaders(nil)
+				}
+			}
+		}()
+	}
+	wg.Wait()
+	if len(r.List()) != 400 {
+		t.Errorf("want 400 addons, got %v", len(r.List()))
+	}
+}
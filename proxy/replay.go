@@ -0,0 +1,126 @@
+package proxy
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"time"
+
+	"github.com/retutils/gomitmproxy/internal/helper"
+)
+
+// Replay sends the request of f again through the proxy: addons, upstream proxies, client certificates and
+// the TLS fingerprint apply as to a request of a client. The replay is a new flow whose ReplayOf is the id of f,
+// it is returned once its response is complete. A streamed response body is not kept in the returned flow.
+func (proxy *Proxy) Replay(f *Flow) (*Flow, error) {
+	return proxy.attacker.replay(f)
+}
+
+func (a *attacker) replay(orig *Flow) (replay *Flow, err error) {
+	if orig == nil || orig.Request == nil || orig.Request.URL == nil {
+		return nil, errors.New("replay: flow has no request")
+	}
+	r := orig.Request
+	if r.URL.Scheme != "http" && r.URL.Scheme != "https" {
+		return nil, fmt.Errorf("replay: unsupported url %v", r.URL)
+	}
+
+	req, err := http.NewRequest(r.Method, r.URL.String(), bytes.NewReader(r.Body))
+	if err != nil {
+		return nil, fmt.Errorf("replay: %w", err)
+	}
+	for key, values := range r.Header {
+		for _, v := range values {
+			req.Header.Add(key, v)
+		}
+	}
+	if len(r.Trailer) > 0 {
+		req.Trailer = r.Trailer.Clone()
+	}
+	if isWebSocketUpgrade(req) {
+		return nil, errors.New("replay: websocket flows can not be replayed")
+	}
+
+	// the replay has a connection of its own, torn down when it is done
+	proxy := a.proxy
+	wc := newWrapClientConn(replayConn{}, proxy)
+	connCtx := newConnContext(wc, proxy)
+	wc.connCtx = connCtx
+	for _, addon := range proxy.addons() {
+		addon.ClientConnected(connCtx.ClientConn)
+	}
+	defer wc.Close()
+
+	ctx := context.WithValue(context.Background(), connContextKey, connCtx)
+	req = req.WithContext(ctx)
+	if req.URL.Scheme == "https" {
+		connCtx.ClientConn.Tls = true
+		connCtx.Intercept = true
+		// the response is read by net/http, which can not speak http/2 over a fingerprinted connection
+		connCtx.ClientConn.clientHello = &tls.ClientHelloInfo{
+			ServerName:      req.URL.Hostname(),
+			SupportedProtos: []string{"http/1.1"},
+		}
+		connCtx.serverAlpn = connCtx.ClientConn.clientHello.SupportedProtos
+		address := helper.CanonicalAddr(req.URL)
+		connectReq := &http.Request{
+			Method: http.MethodConnect,
+			URL:    &url.URL{Host: address},
+			Host:   address,
+			Header: make(http.Header),
+		}
+		a.initHttpsDialFn(connectReq.WithContext(ctx))
+	} else {
+		a.initHttpDialFn(req)
+	}
+
+	f := NewFlow()
+	f.ReplayOf = orig.Id
+	defer func() {
+		// a killed replay aborts like the handler of a client request
+		if v := recover(); v != nil {
+			if v != http.ErrAbortHandler {
+				panic(v)
+			}
+			replay, err = f, fmt.Errorf("replay %v: flow killed", r.URL)
+		}
+	}()
+	a.attackFlow(&replayResponseWriter{header: make(http.Header)}, req, f)
+
+	if f.Response == nil {
+		return f, fmt.Errorf("replay %v: no response from server", r.URL)
+	}
+	return f, nil
+}
+
+// replayConn stands in for the client connection of a replayed flow
+type replayConn struct{}
+
+func (replayConn) Read(b []byte) (int, error)         { return 0, io.EOF }
+func (replayConn) Write(b []byte) (int, error)        { return len(b), nil }
+func (replayConn) Close() error                       { return nil }
+func (replayConn) LocalAddr() net.Addr                { return replayAddr{} }
+func (replayConn) RemoteAddr() net.Addr               { return replayAddr{} }
+func (replayConn) SetDeadline(t time.Time) error      { return nil }
+func (replayConn) SetReadDeadline(t time.Time) error  { return nil }
+func (replayConn) SetWriteDeadline(t time.Time) error { return nil }
+
+type replayAddr struct{}
+
+func (replayAddr) Network() string { return "replay" }
+func (replayAddr) String() string  { return "replay" }
+
+// replayResponseWriter discards the response of a replayed flow, it is kept in the flow
+type replayResponseWriter struct {
+	header http.Header
+}
+
+func (w *replayResponseWriter) Header() http.Header         { return w.header }
+func (w *replayResponseWriter) Write(b []byte) (int, error) { return len(b), nil }
+func (w *replayResponseWriter) WriteHeader(statusCode int)  {}
@@ -0,0 +1,164 @@
+package proxy
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+)
+
+type replayAddon struct {
+	BaseAddon
+	responses     chan *Flow
+	disconnected  chan *ClientConn
+	serverConnCtx chan *ConnContext
+}
+
+func (a *replayAddon) Requestheaders(f *Flow) {
+	if f.Request.URL.Path == "/kill" {
+		f.Kill()
+	}
+}
+
+func (a *replayAddon) Response(f *Flow) {
+	a.responses <- f
+}
+
+func (a *replayAddon) ClientDisconnected(client *ClientConn) {
+	a.disconnected <- client
+}
+
+func (a *replayAddon) ServerConnected(connCtx *ConnContext) {
+	a.serverConnCtx <- connCtx
+}
+
+func TestReplay(t *testing.T) {
+	helper := &testProxyHelper{
+		server: &http.Server{
+			Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				body, _ := io.ReadAll(r.Body)
+				fmt.Fprintf(w, "%v %v %v %s", r.Method, r.URL.Path, r.Header.Get("X-Test"), body)
+			}),
+		},
+		proxyAddr: ":29096",
+	}
+	helper.init(t)
+	testProxy := helper.testProxy
+	addon := &replayAddon{
+		responses:     make(chan *Flow, 4),
+		disconnected:  make(chan *ClientConn, 4),
+		serverConnCtx: make(chan *ConnContext, 4),
+	}
+	testProxy.AddAddon(addon)
+	defer helper.ln.Close()
+	go helper.server.Serve(helper.ln)
+	defer helper.tlsPlainLn.Close()
+	go helper.server.ServeTLS(helper.tlsPlainLn, "", "")
+
+	newFlow := func(rawUrl string) *Flow {
+		u, err := url.Parse(rawUrl)
+		if err != nil {
+			t.Fatal(err)
+		}
+		f := NewFlow()
+		f.Request = &Request{
+			Method: "POST",
+			URL:    u,
+			Proto:  "HTTP/1.1",
+			Header: http.Header{"X-Test": []string{"a"}},
+			Body:   []byte("hello"),
+		}
+		return f
+	}
+
+	replay := func(t *testing.T, orig *Flow, want string) {
+		t.Helper()
+		f, err := testProxy.Replay(orig)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if f.Id == orig.Id || f.ReplayOf != orig.Id {
+			t.Errorf("want a new flow replaying %v, got %v replaying %v", orig.Id, f.Id, f.ReplayOf)
+		}
+		if f.Response == nil || f.Response.StatusCode != 200 || string(f.Response.Body) != want {
+			t.Fatalf("want response %q, got %+v", want, f.Response)
+		}
+		select {
+		case got := <-addon.responses:
+			if got != f {
+				t.Error("want the replay passed to the addons")
+			}
+		case <-time.After(time.Second):
+			t.Error("Response not fired")
+		}
+		select {
+		case connCtx := <-addon.serverConnCtx:
+			if connCtx != f.ConnContext || connCtx.ServerConn.Address != orig.Request.URL.Host {
+				t.Errorf("unexpected server connection %v", connCtx.ServerConn.Address)
+			}
+		case <-time.After(time.Second):
+			t.Error("ServerConnected not fired")
+		}
+		select {
+		case client := <-addon.disconnected:
+			if client != f.ConnContext.ClientConn {
+				t.Error("unexpected client disconnected")
+			}
+		case <-time.After(time.Second):
+			t.Error("want the connection of the replay closed")
+		}
+	}
+
+	for _, tc := range []struct {
+		name        string
+		endpoint    string
+		fingerprint string
+	}{
+		{"http", helper.httpEndpoint, ""},
+		{"https", helper.httpsEndpoint, ""},
+		{"https fingerprint", helper.httpsEndpoint, "chrome"},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			testProxy.Opts.TlsFingerprint = tc.fingerprint
+			defer func() { testProxy.Opts.TlsFingerprint = "" }()
+			replay(t, newFlow(tc.endpoint+"/replay"), "POST /replay a hello")
+		})
+	}
+
+	t.Run("edited", func(t *testing.T) {
+		orig := newFlow(helper.httpEndpoint + "/replay")
+		orig.Request.Method = "PUT"
+		orig.Request.URL.Path = "/edited"
+		orig.Request.Header.Set("X-Test", "b")
+		orig.Request.Body = []byte("changed")
+		replay(t, orig, "PUT /edited b changed")
+	})
+
+	t.Run("killed", func(t *testing.T) {
+		f, err := testProxy.Replay(newFlow(helper.httpEndpoint + "/kill"))
+		if err == nil || !strings.Contains(err.Error(), "killed") {
+			t.Errorf("want killed error, got %v", err)
+		}
+		if f == nil || !f.IsKilled() {
+			t.Error("want the killed replay returned")
+		}
+		<-addon.disconnected
+	})
+
+	t.Run("errors", func(t *testing.T) {
+		if _, err := testProxy.Replay(NewFlow()); err == nil {
+			t.Error("want error for a flow without request")
+		}
+		if _, err := testProxy.Replay(newFlow("ws://127.0.0.1:1/")); err == nil {
+			t.Error("want error for a websocket url")
+		}
+		f, err := testProxy.Replay(newFlow("http://" + deadAddr(t) + "/"))
+		if err == nil || f == nil || f.Response != nil {
+			t.Errorf("want error without response for a dead server, got %v", err)
+		}
+		<-addon.disconnected
+	})
+}
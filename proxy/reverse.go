@@ -0,0 +1,134 @@
+package proxy
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// Reverse proxy mode: the entry listener accepts origin-form requests
+// (GET /path HTTP/1.1) and forwards them to one of Options.Reverse backends.
+// Each client connection sticks to one backend, chosen round-robin.
+
+func parseReverseBackends(backends []string) ([]*url.URL, error) {
+	urls := make([]*url.URL, 0, len(backends))
+	for _, backend := range backends {
+		u, err := url.Parse(backend)
+		if err != nil {
+			return nil, fmt.Errorf("invalid reverse backend %v: %w", backend, err)
+		}
+		if u.Scheme != "http" && u.Scheme != "https" {
+			return nil, fmt.Errorf("invalid reverse backend %v: scheme must be http or https", backend)
+		}
+		if u.Host == "" {
+			return nil, fmt.Errorf("invalid reverse backend %v: missing host", backend)
+		}
+		urls = append(urls, u)
+	}
+	return urls, nil
+}
+
+func (proxy *Proxy) isReverse() bool {
+	return len(proxy.reverseBackends) > 0
+}
+
+func (proxy *Proxy) nextReverseBackend() *url.URL {
+	i := proxy.reverseNext.Inc() - 1
+	return proxy.reverseBackends[int(i)%len(proxy.reverseBackends)]
+}
+
+// tls config of the entry listener when Options.ReverseTls is set
+func (e *entry) reverseTlsConfig() *tls.Config {
+	proxy := e.proxy
+	return &tls.Config{
+		SessionTicketsDisabled: true,
+		NextProtos:             []string{"http/1.1"}, // only support http/1.1
+		GetConfigForClient: func(chi *tls.ClientHelloInfo) (*tls.Config, error) {
+			if wc, ok := chi.Conn.(*wrapClientConn); ok {
+				wc.connCtx.ClientConn.clientHello = chi
+			}
+			serverName := chi.ServerName
+			if serverName == "" {
+				serverName = proxy.reverseBackends[0].Hostname()
+			}
+			c, err := proxy.attacker.ca.GetCert(serverName)
+			if err != nil {
+				return nil, err
+			}
+			return &tls.Config{
+				SessionTicketsDisabled: true,
+				Certificates:           []tls.Certificate{*c},
+				NextProtos:             []string{"http/1.1"},
+			}, nil
+		},
+	}
+}
+
+func (e *entry) serveReverse(res http.ResponseWriter, req *http.Request) {
+	proxy := e.proxy
+	connCtx := req.Context().Value(connContextKey).(*ConnContext)
+
+	if connCtx.reverseBackend == nil {
+		connCtx.reverseBackend = proxy.nextReverseBackend()
+		log.Debugf("%v reverse to %v", connCtx.ClientConn.Conn.RemoteAddr(), connCtx.reverseBackend)
+	}
+	backend := connCtx.reverseBackend
+
+	req.URL.Scheme = backend.Scheme
+	req.URL.Host = backend.Host
+	if p := strings.TrimSuffix(backend.Path, "/"); p != "" {
+		req.URL.Path = p + req.URL.Path
+		req.URL.RawPath = ""
+	}
+	req.Host = backend.Host
+
+	if isWebSocketUpgrade(req) {
+		defaultWebSocket.relay(res, req, &tls.Config{
+			InsecureSkipVerify: proxy.Opts.SslInsecure,
+		}, proxy.addons())
+		return
+	}
+
+	if backend.Scheme == "https" {
+		proxy.attacker.initReverseTlsDialFn(req)
+	} else {
+		proxy.attacker.initHttpDialFn(req)
+	}
+	proxy.attacker.attack(res, req)
+}
+
+func (a *attacker) initReverseTlsDialFn(req *http.Request) {
+	connCtx := req.Context().Value(connContextKey).(*ConnContext)
+
+	connCtx.dialFn = func(ctx context.Context) error {
+		// the client's SNI names the proxy, the backend expects its own name,
+		// the hello of the client is kept for the addons
+		clientHello := &tls.ClientHelloInfo{SupportedProtos: []string{"http/1.1"}}
+		if connCtx.ClientConn.clientHello != nil {
+			hello := *connCtx.ClientConn.clientHello
+			clientHello = &hello
+		}
+		clientHello.ServerName = req.URL.Hostname()
+
+		if _, err := a.httpsDial(ctx, req); err != nil {
+			return err
+		}
+		return a.serverTlsHandshakeHello(ctx, connCtx, clientHello)
+	}
+}
+
+// client connection of the entry server, unwrap tls when the listener terminates it
+func entryClientConn(c net.Conn) *wrapClientConn {
+	if tlsConn, ok := c.(*tls.Conn); ok {
+		wc := tlsConn.NetConn().(*wrapClientConn)
+		wc.connCtx.ClientConn.Tls = true
+		return wc
+	}
+	return c.(*wrapClientConn)
+}
@@ -0,0 +1,203 @@
+package proxy
+
+import (
+	"bufio"
+	"crypto/tls"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/retutils/gomitmproxy/cert"
+)
+
+type urlRecorderAddon struct {
+	BaseAddon
+	urls chan string
+}
+
+func (a *urlRecorderAddon) Response(f *Flow) {
+	a.urls <- f.Request.URL.String()
+}
+
+func TestParseReverseBackends(t *testing.T) {
+	urls, err := parseReverseBackends([]string{"http://127.0.0.1:8000", "https://example.com/api"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(urls) != 2 || urls[1].Path != "/api" {
+		t.Errorf("unexpected backends %v", urls)
+	}
+
+	for _, backend := range []string{"ftp://example.com", "http://", "://bad"} {
+		if _, err := parseReverseBackends([]string{backend}); err == nil {
+			t.Errorf("expected error for %v", backend)
+		}
+	}
+
+	if _, err := NewProxy(&Options{Addr: ":0", Reverse: []string{"example.com"}}); err == nil {
+		t.Error("expected NewProxy error for invalid backend")
+	}
+}
+
+func TestProxy_NextReverseBackend(t *testing.T) {
+	p, err := NewProxy(&Options{Addr: ":0", Reverse: []string{"http://a", "http://b"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	got := []string{p.nextReverseBackend().Host, p.nextReverseBackend().Host, p.nextReverseBackend().Host}
+	if got[0] != "a" || got[1] != "b" || got[2] != "a" {
+		t.Errorf("unexpected round robin %v", got)
+	}
+}
+
+// sniRecorderAddon records the SNI the client sent
+type sniRecorderAddon struct {
+	BaseAddon
+	names chan string
+}
+
+func (a *sniRecorderAddon) Response(f *Flow) {
+	a.names <- f.ConnContext.ClientConn.clientHello.ServerName
+}
+
+func TestIntegration_Reverse(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("reverse " + r.URL.Path))
+	}))
+	defer backend.Close()
+
+	p, err := NewProxy(&Options{
+		Addr:              "127.0.0.1:9092",
+		StreamLargeBodies: 1024 * 1024,
+		Reverse:           []string{backend.URL + "/prefix"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	addon := &urlRecorderAddon{urls: make(chan string, 1)}
+	p.AddAddon(addon)
+	go p.Start()
+	defer p.Close()
+	time.Sleep(100 * time.Millisecond)
+
+	resp, err := http.Get("http://127.0.0.1:9092/hello")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	body, _ := io.ReadAll(resp.Body)
+	if string(body) != "reverse /prefix/hello" {
+		t.Errorf("unexpected body %q", body)
+	}
+
+	select {
+	case u := <-addon.urls:
+		if u != backend.URL+"/prefix/hello" {
+			t.Errorf("unexpected flow url %v", u)
+		}
+	case <-time.After(time.Second):
+		t.Error("addon did not see the flow")
+	}
+}
+
+func TestIntegration_ReverseNoForward(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("reverse " + r.URL.Path))
+	}))
+	defer backend.Close()
+	other := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		t.Errorf("want no request forwarded to %v", r.Host)
+	}))
+	defer other.Close()
+
+	p, err := NewProxy(&Options{Reverse: []string{backend.URL}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := listenTestProxy(t, p)
+
+	for _, tc := range []struct {
+		name   string
+		req    string
+		status int
+	}{
+		{"absolute form", fmt.Sprintf("GET %v/hello HTTP/1.1\r\nHost: %v\r\n\r\n", other.URL, other.Listener.Addr()), http.StatusBadRequest},
+		{"connect", fmt.Sprintf("CONNECT %v HTTP/1.1\r\nHost: %v\r\n\r\n", other.Listener.Addr(), other.Listener.Addr()), http.StatusMethodNotAllowed},
+		{"origin form", "GET /hello HTTP/1.1\r\nHost: example.com\r\n\r\n", http.StatusOK},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			conn, err := net.Dial("tcp", addr)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer conn.Close()
+			io.WriteString(conn, tc.req)
+			resp, err := http.ReadResponse(bufio.NewReader(conn), nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			resp.Body.Close()
+			if resp.StatusCode != tc.status {
+				t.Errorf("want %v, got %v", tc.status, resp.StatusCode)
+			}
+		})
+	}
+}
+
+func TestIntegration_ReverseTls(t *testing.T) {
+	backend := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("reverse tls"))
+	}))
+	defer backend.Close()
+
+	ca, err := cert.NewSelfSignCA(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	p, err := NewProxy(&Options{
+		Addr:              "127.0.0.1:9093",
+		StreamLargeBodies: 1024 * 1024,
+		SslInsecure:       true,
+		Reverse:           []string{backend.URL},
+		ReverseTls:        true,
+		NewCaFunc:         func() (cert.CA, error) { return ca, nil },
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	sni := &sniRecorderAddon{names: make(chan string, 1)}
+	p.AddAddon(sni)
+	go p.Start()
+	defer p.Close()
+	time.Sleep(100 * time.Millisecond)
+
+	client := &http.Client{
+		Transport: &http.Transport{
+			TLSClientConfig: &tls.Config{InsecureSkipVerify: true, ServerName: "proxy.test"},
+		},
+	}
+	resp, err := client.Get("https://127.0.0.1:9093/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	body, _ := io.ReadAll(resp.Body)
+	if string(body) != "reverse tls" {
+		t.Errorf("unexpected body %q", body)
+	}
+	if resp.TLS == nil {
+		t.Error("expected tls response")
+	}
+	select {
+	case name := <-sni.names:
+		if name != "proxy.test" {
+			t.Errorf("want the SNI of the client kept, got %q", name)
+		}
+	case <-time.After(time.Second):
+		t.Error("addon did not see the flow")
+	}
+}
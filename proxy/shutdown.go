@@ -0,0 +1,149 @@
+package proxy
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// shutdownPollInterval is how often Proxy.Shutdown checks whether the flows are done, like http.Server.Shutdown
+const shutdownPollInterval = 10 * time.Millisecond
+
+// shutdownUnwindTimeout is how long Proxy.Shutdown waits for the flows and relays to unwind once their client
+// connections are closed, ctx may be done already
+const shutdownUnwindTimeout = 5 * time.Second
+
+// connTracker keeps the client connections, the flows and the relays in flight of a proxy, they are drained by
+// Proxy.Shutdown. The servers of the proxy lose track of hijacked CONNECT tunnels, websocket relays and http/2
+// connections, the tracker does not.
+type connTracker struct {
+	mu       sync.Mutex
+	conns    map[*wrapClientConn]struct{}
+	flows    map[*Flow]struct{}
+	relays   int // websocket and tcp relays, they end with their connections
+	shutdown bool
+}
+
+func newConnTracker() *connTracker {
+	return &connTracker{
+		conns: make(map[*wrapClientConn]struct{}),
+		flows: make(map[*Flow]struct{}),
+	}
+}
+
+// addConn tracks c until it is closed, false once the proxy shuts down
+func (t *connTracker) addConn(c *wrapClientConn) bool {
+	if t == nil {
+		return true
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.shutdown {
+		return false
+	}
+	t.conns[c] = struct{}{}
+	return true
+}
+
+func (t *connTracker) removeConn(c *wrapClientConn) {
+	if t == nil {
+		return
+	}
+	t.mu.Lock()
+	delete(t.conns, c)
+	t.mu.Unlock()
+}
+
+// flow tracks f until done is called
+func (t *connTracker) flow(f *Flow) (done func()) {
+	if t == nil {
+		return func() {}
+	}
+	t.mu.Lock()
+	t.flows[f] = struct{}{}
+	t.mu.Unlock()
+	return func() {
+		t.mu.Lock()
+		delete(t.flows, f)
+		t.mu.Unlock()
+	}
+}
+
+// relay tracks a websocket or tcp relay until done is called
+func (t *connTracker) relay() (done func()) {
+	if t == nil {
+		return func() {}
+	}
+	t.mu.Lock()
+	t.relays++
+	t.mu.Unlock()
+	return func() {
+		t.mu.Lock()
+		t.relays--
+		t.mu.Unlock()
+	}
+}
+
+// stop refuses the connections accepted from now on
+func (t *connTracker) stop() {
+	if t == nil {
+		return
+	}
+	t.mu.Lock()
+	t.shutdown = true
+	t.mu.Unlock()
+}
+
+// wait waits until the flows are done, and the relays too if relays is set, or ctx is done
+func (t *connTracker) wait(ctx context.Context, relays bool) error {
+	if t == nil {
+		return nil
+	}
+	ticker := time.NewTicker(shutdownPollInterval)
+	defer ticker.Stop()
+	for {
+		t.mu.Lock()
+		idle := len(t.flows) == 0 && (!relays || t.relays == 0)
+		t.mu.Unlock()
+		if idle {
+			return nil
+		}
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-ticker.C:
+		}
+	}
+}
+
+// killFlows kills the flows in flight
+func (t *connTracker) killFlows() {
+	if t == nil {
+		return
+	}
+	t.mu.Lock()
+	flows := make([]*Flow, 0, len(t.flows))
+	for f := range t.flows {
+		flows = append(flows, f)
+	}
+	t.mu.Unlock()
+	for _, f := range flows {
+		f.Kill()
+	}
+}
+
+// closeConns closes the client connections left, which fires ClientDisconnected and ServerDisconnected
+func (t *connTracker) closeConns() {
+	if t == nil {
+		return
+	}
+	t.mu.Lock()
+	conns := make([]*wrapClientConn, 0, len(t.conns))
+	for c := range t.conns {
+		conns = append(conns, c)
+	}
+	t.mu.Unlock()
+	for _, c := range conns {
+		c.Close()
+	}
+}
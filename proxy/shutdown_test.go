@@ -0,0 +1,244 @@
+package proxy
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"go.uber.org/atomic"
+)
+
+// connCounter counts the open connections by their hooks and the responses flushed
+type connCounter struct {
+	BaseAddon
+	clients   atomic.Int64
+	servers   atomic.Int64
+	responses atomic.Int64
+	tcpEnds   atomic.Int64
+	flushed   atomic.Int64 // responses when Flush was called, -1 before
+}
+
+func newConnCounter() *connCounter {
+	c := &connCounter{}
+	c.flushed.Store(-1)
+	return c
+}
+
+func (c *connCounter) ClientConnected(*ClientConn)     { c.clients.Inc() }
+func (c *connCounter) ClientDisconnected(*ClientConn)  { c.clients.Dec() }
+func (c *connCounter) ServerConnected(*ConnContext)    { c.servers.Inc() }
+func (c *connCounter) ServerDisconnected(*ConnContext) { c.servers.Dec() }
+func (c *connCounter) Response(*Flow)                  { c.responses.Inc() }
+func (c *connCounter) TcpEnd(*TcpFlow)                 { c.tcpEnds.Inc() }
+func (c *connCounter) Flush()                          { c.flushed.Store(c.responses.Load()) }
+
+func TestProxy_ShutdownDrain(t *testing.T) {
+	helper := &testProxyHelper{
+		server: &http.Server{
+			Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				if r.URL.Path == "/slow" {
+					time.Sleep(300 * time.Millisecond)
+				}
+				w.Write([]byte(r.URL.Path))
+			}),
+		},
+		proxyAddr: ":29100",
+	}
+	helper.init(t)
+	helper.server.TLSConfig.NextProtos = []string{"h2", "http/1.1"}
+	testProxy := helper.testProxy
+	tunnelHost := helper.tlsLn.Addr().String()
+	testProxy.SetShouldInterceptRule(func(req *http.Request) bool { return req.Host != tunnelHost })
+	counter := newConnCounter()
+	testProxy.AddAddon(counter)
+	defer helper.ln.Close()
+	go helper.server.Serve(helper.ln)
+	defer helper.tlsPlainLn.Close()
+	go helper.server.ServeTLS(helper.tlsPlainLn, "", "")
+	defer helper.tlsLn.Close()
+	go helper.server.ServeTLS(helper.tlsLn, "", "")
+	go testProxy.Start()
+	time.Sleep(time.Millisecond * 10) // wait for test proxy startup
+
+	// an idle http/2 connection through an intercepted tunnel
+	proxyUrl, _ := url.Parse("http://127.0.0.1" + helper.proxyAddr)
+	h2Client := &http.Client{
+		Transport: &http.Transport{
+			Proxy:             http.ProxyURL(proxyUrl),
+			TLSClientConfig:   &tls.Config{InsecureSkipVerify: true},
+			ForceAttemptHTTP2: true,
+		},
+	}
+	resp, err := h2Client.Get(helper.httpsEndpoint + "/h2")
+	if err != nil {
+		t.Fatal(err)
+	}
+	io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if resp.ProtoMajor != 2 {
+		t.Fatalf("want http/2, got %v", resp.Proto)
+	}
+
+	// a tcp relay through a tunnel which is not intercepted
+	tunnel, err := net.Dial("tcp", "127.0.0.1"+helper.proxyAddr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tunnel.Close()
+	io.WriteString(tunnel, "CONNECT "+tunnelHost+" HTTP/1.1\r\nHost: "+tunnelHost+"\r\n\r\n")
+	tunnelResp, err := http.ReadResponse(bufio.NewReader(tunnel), nil)
+	if err != nil || tunnelResp.StatusCode != 200 {
+		t.Fatalf("want the tunnel established, got %v %v", tunnelResp, err)
+	}
+
+	// a flow in flight
+	slow := make(chan string, 1)
+	go func() {
+		resp, err := helper.getProxyClient().Get(helper.httpEndpoint + "/slow")
+		if err != nil {
+			slow <- err.Error()
+			return
+		}
+		body, _ := io.ReadAll(resp.Body)
+		resp.Body.Close()
+		slow <- string(body)
+	}()
+	time.Sleep(100 * time.Millisecond)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := testProxy.Shutdown(ctx); err != nil {
+		t.Fatalf("want the flows drained, got %v", err)
+	}
+	if got := <-slow; got != "/slow" {
+		t.Errorf("want the flow in flight finished, got %v", got)
+	}
+	if clients, servers := counter.clients.Load(), counter.servers.Load(); clients != 0 || servers != 0 {
+		t.Errorf("want every connection disconnected, got %v clients and %v servers open", clients, servers)
+	}
+	if counter.tcpEnds.Load() != 1 {
+		t.Error("want the tcp relay ended")
+	}
+	if flushed := counter.flushed.Load(); flushed != 2 {
+		t.Errorf("want the addon flushed after 2 responses, got %v", flushed)
+	}
+	tunnel.SetReadDeadline(time.Now().Add(time.Second))
+	if _, err := tunnel.Read(make([]byte, 1)); err != io.EOF {
+		t.Errorf("want the tunnel closed, got %v", err)
+	}
+	if conn, err := net.Dial("tcp", "127.0.0.1"+helper.proxyAddr); err == nil {
+		conn.Close()
+		t.Error("want no more connections accepted")
+	}
+}
+
+func TestProxy_ShutdownDeadline(t *testing.T) {
+	release := make(chan struct{})
+	defer close(release)
+	helper := &testProxyHelper{
+		server: &http.Server{
+			Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				<-release
+			}),
+		},
+		proxyAddr: ":29101",
+	}
+	helper.init(t)
+	testProxy := helper.testProxy
+	counter := newConnCounter()
+	testProxy.AddAddon(counter)
+	defer helper.ln.Close()
+	go helper.server.Serve(helper.ln)
+	go testProxy.Start()
+	time.Sleep(time.Millisecond * 10) // wait for test proxy startup
+
+	stuck := make(chan error, 1)
+	go func() {
+		resp, err := helper.getProxyClient().Get(helper.httpEndpoint + "/stuck")
+		if err == nil {
+			resp.Body.Close()
+		}
+		stuck <- err
+	}()
+	time.Sleep(100 * time.Millisecond)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 200*time.Millisecond)
+	defer cancel()
+	if err := testProxy.Shutdown(ctx); err != context.DeadlineExceeded {
+		t.Errorf("want the deadline exceeded, got %v", err)
+	}
+	if err := <-stuck; err == nil || !strings.Contains(err.Error(), "EOF") {
+		t.Errorf("want the flow cut, got %v", err)
+	}
+	if clients := counter.clients.Load(); clients != 0 {
+		t.Errorf("want every client disconnected, got %v open", clients)
+	}
+	if counter.flushed.Load() != 0 {
+		t.Error("want the addon flushed")
+	}
+}
+
+func TestProxy_ShutdownConnPool(t *testing.T) {
+	var open atomic.Int64
+	helper := &testProxyHelper{
+		server: &http.Server{
+			Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				w.Write([]byte(r.RemoteAddr))
+			}),
+			ConnState: func(conn net.Conn, state http.ConnState) {
+				switch state {
+				case http.StateNew:
+					open.Inc()
+				case http.StateClosed, http.StateHijacked:
+					open.Dec()
+				}
+			},
+		},
+	}
+	helper.init(t)
+	defer helper.tlsPlainLn.Close()
+	go helper.server.ServeTLS(helper.tlsPlainLn, "", "")
+	testProxy, err := NewProxy(&Options{SslInsecure: true, ConnPool: true})
+	handleError(t, err)
+	client := serveTestProxy(t, testProxy)
+
+	// the first client's connection is pooled and reused by the second, whose own dialed connection is left untaken
+	for i := 0; i < 2; i++ {
+		resp, err := client.Get(helper.httpsEndpoint)
+		if err != nil {
+			t.Fatal(err)
+		}
+		io.ReadAll(resp.Body)
+		resp.Body.Close()
+		client.CloseIdleConnections()
+	}
+	time.Sleep(50 * time.Millisecond)
+	if n := open.Load(); n != 2 {
+		t.Fatalf("%d upstream connections open, want the idle pooled one and the adopted one", n)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	if err := testProxy.Shutdown(ctx); err != nil {
+		t.Fatal(err)
+	}
+	deadline := time.Now().Add(time.Second)
+	for open.Load() != 0 && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if n := open.Load(); n != 0 {
+		t.Errorf("%d upstream connections left open after shutdown", n)
+	}
+	testProxy.connPool.mu.Lock()
+	defer testProxy.connPool.mu.Unlock()
+	if len(testProxy.connPool.transports) != 0 || len(testProxy.connPool.seeds) != 0 {
+		t.Errorf("pool not emptied: %d transports, %d seeds", len(testProxy.connPool.transports), len(testProxy.connPool.seeds))
+	}
+}
@@ -0,0 +1,135 @@
+package proxy
+
+import (
+	"bytes"
+	"io"
+	"mime"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// ServerSentEvent is an event parsed from a text/event-stream response
+type ServerSentEvent struct {
+	Id    string `json:"id"`
+	Event string `json:"event"`
+	Data  string `json:"data"`  // data lines joined by \n
+	Retry int    `json:"retry"` // reconnection time in milliseconds, 0 if not set
+}
+
+// IsEventStream reports whether the response is a Server-Sent Events stream
+func (r *Response) IsEventStream() bool {
+	if r == nil || r.Header == nil {
+		return false
+	}
+	mediaType, _, err := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	return err == nil && mediaType == "text/event-stream"
+}
+
+// sseReader passes the stream through and parses it, onEvent is called for each event read
+type sseReader struct {
+	r       io.Reader
+	onEvent func(*ServerSentEvent)
+
+	line    []byte
+	lastCR  bool
+	event   ServerSentEvent
+	data    []string
+	pending bool // a field of the current event has been read
+}
+
+func newSseReader(r io.Reader, onEvent func(*ServerSentEvent)) *sseReader {
+	return &sseReader{r: r, onEvent: onEvent}
+}
+
+func (s *sseReader) Read(p []byte) (int, error) {
+	n, err := s.r.Read(p)
+	if n > 0 {
+		s.feed(p[:n])
+	}
+	if err == io.EOF {
+		// an incomplete event at the end of the stream is discarded, as browsers do
+		s.reset()
+	}
+	return n, err
+}
+
+// lines end with \r\n, \n or \r
+func (s *sseReader) feed(b []byte) {
+	for _, c := range b {
+		if c == '\n' && s.lastCR {
+			s.lastCR = false
+			continue
+		}
+		s.lastCR = c == '\r'
+		if c == '\n' || c == '\r' {
+			s.processLine(s.line)
+			s.line = s.line[:0]
+			continue
+		}
+		s.line = append(s.line, c)
+	}
+}
+
+func (s *sseReader) processLine(line []byte) {
+	if len(line) == 0 {
+		s.dispatch()
+		return
+	}
+	// comment
+	if line[0] == ':' {
+		return
+	}
+
+	field, value := line, []byte{}
+	if i := bytes.IndexByte(line, ':'); i >= 0 {
+		field, value = line[:i], line[i+1:]
+		value = bytes.TrimPrefix(value, []byte(" "))
+	}
+
+	switch string(field) {
+	case "id":
+		s.event.Id = string(value)
+	case "event":
+		s.event.Event = string(value)
+	case "data":
+		s.data = append(s.data, string(value))
+	case "retry":
+		retry, err := strconv.Atoi(string(value))
+		if err != nil {
+			return
+		}
+		s.event.Retry = retry
+	default:
+		return
+	}
+	s.pending = true
+}
+
+func (s *sseReader) dispatch() {
+	if !s.pending {
+		return
+	}
+	ev := s.event
+	ev.Data = strings.Join(s.data, "\n")
+	s.reset()
+	s.onEvent(&ev)
+}
+
+func (s *sseReader) reset() {
+	s.event = ServerSentEvent{}
+	s.data = s.data[:0]
+	s.pending = false
+}
+
+// flushWriter flushes after every write, so streamed events reach the client immediately
+type flushWriter struct {
+	w io.Writer
+	f http.Flusher
+}
+
+func (fw *flushWriter) Write(p []byte) (int, error) {
+	n, err := fw.w.Write(p)
+	fw.f.Flush()
+	return n, err
+}
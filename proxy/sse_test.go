@@ -0,0 +1,162 @@
+package proxy
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestSseReader(t *testing.T) {
+	stream := ": comment\r\n" +
+		"id: 1\r\nevent: token\r\ndata: hello\r\ndata:world\r\n\r\n" +
+		"retry: 3000\n\n" +
+		"data: cr only\r\r" +
+		"retry: bad\nfoo: bar\n\n" +
+		"data: incomplete"
+
+	var events []*ServerSentEvent
+	r := newSseReader(strings.NewReader(stream), func(ev *ServerSentEvent) {
+		events = append(events, ev)
+	})
+	// read in tiny chunks to cover events split across reads
+	out, err := io.ReadAll(&oneByteReader{r})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(out) != stream {
+		t.Errorf("stream should pass through unchanged")
+	}
+
+	want := []ServerSentEvent{
+		{Id: "1", Event: "token", Data: "hello\nworld"},
+		{Retry: 3000},
+		{Data: "cr only"},
+	}
+	if len(events) != len(want) {
+		t.Fatalf("want %d events, got %d: %+v", len(want), len(events), events)
+	}
+	for i, ev := range events {
+		if *ev != want[i] {
+			t.Errorf("event %d: want %+v, got %+v", i, want[i], *ev)
+		}
+	}
+}
+
+type oneByteReader struct {
+	r io.Reader
+}
+
+func (o *oneByteReader) Read(p []byte) (int, error) {
+	if len(p) == 0 {
+		return 0, nil
+	}
+	return o.r.Read(p[:1])
+}
+
+func TestResponse_IsEventStream(t *testing.T) {
+	for contentType, want := range map[string]bool{
+		"text/event-stream":                true,
+		"text/event-stream; charset=utf-8": true,
+		"text/plain":                       false,
+		"":                                 false,
+	} {
+		r := &Response{Header: http.Header{"Content-Type": {contentType}}}
+		if got := r.IsEventStream(); got != want {
+			t.Errorf("%q: want %v, got %v", contentType, want, got)
+		}
+	}
+	if (*Response)(nil).IsEventStream() {
+		t.Error("nil response is not an event stream")
+	}
+}
+
+type sseRecorderAddon struct {
+	BaseAddon
+	events chan *ServerSentEvent
+}
+
+func (a *sseRecorderAddon) ServerSentEvent(f *Flow, ev *ServerSentEvent) {
+	a.events <- ev
+}
+
+func TestIntegration_ServerSentEvents(t *testing.T) {
+	release := make(chan struct{})
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/event-stream")
+		flusher := w.(http.Flusher)
+		fmt.Fprint(w, "id: 1\ndata: first\n\n")
+		flusher.Flush()
+		<-release
+		fmt.Fprint(w, "event: done\ndata: second\n\n")
+	}))
+	defer backend.Close()
+	defer func() {
+		select {
+		case <-release:
+		default:
+			close(release)
+		}
+	}()
+
+	p, err := NewProxy(&Options{Addr: "127.0.0.1:9102", StreamLargeBodies: 1024 * 1024})
+	if err != nil {
+		t.Fatal(err)
+	}
+	addon := &sseRecorderAddon{events: make(chan *ServerSentEvent, 2)}
+	p.AddAddon(addon)
+	go p.Start()
+	defer p.Close()
+	time.Sleep(100 * time.Millisecond)
+
+	proxyURL, _ := url.Parse("http://127.0.0.1:9102")
+	client := &http.Client{Transport: &http.Transport{Proxy: http.ProxyURL(proxyURL)}}
+	resp, err := client.Get(backend.URL + "/events")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+
+	// the first event arrives while the server is still streaming
+	reader := bufio.NewReader(resp.Body)
+	lines := make(chan string, 1)
+	go func() {
+		line, _ := reader.ReadString('\n')
+		lines <- line
+	}()
+	select {
+	case line := <-lines:
+		if line != "id: 1\n" {
+			t.Errorf("unexpected first line %q", line)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("event stream is buffered by the proxy")
+	}
+	select {
+	case ev := <-addon.events:
+		if ev.Id != "1" || ev.Data != "first" {
+			t.Errorf("unexpected event %+v", ev)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("ServerSentEvent not fired")
+	}
+
+	close(release)
+	rest, _ := io.ReadAll(reader)
+	if !strings.Contains(string(rest), "data: second") {
+		t.Errorf("unexpected rest of stream %q", rest)
+	}
+	select {
+	case ev := <-addon.events:
+		if ev.Event != "done" || ev.Data != "second" {
+			t.Errorf("unexpected event %+v", ev)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("ServerSentEvent not fired")
+	}
+}
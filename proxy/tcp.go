@@ -0,0 +1,118 @@
+package proxy
+
+import (
+	"encoding/json"
+	"net"
+	"time"
+
+	uuid "github.com/satori/go.uuid"
+	log "github.com/sirupsen/logrus"
+	"go.uber.org/atomic"
+)
+
+// tcp chunk of a TcpFlow
+type TcpMessage struct {
+	FromClient bool // true if chunk is from client, false if from server
+	Data       []byte
+	Drop       bool // if true, the chunk is not forwarded
+}
+
+// raw tcp stream, when the traffic is neither http nor intercepted tls
+type TcpFlow struct {
+	Id          uuid.UUID
+	ConnContext *ConnContext
+	Address     string // server address
+	StartTime   time.Time
+	EndTime     time.Time
+
+	ClientBytes atomic.Int64 // bytes read from client
+	ServerBytes atomic.Int64 // bytes read from server
+
+	// Metadata to pass data between addons
+	Metadata map[string]interface{}
+}
+
+func newTcpFlow(connCtx *ConnContext, address string) *TcpFlow {
+	return &TcpFlow{
+		Id:          uuid.NewV4(),
+		ConnContext: connCtx,
+		Address:     address,
+		StartTime:   time.Now(),
+		Metadata:    make(map[string]interface{}),
+	}
+}
+
+func (f *TcpFlow) MarshalJSON() ([]byte, error) {
+	m := make(map[string]interface{})
+	m["id"] = f.Id
+	m["address"] = f.Address
+	m["startTime"] = f.StartTime.UnixMilli()
+	if !f.EndTime.IsZero() {
+		m["endTime"] = f.EndTime.UnixMilli()
+	}
+	m["clientBytes"] = f.ClientBytes.Load()
+	m["serverBytes"] = f.ServerBytes.Load()
+	if f.ConnContext != nil {
+		m["connId"] = f.ConnContext.Id().String()
+	}
+	return json.Marshal(m)
+}
+
+// relay server and client, trigger addon events TcpStart, TcpMessage and TcpEnd
+func (proxy *Proxy) tcpRelay(f *TcpFlow, server, client net.Conn) {
+	log := log.WithFields(log.Fields{
+		"in":   "Proxy.tcpRelay",
+		"host": f.Address,
+	})
+	defer proxy.conns.relay()()
+
+	for _, addon := range proxy.addons() {
+		addon.TcpStart(f)
+	}
+
+	pipe := func(dst, src net.Conn, fromClient bool, done chan<- struct{}) {
+		defer func() {
+			// unblock the other direction
+			dst.Close()
+			done <- struct{}{}
+		}()
+		buf := make([]byte, 32*1024)
+		for {
+			n, err := src.Read(buf)
+			if n > 0 {
+				if fromClient {
+					f.ClientBytes.Add(int64(n))
+				} else {
+					f.ServerBytes.Add(int64(n))
+				}
+				data := make([]byte, n)
+				copy(data, buf[:n])
+				msg := &TcpMessage{FromClient: fromClient, Data: data}
+				for _, addon := range proxy.addons() {
+					addon.TcpMessage(f, msg)
+				}
+				if !msg.Drop && len(msg.Data) > 0 {
+					if _, werr := dst.Write(msg.Data); werr != nil {
+						log.Debugf("tcp write end, fromClient %v: %v", fromClient, werr)
+						return
+					}
+				}
+			}
+			if err != nil {
+				log.Debugf("tcp read end, fromClient %v: %v", fromClient, err)
+				return
+			}
+		}
+	}
+
+	done := make(chan struct{}, 2)
+	go pipe(server, client, true, done)
+	go pipe(client, server, false, done)
+	<-done
+	<-done
+
+	f.EndTime = time.Now()
+	for _, addon := range proxy.addons() {
+		addon.TcpEnd(f)
+	}
+}
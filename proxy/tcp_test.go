@@ -0,0 +1,316 @@
+package proxy
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/tls"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"golang.org/x/net/http2"
+	"golang.org/x/net/http2/h2c"
+)
+
+type tcpRecorderAddon struct {
+	BaseAddon
+	mu       sync.Mutex
+	started  int
+	messages []*TcpMessage
+	ended    chan *TcpFlow
+}
+
+func (a *tcpRecorderAddon) TcpStart(f *TcpFlow) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.started++
+}
+
+func (a *tcpRecorderAddon) TcpMessage(f *TcpFlow, msg *TcpMessage) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.messages = append(a.messages, &TcpMessage{FromClient: msg.FromClient, Data: append([]byte(nil), msg.Data...)})
+	if msg.FromClient {
+		msg.Data = bytes.ToUpper(msg.Data)
+	} else if string(msg.Data) == "secret" {
+		msg.Drop = true
+	}
+}
+
+func (a *tcpRecorderAddon) TcpEnd(f *TcpFlow) {
+	a.ended <- f
+}
+
+type tcpEndAddon struct {
+	BaseAddon
+	ended chan *TcpFlow
+}
+
+func (a *tcpEndAddon) TcpEnd(f *TcpFlow) {
+	a.ended <- f
+}
+
+func TestProxy_TcpRelay(t *testing.T) {
+	p, _ := NewProxy(&Options{Addr: ":0"})
+	addon := &tcpRecorderAddon{ended: make(chan *TcpFlow, 1)}
+	p.AddAddon(addon)
+
+	clientSide, clientProxySide := net.Pipe()
+	serverProxySide, serverSide := net.Pipe()
+
+	connCtx := newConnContext(clientProxySide, p)
+	f := newTcpFlow(connCtx, "example.com:25")
+	go p.tcpRelay(f, serverProxySide, clientProxySide)
+
+	// modified client chunk
+	go clientSide.Write([]byte("hello"))
+	buf := make([]byte, 16)
+	n, err := serverSide.Read(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(buf[:n]) != "HELLO" {
+		t.Errorf("want HELLO, got %q", buf[:n])
+	}
+
+	// dropped server chunk, then a forwarded one
+	go func() {
+		serverSide.Write([]byte("secret"))
+		serverSide.Write([]byte("public"))
+	}()
+	n, err = clientSide.Read(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(buf[:n]) != "public" {
+		t.Errorf("want public, got %q", buf[:n])
+	}
+
+	clientSide.Close()
+
+	select {
+	case ended := <-addon.ended:
+		if ended.ClientBytes.Load() != 5 || ended.ServerBytes.Load() != 12 {
+			t.Errorf("unexpected byte counts %v/%v", ended.ClientBytes.Load(), ended.ServerBytes.Load())
+		}
+		if ended.EndTime.IsZero() {
+			t.Error("expected end time")
+		}
+	case <-time.After(time.Second):
+		t.Fatal("TcpEnd not triggered")
+	}
+
+	addon.mu.Lock()
+	defer addon.mu.Unlock()
+	if addon.started != 1 || len(addon.messages) != 3 {
+		t.Errorf("unexpected events: started %v, messages %v", addon.started, len(addon.messages))
+	}
+}
+
+func TestIntegration_TcpInConnectTunnel(t *testing.T) {
+	// line echo server, non http and non tls
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	go func() {
+		for {
+			c, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer c.Close()
+				line, _ := bufio.NewReader(c).ReadString('\n')
+				io.WriteString(c, "echo "+line)
+			}()
+		}
+	}()
+	target := ln.Addr().String()
+
+	cases := []struct {
+		name      string
+		intercept bool
+		upstream  bool
+	}{
+		{"dial first", true, true},
+		{"lazy", true, false},
+		{"direct", false, true},
+	}
+	for i, tc := range cases {
+		addr := fmt.Sprintf("127.0.0.1:%v", 9097+i)
+		p, err := NewProxy(&Options{Addr: addr})
+		if err != nil {
+			t.Fatal(err)
+		}
+		p.AddAddon(NewUpstreamCertAddon(tc.upstream))
+		if !tc.intercept {
+			p.SetShouldInterceptRule(func(*http.Request) bool { return false })
+		}
+		addon := &tcpEndAddon{ended: make(chan *TcpFlow, 1)}
+		p.AddAddon(addon)
+		go p.Start()
+		time.Sleep(100 * time.Millisecond)
+
+		conn, err := net.Dial("tcp", addr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		fmt.Fprintf(conn, "CONNECT %v HTTP/1.1\r\nHost: %v\r\n\r\n", target, target)
+		br := bufio.NewReader(conn)
+		resp, err := http.ReadResponse(br, nil)
+		if err != nil || resp.StatusCode != 200 {
+			t.Fatalf("%v: connect failed: %v", tc.name, err)
+		}
+		io.WriteString(conn, "ping\n")
+		line, _ := br.ReadString('\n')
+		if line != "echo ping\n" {
+			t.Errorf("%v: unexpected reply %q", tc.name, line)
+		}
+		conn.Close()
+
+		select {
+		case f := <-addon.ended:
+			if f.Address != target || f.ClientBytes.Load() != 5 || f.ServerBytes.Load() != 10 {
+				t.Errorf("%v: unexpected tcp flow %v %v/%v", tc.name, f.Address, f.ClientBytes.Load(), f.ServerBytes.Load())
+			}
+		case <-time.After(2 * time.Second):
+			t.Errorf("%v: TcpEnd not triggered", tc.name)
+		}
+		p.Close()
+	}
+}
+
+func TestIntegration_H2cInConnectTunnel(t *testing.T) {
+	backend := httptest.NewServer(h2c.NewHandler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintf(w, "%v %v", r.Proto, r.URL.Path)
+	}), &http2.Server{}))
+	defer backend.Close()
+	target := backend.Listener.Addr().String()
+
+	for _, upstream := range []bool{true, false} {
+		t.Run(fmt.Sprintf("upstream cert %v", upstream), func(t *testing.T) {
+			p, err := NewProxy(&Options{StreamLargeBodies: 1024 * 1024})
+			if err != nil {
+				t.Fatal(err)
+			}
+			p.AddAddon(NewUpstreamCertAddon(upstream))
+			flows := make(chan *Flow, 1)
+			p.AddAddon(&flowCollector{flows: flows})
+			proxyAddr := listenTestProxy(t, p)
+
+			client := &http.Client{
+				Transport: &http2.Transport{
+					AllowHTTP: true,
+					DialTLSContext: func(ctx context.Context, network, addr string, cfg *tls.Config) (net.Conn, error) {
+						conn, err := net.Dial("tcp", proxyAddr)
+						if err != nil {
+							return nil, err
+						}
+						fmt.Fprintf(conn, "CONNECT %v HTTP/1.1\r\nHost: %v\r\n\r\n", target, target)
+						resp, err := http.ReadResponse(bufio.NewReader(conn), nil)
+						if err != nil || resp.StatusCode != 200 {
+							conn.Close()
+							return nil, fmt.Errorf("connect failed: %v", err)
+						}
+						return conn, nil
+					},
+				},
+			}
+			resp, err := client.Get("http://" + target + "/h2c")
+			if err != nil {
+				t.Fatal(err)
+			}
+			body, _ := io.ReadAll(resp.Body)
+			resp.Body.Close()
+			if string(body) != "HTTP/2.0 /h2c" {
+				t.Errorf("want h2c end to end, got %q", body)
+			}
+			select {
+			case f := <-flows:
+				if f.Request.Proto != "HTTP/2.0" || f.Request.URL.String() != "http://"+target+"/h2c" {
+					t.Errorf("unexpected flow %v %v", f.Request.Proto, f.Request.URL)
+				}
+			case <-time.After(time.Second):
+				t.Error("want the flow intercepted")
+			}
+		})
+	}
+}
+
+func TestIntegration_ServerFirstInConnectTunnel(t *testing.T) {
+	defer func(timeout time.Duration) { serverFirstTimeout = timeout }(serverFirstTimeout)
+	serverFirstTimeout = 100 * time.Millisecond
+
+	// smtp like server, greets the client before it sends anything
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	go func() {
+		for {
+			c, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer c.Close()
+				io.WriteString(c, "220 ready\r\n")
+				line, _ := bufio.NewReader(c).ReadString('\n')
+				io.WriteString(c, "250 "+line)
+			}()
+		}
+	}()
+	target := ln.Addr().String()
+
+	for _, upstream := range []bool{true, false} {
+		t.Run(fmt.Sprintf("upstream cert %v", upstream), func(t *testing.T) {
+			p, err := NewProxy(&Options{})
+			if err != nil {
+				t.Fatal(err)
+			}
+			p.AddAddon(NewUpstreamCertAddon(upstream))
+			addon := &tcpEndAddon{ended: make(chan *TcpFlow, 1)}
+			p.AddAddon(addon)
+			proxyAddr := listenTestProxy(t, p)
+
+			conn, err := net.Dial("tcp", proxyAddr)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer conn.Close()
+			fmt.Fprintf(conn, "CONNECT %v HTTP/1.1\r\nHost: %v\r\n\r\n", target, target)
+			br := bufio.NewReader(conn)
+			resp, err := http.ReadResponse(br, nil)
+			if err != nil || resp.StatusCode != 200 {
+				t.Fatalf("connect failed: %v", err)
+			}
+			conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+			if line, _ := br.ReadString('\n'); line != "220 ready\r\n" {
+				t.Fatalf("want the greeting of the server, got %q", line)
+			}
+			io.WriteString(conn, "HELO a\r\n")
+			if line, _ := br.ReadString('\n'); line != "250 HELO a\r\n" {
+				t.Errorf("unexpected reply %q", line)
+			}
+			conn.Close()
+
+			select {
+			case f := <-addon.ended:
+				if f.Address != target {
+					t.Errorf("unexpected tcp flow %v", f.Address)
+				}
+			case <-time.After(2 * time.Second):
+				t.Error("TcpEnd not triggered")
+			}
+		})
+	}
+}
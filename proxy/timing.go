@@ -0,0 +1,166 @@
+package proxy
+
+import (
+	"context"
+	"net/http/httptrace"
+	"sync"
+	"time"
+
+	"golang.org/x/net/idna"
+)
+
+// ConnTiming holds the timestamps of a client connection and its server connection.
+// A timestamp is zero if the phase did not happen, e.g. no dns lookup when an upstream proxy is used.
+type ConnTiming struct {
+	ClientConnected time.Time `json:"clientConnected,omitzero"`
+	ClientTlsStart  time.Time `json:"clientTlsStart,omitzero"`
+	ClientTlsDone   time.Time `json:"clientTlsDone,omitzero"`
+	DnsStart        time.Time `json:"dnsStart,omitzero"`
+	DnsDone         time.Time `json:"dnsDone,omitzero"`
+	TcpConnectStart time.Time `json:"tcpConnectStart,omitzero"`
+	TcpConnectDone  time.Time `json:"tcpConnectDone,omitzero"`
+	ServerTlsStart  time.Time `json:"serverTlsStart,omitzero"`
+	ServerTlsDone   time.Time `json:"serverTlsDone,omitzero"`
+}
+
+// FlowTiming holds the timestamps of a flow, zero if not reached
+type FlowTiming struct {
+	Start             time.Time `json:"start,omitzero"`             // request headers received from client
+	RequestSent       time.Time `json:"requestSent,omitzero"`       // request fully sent to server
+	FirstResponseByte time.Time `json:"firstResponseByte,omitzero"` // first byte of the response headers received from server
+	ResponseComplete  time.Time `json:"responseComplete,omitzero"`  // response body fully received, or sent to client when streamed
+	ConnReused        bool      `json:"connReused"`                 // the connection was used by an earlier flow
+}
+
+// TTFB returns the time from the request sent to the first response byte, 0 if not measured
+func (t *FlowTiming) TTFB() time.Duration {
+	return since(t.RequestSent, t.FirstResponseByte)
+}
+
+// Duration returns the time from the request headers received to the response complete, 0 if not measured
+func (t *FlowTiming) Duration() time.Duration {
+	return since(t.Start, t.ResponseComplete)
+}
+
+func since(start, end time.Time) time.Duration {
+	if start.IsZero() || end.IsZero() {
+		return 0
+	}
+	return end.Sub(start)
+}
+
+// flowTrace records the timestamps of the request to the server. The trace callbacks may run on the
+// goroutines of the transport, the goroutine handling the flow copies them to the flow timing with apply.
+type flowTrace struct {
+	mu                sync.Mutex
+	requestSent       time.Time
+	firstResponseByte time.Time
+}
+
+// trace the request to the server
+func withFlowTrace(ctx context.Context) (context.Context, *flowTrace) {
+	t := new(flowTrace)
+	return httptrace.WithClientTrace(ctx, &httptrace.ClientTrace{
+		WroteRequest: func(httptrace.WroteRequestInfo) {
+			t.mark(&t.requestSent)
+		},
+		GotFirstResponseByte: func() {
+			t.mark(&t.firstResponseByte)
+		},
+	}), t
+}
+
+func (t *flowTrace) mark(ts *time.Time) {
+	now := time.Now()
+	t.mu.Lock()
+	*ts = now
+	t.mu.Unlock()
+}
+
+// apply sets the timestamps recorded so far to the timing of f
+func (t *flowTrace) apply(f *Flow) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if !t.requestSent.IsZero() {
+		f.Timing.RequestSent = t.requestSent
+	}
+	if !t.firstResponseByte.IsZero() {
+		f.Timing.FirstResponseByte = t.firstResponseByte
+	}
+}
+
+// dnsTrace times the lookups of the dialer. fastdialer resolves the host inside Dial, unless it has cached
+// the addresses of the connection, and calls OnBeforeDial in the dialing goroutine once it has them.
+// Concurrent dials of a host share the lookup, so they are all marked resolved by the first call.
+type dnsTrace struct {
+	mu    sync.Mutex
+	dials map[string]map[*dnsDial]struct{} // dials in flight by hostname
+}
+
+type dnsDial struct {
+	host     string
+	resolved time.Time // zero if the dialer did not resolve
+}
+
+func newDnsTrace() *dnsTrace {
+	return &dnsTrace{dials: make(map[string]map[*dnsDial]struct{})}
+}
+
+// start tracks a dial of host until done
+func (t *dnsTrace) start(host string) *dnsDial {
+	if t == nil {
+		return nil
+	}
+	// fastdialer reports the hostname in ascii
+	if ascii, err := idna.ToASCII(host); err == nil {
+		host = ascii
+	}
+	d := &dnsDial{host: host}
+	t.mu.Lock()
+	if t.dials[host] == nil {
+		t.dials[host] = make(map[*dnsDial]struct{})
+	}
+	t.dials[host][d] = struct{}{}
+	t.mu.Unlock()
+	return d
+}
+
+// done stops tracking d and returns when the dialer resolved its host, zero if it did not
+func (t *dnsTrace) done(d *dnsDial) time.Time {
+	if t == nil {
+		return time.Time{}
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	delete(t.dials[d.host], d)
+	if len(t.dials[d.host]) == 0 {
+		delete(t.dials, d.host)
+	}
+	return d.resolved
+}
+
+// onBeforeDial is the fastdialer.Options.OnBeforeDial callback
+func (t *dnsTrace) onBeforeDial(hostname, ip, port string) {
+	now := time.Now()
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	for d := range t.dials[hostname] {
+		if d.resolved.IsZero() {
+			d.resolved = now
+		}
+	}
+}
+
+var connTimingCtxKey = ctxKey("connTiming")
+
+// the conn timing of the connection the dial is for: the one of a pooled connection,
+// else the one of the client connection, a throwaway one if there is none
+func connTimingFromContext(ctx context.Context) *ConnTiming {
+	if timing, ok := ctx.Value(connTimingCtxKey).(*ConnTiming); ok {
+		return timing
+	}
+	if connCtx, ok := ctx.Value(connContextKey).(*ConnContext); ok && connCtx != nil {
+		return &connCtx.Timing
+	}
+	return new(ConnTiming)
+}
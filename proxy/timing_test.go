@@ -0,0 +1,173 @@
+package proxy
+
+import (
+	"io"
+	"net/http"
+	"sync"
+	"testing"
+	"time"
+)
+
+type recordedTiming struct {
+	flow FlowTiming
+	conn ConnTiming
+}
+
+type timingRecorderAddon struct {
+	BaseAddon
+	timings chan recordedTiming
+}
+
+func (a *timingRecorderAddon) Response(f *Flow) {
+	a.timings <- recordedTiming{f.Timing, f.ConnTiming()}
+}
+
+func TestFlowTiming(t *testing.T) {
+	helper := &testProxyHelper{
+		server: &http.Server{
+			Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				time.Sleep(50 * time.Millisecond)
+				w.Write([]byte("ok"))
+			}),
+		},
+		proxyAddr: ":29090",
+	}
+	helper.init(t)
+	testProxy := helper.testProxy
+	addon := &timingRecorderAddon{timings: make(chan recordedTiming, 1)}
+	testProxy.AddAddon(addon)
+	defer helper.ln.Close()
+	go helper.server.Serve(helper.ln)
+	defer helper.tlsPlainLn.Close()
+	go helper.server.ServeTLS(helper.tlsPlainLn, "", "")
+	go testProxy.Start()
+	time.Sleep(time.Millisecond * 10) // wait for test proxy startup
+
+	for _, tc := range []struct {
+		name     string
+		endpoint string
+		tls      bool
+	}{
+		{"http", helper.httpEndpoint, false},
+		{"https", helper.httpsEndpoint, true},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			resp, err := helper.getProxyClient().Get(tc.endpoint)
+			if err != nil {
+				t.Fatal(err)
+			}
+			io.ReadAll(resp.Body)
+			resp.Body.Close()
+
+			var recorded recordedTiming
+			select {
+			case recorded = <-addon.timings:
+			case <-time.After(time.Second):
+				t.Fatal("Response not fired")
+			}
+			ft, ct := recorded.flow, recorded.conn
+
+			ordered := []time.Time{ft.Start, ft.RequestSent, ft.FirstResponseByte, ft.ResponseComplete}
+			for i, ts := range ordered {
+				if ts.IsZero() || (i > 0 && ts.Before(ordered[i-1])) {
+					t.Fatalf("unexpected flow timing %+v", ft)
+				}
+			}
+			if ft.TTFB() < 50*time.Millisecond || ft.Duration() < ft.TTFB() {
+				t.Errorf("unexpected ttfb %v duration %v", ft.TTFB(), ft.Duration())
+			}
+			if ft.ConnReused {
+				t.Error("first flow of the connection should not be reused")
+			}
+
+			if ct.ClientConnected.IsZero() || ct.DnsDone.Before(ct.DnsStart) || ct.TcpConnectStart.IsZero() || ct.TcpConnectDone.Before(ct.TcpConnectStart) {
+				t.Errorf("unexpected conn timing %+v", ct)
+			}
+			// the dialer resolves the host of a new address, the connect starts once it has
+			if ct.DnsStart.IsZero() || !ct.DnsDone.Equal(ct.TcpConnectStart) {
+				t.Errorf("want the lookup of the dialer timed, got %+v", ct)
+			}
+			if tc.tls != !ct.ServerTlsDone.IsZero() || tc.tls != !ct.ClientTlsDone.IsZero() {
+				t.Errorf("unexpected tls timing %+v", ct)
+			}
+		})
+	}
+}
+
+type poolTimingRecorderAddon struct {
+	BaseAddon
+	timings chan recordedTiming
+	hits    chan bool
+}
+
+func (a *poolTimingRecorderAddon) Response(f *Flow) {
+	a.timings <- recordedTiming{f.Timing, f.ConnTiming()}
+	a.hits <- f.ConnPoolHit
+}
+
+func TestFlowTiming_ConnPool(t *testing.T) {
+	helper := &testProxyHelper{
+		server: &http.Server{
+			Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				time.Sleep(20 * time.Millisecond)
+				w.Write([]byte("ok"))
+			}),
+			// one stream per connection, so concurrent requests dial connections of their own
+			HTTP2: &http.HTTP2Config{MaxConcurrentStreams: 1},
+		},
+	}
+	helper.init(t)
+	helper.server.TLSConfig.NextProtos = []string{"h2", "http/1.1"}
+	defer helper.tlsPlainLn.Close()
+	go helper.server.ServeTLS(helper.tlsPlainLn, "", "")
+	testProxy := helper.testProxy
+	testProxy.Opts.ConnPool = true
+	testProxy.connPool = newConnPool(testProxy)
+	addon := &poolTimingRecorderAddon{timings: make(chan recordedTiming, 9), hits: make(chan bool, 9)}
+	testProxy.AddAddon(addon)
+	client := serveTestProxy(t, testProxy)
+	client.Transport.(*http.Transport).ForceAttemptHTTP2 = true
+	defer client.CloseIdleConnections()
+
+	get := func() {
+		resp, err := client.Get(helper.httpsEndpoint)
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		io.ReadAll(resp.Body)
+		resp.Body.Close()
+	}
+	// opens the client connection
+	get()
+
+	// then its streams dial pooled connections concurrently
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			get()
+		}()
+	}
+	wg.Wait()
+
+	dialed := 0
+	for i := 0; i < 9; i++ {
+		recorded, hit := <-addon.timings, <-addon.hits
+		ct := recorded.conn
+		if ct.ClientTlsDone.IsZero() {
+			t.Errorf("want the client tls timed, got %+v", ct)
+		}
+		// each dial is timed on the flow which got the connection
+		if !hit && !ct.ServerTlsDone.IsZero() {
+			dialed++
+			if ct.TcpConnectDone.Before(ct.TcpConnectStart) || ct.ServerTlsStart.IsZero() || ct.ServerTlsDone.Before(ct.ServerTlsStart) {
+				t.Errorf("unexpected timing of the dialed connection %+v", ct)
+			}
+		}
+	}
+	if dialed < 2 {
+		t.Errorf("%d flows dialed their connection, want the concurrent ones too", dialed)
+	}
+}
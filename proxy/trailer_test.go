@@ -0,0 +1,181 @@
+package proxy
+
+import (
+	"crypto/tls"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+)
+
+type trailerRecorderAddon struct {
+	BaseAddon
+	trailers chan http.Header
+}
+
+func (a *trailerRecorderAddon) Response(f *Flow) {
+	a.trailers <- f.Response.Trailer.Clone()
+}
+
+func TestTrailers(t *testing.T) {
+	helper := &testProxyHelper{
+		server: &http.Server{
+			Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				io.ReadAll(r.Body)
+				w.Header().Set("Trailer", "Grpc-Status")
+				w.Write([]byte("body"))
+				w.Header().Set("Grpc-Status", "0")
+				// undeclared trailer
+				w.Header().Set(http.TrailerPrefix+"X-Echo", r.Trailer.Get("X-Checksum"))
+			}),
+		},
+		proxyAddr: ":29089",
+	}
+	helper.init(t)
+	helper.server.TLSConfig.NextProtos = []string{"h2"}
+	testProxy := helper.testProxy
+	addon := &trailerRecorderAddon{trailers: make(chan http.Header, 1)}
+	testProxy.AddAddon(addon)
+	defer helper.ln.Close()
+	go helper.server.Serve(helper.ln)
+	defer helper.tlsPlainLn.Close()
+	go helper.server.ServeTLS(helper.tlsPlainLn, "", "")
+	go testProxy.Start()
+	time.Sleep(time.Millisecond * 10) // wait for test proxy startup
+
+	h2Client := &http.Client{
+		Transport: &http.Transport{
+			ForceAttemptHTTP2: true,
+			TLSClientConfig:   &tls.Config{InsecureSkipVerify: true},
+			Proxy: func(r *http.Request) (*url.URL, error) {
+				return url.Parse("http://127.0.0.1" + helper.proxyAddr)
+			},
+		},
+	}
+
+	for _, tc := range []struct {
+		name     string
+		endpoint string
+		client   *http.Client
+		proto    int
+	}{
+		{"http", helper.httpEndpoint, helper.getProxyClient(), 1},
+		{"h2", helper.httpsEndpoint, h2Client, 2},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			// unknown length, so the request body is chunked and can carry trailers
+			req, _ := http.NewRequest("POST", tc.endpoint, io.MultiReader(strings.NewReader("request")))
+			req.Trailer = http.Header{"X-Checksum": {"abc"}}
+			resp, err := tc.client.Do(req)
+			if err != nil {
+				t.Fatal(err)
+			}
+			body, _ := io.ReadAll(resp.Body)
+			resp.Body.Close()
+			if string(body) != "body" || resp.ProtoMajor != tc.proto {
+				t.Errorf("unexpected response %v %q", resp.Proto, body)
+			}
+			if resp.Trailer.Get("Grpc-Status") != "0" || resp.Trailer.Get("X-Echo") != "abc" {
+				t.Errorf("trailers not forwarded: %v", resp.Trailer)
+			}
+
+			select {
+			case trailer := <-addon.trailers:
+				if trailer.Get("Grpc-Status") != "0" || trailer.Get("X-Echo") != "abc" {
+					t.Errorf("unexpected trailers on Response: %v", trailer)
+				}
+			case <-time.After(time.Second):
+				t.Fatal("Response not fired")
+			}
+		})
+	}
+}
+
+// streamTrailerAddon streams the response of the requests with X-Stream
+type streamTrailerAddon struct {
+	trailerRecorderAddon
+}
+
+func (a *streamTrailerAddon) Requestheaders(f *Flow) {
+	f.Stream = f.Request.Header.Get("X-Stream") != ""
+}
+
+func TestTrailers_Undeclared(t *testing.T) {
+	helper := &testProxyHelper{
+		server: &http.Server{
+			Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				// no Trailer header at all, like grpc-status of a grpc error, the flush makes the h1 body chunked
+				w.Write([]byte("body"))
+				w.(http.Flusher).Flush()
+				w.Header().Set(http.TrailerPrefix+"Grpc-Status", "5")
+			}),
+		},
+		proxyAddr: ":29102",
+	}
+	helper.init(t)
+	helper.server.TLSConfig.NextProtos = []string{"h2"}
+	testProxy := helper.testProxy
+	addon := &streamTrailerAddon{trailerRecorderAddon{trailers: make(chan http.Header, 1)}}
+	testProxy.AddAddon(addon)
+	defer helper.ln.Close()
+	go helper.server.Serve(helper.ln)
+	defer helper.tlsPlainLn.Close()
+	go helper.server.ServeTLS(helper.tlsPlainLn, "", "")
+	go testProxy.Start()
+	time.Sleep(time.Millisecond * 10) // wait for test proxy startup
+
+	h2Client := &http.Client{
+		Transport: &http.Transport{
+			ForceAttemptHTTP2: true,
+			TLSClientConfig:   &tls.Config{InsecureSkipVerify: true},
+			Proxy: func(r *http.Request) (*url.URL, error) {
+				return url.Parse("http://127.0.0.1" + helper.proxyAddr)
+			},
+		},
+	}
+
+	for _, tc := range []struct {
+		name     string
+		endpoint string
+		client   *http.Client
+		stream   bool
+	}{
+		{"http", helper.httpEndpoint, helper.getProxyClient(), false},
+		{"h2", helper.httpsEndpoint, h2Client, false},
+		{"http stream", helper.httpEndpoint, helper.getProxyClient(), true},
+		{"h2 stream", helper.httpsEndpoint, h2Client, true},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			req, _ := http.NewRequest("GET", tc.endpoint, nil)
+			if tc.stream {
+				req.Header.Set("X-Stream", "1")
+			}
+			resp, err := tc.client.Do(req)
+			if err != nil {
+				t.Fatal(err)
+			}
+			body, _ := io.ReadAll(resp.Body)
+			resp.Body.Close()
+			if string(body) != "body" {
+				t.Errorf("unexpected body %q", body)
+			}
+			if resp.Trailer.Get("Grpc-Status") != "5" {
+				t.Errorf("trailer not forwarded: %v", resp.Trailer)
+			}
+
+			if tc.stream {
+				return
+			}
+			select {
+			case trailer := <-addon.trailers:
+				if trailer.Get("Grpc-Status") != "5" {
+					t.Errorf("unexpected trailers on Response: %v", trailer)
+				}
+			case <-time.After(time.Second):
+				t.Fatal("Response not fired")
+			}
+		})
+	}
+}
@@ -0,0 +1,236 @@
+package proxy
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"github.com/retutils/gomitmproxy/internal/helper"
+	"github.com/samber/lo"
+	log "github.com/sirupsen/logrus"
+	"github.com/tidwall/match"
+)
+
+// UpstreamDirect as UpstreamRule.Upstream connects to the server without upstream proxy
+const UpstreamDirect = "DIRECT"
+
+// UpstreamRule sends the requests it matches through Upstream.
+// A rule matches if each of its non-empty criteria matches, hosts and cidrs match if any of them does.
+type UpstreamRule struct {
+	Hosts    []string `json:"hosts"`    // host globs with optional port, e.g. *.corp, api-*.example.com:8443
+	Cidrs    []string `json:"cidrs"`    // server ip ranges or ips, e.g. 10.0.0.0/8, hostnames are resolved
+	Schemes  []string `json:"schemes"`  // http or https, tunneled (CONNECT) requests are https
+	Upstream string   `json:"upstream"` // upstream proxy url (http, https or socks5), or DIRECT
+}
+
+// NewUpstreamRulesFromFile reads a json array of UpstreamRule
+func NewUpstreamRulesFromFile(filename string) ([]*UpstreamRule, error) {
+	var rules []*UpstreamRule
+	if err := helper.NewStructFromFile(filename, &rules); err != nil {
+		return nil, err
+	}
+	return rules, nil
+}
+
+type upstreamRoute struct {
+	hosts    []string
+	nets     []*net.IPNet
+	schemes  []string
+	upstream *url.URL // nil for DIRECT
+}
+
+// upstreamRouter chooses the upstream proxy of a request by Options.UpstreamRules, then Options.UpstreamPac
+type upstreamRouter struct {
+	proxy  *Proxy
+	routes []*upstreamRoute
+	pac    *pacScript // nil if Options.UpstreamPac is not set
+}
+
+func newUpstreamRouter(proxy *Proxy) (*upstreamRouter, error) {
+	router := &upstreamRouter{proxy: proxy}
+	for i, rule := range proxy.Opts.UpstreamRules {
+		route, err := newUpstreamRoute(rule)
+		if err != nil {
+			return nil, fmt.Errorf("upstream rule %v: %w", i, err)
+		}
+		router.routes = append(router.routes, route)
+	}
+	if proxy.Opts.UpstreamPac != "" {
+		src, err := loadPac(proxy.Opts.UpstreamPac)
+		if err != nil {
+			return nil, fmt.Errorf("load pac %v: %w", proxy.Opts.UpstreamPac, err)
+		}
+		pac, err := newPacScript(src, router.resolve)
+		if err != nil {
+			return nil, fmt.Errorf("pac %v: %w", proxy.Opts.UpstreamPac, err)
+		}
+		router.pac = pac
+	}
+	return router, nil
+}
+
+func newUpstreamRoute(rule *UpstreamRule) (*upstreamRoute, error) {
+	route := &upstreamRoute{hosts: rule.Hosts}
+	for _, cidr := range rule.Cidrs {
+		ipNet, err := parseCidr(cidr)
+		if err != nil {
+			return nil, err
+		}
+		route.nets = append(route.nets, ipNet)
+	}
+	for _, scheme := range rule.Schemes {
+		scheme = strings.ToLower(scheme)
+		if scheme != "http" && scheme != "https" {
+			return nil, fmt.Errorf("invalid scheme %v", scheme)
+		}
+		route.schemes = append(route.schemes, scheme)
+	}
+	if strings.EqualFold(rule.Upstream, UpstreamDirect) {
+		return route, nil
+	}
+	if rule.Upstream == "" {
+		return nil, fmt.Errorf("no upstream")
+	}
+	upstream, err := url.Parse(rule.Upstream)
+	if err != nil {
+		return nil, err
+	}
+	if upstream.Scheme != "http" && upstream.Scheme != "https" && upstream.Scheme != "socks5" {
+		return nil, fmt.Errorf("invalid upstream %v", rule.Upstream)
+	}
+	route.upstream = upstream
+	return route, nil
+}
+
+// parseCidr parses an ip range, or a single ip
+func parseCidr(cidr string) (*net.IPNet, error) {
+	if strings.Contains(cidr, "/") {
+		_, ipNet, err := net.ParseCIDR(cidr)
+		return ipNet, err
+	}
+	ip := net.ParseIP(cidr)
+	if ip == nil {
+		return nil, fmt.Errorf("invalid cidr %v", cidr)
+	}
+	bits := 8 * len(ip.To16())
+	if ip.To4() != nil {
+		ip, bits = ip.To4(), 32
+	}
+	return &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)}, nil
+}
+
+// route returns the upstream proxy of req, nil for DIRECT, ok is false if no rule matches and there is no pac
+func (r *upstreamRouter) route(req *http.Request) (proxyUrl *url.URL, ok bool, err error) {
+	scheme, hostname, port := upstreamTarget(req)
+	for _, route := range r.routes {
+		if route.match(r, scheme, hostname, port) {
+			return route.upstream, true, nil
+		}
+	}
+	if r.pac == nil {
+		return nil, false, nil
+	}
+
+	// as browsers, the path of https urls is not exposed to the pac
+	rawUrl := scheme + "://" + net.JoinHostPort(hostname, port) + "/"
+	if port == "80" && scheme == "http" || port == "443" && scheme == "https" {
+		rawUrl = scheme + "://" + hostname + "/"
+	}
+	if scheme == "http" && req.URL != nil && req.URL.IsAbs() {
+		rawUrl = req.URL.String()
+	}
+	result, err := r.pac.findProxy(rawUrl, hostname)
+	if err != nil {
+		return nil, false, err
+	}
+	proxyUrl, err = parsePacResult(result)
+	if err != nil {
+		return nil, false, err
+	}
+	return proxyUrl, true, nil
+}
+
+func (route *upstreamRoute) match(r *upstreamRouter, scheme, hostname, port string) bool {
+	if len(route.schemes) > 0 && !lo.Contains(route.schemes, scheme) {
+		return false
+	}
+	if len(route.hosts) == 0 && len(route.nets) == 0 {
+		return true
+	}
+	for _, host := range route.hosts {
+		if matchHostGlob(hostname, port, host) {
+			return true
+		}
+	}
+	if len(route.nets) == 0 {
+		return false
+	}
+	for _, ip := range r.resolve(hostname) {
+		for _, ipNet := range route.nets {
+			if ipNet.Contains(ip) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// resolve hostname with the proxy resolver, hostname may be an ip
+func (r *upstreamRouter) resolve(hostname string) []net.IP {
+	if ip := net.ParseIP(hostname); ip != nil {
+		return []net.IP{ip}
+	}
+	if r.proxy.fastDialer == nil {
+		return nil
+	}
+	data, err := r.proxy.fastDialer.GetDNSData(hostname)
+	if err != nil {
+		log.Debugf("upstream routing: resolve %v: %v", hostname, err)
+		return nil
+	}
+	var ips []net.IP
+	for _, addr := range append(data.A, data.AAAA...) {
+		if ip := net.ParseIP(addr); ip != nil {
+			ips = append(ips, ip)
+		}
+	}
+	return ips
+}
+
+// scheme, hostname and port of the server req is for, req is received by proxy.server
+func upstreamTarget(req *http.Request) (scheme, hostname, port string) {
+	scheme = "http"
+	if req.Method == http.MethodConnect {
+		scheme = "https"
+	} else if req.URL != nil && req.URL.Scheme != "" {
+		scheme = strings.ToLower(req.URL.Scheme)
+	}
+	host := req.Host
+	if host == "" && req.URL != nil {
+		host = req.URL.Host
+	}
+	hostname, port, err := net.SplitHostPort(host)
+	if err != nil {
+		hostname = strings.TrimSuffix(strings.TrimPrefix(host, "["), "]")
+		port = "80"
+		if scheme == "https" {
+			port = "443"
+		}
+	}
+	return scheme, strings.ToLower(hostname), port
+}
+
+// matchHostGlob reports whether hostname and port match a glob like *.corp or api-*.example.com:8443,
+// *.example.com also matches example.com
+func matchHostGlob(hostname, port, pattern string) bool {
+	h, p := strings.ToLower(pattern), ""
+	if i := strings.LastIndex(h, ":"); i != -1 && !strings.Contains(h[:i], ":") {
+		h, p = h[:i], h[i+1:]
+	}
+	if p != "" && p != port {
+		return false
+	}
+	return match.Match(hostname, h) || strings.HasPrefix(h, "*.") && hostname == h[2:]
+}
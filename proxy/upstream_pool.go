@@ -0,0 +1,328 @@
+package proxy
+
+import (
+	"context"
+	"fmt"
+	"hash/fnv"
+	"math/rand"
+	"net"
+	"net/http"
+	"net/url"
+	"sync"
+	"time"
+
+	"github.com/retutils/gomitmproxy/internal/helper"
+	log "github.com/sirupsen/logrus"
+	"go.uber.org/atomic"
+)
+
+// upstream selection strategies of Options.UpstreamStrategy
+const (
+	UpstreamRoundRobin  = "round-robin"
+	UpstreamRandom      = "random"
+	UpstreamStickyConn  = "sticky-conn" // the same upstream for all requests of a client connection
+	UpstreamStickyHost  = "sticky-host" // the same upstream for all requests to a host
+	UpstreamLeastErrors = "least-errors"
+)
+
+const (
+	upstreamFailCooldown    = 30 * time.Second // an upstream whose dial failed is skipped for this long
+	upstreamHealthTimeout   = 10 * time.Second
+	defaultUpstreamStrategy = UpstreamRoundRobin
+)
+
+// UpstreamStats describes an upstream of the pool
+type UpstreamStats struct {
+	Url       string `json:"url"`
+	Healthy   bool   `json:"healthy"`
+	Dials     uint64 `json:"dials"`  // successful connections through the upstream
+	Errors    uint64 `json:"errors"` // failed connections, including health checks
+	LastError string `json:"lastError"`
+}
+
+type upstreamMember struct {
+	url       *url.URL
+	downUntil atomic.Int64 // unix nano, skipped until then after a failed dial
+	checkDown atomic.Bool  // the last health check failed
+	dials     atomic.Uint64
+	errors    atomic.Uint64
+	lastError atomic.String
+}
+
+func (m *upstreamMember) healthy(now time.Time) bool {
+	return !m.checkDown.Load() && now.UnixNano() >= m.downUntil.Load()
+}
+
+func (m *upstreamMember) fail(err error) {
+	m.errors.Add(1)
+	m.lastError.Store(err.Error())
+	m.downUntil.Store(time.Now().Add(upstreamFailCooldown).UnixNano())
+}
+
+func (m *upstreamMember) succeed() {
+	m.dials.Add(1)
+	m.downUntil.Store(0)
+}
+
+// upstreamPool spreads requests over Options.UpstreamPool, dials fail over to the next upstream
+type upstreamPool struct {
+	proxy       *Proxy
+	strategy    string
+	members     []*upstreamMember
+	next        atomic.Uint32
+	interval    time.Duration // health check interval, 0 if disabled
+	checkTarget string        // host:port connected to through each upstream by health checks
+
+	stopOnce sync.Once
+	done     chan struct{}
+}
+
+func newUpstreamPool(proxy *Proxy) (*upstreamPool, error) {
+	opts := proxy.Opts
+	pool := &upstreamPool{
+		proxy:       proxy,
+		strategy:    opts.UpstreamStrategy,
+		interval:    opts.UpstreamHealthCheck,
+		checkTarget: opts.UpstreamHealthCheckTarget,
+		done:        make(chan struct{}),
+	}
+	switch pool.strategy {
+	case "":
+		pool.strategy = defaultUpstreamStrategy
+	case UpstreamRoundRobin, UpstreamRandom, UpstreamStickyConn, UpstreamStickyHost, UpstreamLeastErrors:
+	default:
+		return nil, fmt.Errorf("invalid upstream strategy %v", pool.strategy)
+	}
+	for _, rawUrl := range opts.UpstreamPool {
+		u, err := url.Parse(rawUrl)
+		if err != nil {
+			return nil, fmt.Errorf("upstream pool %v: %w", rawUrl, err)
+		}
+		if u.Scheme != "http" && u.Scheme != "https" && u.Scheme != "socks5" {
+			return nil, fmt.Errorf("invalid upstream %v", rawUrl)
+		}
+		pool.members = append(pool.members, &upstreamMember{url: u})
+	}
+	return pool, nil
+}
+
+// pick the upstream of req by the strategy, healthy upstreams first
+func (p *upstreamPool) pick(req *http.Request) *upstreamMember {
+	candidates := p.candidates(nil)
+	if len(candidates) == 1 {
+		return candidates[0]
+	}
+	switch p.strategy {
+	case UpstreamRandom:
+		return candidates[rand.Intn(len(candidates))]
+	case UpstreamStickyConn, UpstreamStickyHost:
+		return p.sticky(p.stickyKey(req), candidates)
+	case UpstreamLeastErrors:
+		// ties are spread round-robin
+		start := int(p.next.Inc())
+		var best *upstreamMember
+		for i := range candidates {
+			m := candidates[(start+i)%len(candidates)]
+			if best == nil || m.errors.Load() < best.errors.Load() {
+				best = m
+			}
+		}
+		return best
+	default:
+		return candidates[int(p.next.Inc()-1)%len(candidates)]
+	}
+}
+
+// candidates are the healthy upstreams not tried yet, all not tried ones if none is healthy
+func (p *upstreamPool) candidates(tried map[*upstreamMember]bool) []*upstreamMember {
+	now := time.Now()
+	var healthy, rest []*upstreamMember
+	for _, m := range p.members {
+		if tried[m] {
+			continue
+		}
+		if m.healthy(now) {
+			healthy = append(healthy, m)
+		} else {
+			rest = append(rest, m)
+		}
+	}
+	if len(healthy) > 0 {
+		return healthy
+	}
+	return rest
+}
+
+func (p *upstreamPool) stickyKey(req *http.Request) string {
+	if p.strategy == UpstreamStickyConn {
+		if connCtx, ok := req.Context().Value(connContextKey).(*ConnContext); ok && connCtx != nil {
+			return connCtx.Id().String()
+		}
+	}
+	_, hostname, _ := upstreamTarget(req)
+	return hostname
+}
+
+// the upstream key hashes to among all members, or the next candidate if it is unhealthy
+func (p *upstreamPool) sticky(key string, candidates []*upstreamMember) *upstreamMember {
+	h := fnv.New32a()
+	h.Write([]byte(key))
+	start := int(h.Sum32() % uint32(len(p.members)))
+	for i := range p.members {
+		m := p.members[(start+i)%len(p.members)]
+		for _, c := range candidates {
+			if c == m {
+				return m
+			}
+		}
+	}
+	return candidates[0]
+}
+
+// member returns the pool upstream of u, nil if u is not in the pool
+func (p *upstreamPool) member(u *url.URL) *upstreamMember {
+	for _, m := range p.members {
+		if m.url == u {
+			return m
+		}
+	}
+	s := u.String()
+	for _, m := range p.members {
+		if m.url.String() == s {
+			return m
+		}
+	}
+	return nil
+}
+
+// dial address through m, failing over to the other upstreams until one connects
+func (p *upstreamPool) dial(ctx context.Context, m *upstreamMember, address string) (net.Conn, error) {
+	tried := make(map[*upstreamMember]bool)
+	for {
+		tried[m] = true
+		conn, err := p.proxy.dialProxy(ctx, m.url, address)
+		if err == nil {
+			m.succeed()
+			return conn, nil
+		}
+		m.fail(err)
+		candidates := p.candidates(tried)
+		if len(candidates) == 0 || ctx.Err() != nil {
+			return nil, err
+		}
+		next := candidates[0]
+		if p.strategy == UpstreamRandom {
+			next = candidates[rand.Intn(len(candidates))]
+		}
+		log.Warnf("upstream %v failed to connect %v: %v, failing over to %v", m.url.Redacted(), address, err, next.url.Redacted())
+		m = next
+	}
+}
+
+func (p *upstreamPool) start() {
+	if p.interval <= 0 {
+		return
+	}
+	go func() {
+		p.check()
+		ticker := time.NewTicker(p.interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				p.check()
+			case <-p.done:
+				return
+			}
+		}
+	}()
+}
+
+func (p *upstreamPool) stop() {
+	p.stopOnce.Do(func() {
+		close(p.done)
+	})
+}
+
+// check the health of all upstreams concurrently
+func (p *upstreamPool) check() {
+	var wg sync.WaitGroup
+	for _, m := range p.members {
+		wg.Add(1)
+		go func(m *upstreamMember) {
+			defer wg.Done()
+			err := p.probe(m)
+			wasDown := m.checkDown.Load()
+			if err != nil {
+				m.errors.Add(1)
+				m.lastError.Store(err.Error())
+				m.checkDown.Store(true)
+				if !wasDown {
+					log.Warnf("upstream %v is down: %v", m.url.Redacted(), err)
+				}
+				return
+			}
+			m.checkDown.Store(false)
+			m.downUntil.Store(0)
+			if wasDown {
+				log.Infof("upstream %v is up", m.url.Redacted())
+			}
+		}(m)
+	}
+	wg.Wait()
+}
+
+// probe connects to the upstream, or through it to checkTarget if set
+func (p *upstreamPool) probe(m *upstreamMember) error {
+	ctx, cancel := context.WithTimeout(context.Background(), upstreamHealthTimeout)
+	defer cancel()
+	var conn net.Conn
+	var err error
+	if p.checkTarget != "" {
+		conn, err = helper.GetProxyConn(ctx, m.url, p.checkTarget, p.proxy.Opts.SslInsecure)
+	} else {
+		conn, err = (&net.Dialer{}).DialContext(ctx, "tcp", helper.CanonicalAddr(m.url))
+	}
+	if err != nil {
+		return err
+	}
+	return conn.Close()
+}
+
+func (p *upstreamPool) stats() []UpstreamStats {
+	now := time.Now()
+	stats := make([]UpstreamStats, 0, len(p.members))
+	for _, m := range p.members {
+		stats = append(stats, UpstreamStats{
+			Url:       m.url.Redacted(),
+			Healthy:   m.healthy(now),
+			Dials:     m.dials.Load(),
+			Errors:    m.errors.Load(),
+			LastError: m.lastError.Load(),
+		})
+	}
+	return stats
+}
+
+// upstreamConn is a server connection dialed through an upstream proxy
+type upstreamConn struct {
+	net.Conn
+	upstream *url.URL
+}
+
+// connUpstream returns the upstream proxy conn was dialed through, nil if it is direct
+func connUpstream(conn net.Conn) *url.URL {
+	for conn != nil {
+		switch c := conn.(type) {
+		case *upstreamConn:
+			return c.upstream
+		case *wrapServerConn:
+			conn = c.Conn
+		case interface{ NetConn() net.Conn }:
+			conn = c.NetConn()
+		default:
+			return nil
+		}
+	}
+	return nil
+}
@@ -0,0 +1,289 @@
+package proxy
+
+import (
+	"bufio"
+	"context"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"testing"
+	"time"
+
+	uuid "github.com/satori/go.uuid"
+)
+
+// startConnectProxy starts a http proxy which only tunnels CONNECT requests
+func startConnectProxy(t *testing.T) (string, func()) {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				req, err := http.ReadRequest(bufio.NewReader(conn))
+				if err != nil || req.Method != "CONNECT" {
+					return
+				}
+				server, err := net.Dial("tcp", req.Host)
+				if err != nil {
+					conn.Write([]byte("HTTP/1.1 502 Bad Gateway\r\n\r\n"))
+					return
+				}
+				defer server.Close()
+				conn.Write([]byte("HTTP/1.1 200 Connection Established\r\n\r\n"))
+				go io.Copy(server, conn)
+				io.Copy(conn, server)
+			}()
+		}
+	}()
+	return "http://" + ln.Addr().String(), func() { ln.Close() }
+}
+
+// address nothing listens on
+func deadAddr(t *testing.T) string {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := ln.Addr().String()
+	ln.Close()
+	return addr
+}
+
+func newTestUpstreamPool(t *testing.T, strategy string, upstreams ...string) *upstreamPool {
+	t.Helper()
+	pool, err := newUpstreamPool(&Proxy{Opts: &Options{UpstreamPool: upstreams, UpstreamStrategy: strategy}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return pool
+}
+
+func TestUpstreamPool_Pick(t *testing.T) {
+	upstreams := []string{"http://a:3128", "http://b:3128", "socks5://c:1080"}
+	connect := func(host string) *http.Request {
+		return &http.Request{Method: "CONNECT", Host: host + ":443"}
+	}
+
+	t.Run("round-robin", func(t *testing.T) {
+		pool := newTestUpstreamPool(t, "", upstreams...)
+		for i := 0; i < 6; i++ {
+			if got := pool.pick(connect("example.com")).url.String(); got != upstreams[i%3] {
+				t.Errorf("pick %d: want %v, got %v", i, upstreams[i%3], got)
+			}
+		}
+		// unhealthy upstreams are skipped
+		pool.members[1].fail(io.EOF)
+		for i := 0; i < 4; i++ {
+			if got := pool.pick(connect("example.com")); got == pool.members[1] {
+				t.Errorf("pick %d: unhealthy upstream picked", i)
+			}
+		}
+		// all unhealthy, pick among all
+		pool.members[0].checkDown.Store(true)
+		pool.members[2].checkDown.Store(true)
+		if got := pool.pick(connect("example.com")); got == nil {
+			t.Error("want an upstream when none is healthy")
+		}
+	})
+
+	t.Run("random", func(t *testing.T) {
+		pool := newTestUpstreamPool(t, UpstreamRandom, upstreams...)
+		seen := make(map[*upstreamMember]bool)
+		for i := 0; i < 100; i++ {
+			seen[pool.pick(connect("example.com"))] = true
+		}
+		if len(seen) != 3 {
+			t.Errorf("want all upstreams picked, got %v", len(seen))
+		}
+	})
+
+	t.Run("sticky-host", func(t *testing.T) {
+		pool := newTestUpstreamPool(t, UpstreamStickyHost, upstreams...)
+		seen := make(map[*upstreamMember]bool)
+		for _, host := range []string{"a.com", "b.com", "c.com", "d.com", "e.com", "f.com", "g.com"} {
+			first := pool.pick(connect(host))
+			seen[first] = true
+			for i := 0; i < 3; i++ {
+				if got := pool.pick(connect(host)); got != first {
+					t.Errorf("%v: want %v, got %v", host, first.url, got.url)
+				}
+			}
+			// an unhealthy sticky upstream is replaced until it is healthy again
+			first.checkDown.Store(true)
+			if got := pool.pick(connect(host)); got == first {
+				t.Errorf("%v: unhealthy upstream picked", host)
+			}
+			first.checkDown.Store(false)
+		}
+		if len(seen) < 2 {
+			t.Error("want hosts spread over the upstreams")
+		}
+	})
+
+	t.Run("sticky-conn", func(t *testing.T) {
+		pool := newTestUpstreamPool(t, UpstreamStickyConn, upstreams...)
+		connCtx := &ConnContext{ClientConn: &ClientConn{Id: uuid.NewV4()}}
+		req := connect("a.com").WithContext(context.WithValue(context.Background(), connContextKey, connCtx))
+		first := pool.pick(req)
+		for _, host := range []string{"b.com", "c.com", "d.com"} {
+			req := connect(host).WithContext(req.Context())
+			if got := pool.pick(req); got != first {
+				t.Errorf("%v: want %v, got %v", host, first.url, got.url)
+			}
+		}
+	})
+
+	t.Run("least-errors", func(t *testing.T) {
+		pool := newTestUpstreamPool(t, UpstreamLeastErrors, upstreams...)
+		pool.members[0].errors.Store(3)
+		pool.members[1].errors.Store(1)
+		pool.members[2].errors.Store(2)
+		for i := 0; i < 3; i++ {
+			if got := pool.pick(connect("example.com")); got != pool.members[1] {
+				t.Errorf("want %v, got %v", pool.members[1].url, got.url)
+			}
+		}
+	})
+}
+
+func TestUpstreamPool_Invalid(t *testing.T) {
+	for _, opts := range []*Options{
+		{Addr: ":0", UpstreamPool: []string{"ftp://a:21"}},
+		{Addr: ":0", UpstreamPool: []string{"http://a:3128"}, UpstreamStrategy: "fastest"},
+		{Addr: ":0", UpstreamPool: []string{"http://a:3128", "://"}},
+	} {
+		if _, err := NewProxy(opts); err == nil {
+			t.Errorf("%v %v: want error", opts.UpstreamPool, opts.UpstreamStrategy)
+		}
+	}
+}
+
+func TestUpstreamPool_HealthCheck(t *testing.T) {
+	good, closeGood := startConnectProxy(t)
+	defer closeGood()
+	target, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer target.Close()
+	go func() {
+		for {
+			conn, err := target.Accept()
+			if err != nil {
+				return
+			}
+			conn.Close()
+		}
+	}()
+
+	dead := "http://" + deadAddr(t)
+	for _, checkTarget := range []string{"", target.Addr().String()} {
+		pool, err := newUpstreamPool(&Proxy{Opts: &Options{
+			UpstreamPool:              []string{dead, good},
+			UpstreamHealthCheck:       time.Hour,
+			UpstreamHealthCheckTarget: checkTarget,
+		}})
+		if err != nil {
+			t.Fatal(err)
+		}
+		pool.check()
+		stats := pool.stats()
+		if stats[0].Healthy || stats[0].Errors != 1 || stats[0].LastError == "" {
+			t.Errorf("target %q: want dead upstream down, got %+v", checkTarget, stats[0])
+		}
+		if !stats[1].Healthy || stats[1].Errors != 0 {
+			t.Errorf("target %q: want good upstream up, got %+v", checkTarget, stats[1])
+		}
+
+		// a recovered upstream is up again after the next check
+		pool.members[0].url = pool.members[1].url
+		pool.check()
+		if !pool.stats()[0].Healthy {
+			t.Errorf("target %q: want recovered upstream up", checkTarget)
+		}
+	}
+}
+
+type upstreamRecorderAddon struct {
+	BaseAddon
+	upstreams chan interface{}
+	servers   chan *url.URL
+}
+
+func (a *upstreamRecorderAddon) ServerConnected(connCtx *ConnContext) {
+	a.servers <- connCtx.ServerConn.Upstream
+}
+
+func (a *upstreamRecorderAddon) Response(f *Flow) {
+	a.upstreams <- f.Metadata["upstream"]
+}
+
+func TestUpstreamPool_Failover(t *testing.T) {
+	helper := &testProxyHelper{
+		server:    &http.Server{},
+		proxyAddr: ":29092",
+	}
+	helper.init(t)
+	testProxy := helper.testProxy
+	good, closeGood := startConnectProxy(t)
+	defer closeGood()
+	dead := "http://" + deadAddr(t)
+	testProxy.Opts.UpstreamPool = []string{dead, good}
+	pool, err := newUpstreamPool(testProxy)
+	if err != nil {
+		t.Fatal(err)
+	}
+	testProxy.upstreamPool = pool
+	addon := &upstreamRecorderAddon{upstreams: make(chan interface{}, 4), servers: make(chan *url.URL, 4)}
+	testProxy.AddAddon(addon)
+	defer helper.ln.Close()
+	go helper.server.Serve(helper.ln)
+	defer helper.tlsPlainLn.Close()
+	go helper.server.ServeTLS(helper.tlsPlainLn, "", "")
+	go testProxy.Start()
+	defer testProxy.Close()
+	time.Sleep(time.Millisecond * 10) // wait for test proxy startup
+
+	for _, endpoint := range []string{helper.httpEndpoint, helper.httpsEndpoint} {
+		client := helper.getProxyClient()
+		resp, err := client.Get(endpoint)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		client.CloseIdleConnections()
+		if resp.StatusCode != 200 {
+			t.Fatalf("%v: unexpected status %v", endpoint, resp.StatusCode)
+		}
+		if got := <-addon.servers; got == nil || got.String() != good {
+			t.Errorf("%v: want server conn through %v, got %v", endpoint, good, got)
+		}
+		if got := <-addon.upstreams; got != good {
+			t.Errorf("%v: want flow upstream %v, got %v", endpoint, good, got)
+		}
+	}
+
+	stats := testProxy.UpstreamStats()
+	if stats[0].Healthy || stats[0].Errors == 0 {
+		t.Errorf("want dead upstream marked down, got %+v", stats[0])
+	}
+	if stats[1].Dials != 2 {
+		t.Errorf("want 2 dials through good upstream, got %+v", stats[1])
+	}
+
+	// every upstream failing returns the last error
+	pool.members[1].url, _ = url.Parse(dead)
+	if _, err := testProxy.dialUpstream(context.Background(), pool.members[0].url, helper.ln.Addr().String()); err == nil {
+		t.Error("want error when all upstreams fail")
+	}
+}
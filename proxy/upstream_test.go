@@ -0,0 +1,139 @@
+package proxy
+
+import (
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestMatchHostGlob(t *testing.T) {
+	cases := []struct {
+		hostname, port, pattern string
+		want                    bool
+	}{
+		{"a.corp", "443", "*.corp", true},
+		{"corp", "443", "*.corp", true},
+		{"a.corp.com", "443", "*.corp", false},
+		{"api-1.example.com", "443", "api-*.example.com", true},
+		{"www.example.com", "443", "api-*.example.com", false},
+		{"example.com", "8443", "example.com:8443", true},
+		{"example.com", "443", "example.com:8443", false},
+		{"example.com", "80", "EXAMPLE.com", true},
+		{"example.com", "80", "*", true},
+	}
+	for _, c := range cases {
+		if got := matchHostGlob(c.hostname, c.port, c.pattern); got != c.want {
+			t.Errorf("matchHostGlob(%v, %v, %v) = %v, want %v", c.hostname, c.port, c.pattern, got, c.want)
+		}
+	}
+}
+
+func TestUpstreamTarget(t *testing.T) {
+	connect := &http.Request{Method: "CONNECT", Host: "example.com:8443", URL: &url.URL{Host: "example.com:8443"}}
+	if scheme, hostname, port := upstreamTarget(connect); scheme != "https" || hostname != "example.com" || port != "8443" {
+		t.Errorf("connect: %v %v %v", scheme, hostname, port)
+	}
+	plain := &http.Request{Method: "GET", Host: "Example.com", URL: &url.URL{Scheme: "http", Host: "Example.com", Path: "/a"}}
+	if scheme, hostname, port := upstreamTarget(plain); scheme != "http" || hostname != "example.com" || port != "80" {
+		t.Errorf("http: %v %v %v", scheme, hostname, port)
+	}
+	noUrl := &http.Request{Host: "[::1]"}
+	if scheme, hostname, port := upstreamTarget(noUrl); scheme != "http" || hostname != "::1" || port != "80" {
+		t.Errorf("no url: %v %v %v", scheme, hostname, port)
+	}
+}
+
+func TestUpstreamRules(t *testing.T) {
+	p, err := NewProxy(&Options{
+		Addr:     ":0",
+		Upstream: "http://default:3128",
+		UpstreamRules: []*UpstreamRule{
+			{Hosts: []string{"*.corp"}, Upstream: "http://corp:3128"},
+			{Cidrs: []string{"10.0.0.0/8", "192.168.1.1"}, Upstream: "DIRECT"},
+			{Hosts: []string{"*.example.com"}, Schemes: []string{"http"}, Upstream: "socks5://socks:1080"},
+			{Hosts: []string{"direct.example.com"}, Upstream: "direct"},
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cases := []struct {
+		name string
+		req  *http.Request
+		want string // "" for DIRECT
+	}{
+		{"host glob", &http.Request{Method: "CONNECT", Host: "git.corp:443"}, "http://corp:3128"},
+		{"cidr", &http.Request{Method: "GET", Host: "10.1.2.3", URL: &url.URL{Scheme: "http", Host: "10.1.2.3"}}, ""},
+		{"ip", &http.Request{Method: "CONNECT", Host: "192.168.1.1:443"}, ""},
+		{"ip not in cidr", &http.Request{Method: "CONNECT", Host: "192.168.1.2:443"}, "http://default:3128"},
+		{"scheme", &http.Request{Method: "GET", Host: "www.example.com", URL: &url.URL{Scheme: "http", Host: "www.example.com"}}, "socks5://socks:1080"},
+		{"scheme mismatch", &http.Request{Method: "CONNECT", Host: "www.example.com:443"}, "http://default:3128"},
+		{"direct before default", &http.Request{Method: "CONNECT", Host: "direct.example.com:443"}, ""},
+		{"no rule", &http.Request{Method: "CONNECT", Host: "other.org:443"}, "http://default:3128"},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			got, err := p.getUpstreamProxyUrl(c.req)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if c.want == "" {
+				if got != nil {
+					t.Errorf("want DIRECT, got %v", got)
+				}
+				return
+			}
+			if got == nil || got.String() != c.want {
+				t.Errorf("want %v, got %v", c.want, got)
+			}
+		})
+	}
+
+	// SetUpstreamProxy still takes precedence
+	u, _ := url.Parse("http://callback:8080")
+	p.SetUpstreamProxy(func(req *http.Request) (*url.URL, error) { return u, nil })
+	got, err := p.getUpstreamProxyUrl(&http.Request{Method: "CONNECT", Host: "git.corp:443"})
+	if err != nil || got != u {
+		t.Errorf("want callback upstream, got %v %v", got, err)
+	}
+}
+
+func TestUpstreamRules_Invalid(t *testing.T) {
+	rules := [][]*UpstreamRule{
+		{{Hosts: []string{"a"}}},
+		{{Cidrs: []string{"10.0.0.0/33"}, Upstream: "DIRECT"}},
+		{{Cidrs: []string{"not-an-ip"}, Upstream: "DIRECT"}},
+		{{Schemes: []string{"ftp"}, Upstream: "DIRECT"}},
+		{{Hosts: []string{"a"}, Upstream: "ftp://proxy:21"}},
+	}
+	for i, r := range rules {
+		if _, err := NewProxy(&Options{Addr: ":0", UpstreamRules: r}); err == nil {
+			t.Errorf("%v: want error", i)
+		}
+	}
+}
+
+func TestNewUpstreamRulesFromFile(t *testing.T) {
+	filename := filepath.Join(t.TempDir(), "rules.json")
+	data := `[
+		{"hosts": ["*.corp"], "upstream": "http://corp:3128"},
+		{"cidrs": ["10.0.0.0/8"], "schemes": ["https"], "upstream": "DIRECT"}
+	]`
+	if err := os.WriteFile(filename, []byte(data), 0644); err != nil {
+		t.Fatal(err)
+	}
+	rules, err := NewUpstreamRulesFromFile(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(rules) != 2 || rules[0].Hosts[0] != "*.corp" || rules[1].Cidrs[0] != "10.0.0.0/8" || rules[1].Schemes[0] != "https" || rules[1].Upstream != "DIRECT" {
+		t.Errorf("unexpected rules %+v %+v", rules[0], rules[1])
+	}
+
+	if _, err := NewUpstreamRulesFromFile(filepath.Join(t.TempDir(), "missing.json")); err == nil {
+		t.Error("want error for missing file")
+	}
+}
@@ -12,12 +12,28 @@ import (
 // NewUtlsConn creates and configures a utls.UConn based on the proxy options and client hello info.
 // It handles standard fingerprints, "client" mirroring, and saved profiles.
 func NewUtlsConn(conn net.Conn, opts *Options, clientHello *tls.ClientHelloInfo) (*utls.UConn, error) {
+	return newUtlsConn(conn, opts, clientHello, nil)
+}
+
+// newUtlsConn is NewUtlsConn answering certificate requests of the server with getClientCertificate if not nil
+func newUtlsConn(conn net.Conn, opts *Options, clientHello *tls.ClientHelloInfo, getClientCertificate func(*utls.CertificateRequestInfo) (*utls.Certificate, error)) (*utls.UConn, error) {
+	return newUtlsConnAlpn(conn, opts, clientHello, getClientCertificate, nil)
+}
+
+// newUtlsConnAlpn is newUtlsConn offering the protocols alpn in the ALPN extension instead of the fingerprint's if not nil
+func newUtlsConnAlpn(conn net.Conn, opts *Options, clientHello *tls.ClientHelloInfo, getClientCertificate func(*utls.CertificateRequestInfo) (*utls.Certificate, error), alpn []string) (*utls.UConn, error) {
+	if alpn != nil {
+		hello := *clientHello
+		hello.SupportedProtos = alpn
+		clientHello = &hello
+	}
 	uConfig := &utls.Config{
-		InsecureSkipVerify: opts.SslInsecure,
-		KeyLogWriter:       helper.GetTlsKeyLogWriter(),
-		ServerName:         clientHello.ServerName,
-		NextProtos:         clientHello.SupportedProtos,
-		CipherSuites:       clientHello.CipherSuites,
+		InsecureSkipVerify:   opts.SslInsecure,
+		KeyLogWriter:         helper.GetTlsKeyLogWriter(),
+		ServerName:           clientHello.ServerName,
+		NextProtos:           clientHello.SupportedProtos,
+		CipherSuites:         clientHello.CipherSuites,
+		GetClientCertificate: getClientCertificate,
 	}
 
 	if len(clientHello.SupportedVersions) > 0 {
@@ -58,6 +74,19 @@ func NewUtlsConn(conn net.Conn, opts *Options, clientHello *tls.ClientHelloInfo)
 			}
 		}
 	}
+	if alpn != nil {
+		if spec == nil && id != utls.HelloRandomized {
+			// the ALPN extension of a preset is only replaceable in its spec, randomized ones offer uConfig.NextProtos
+			if s, err := utls.UTLSIdToSpec(id); err == nil {
+				uConfig.CipherSuites = nil
+				id = utls.HelloCustom
+				spec = &s
+			}
+		}
+		if spec != nil {
+			setAlpn(spec, alpn)
+		}
+	}
 
 	uConn := utls.UClient(conn, uConfig, id)
 
@@ -95,6 +124,15 @@ func getClientHelloID(name string) (utls.ClientHelloID, bool) {
 	}
 }
 
+// setAlpn replaces the protocols of the ALPN extension of spec, if any
+func setAlpn(spec *utls.ClientHelloSpec, alpn []string) {
+	for _, ext := range spec.Extensions {
+		if e, ok := ext.(*utls.ALPNExtension); ok {
+			e.AlpnProtocols = alpn
+		}
+	}
+}
+
 func ensureSNI(spec *utls.ClientHelloSpec, serverName string) {
 	hasSNI := false
 	for _, ext := range spec.Extensions {
@@ -1,40 +1,68 @@
 package proxy
 
 import (
+	"context"
 	"crypto/tls"
+	"net"
 	"net/http"
 	"net/url"
 	"strings"
+	"time"
 
 	"github.com/gorilla/websocket"
 	log "github.com/sirupsen/logrus"
 )
 
-// 当前仅做了转发 websocket 流量
+// 转发 websocket 流量, 控制帧, 关闭状态码, 子协议和 permessage-deflate 均端到端透传
 
 type webSocket struct{}
 
 var defaultWebSocket webSocket
 
-func (s *webSocket) wss(res http.ResponseWriter, req *http.Request, tlsConfig *tls.Config, addons []Addon) {
-	log := log.WithField("in", "webSocket.wss").WithField("host", req.Host)
+func isWebSocketUpgrade(req *http.Request) bool {
+	if !strings.EqualFold(req.Header.Get("Upgrade"), "websocket") {
+		return false
+	}
+	for _, v := range req.Header.Values("Connection") {
+		for _, token := range strings.Split(v, ",") {
+			if strings.EqualFold(strings.TrimSpace(token), "Upgrade") {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// relay ws or wss, the scheme is picked from req.URL.Scheme: http/ws -> ws, otherwise wss
+func (s *webSocket) relay(res http.ResponseWriter, req *http.Request, tlsConfig *tls.Config, addons []Addon) {
+	log := log.WithField("in", "webSocket.relay").WithField("host", req.Host)
 
 	f := NewFlow()
 	f.Request = NewRequest(req)
 	f.ConnContext = req.Context().Value(connContextKey).(*ConnContext)
 	defer f.Finish()
+	if proxy := f.ConnContext.proxy; proxy != nil {
+		defer proxy.conns.relay()()
+	}
 
 	// 1. Dial backend
-	host := req.Host
-	if !strings.Contains(host, ":") {
-		host = host + ":443"
+	scheme, httpScheme, port := "wss", "https", "443"
+	if req.URL.Scheme == "http" || req.URL.Scheme == "ws" {
+		scheme, httpScheme, port = "ws", "http", "80"
+	}
+	host := req.URL.Host
+	if host == "" {
+		host = req.Host
+	}
+	if u := (&url.URL{Host: host}); u.Port() == "" {
+		host = net.JoinHostPort(u.Hostname(), port)
 	}
-	targetURL := url.URL{Scheme: "wss", Host: host, Path: req.URL.Path, RawQuery: req.URL.RawQuery}
+	targetURL := url.URL{Scheme: scheme, Host: host, Path: req.URL.Path, RawQuery: req.URL.RawQuery}
 
-	// Copy headers
+	// Copy headers, the handshake headers are generated by the dialer
 	requestHeader := http.Header{}
 	for k, v := range req.Header {
-		if k == "Upgrade" || k == "Connection" || k == "Sec-Websocket-Key" || k == "Sec-Websocket-Version" || k == "Sec-Websocket-Extensions" {
+		if k == "Upgrade" || k == "Connection" || k == "Sec-Websocket-Key" || k == "Sec-Websocket-Version" || k == "Sec-Websocket-Extensions" || k == "Sec-Websocket-Protocol" {
 			continue
 		}
 		requestHeader[k] = v
@@ -42,6 +70,22 @@ func (s *webSocket) wss(res http.ResponseWriter, req *http.Request, tlsConfig *t
 
 	dialer := websocket.Dialer{
 		TLSClientConfig: tlsConfig,
+		// pass the full subprotocol list of the client to the server
+		Subprotocols: websocket.Subprotocols(req),
+		// messages are decoded by the relay, so permessage-deflate is the only extension which can be negotiated end-to-end
+		EnableCompression: offersCompression(req.Header),
+	}
+	// dial through upstream proxy if configured
+	if proxy := f.ConnContext.proxy; proxy != nil {
+		dialer.NetDialContext = func(ctx context.Context, network, addr string) (net.Conn, error) {
+			dialReq := req.WithContext(ctx)
+			dialReq.URL = &url.URL{Scheme: httpScheme, Host: addr}
+			conn, err := proxy.getUpstreamConn(ctx, dialReq)
+			if upstream := connUpstream(conn); upstream != nil {
+				f.Metadata["upstream"] = upstream.Redacted()
+			}
+			return conn, err
+		}
 	}
 	serverConn, resp, err := dialer.Dial(targetURL.String(), requestHeader)
 	if err != nil {
@@ -51,11 +95,12 @@ func (s *webSocket) wss(res http.ResponseWriter, req *http.Request, tlsConfig *t
 	}
 	defer serverConn.Close()
 
-	// 2. Upgrade client connection
+	// 2. Upgrade client connection with what the server accepted
 	upgrader := websocket.Upgrader{
-		CheckOrigin: func(r *http.Request) bool { return true },
+		CheckOrigin:       func(r *http.Request) bool { return true },
+		EnableCompression: offersCompression(resp.Header),
 	}
-	if protocol := resp.Header.Get("Sec-WebSocket-Protocol"); protocol != "" {
+	if protocol := serverConn.Subprotocol(); protocol != "" {
 		upgrader.Subprotocols = []string{protocol}
 	}
 
@@ -70,6 +115,8 @@ func (s *webSocket) wss(res http.ResponseWriter, req *http.Request, tlsConfig *t
 		Header:     resp.Header,
 	}
 
+	f.WebSocket = newWebSocketSession(clientConn, serverConn)
+
 	for _, addon := range addons {
 		addon.WebsocketHandshake(f)
 	}
@@ -78,51 +125,112 @@ func (s *webSocket) wss(res http.ResponseWriter, req *http.Request, tlsConfig *t
 
 	// 3. Transfer loop
 	errChan := make(chan error, 2)
-	
-	// Client -> Server
-	go func() {
-		for {
-			messageType, p, err := clientConn.ReadMessage()
-			if err != nil {
-				errChan <- err
-				return
-			}
-			// Addon Interception
-			msg := &WebSocketMessage{Type: messageType, Data: p, FromClient: true}
+
+	pipe := func(src, dst *websocket.Conn, fromClient bool) {
+		// forward ping and pong frames to the peer instead of answering them locally,
+		// they are passed to the addons like data frames
+		control := func(messageType int, data string) error {
+			msg := newWebSocketMessage(messageType, []byte(data), fromClient)
 			for _, addon := range addons {
 				addon.WebsocketMessage(f, msg)
 			}
-			
-			if err := serverConn.WriteMessage(msg.Type, msg.Data); err != nil {
-				errChan <- err
-				return
+			msg.decide()
+			if msg.Drop {
+				return nil
 			}
+			return ignoreWriteError(dst.WriteControl(msg.Type, msg.Data, time.Now().Add(controlWriteWait)))
 		}
-	}()
+		src.SetPingHandler(func(data string) error {
+			return control(websocket.PingMessage, data)
+		})
+		src.SetPongHandler(func(data string) error {
+			return control(websocket.PongMessage, data)
+		})
+		src.SetCloseHandler(func(code int, text string) error {
+			f.WebSocket.recordClose(code, text, fromClient)
+			payload := []byte{}
+			if code != websocket.CloseNoStatusReceived {
+				payload = websocket.FormatCloseMessage(code, text)
+			}
+			return ignoreWriteError(dst.WriteControl(websocket.CloseMessage, payload, time.Now().Add(controlWriteWait)))
+		})
 
-	// Server -> Client
-	go func() {
 		for {
-			messageType, p, err := serverConn.ReadMessage()
+			messageType, p, err := src.ReadMessage()
 			if err != nil {
+				if _, ok := err.(*websocket.CloseError); !ok {
+					f.WebSocket.recordClose(websocket.CloseAbnormalClosure, "", fromClient)
+				}
 				errChan <- err
 				return
 			}
 			// Addon Interception
-			msg := &WebSocketMessage{Type: messageType, Data: p, FromClient: false}
+			msg := newWebSocketMessage(messageType, p, fromClient)
 			for _, addon := range addons {
 				addon.WebsocketMessage(f, msg)
 			}
-				
-			if err := clientConn.WriteMessage(msg.Type, msg.Data); err != nil {
+			msg.decide()
+			if msg.Drop {
+				continue
+			}
+
+			if err := f.WebSocket.forward(msg); err != nil {
+				// the peer went away
+				f.WebSocket.recordClose(websocket.CloseAbnormalClosure, "", !fromClient)
 				errChan <- err
 				return
 			}
 		}
-	}()
-	
-	select {
-	case err := <-errChan:
-		log.Debugf("websocket loop end: %v", err)
 	}
+
+	// Client -> Server
+	go pipe(clientConn, serverConn, true)
+	// Server -> Client
+	go pipe(serverConn, clientConn, false)
+
+	err = <-errChan
+	log.Debugf("websocket loop end: %v", err)
+	pending := 1
+
+	// after a close frame, give the peer time to answer with its own close frame
+	if _, ok := err.(*websocket.CloseError); ok {
+		select {
+		case err = <-errChan:
+			log.Debugf("websocket loop end: %v", err)
+			pending--
+		case <-time.After(closeWait):
+		}
+	}
+
+	// stop the other pipe, the flow is finished once neither touches it
+	clientConn.Close()
+	serverConn.Close()
+	for ; pending > 0; pending-- {
+		<-errChan
+	}
+}
+
+const (
+	controlWriteWait = 5 * time.Second
+	closeWait        = 5 * time.Second
+)
+
+// a failed write of a control frame should not abort reading from the other side
+func ignoreWriteError(err error) error {
+	if err != nil && err != websocket.ErrCloseSent {
+		log.Debugf("websocket write control: %v", err)
+	}
+	return nil
+}
+
+func offersCompression(header http.Header) bool {
+	for _, v := range header.Values("Sec-Websocket-Extensions") {
+		for _, ext := range strings.Split(v, ",") {
+			name, _, _ := strings.Cut(strings.TrimSpace(ext), ";")
+			if strings.EqualFold(strings.TrimSpace(name), "permessage-deflate") {
+				return true
+			}
+		}
+	}
+	return false
 }
@@ -22,7 +22,7 @@ func TestWebSocket_DialError(t *testing.T) {
 	rec := httptest.NewRecorder()
 	
 	ws := &webSocket{}
-	ws.wss(rec, req, &tls.Config{InsecureSkipVerify: true}, nil)
+	ws.relay(rec, req, &tls.Config{InsecureSkipVerify: true}, nil)
 
 	if rec.Code != 502 {
 		t.Errorf("Expected 502 status code for dial error, got %d", rec.Code)
@@ -50,7 +50,7 @@ func TestWebSocket_UpgradeError(t *testing.T) {
 
 	ws := &webSocket{}
 	// Use InsecureSkipVerify to trust the test backend cert
-	ws.wss(rec, req, &tls.Config{InsecureSkipVerify: true}, nil)
+	ws.relay(rec, req, &tls.Config{InsecureSkipVerify: true}, nil)
 
 	// We expect Upgrade to fail. 
 	// The function should log error and return. 
@@ -1,8 +1,97 @@
 package proxy
 
+import (
+	"sync"
+
+	"github.com/gorilla/websocket"
+)
+
 // WebSocketMessage
 type WebSocketMessage struct {
-	Type       int
+	Type       int // a data message type, or websocket.PingMessage and websocket.PongMessage for control frames
 	Data       []byte
 	FromClient bool // true if message is from client, false if from server
+	Drop       bool // if true, the message is not forwarded
+
+	decided chan struct{} // closed by the relay once every addon has seen the message
+}
+
+func newWebSocketMessage(messageType int, data []byte, fromClient bool) *WebSocketMessage {
+	return &WebSocketMessage{Type: messageType, Data: data, FromClient: fromClient, decided: make(chan struct{})}
+}
+
+var closedChan = func() chan struct{} {
+	ch := make(chan struct{})
+	close(ch)
+	return ch
+}()
+
+// Decided is closed once every addon has seen the message, Drop is final and safe to read from then on.
+// Addons which keep the message, e.g. to store it, wait for it to know whether the message was forwarded.
+func (m *WebSocketMessage) Decided() <-chan struct{} {
+	if m.decided == nil {
+		return closedChan
+	}
+	return m.decided
+}
+
+func (m *WebSocketMessage) decide() {
+	if m.decided != nil {
+		close(m.decided)
+	}
+}
+
+// WebSocketSession is the handle of a relayed websocket connection, available as Flow.WebSocket
+// from Addon.WebsocketHandshake. Addons can use it to inject messages at any time during the session,
+// injected messages are not passed to Addon.WebsocketMessage.
+type WebSocketSession struct {
+	client   *websocket.Conn
+	server   *websocket.Conn
+	clientMu sync.Mutex
+	serverMu sync.Mutex
+
+	// close status of the session, recorded from the first close frame seen by the relay.
+	// CloseCode is websocket.CloseAbnormalClosure if a side went away without a close frame.
+	CloseCode      int
+	CloseReason    string
+	ClosedByClient bool
+	closeOnce      sync.Once
+}
+
+func newWebSocketSession(client, server *websocket.Conn) *WebSocketSession {
+	return &WebSocketSession{
+		client: client,
+		server: server,
+	}
+}
+
+// SendToClient sends a message to the client, messageType is websocket.TextMessage or websocket.BinaryMessage
+func (s *WebSocketSession) SendToClient(messageType int, data []byte) error {
+	s.clientMu.Lock()
+	defer s.clientMu.Unlock()
+	return s.client.WriteMessage(messageType, data)
+}
+
+// SendToServer sends a message to the server, messageType is websocket.TextMessage or websocket.BinaryMessage
+func (s *WebSocketSession) SendToServer(messageType int, data []byte) error {
+	s.serverMu.Lock()
+	defer s.serverMu.Unlock()
+	return s.server.WriteMessage(messageType, data)
+}
+
+// forward a relayed message to its peer
+func (s *WebSocketSession) forward(msg *WebSocketMessage) error {
+	if msg.FromClient {
+		return s.SendToServer(msg.Type, msg.Data)
+	}
+	return s.SendToClient(msg.Type, msg.Data)
+}
+
+// record the close status, only the first call takes effect
+func (s *WebSocketSession) recordClose(code int, reason string, fromClient bool) {
+	s.closeOnce.Do(func() {
+		s.CloseCode = code
+		s.CloseReason = reason
+		s.ClosedByClient = fromClient
+	})
 }
@@ -1,9 +1,12 @@
 package proxy
 
 import (
+	"bufio"
 	"context"
 	"crypto/tls"
+	"fmt"
 	"io"
+	"net"
 	"net/http"
 	"net/http/httptest"
 	"net/url"
@@ -88,7 +91,7 @@ func TestWebSocket_Integration(t *testing.T) {
 		// Trust the backend cert
 		tlsConfig := &tls.Config{InsecureSkipVerify: true}
 		
-		ws.wss(w, r, tlsConfig, addons)
+		ws.relay(w, r, tlsConfig, addons)
 	}))
 	defer proxyServer.Close()
 
@@ -172,7 +175,7 @@ func TestWebSocket_DialFail(t *testing.T) {
 	ctx := context.WithValue(req.Context(), connContextKey, &ConnContext{ClientConn: &ClientConn{}})
 	req = req.WithContext(ctx)
 	
-	ws.wss(rec, req, nil, nil)
+	ws.relay(rec, req, nil, nil)
 	if rec.Code != 502 {
 		t.Errorf("Expected 502, got %d", rec.Code)
 	}
@@ -193,6 +196,426 @@ func TestWebSocket_UpgradeFail(t *testing.T) {
 	ctx := context.WithValue(req.Context(), connContextKey, &ConnContext{ClientConn: &ClientConn{}})
 	req = req.WithContext(ctx)
 	
-	ws.wss(rec, req, nil, nil)
+	ws.relay(rec, req, nil, nil)
 	// It should fail dial because it's not a websocket server
 }
+
+func TestIsWebSocketUpgrade(t *testing.T) {
+	req := httptest.NewRequest("GET", "/", nil)
+	req.Header.Set("Upgrade", "websocket")
+	req.Header.Set("Connection", "keep-alive, Upgrade")
+	if !isWebSocketUpgrade(req) {
+		t.Error("expected websocket upgrade")
+	}
+	req.Header.Set("Connection", "keep-alive")
+	if isWebSocketUpgrade(req) {
+		t.Error("expected no websocket upgrade")
+	}
+}
+
+func newEchoWebSocketServer() *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		upgrader := websocket.Upgrader{}
+		c, err := upgrader.Upgrade(w, r, nil)
+		if err != nil {
+			return
+		}
+		defer c.Close()
+		for {
+			mt, message, err := c.ReadMessage()
+			if err != nil {
+				return
+			}
+			if err := c.WriteMessage(mt, message); err != nil {
+				return
+			}
+		}
+	}))
+}
+
+func TestWebSocket_AbsoluteFormProxy(t *testing.T) {
+	backend := newEchoWebSocketServer()
+	defer backend.Close()
+	target := backend.Listener.Addr().String()
+
+	p, err := NewProxy(&Options{Addr: "127.0.0.1:9100"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	mockAddon := &MockAddon{}
+	p.AddAddon(mockAddon)
+	go p.Start()
+	defer p.Close()
+	time.Sleep(100 * time.Millisecond)
+
+	conn, err := net.Dial("tcp", "127.0.0.1:9100")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	// absolute-form upgrade, as sent by plain http proxy clients
+	fmt.Fprintf(conn, "GET http://%v/ws HTTP/1.1\r\nHost: %v\r\nUpgrade: websocket\r\nConnection: Upgrade\r\nSec-WebSocket-Key: dGhlIHNhbXBsZSBub25jZQ==\r\nSec-WebSocket-Version: 13\r\n\r\n", target, target)
+	br := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(br, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.StatusCode != http.StatusSwitchingProtocols {
+		t.Fatalf("want 101, got %v", resp.StatusCode)
+	}
+
+	// masked text frame with a zero mask key
+	payload := []byte("hi")
+	frame := append([]byte{0x81, 0x80 | byte(len(payload)), 0, 0, 0, 0}, payload...)
+	if _, err := conn.Write(frame); err != nil {
+		t.Fatal(err)
+	}
+	head := make([]byte, 2)
+	if _, err := io.ReadFull(br, head); err != nil {
+		t.Fatal(err)
+	}
+	echo := make([]byte, head[1])
+	if _, err := io.ReadFull(br, echo); err != nil {
+		t.Fatal(err)
+	}
+	if head[0] != 0x81 || string(echo) != "hi" {
+		t.Errorf("unexpected echo frame %x %q", head, echo)
+	}
+
+	mockAddon.mu.Lock()
+	defer mockAddon.mu.Unlock()
+	if len(mockAddon.Handshakes) != 1 || mockAddon.Handshakes[0] != "http://"+target+"/ws" {
+		t.Errorf("unexpected handshakes %v", mockAddon.Handshakes)
+	}
+	if len(mockAddon.Messages) != 2 {
+		t.Errorf("expected 2 messages, got %d", len(mockAddon.Messages))
+	}
+}
+
+func TestWebSocket_ReverseProxy(t *testing.T) {
+	backend := newEchoWebSocketServer()
+	defer backend.Close()
+
+	p, err := NewProxy(&Options{Addr: "127.0.0.1:9101", Reverse: []string{backend.URL}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	go p.Start()
+	defer p.Close()
+	time.Sleep(100 * time.Millisecond)
+
+	c, _, err := websocket.DefaultDialer.Dial("ws://127.0.0.1:9101/ws", nil)
+	if err != nil {
+		t.Fatalf("dial: %v", err)
+	}
+	defer c.Close()
+	if err := c.WriteMessage(websocket.TextMessage, []byte("reverse")); err != nil {
+		t.Fatal(err)
+	}
+	_, recv, err := c.ReadMessage()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(recv) != "reverse" {
+		t.Errorf("unexpected message %q", recv)
+	}
+}
+
+type tamperWebSocketAddon struct {
+	BaseAddon
+}
+
+func (a *tamperWebSocketAddon) WebsocketHandshake(f *Flow) {
+	f.WebSocket.SendToClient(websocket.TextMessage, []byte("welcome"))
+}
+
+func (a *tamperWebSocketAddon) WebsocketMessage(f *Flow, msg *WebSocketMessage) {
+	if !msg.FromClient {
+		return
+	}
+	switch string(msg.Data) {
+	case "drop me":
+		msg.Drop = true
+	case "inject":
+		msg.Drop = true
+		f.WebSocket.SendToServer(websocket.TextMessage, []byte("injected"))
+	default:
+		msg.Data = []byte("rewritten " + string(msg.Data))
+	}
+}
+
+// decisionRecorderAddon waits for the final decision on the client messages, like the storage addon
+type decisionRecorderAddon struct {
+	BaseAddon
+	dropped chan bool
+}
+
+func (a *decisionRecorderAddon) WebsocketMessage(f *Flow, msg *WebSocketMessage) {
+	if !msg.FromClient || msg.Type != websocket.TextMessage {
+		return
+	}
+	go func() {
+		<-msg.Decided()
+		a.dropped <- msg.Drop
+	}()
+}
+
+func TestWebSocket_DropInjectRewrite(t *testing.T) {
+	backend := newEchoWebSocketServer()
+	defer backend.Close()
+	backendURL, _ := url.Parse(backend.URL)
+
+	decisions := &decisionRecorderAddon{dropped: make(chan bool, 3)}
+	addons := []Addon{decisions, &tamperWebSocketAddon{}}
+	proxyServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ctx := context.WithValue(r.Context(), connContextKey, &ConnContext{ClientConn: &ClientConn{}})
+		r = r.WithContext(ctx)
+		r.Host = backendURL.Host
+		r.URL.Scheme = "http"
+		r.URL.Host = backendURL.Host
+		defaultWebSocket.relay(w, r, nil, addons)
+	}))
+	defer proxyServer.Close()
+
+	c, _, err := websocket.DefaultDialer.Dial("ws://"+proxyServer.Listener.Addr().String()+"/ws", nil)
+	if err != nil {
+		t.Fatalf("dial: %v", err)
+	}
+	defer c.Close()
+
+	read := func() string {
+		c.SetReadDeadline(time.Now().Add(time.Second))
+		_, p, err := c.ReadMessage()
+		if err != nil {
+			t.Fatalf("read: %v", err)
+		}
+		return string(p)
+	}
+
+	if got := read(); got != "welcome" {
+		t.Errorf("want welcome, got %q", got)
+	}
+
+	c.WriteMessage(websocket.TextMessage, []byte("drop me"))
+	c.WriteMessage(websocket.TextMessage, []byte("inject"))
+	c.WriteMessage(websocket.TextMessage, []byte("hello"))
+
+	if got := read(); got != "injected" {
+		t.Errorf("want injected, got %q", got)
+	}
+	if got := read(); got != "rewritten hello" {
+		t.Errorf("want rewritten hello, got %q", got)
+	}
+
+	// the addon before the one dropping the messages sees the drops once decided
+	drops := 0
+	for i := 0; i < 3; i++ {
+		if <-decisions.dropped {
+			drops++
+		}
+	}
+	if drops != 2 {
+		t.Errorf("want 2 messages dropped, got %v", drops)
+	}
+}
+
+type handshakeRecorderAddon struct {
+	BaseAddon
+	flows    chan *Flow
+	controls chan *WebSocketMessage // ping and pong frames
+}
+
+func (a *handshakeRecorderAddon) WebsocketHandshake(f *Flow) {
+	a.flows <- f
+}
+
+func (a *handshakeRecorderAddon) WebsocketMessage(f *Flow, msg *WebSocketMessage) {
+	if a.controls != nil && (msg.Type == websocket.PingMessage || msg.Type == websocket.PongMessage) {
+		a.controls <- msg
+	}
+}
+
+func TestWebSocket_FullFidelity(t *testing.T) {
+	offered := make(chan []string, 1)
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		offered <- websocket.Subprotocols(r)
+		upgrader := websocket.Upgrader{Subprotocols: []string{"v2"}, EnableCompression: true}
+		c, err := upgrader.Upgrade(w, r, nil)
+		if err != nil {
+			return
+		}
+		defer c.Close()
+		for {
+			mt, message, err := c.ReadMessage()
+			if err != nil {
+				return
+			}
+			if err := c.WriteMessage(mt, message); err != nil {
+				return
+			}
+		}
+	}))
+	defer backend.Close()
+	backendURL, _ := url.Parse(backend.URL)
+
+	recorder := &handshakeRecorderAddon{flows: make(chan *Flow, 1), controls: make(chan *WebSocketMessage, 2)}
+	proxyServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ctx := context.WithValue(r.Context(), connContextKey, &ConnContext{ClientConn: &ClientConn{}})
+		r = r.WithContext(ctx)
+		r.URL.Scheme = "http"
+		r.URL.Host = backendURL.Host
+		defaultWebSocket.relay(w, r, nil, []Addon{recorder})
+	}))
+	defer proxyServer.Close()
+
+	dialer := websocket.Dialer{Subprotocols: []string{"v1", "v2"}, EnableCompression: true}
+	c, resp, err := dialer.Dial("ws://"+proxyServer.Listener.Addr().String()+"/ws", nil)
+	if err != nil {
+		t.Fatalf("dial: %v", err)
+	}
+	defer c.Close()
+
+	// subprotocols and extensions
+	if got := <-offered; len(got) != 2 || got[0] != "v1" || got[1] != "v2" {
+		t.Errorf("server should see full subprotocol list, got %v", got)
+	}
+	if c.Subprotocol() != "v2" {
+		t.Errorf("want subprotocol v2, got %q", c.Subprotocol())
+	}
+	if !offersCompression(resp.Header) {
+		t.Errorf("permessage-deflate not negotiated: %v", resp.Header)
+	}
+	f := <-recorder.flows
+
+	// ping is answered by the server, not by the proxy
+	pong := make(chan string, 1)
+	c.SetPongHandler(func(data string) error {
+		pong <- data
+		return nil
+	})
+	readErr := make(chan error, 1)
+	go func() {
+		for {
+			if _, _, err := c.ReadMessage(); err != nil {
+				readErr <- err
+				return
+			}
+		}
+	}()
+	if err := c.WriteControl(websocket.PingMessage, []byte("hi"), time.Now().Add(time.Second)); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case data := <-pong:
+		if data != "hi" {
+			t.Errorf("want pong hi, got %q", data)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("pong timeout")
+	}
+	// both control frames are passed to the addons with their direction
+	for _, want := range []struct {
+		mt         int
+		fromClient bool
+	}{{websocket.PingMessage, true}, {websocket.PongMessage, false}} {
+		msg := <-recorder.controls
+		if msg.Type != want.mt || msg.FromClient != want.fromClient || string(msg.Data) != "hi" {
+			t.Errorf("want control frame %v from client %v, got %v from client %v %q", want.mt, want.fromClient, msg.Type, msg.FromClient, msg.Data)
+		}
+	}
+
+	// close status is forwarded both ways and recorded
+	c.WriteControl(websocket.CloseMessage, websocket.FormatCloseMessage(4001, "bye"), time.Now().Add(time.Second))
+	select {
+	case err := <-readErr:
+		ce, ok := err.(*websocket.CloseError)
+		if !ok || ce.Code != 4001 {
+			t.Errorf("want close 4001 echoed by server, got %v", err)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("close timeout")
+	}
+
+	select {
+	case <-f.Done():
+	case <-time.After(2 * time.Second):
+		t.Fatal("flow not finished")
+	}
+	if f.WebSocket.CloseCode != 4001 || f.WebSocket.CloseReason != "bye" || !f.WebSocket.ClosedByClient {
+		t.Errorf("unexpected close status %d %q %v", f.WebSocket.CloseCode, f.WebSocket.CloseReason, f.WebSocket.ClosedByClient)
+	}
+}
+
+// serverGoneAddon fails the write of a client message to the server, the read from the server goes on
+type serverGoneAddon struct {
+	handshakeRecorderAddon
+}
+
+func (a *serverGoneAddon) WebsocketMessage(f *Flow, msg *WebSocketMessage) {
+	if msg.FromClient && string(msg.Data) == "gone" {
+		f.WebSocket.server.SetWriteDeadline(time.Now())
+	}
+}
+
+func TestWebSocket_ServerGone(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		c, err := (&websocket.Upgrader{}).Upgrade(w, r, nil)
+		if err != nil {
+			return
+		}
+		defer c.Close()
+		for {
+			if _, _, err := c.ReadMessage(); err != nil {
+				return
+			}
+		}
+	}))
+	defer backend.Close()
+	backendURL, _ := url.Parse(backend.URL)
+
+	addon := &serverGoneAddon{handshakeRecorderAddon{flows: make(chan *Flow, 1)}}
+	proxyServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ctx := context.WithValue(r.Context(), connContextKey, &ConnContext{ClientConn: &ClientConn{}})
+		r = r.WithContext(ctx)
+		r.URL.Scheme = "http"
+		r.URL.Host = backendURL.Host
+		defaultWebSocket.relay(w, r, nil, []Addon{addon})
+	}))
+	defer proxyServer.Close()
+
+	c, _, err := websocket.DefaultDialer.Dial("ws://"+proxyServer.Listener.Addr().String()+"/ws", nil)
+	if err != nil {
+		t.Fatalf("dial: %v", err)
+	}
+	defer c.Close()
+	f := <-addon.flows
+
+	if err := c.WriteMessage(websocket.TextMessage, []byte("gone")); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case <-f.Done():
+	case <-time.After(2 * time.Second):
+		t.Fatal("flow not finished")
+	}
+	// the relay is done with both sides once the flow is finished
+	if f.WebSocket.CloseCode != websocket.CloseAbnormalClosure || f.WebSocket.ClosedByClient {
+		t.Errorf("want an abnormal close by the server, got %d %v", f.WebSocket.CloseCode, f.WebSocket.ClosedByClient)
+	}
+	c.SetReadDeadline(time.Now().Add(time.Second))
+	if _, _, err := c.ReadMessage(); err == nil {
+		t.Error("want the client connection closed")
+	}
+}
+
+func TestOffersCompression(t *testing.T) {
+	h := http.Header{}
+	if offersCompression(h) {
+		t.Error("empty header")
+	}
+	h.Set("Sec-WebSocket-Extensions", "x-foo, permessage-deflate; client_max_window_bits")
+	if !offersCompression(h) {
+		t.Error("should detect permessage-deflate")
+	}
+}
@@ -4,6 +4,8 @@ import (
 	"encoding/json"
 	"errors"
 	"net/http"
+	"net/url"
+	"strconv"
 	"time"
 
 	"github.com/retutils/gomitmproxy/proxy"
@@ -12,21 +14,34 @@ import (
 
 // FlowEntry represents a stored HTTP flow optimized for database storage
 type FlowEntry struct {
-	ID             string    `json:"id"`
-	ConnID         string    `json:"conn_id"`
-	Method         string    `json:"method"`
-	URL            string    `json:"url"`
-	Proto          string    `json:"proto"`
-	StatusCode     int       `json:"status_code"`
-	RequestHeader  string    `json:"request_header"` // JSON string
-	RequestBody    []byte    `json:"request_body"`
-	ResponseHeader string    `json:"response_header"` // JSON string
-	ResponseBody   []byte    `json:"response_body"`
-	BodyIsText     bool      `json:"body_is_text"`
-	StartTime      time.Time `json:"start_time"`
-	EndTime        time.Time `json:"end_time"`
-	DurationMs     int64     `json:"duration_ms"`
-	HasPII         bool      `json:"has_pii"`
+	ID              string    `json:"id"`
+	ConnID          string    `json:"conn_id"`
+	Method          string    `json:"method"`
+	URL             string    `json:"url"`
+	Proto           string    `json:"proto"`
+	StatusCode      int       `json:"status_code"`
+	RequestHeader   string    `json:"request_header"` // JSON string
+	RequestBody     []byte    `json:"request_body"`
+	ResponseHeader  string    `json:"response_header"` // JSON string
+	ResponseBody    []byte    `json:"response_body"`
+	RequestTrailer  string    `json:"request_trailer"`  // JSON string
+	ResponseTrailer string    `json:"response_trailer"` // JSON string
+	BodyIsText      bool      `json:"body_is_text"`
+	StartTime       time.Time `json:"start_time"`
+	EndTime         time.Time `json:"end_time"`
+	DurationMs      int64     `json:"duration_ms"`
+	TtfbMs          int64     `json:"ttfb_ms"`     // -1 if not measured
+	Timing          string    `json:"timing"`      // JSON string of the flow and connection timestamps
+	Upstream        string    `json:"upstream"`    // upstream proxy the flow was sent through, empty if direct
+	ClientCert      string    `json:"client_cert"` // subject of the certificate the client presented, empty if none
+	Killed          bool      `json:"killed"`      // the flow was aborted by Flow.Kill
+	ReplayOf        string    `json:"replay_of"`   // id of the flow this flow replays, empty if it is no replay
+	Fault           string    `json:"fault"`       // fault injected into the flow, empty if none
+	HasPII          bool      `json:"has_pii"`
+
+	// grpc messages decoded with the descriptors of the proxy, indexed instead of the raw bodies
+	grpcRequest  []byte
+	grpcResponse []byte
 }
 
 // NewFlowEntry converts a proxy.Flow to a storage-ready FlowEntry
@@ -56,10 +71,38 @@ func NewFlowEntry(f *proxy.Flow) (*FlowEntry, error) {
 
 	reqBody, _ := f.Request.DecodedBody()
 
-	// Approximate duration if start/end times aren't explicitly tracked in Flow
-	// For now we use current time as end time
-	endTime := time.Now()
-	startTime := endTime // TODO: Flow doesn't expose timing yet, using current time placeholder
+	reqTrailerJSON := marshalTrailer(f.Request.Trailer)
+	resTrailerJSON := "{}"
+	if f.Response != nil {
+		resTrailerJSON = marshalTrailer(f.Response.Trailer)
+	}
+
+	// streamed flows are stored before the response is complete, their end time is the time of storing
+	startTime := f.Timing.Start
+	endTime := f.Timing.ResponseComplete
+	if endTime.IsZero() {
+		endTime = time.Now()
+	}
+	if startTime.IsZero() {
+		startTime = endTime
+	}
+	ttfbMs := int64(-1)
+	if ttfb := f.Timing.TTFB(); ttfb > 0 {
+		ttfbMs = ttfb.Milliseconds()
+	}
+
+	upstream, _ := f.Metadata["upstream"].(string)
+	fault, _ := f.Metadata["fault"].(string)
+
+	clientCert := ""
+	if f.ConnContext.ClientConn != nil && len(f.ConnContext.ClientConn.PeerCertificates) > 0 {
+		clientCert = f.ConnContext.ClientConn.PeerCertificates[0].Subject.String()
+	}
+
+	replayOf := ""
+	if f.ReplayOf != uuid.Nil {
+		replayOf = f.ReplayOf.String()
+	}
 
 	isPII := false
 	if val, ok := f.Metadata["pii"]; ok {
@@ -68,49 +111,169 @@ func NewFlowEntry(f *proxy.Flow) (*FlowEntry, error) {
 		}
 	}
 
+	var grpcRequest, grpcResponse []byte
+	if f.Request.IsGrpc() {
+		grpcRequest, _ = f.DecodedGrpcRequest()
+		if f.Response != nil && f.Response.IsGrpc() {
+			grpcResponse, _ = f.DecodedGrpcResponse()
+		}
+	}
+
 	return &FlowEntry{
-		ID:             f.Id.String(),
-		ConnID:         f.ConnContext.Id().String(),
-		Method:         f.Request.Method,
-		URL:            f.Request.URL.String(),
-		Proto:          f.Request.Proto,
-		StatusCode:     statusCode,
-		RequestHeader:  string(reqHeaderJSON),
-		RequestBody:    reqBody,
-		ResponseHeader: string(resHeaderJSON),
-		ResponseBody:   resBody,
-		BodyIsText:     isText,
-		StartTime:      startTime,
-		EndTime:        endTime,
-		DurationMs:     0,
-		HasPII:         isPII,
+		ID:              f.Id.String(),
+		ConnID:          f.ConnContext.Id().String(),
+		Method:          f.Request.Method,
+		URL:             f.Request.URL.String(),
+		Proto:           f.Request.Proto,
+		StatusCode:      statusCode,
+		RequestHeader:   string(reqHeaderJSON),
+		RequestBody:     reqBody,
+		ResponseHeader:  string(resHeaderJSON),
+		ResponseBody:    resBody,
+		RequestTrailer:  reqTrailerJSON,
+		ResponseTrailer: resTrailerJSON,
+		BodyIsText:      isText,
+		StartTime:       startTime,
+		EndTime:         endTime,
+		DurationMs:      endTime.Sub(startTime).Milliseconds(),
+		TtfbMs:          ttfbMs,
+		Timing:          marshalTiming(f),
+		Upstream:        upstream,
+		ClientCert:      clientCert,
+		Killed:          f.IsKilled(),
+		ReplayOf:        replayOf,
+		Fault:           fault,
+		HasPII:          isPII,
+		grpcRequest:     grpcRequest,
+		grpcResponse:    grpcResponse,
 	}, nil
 }
 
-// ToProxyFlow converts a FlowEntry back to a proxy.Flow (partial implementation for display)
+func marshalTrailer(trailer http.Header) string {
+	if len(trailer) == 0 {
+		return "{}"
+	}
+	content, err := json.Marshal(trailer)
+	if err != nil {
+		return "{}"
+	}
+	return string(content)
+}
+
+func marshalTiming(f *proxy.Flow) string {
+	content, err := json.Marshal(map[string]interface{}{
+		"flow": f.Timing,
+		"conn": f.ConnTiming(),
+	})
+	if err != nil {
+		return "{}"
+	}
+	return string(content)
+}
+
+// ToProxyFlow converts a FlowEntry back to a finished proxy.Flow, which can be replayed by proxy.Replay.
+// Bodies are stored decoded, their Content-Encoding header is dropped.
 func (e *FlowEntry) ToProxyFlow() (*proxy.Flow, error) {
-	// Reconstruct Request Headers
-	var reqHeader http.Header
-	if err := json.Unmarshal([]byte(e.RequestHeader), &reqHeader); err != nil {
+	id, err := uuid.FromString(e.ID)
+	if err != nil {
 		return nil, err
 	}
 
-	// Reconstruct Response Headers
-	var resHeader http.Header
-	if err := json.Unmarshal([]byte(e.ResponseHeader), &resHeader); err != nil {
+	reqHeader, err := unmarshalHeader(e.RequestHeader)
+	if err != nil {
+		return nil, err
+	}
+	resHeader, err := unmarshalHeader(e.ResponseHeader)
+	if err != nil {
+		return nil, err
+	}
+	reqTrailer, err := unmarshalHeader(e.RequestTrailer)
+	if err != nil {
+		return nil, err
+	}
+	resTrailer, err := unmarshalHeader(e.ResponseTrailer)
+	if err != nil {
 		return nil, err
 	}
 
-	id, err := uuid.FromString(e.ID)
+	u, err := url.Parse(e.URL)
 	if err != nil {
 		return nil, err
 	}
+	proto := e.Proto
+	if proto == "" {
+		proto = "HTTP/1.1"
+	}
 
-	// NOTE: This reconstructs a display-only Flow, not a functional one for replay
-	// URL parsing omitted for brevity, assuming simple string reconstruction
+	f := proxy.NewFlow()
+	f.Id = id
+	f.Request = &proxy.Request{
+		Method:  e.Method,
+		URL:     u,
+		Proto:   proto,
+		Header:  decodedHeader(reqHeader, e.RequestBody),
+		Body:    e.RequestBody,
+		Trailer: reqTrailer,
+	}
+	if e.StatusCode != 0 {
+		f.Response = &proxy.Response{
+			StatusCode: e.StatusCode,
+			Header:     decodedHeader(resHeader, e.ResponseBody),
+			Body:       e.ResponseBody,
+			Trailer:    resTrailer,
+		}
+	}
 
-	return &proxy.Flow{
-		Id: id,
-		// Request and Response would need full reconstruction if needed
-	}, nil
+	var timing struct {
+		Flow proxy.FlowTiming `json:"flow"`
+	}
+	if e.Timing != "" && json.Unmarshal([]byte(e.Timing), &timing) == nil {
+		f.Timing = timing.Flow
+	} else {
+		f.Timing = proxy.FlowTiming{Start: e.StartTime, ResponseComplete: e.EndTime}
+	}
+
+	if e.ReplayOf != "" {
+		if f.ReplayOf, err = uuid.FromString(e.ReplayOf); err != nil {
+			return nil, err
+		}
+	}
+	if e.Upstream != "" {
+		f.Metadata["upstream"] = e.Upstream
+	}
+	if e.Fault != "" {
+		f.Metadata["fault"] = e.Fault
+	}
+	if e.HasPII {
+		f.Metadata["pii"] = true
+	}
+	f.Finish()
+	return f, nil
+}
+
+// header of a JSON string, nil if it is empty
+func unmarshalHeader(s string) (http.Header, error) {
+	if s == "" {
+		return nil, nil
+	}
+	var header http.Header
+	if err := json.Unmarshal([]byte(s), &header); err != nil {
+		return nil, err
+	}
+	return header, nil
+}
+
+// decodedHeader fits header to the decoded body
+func decodedHeader(header http.Header, body []byte) http.Header {
+	if header == nil {
+		header = make(http.Header)
+	}
+	if header.Get("Content-Encoding") == "" {
+		return header
+	}
+	header.Del("Content-Encoding")
+	if header.Get("Content-Length") != "" {
+		header.Set("Content-Length", strconv.Itoa(len(body)))
+	}
+	return header
 }
@@ -37,6 +37,10 @@ func BuildBleveQuery(q *httpql.Query) query.Query {
 		return buildRespQuery(q.Resp)
 	}
 
+	if q.Ws != nil {
+		return buildWsQuery(q.Ws)
+	}
+
 	return query.NewMatchAllQuery()
 }
 
@@ -78,10 +82,40 @@ func buildRespQuery(r *httpql.ResponseClause) query.Query {
 	if r.Length != nil {
 		bq.AddMust(buildIntQuery("RespLen", r.Length))
 	}
+	if r.TTFB != nil {
+		bq.AddMust(buildIntQuery("Ttfb", r.TTFB))
+	}
+	if r.Duration != nil {
+		bq.AddMust(buildIntQuery("Duration", r.Duration))
+	}
+
+	return bq
+}
+
+func buildWsQuery(w *httpql.WebSocketClause) query.Query {
+	bq := query.NewBooleanQuery(nil, nil, nil)
+
+	if w.Message != nil {
+		bq.AddMust(buildStringQuery("WsMsg", w.Message))
+	}
+	if w.Direction != nil {
+		bq.AddMust(buildStringQuery("WsDirection", w.Direction))
+	}
+	if w.ClientMessage != nil {
+		bq.AddMust(buildStringQuery("WsClientMsg", w.ClientMessage))
+	}
+	if w.ServerMessage != nil {
+		bq.AddMust(buildStringQuery("WsServerMsg", w.ServerMessage))
+	}
 
 	return bq
 }
 
+// fields indexed with the keyword analyzer
+func isKeywordField(field string) bool {
+	return field == "Method" || field == "WsDirection"
+}
+
 func buildStringQuery(field string, s *httpql.StringExpr) query.Query {
 	switch s.Operator {
 	case httpql.OpEq:
@@ -89,7 +123,7 @@ func buildStringQuery(field string, s *httpql.StringExpr) query.Query {
 		// For fields analyzed with "standard", TermQuery matches tokens.
 		// For "keyword" analyzer (Method), TermQuery matches exact string.
 		// For others, MatchQuery is safer for text.
-		if field == "Method" {
+		if isKeywordField(field) {
 			tq := query.NewTermQuery(s.Value)
 			tq.SetField(field)
 			return tq
@@ -112,7 +146,7 @@ func buildStringQuery(field string, s *httpql.StringExpr) query.Query {
 		// Better approach for standard text: MatchQuery (matches tokens) or specialized logic.
 		// For consistency with "Contains", if it's a phrase, we probably want MatchPhrase.
 
-		if field == "Method" {
+		if isKeywordField(field) {
 			wq := query.NewWildcardQuery("*" + s.Value + "*")
 			wq.SetField(field)
 			return wq
@@ -36,6 +36,22 @@ func TestBuildBleveQuery(t *testing.T) {
 		}
 	})
 
+	t.Run("WsQuery", func(t *testing.T) {
+		q := &httpql.Query{
+			Ws: &httpql.WebSocketClause{
+				Message:   &httpql.StringExpr{Value: "hello", Operator: httpql.OpCont},
+				Direction: &httpql.StringExpr{Value: "client", Operator: httpql.OpEq},
+			},
+		}
+		bq, ok := BuildBleveQuery(q).(*query.BooleanQuery)
+		if !ok {
+			t.Fatalf("Expected BooleanQuery, got %T", bq)
+		}
+		if _, ok := buildStringQuery("WsDirection", q.Ws.Direction).(*query.TermQuery); !ok {
+			t.Error("Expected TermQuery for keyword field WsDirection")
+		}
+	})
+
 	t.Run("OrQuery", func(t *testing.T) {
 		q := &httpql.Query{
 			Or: []*httpql.Query{
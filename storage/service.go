@@ -3,6 +3,7 @@ package storage
 import (
 	"database/sql"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"net/url"
 	"os"
@@ -24,6 +25,9 @@ type HostTechnology struct {
 	LastDetected time.Time `json:"last_detected"`
 }
 
+// ErrFlowNotFound is returned by Get for an id which is not stored
+var ErrFlowNotFound = errors.New("flow not found")
+
 type Service struct {
 	db    *sql.DB
 	index bleve.Index
@@ -56,6 +60,18 @@ func NewService(storageDir string) (*Service, error) {
 			created_at TIMESTAMP,
 			has_pii BOOLEAN
 		);
+		ALTER TABLE flows ADD COLUMN IF NOT EXISTS req_trailer JSON;
+		ALTER TABLE flows ADD COLUMN IF NOT EXISTS res_trailer JSON;
+		ALTER TABLE flows ADD COLUMN IF NOT EXISTS start_time TIMESTAMP;
+		ALTER TABLE flows ADD COLUMN IF NOT EXISTS end_time TIMESTAMP;
+		ALTER TABLE flows ADD COLUMN IF NOT EXISTS duration_ms BIGINT;
+		ALTER TABLE flows ADD COLUMN IF NOT EXISTS ttfb_ms BIGINT;
+		ALTER TABLE flows ADD COLUMN IF NOT EXISTS timing JSON;
+		ALTER TABLE flows ADD COLUMN IF NOT EXISTS upstream TEXT;
+		ALTER TABLE flows ADD COLUMN IF NOT EXISTS client_cert TEXT;
+		ALTER TABLE flows ADD COLUMN IF NOT EXISTS killed BOOLEAN;
+		ALTER TABLE flows ADD COLUMN IF NOT EXISTS replay_of TEXT;
+		ALTER TABLE flows ADD COLUMN IF NOT EXISTS fault TEXT;
 		CREATE TABLE IF NOT EXISTS pii_detections (
 			flow_id TEXT,
 			source TEXT,
@@ -70,6 +86,32 @@ func NewService(storageDir string) (*Service, error) {
 			last_detected TIMESTAMP,
 			PRIMARY KEY (hostname, tech_name)
 		);
+		CREATE TABLE IF NOT EXISTS tcp_flows (
+			id TEXT PRIMARY KEY,
+			conn_id TEXT,
+			client_addr TEXT,
+			server_addr TEXT,
+			client_bytes BIGINT,
+			server_bytes BIGINT,
+			start_time TIMESTAMP,
+			end_time TIMESTAMP
+		);
+		CREATE TABLE IF NOT EXISTS websocket_messages (
+			flow_id TEXT,
+			direction TEXT,
+			opcode INTEGER,
+			timestamp TIMESTAMP,
+			payload BLOB
+		);
+		ALTER TABLE websocket_messages ADD COLUMN IF NOT EXISTS dropped BOOLEAN;
+		CREATE TABLE IF NOT EXISTS sse_events (
+			flow_id TEXT,
+			event_id TEXT,
+			event TEXT,
+			data TEXT,
+			retry INTEGER,
+			timestamp TIMESTAMP
+		);
 	`)
 	if err != nil {
 		db.Close()
@@ -100,6 +142,10 @@ func NewService(storageDir string) (*Service, error) {
 		docMapping.AddFieldMappingsAt("Query", textFieldMapping)
 		docMapping.AddFieldMappingsAt("ReqBody", textFieldMapping)
 		docMapping.AddFieldMappingsAt("ResBody", textFieldMapping)
+		docMapping.AddFieldMappingsAt("WsMsg", textFieldMapping)
+		docMapping.AddFieldMappingsAt("WsDirection", keywordFieldMapping)
+		docMapping.AddFieldMappingsAt("WsClientMsg", textFieldMapping)
+		docMapping.AddFieldMappingsAt("WsServerMsg", textFieldMapping)
 
 		booleanFieldMapping := bleve.NewBooleanFieldMapping()
 		docMapping.AddFieldMappingsAt("HasPII", booleanFieldMapping)
@@ -108,6 +154,8 @@ func NewService(storageDir string) (*Service, error) {
 		docMapping.AddFieldMappingsAt("ReqLen", numericFieldMapping)
 		docMapping.AddFieldMappingsAt("RespLen", numericFieldMapping)
 		docMapping.AddFieldMappingsAt("Port", numericFieldMapping)
+		docMapping.AddFieldMappingsAt("Ttfb", numericFieldMapping)
+		docMapping.AddFieldMappingsAt("Duration", numericFieldMapping)
 
 		// Headers Mapping (Dynamic)
 		headerMapping := bleve.NewDocumentMapping()
@@ -148,9 +196,11 @@ func (s *Service) SaveEntry(entry *FlowEntry, piiData interface{}) error {
 	// 1. Save to DuckDB
 	// Note: DuckDB supports standard SQL
 	_, err := s.db.Exec(`
-		INSERT INTO flows (id, conn_id, method, url, status_code, req_header, req_body, res_header, res_body, created_at, has_pii)
-		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)
-	`, entry.ID, entry.ConnID, entry.Method, entry.URL, entry.StatusCode, entry.RequestHeader, entry.RequestBody, entry.ResponseHeader, entry.ResponseBody, time.Now(), entry.HasPII)
+		INSERT INTO flows (id, conn_id, method, url, status_code, req_header, req_body, res_header, res_body, created_at, has_pii, req_trailer, res_trailer,
+			start_time, end_time, duration_ms, ttfb_ms, timing, upstream, client_cert, killed, replay_of, fault)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)
+	`, entry.ID, entry.ConnID, entry.Method, entry.URL, entry.StatusCode, entry.RequestHeader, entry.RequestBody, entry.ResponseHeader, entry.ResponseBody, time.Now(), entry.HasPII, nullJSON(entry.RequestTrailer), nullJSON(entry.ResponseTrailer),
+		entry.StartTime, entry.EndTime, entry.DurationMs, entry.TtfbMs, nullJSON(entry.Timing), entry.Upstream, entry.ClientCert, entry.Killed, entry.ReplayOf, entry.Fault)
 
 	if err != nil {
 		log.Errorf("failed to insert into duckdb: %v", err)
@@ -184,6 +234,56 @@ func (s *Service) SaveEntry(entry *FlowEntry, piiData interface{}) error {
 		}
 	}
 
+	// 2. Index in Bleve
+	if err := s.index.Index(entry.ID, newIndexDoc(entry)); err != nil {
+		log.Errorf("failed to index in bleve: %v", err)
+		return err
+	}
+
+	return nil
+}
+
+// MarkKilled marks the stored flow id as killed
+func (s *Service) MarkKilled(id string) error {
+	_, err := s.db.Exec(`UPDATE flows SET killed = true WHERE id = ?`, id)
+	return err
+}
+
+// empty strings are stored as NULL, not as malformed JSON
+func nullJSON(s string) interface{} {
+	if s == "" {
+		return nil
+	}
+	return s
+}
+
+// document indexed in Bleve for a flow
+type indexDoc struct {
+	ID          string
+	Method      string
+	URL         string
+	Host        string
+	Path        string
+	Query       string
+	Port        int
+	Status      int
+	ReqLen      int
+	RespLen     int
+	ReqBody     string
+	ResBody     string
+	ReqHeader   map[string]interface{}
+	ResHeader   map[string]interface{}
+	HasPII      bool
+	Ttfb        *int64 `json:",omitempty"` // milliseconds, not indexed if not measured
+	Duration    int64
+	WsMsg       []string `json:",omitempty"`
+	WsDirection []string `json:",omitempty"`
+	WsClientMsg []string `json:",omitempty"` // text messages of WsMsg sent by the client
+	WsServerMsg []string `json:",omitempty"` // text messages of WsMsg sent by the server
+}
+
+// We index relevant fields for search
+func newIndexDoc(entry *FlowEntry) *indexDoc {
 	// Unmarshal headers for indexing
 	var reqHeaderMap map[string]interface{}
 	if err := json.Unmarshal([]byte(entry.RequestHeader), &reqHeaderMap); err != nil {
@@ -201,31 +301,13 @@ func (s *Service) SaveEntry(entry *FlowEntry, piiData interface{}) error {
 		parsedURL = &url.URL{}
 	}
 
-	// 2. Index in Bleve
-	// We index relevant fields for search
-	doc := struct {
-		ID        string
-		Method    string
-		URL       string
-		Host      string
-		Path      string
-		Query     string
-		Port      int
-		Status    int
-		ReqLen    int
-		RespLen   int
-		ReqBody   string
-		ResBody   string
-		ReqHeader map[string]interface{}
-		ResHeader map[string]interface{}
-		HasPII    bool
-	}{
-		ID:     entry.ID,
-		Method: entry.Method,
-		URL:    entry.URL,
-		Host:   parsedURL.Hostname(),
-		Path:   parsedURL.Path,
-		Query:  parsedURL.RawQuery,
+	doc := &indexDoc{
+		ID:        entry.ID,
+		Method:    entry.Method,
+		URL:       entry.URL,
+		Host:      parsedURL.Hostname(),
+		Path:      parsedURL.Path,
+		Query:     parsedURL.RawQuery,
 		Status:    entry.StatusCode,
 		ReqLen:    len(entry.RequestBody),
 		RespLen:   len(entry.ResponseBody),
@@ -234,6 +316,10 @@ func (s *Service) SaveEntry(entry *FlowEntry, piiData interface{}) error {
 		ReqHeader: reqHeaderMap,
 		ResHeader: resHeaderMap,
 		HasPII:    entry.HasPII,
+		Duration:  entry.DurationMs,
+	}
+	if entry.TtfbMs >= 0 {
+		doc.Ttfb = &entry.TtfbMs
 	}
 
 	// Try parse port
@@ -241,12 +327,15 @@ func (s *Service) SaveEntry(entry *FlowEntry, piiData interface{}) error {
 		fmt.Sscanf(portStr, "%d", &doc.Port)
 	}
 
-	if err := s.index.Index(entry.ID, doc); err != nil {
-		log.Errorf("failed to index in bleve: %v", err)
-		return err
+	// Index decoded grpc messages instead of raw protobuf
+	if entry.grpcRequest != nil {
+		doc.ReqBody = string(entry.grpcRequest)
+	}
+	if entry.grpcResponse != nil {
+		doc.ResBody = string(entry.grpcResponse)
 	}
 
-	return nil
+	return doc
 }
 
 func (s *Service) Search(queryStr string) ([]*FlowEntry, error) {
@@ -288,39 +377,107 @@ func (s *Service) Search(queryStr string) ([]*FlowEntry, error) {
 
 	results := make([]*FlowEntry, 0, len(ids))
 	for _, id := range ids {
-		row := s.db.QueryRow(`
-			SELECT id, conn_id, method, url, status_code, req_header, req_body, res_header, res_body
-			FROM flows WHERE id = ?
-		`, id)
-
-		var e FlowEntry
-		var reqBody, resBody []byte
-		var reqHeader, resHeader interface{}
-
-		err := row.Scan(&e.ID, &e.ConnID, &e.Method, &e.URL, &e.StatusCode, &reqHeader, &reqBody, &resHeader, &resBody)
+		e, err := s.Get(id)
 		if err != nil {
-			if err == sql.ErrNoRows {
+			if errors.Is(err, ErrFlowNotFound) {
 				continue
 			}
 			return nil, err
 		}
-		e.RequestBody = reqBody
-		e.ResponseBody = resBody
+		results = append(results, e)
+	}
+
+	return results, nil
+}
 
-		// Convert headers back to string
-		if reqHeader != nil {
-			bytes, _ := json.Marshal(reqHeader)
-			e.RequestHeader = string(bytes)
+// flowColumns are the columns scanFlowEntry reads
+const flowColumns = `id, conn_id, method, url, status_code, req_header, req_body, res_header, res_body, req_trailer, res_trailer,
+	start_time, end_time, duration_ms, ttfb_ms, timing, upstream, client_cert, killed, replay_of, fault`
+
+// Get returns the stored flow id, ErrFlowNotFound if there is none
+func (s *Service) Get(id string) (*FlowEntry, error) {
+	e, err := scanFlowEntry(s.db.QueryRow(`SELECT `+flowColumns+` FROM flows WHERE id = ?`, id))
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return nil, fmt.Errorf("%w: %v", ErrFlowNotFound, id)
 		}
-		if resHeader != nil {
-			bytes, _ := json.Marshal(resHeader)
-			e.ResponseHeader = string(bytes)
+		return nil, err
+	}
+	return e, nil
+}
+
+// All returns the stored flows in the order they started
+func (s *Service) All() ([]*FlowEntry, error) {
+	rows, err := s.db.Query(`SELECT ` + flowColumns + ` FROM flows ORDER BY start_time, id`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var results []*FlowEntry
+	for rows.Next() {
+		e, err := scanFlowEntry(rows)
+		if err != nil {
+			return nil, err
 		}
+		results = append(results, e)
+	}
+	return results, rows.Err()
+}
 
-		results = append(results, &e)
+func scanFlowEntry(row interface{ Scan(dest ...any) error }) (*FlowEntry, error) {
+	var e FlowEntry
+	var reqBody, resBody []byte
+	var reqHeader, resHeader, reqTrailer, resTrailer, timing interface{}
+	var startTime, endTime sql.NullTime
+	var durationMs, ttfbMs sql.NullInt64
+	var upstream, clientCert, replayOf, fault sql.NullString
+	var killed sql.NullBool
+
+	err := row.Scan(&e.ID, &e.ConnID, &e.Method, &e.URL, &e.StatusCode, &reqHeader, &reqBody, &resHeader, &resBody, &reqTrailer, &resTrailer,
+		&startTime, &endTime, &durationMs, &ttfbMs, &timing, &upstream, &clientCert, &killed, &replayOf, &fault)
+	if err != nil {
+		return nil, err
 	}
+	e.RequestBody = reqBody
+	e.ResponseBody = resBody
 
-	return results, nil
+	// Convert headers back to string
+	if reqHeader != nil {
+		bytes, _ := json.Marshal(reqHeader)
+		e.RequestHeader = string(bytes)
+	}
+	if resHeader != nil {
+		bytes, _ := json.Marshal(resHeader)
+		e.ResponseHeader = string(bytes)
+	}
+	if reqTrailer != nil {
+		bytes, _ := json.Marshal(reqTrailer)
+		e.RequestTrailer = string(bytes)
+	}
+	if resTrailer != nil {
+		bytes, _ := json.Marshal(resTrailer)
+		e.ResponseTrailer = string(bytes)
+	}
+	if timing != nil {
+		bytes, _ := json.Marshal(timing)
+		e.Timing = string(bytes)
+	}
+	// rows stored before timings were recorded have none
+	e.StartTime = startTime.Time
+	e.EndTime = endTime.Time
+	e.DurationMs = durationMs.Int64
+	e.TtfbMs = -1
+	if ttfbMs.Valid {
+		e.TtfbMs = ttfbMs.Int64
+	}
+	e.Upstream = upstream.String
+	e.ClientCert = clientCert.String
+	e.Killed = killed.Bool
+	e.ReplayOf = replayOf.String
+	e.Fault = fault.String
+
+	return &e, nil
 }
 
 func (s *Service) SaveHostTechnologies(hostname string, techs []HostTechnology) error {
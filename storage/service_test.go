@@ -1,12 +1,21 @@
 package storage
 
 import (
+	"bytes"
+	"compress/gzip"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"errors"
 	"net/http"
 	"net/url"
 	"os"
 	"path/filepath"
+	"strconv"
+	"strings"
 	"testing"
+	"time"
 
+	"github.com/gorilla/websocket"
 	"github.com/retutils/gomitmproxy/proxy"
 	uuid "github.com/satori/go.uuid"
 )
@@ -342,3 +351,462 @@ func TestNewService_Error(t *testing.T) {
         t.Error("Expected error for invalid storage path")
     }
 }
+
+func TestService_SaveTcpEntry(t *testing.T) {
+	svc, err := NewService(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer svc.Close()
+
+	f := &proxy.TcpFlow{
+		Id:          uuid.NewV4(),
+		ConnContext: &proxy.ConnContext{ClientConn: &proxy.ClientConn{Id: uuid.NewV4()}},
+		Address:     "mail.example.com:25",
+		StartTime:   time.Now().Add(-time.Second),
+		EndTime:     time.Now(),
+	}
+	f.ClientBytes.Store(12)
+	f.ServerBytes.Store(34)
+
+	entry, err := NewTcpFlowEntry(f)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := svc.SaveTcpEntry(entry); err != nil {
+		t.Fatalf("SaveTcpEntry failed: %v", err)
+	}
+
+	entries, err := svc.ListTcpEntries()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 1 {
+		t.Fatalf("Expected 1 tcp entry, got %d", len(entries))
+	}
+	got := entries[0]
+	if got.ID != f.Id.String() || got.ServerAddr != "mail.example.com:25" || got.ClientBytes != 12 || got.ServerBytes != 34 {
+		t.Errorf("Unexpected tcp entry %+v", got)
+	}
+
+	if _, err := NewTcpFlowEntry(&proxy.TcpFlow{}); err == nil {
+		t.Error("Expected error for tcp flow without connection context")
+	}
+}
+
+func TestService_WebSocketMessages(t *testing.T) {
+	svc, err := NewService(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer svc.Close()
+
+	f := proxy.NewFlow()
+	f.ConnContext = &proxy.ConnContext{ClientConn: &proxy.ClientConn{}}
+	f.Request = &proxy.Request{
+		Method: "GET",
+		URL:    &url.URL{Scheme: "wss", Host: "chat.example.com", Path: "/socket"},
+		Header: http.Header{},
+	}
+	f.Response = &proxy.Response{StatusCode: 101, Header: http.Header{}}
+
+	entry, err := NewFlowEntry(f)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := svc.SaveEntry(entry, nil); err != nil {
+		t.Fatal(err)
+	}
+
+	msgs := []*proxy.WebSocketMessage{
+		{Type: websocket.TextMessage, Data: []byte("hello secret room"), FromClient: true},
+		{Type: websocket.BinaryMessage, Data: []byte{0, 1, 2}, FromClient: false},
+	}
+	for _, msg := range msgs {
+		wsEntry, err := NewWebSocketMessageEntry(f, msg)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := svc.SaveWebSocketMessage(wsEntry); err != nil {
+			t.Fatalf("SaveWebSocketMessage failed: %v", err)
+		}
+	}
+
+	stored, err := svc.ListWebSocketMessages(entry.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(stored) != 2 {
+		t.Fatalf("Expected 2 messages, got %d", len(stored))
+	}
+	if stored[0].Direction != "client" || stored[0].Opcode != websocket.TextMessage || string(stored[0].Payload) != "hello secret room" {
+		t.Errorf("Unexpected message %+v", stored[0])
+	}
+	if stored[1].Direction != "server" || stored[1].Opcode != websocket.BinaryMessage {
+		t.Errorf("Unexpected message %+v", stored[1])
+	}
+
+	if results, _ := svc.Search(`ws.msg.cont:"secret room"`); len(results) != 0 {
+		t.Errorf("Expected no result before the session is indexed, got %d", len(results))
+	}
+	if err := svc.IndexWebSocketSession(entry); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, q := range []string{`ws.msg.cont:"secret room"`, `ws.direction.eq:server AND req.path.cont:"socket"`, `ws.client_msg.cont:"secret room"`} {
+		results, err := svc.Search(q)
+		if err != nil {
+			t.Fatalf("Search %s failed: %v", q, err)
+		}
+		if len(results) != 1 || results[0].ID != entry.ID {
+			t.Errorf("Search %s: expected the websocket flow, got %v", q, results)
+		}
+	}
+	for _, q := range []string{`ws.msg.cont:"lobby"`, `ws.server_msg.cont:"secret room"`} {
+		if results, _ := svc.Search(q); len(results) != 0 {
+			t.Errorf("Search %s: expected no result, got %d", q, len(results))
+		}
+	}
+
+	if _, err := NewWebSocketMessageEntry(nil, nil); err == nil {
+		t.Error("Expected error for missing flow")
+	}
+}
+
+func TestService_ServerSentEvents(t *testing.T) {
+	svc, err := NewService(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer svc.Close()
+
+	f := proxy.NewFlow()
+	f.ConnContext = &proxy.ConnContext{ClientConn: &proxy.ClientConn{}}
+	f.Request = &proxy.Request{
+		Method: "POST",
+		URL:    &url.URL{Scheme: "https", Host: "llm.example.com", Path: "/v1/chat"},
+		Header: http.Header{},
+	}
+	f.Response = &proxy.Response{StatusCode: 200, Header: http.Header{"Content-Type": {"text/event-stream"}}}
+
+	entry, err := NewFlowEntry(f)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := svc.SaveEntry(entry, nil); err != nil {
+		t.Fatal(err)
+	}
+	for _, ev := range []*proxy.ServerSentEvent{
+		{Id: "1", Event: "token", Data: "streamed"},
+		{Id: "2", Event: "token", Data: "answer", Retry: 500},
+	} {
+		sseEntry, err := NewServerSentEventEntry(f, ev)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := svc.SaveServerSentEvent(sseEntry); err != nil {
+			t.Fatalf("SaveServerSentEvent failed: %v", err)
+		}
+	}
+
+	events, err := svc.ListServerSentEvents(entry.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(events) != 2 || events[0].EventID != "1" || events[1].Data != "answer" || events[1].Retry != 500 {
+		t.Fatalf("Unexpected events %+v", events)
+	}
+
+	if err := svc.IndexEventStream(entry); err != nil {
+		t.Fatal(err)
+	}
+	results, err := svc.Search(`resp.body.cont:"answer"`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(results) != 1 || results[0].ID != entry.ID {
+		t.Errorf("Expected the event stream flow, got %v", results)
+	}
+
+	if _, err := NewServerSentEventEntry(f, nil); err == nil {
+		t.Error("Expected error for missing event")
+	}
+}
+
+func TestService_IndexGrpc(t *testing.T) {
+	svc, err := NewService(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer svc.Close()
+
+	// field 1 = varint 12345, length-prefixed
+	msg := []byte{0, 0, 0, 0, 3, 0x08, 0xb9, 0x60}
+	f := proxy.NewFlow()
+	f.ConnContext = &proxy.ConnContext{ClientConn: &proxy.ClientConn{}}
+	f.Request = &proxy.Request{
+		Method: "POST",
+		URL:    &url.URL{Scheme: "https", Host: "api.example.com", Path: "/test.Greeter/SayHello"},
+		Header: http.Header{"Content-Type": {"application/grpc"}},
+		Body:   msg,
+	}
+	f.Response = &proxy.Response{StatusCode: 200, Header: http.Header{"Content-Type": {"application/grpc"}}, Body: msg}
+
+	entry, err := NewFlowEntry(f)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := svc.SaveEntry(entry, nil); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, q := range []string{`req.body.cont:"12345"`, `resp.body.cont:"12345"`} {
+		results, err := svc.Search(q)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(results) != 1 || results[0].ID != entry.ID {
+			t.Errorf("Search %s: expected the grpc flow, got %v", q, results)
+		}
+	}
+}
+
+func TestService_Trailers(t *testing.T) {
+	svc, err := NewService(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer svc.Close()
+
+	f := proxy.NewFlow()
+	f.ConnContext = &proxy.ConnContext{ClientConn: &proxy.ClientConn{}}
+	f.Request = &proxy.Request{
+		Method:  "POST",
+		URL:     &url.URL{Scheme: "https", Host: "trailers.example.com", Path: "/upload"},
+		Header:  http.Header{},
+		Trailer: http.Header{"X-Checksum": {"abc"}},
+	}
+	f.Response = &proxy.Response{StatusCode: 200, Header: http.Header{}, Trailer: http.Header{"Grpc-Status": {"0"}}}
+
+	entry, err := NewFlowEntry(f)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := svc.SaveEntry(entry, nil); err != nil {
+		t.Fatal(err)
+	}
+
+	results, err := svc.Search(`req.path.cont:"upload"`)
+	if err != nil || len(results) != 1 {
+		t.Fatalf("Expected 1 result, got %v %v", results, err)
+	}
+	if results[0].RequestTrailer != `{"X-Checksum":["abc"]}` || results[0].ResponseTrailer != `{"Grpc-Status":["0"]}` {
+		t.Errorf("Unexpected trailers %q %q", results[0].RequestTrailer, results[0].ResponseTrailer)
+	}
+}
+
+func TestService_Timing(t *testing.T) {
+	svc, err := NewService(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer svc.Close()
+
+	start := time.Now()
+	save := func(path string, ttfb time.Duration, measured bool) {
+		f := proxy.NewFlow()
+		f.ConnContext = &proxy.ConnContext{ClientConn: &proxy.ClientConn{}}
+		f.ConnContext.Timing.DnsStart = start
+		f.ConnContext.Timing.DnsDone = start.Add(5 * time.Millisecond)
+		f.Request = &proxy.Request{Method: "GET", URL: &url.URL{Scheme: "https", Host: "timing.example.com", Path: path}, Header: http.Header{}}
+		f.Response = &proxy.Response{StatusCode: 200, Header: http.Header{}}
+		f.Timing.Start = start
+		if measured {
+			f.Timing.RequestSent = start.Add(10 * time.Millisecond)
+			f.Timing.FirstResponseByte = f.Timing.RequestSent.Add(ttfb)
+		}
+		f.Timing.ResponseComplete = start.Add(ttfb + time.Second)
+
+		entry, err := NewFlowEntry(f)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := svc.SaveEntry(entry, nil); err != nil {
+			t.Fatal(err)
+		}
+	}
+	save("/slow", 800*time.Millisecond, true)
+	save("/fast", 20*time.Millisecond, true)
+	save("/unmeasured", 0, false)
+
+	results, err := svc.Search(`resp.ttfb.gt:500`)
+	if err != nil || len(results) != 1 {
+		t.Fatalf("Expected 1 result, got %v %v", results, err)
+	}
+	e := results[0]
+	if e.TtfbMs != 800 || e.DurationMs != 1800 || !e.StartTime.Equal(start.Truncate(time.Microsecond)) {
+		t.Errorf("Unexpected timing %v %v %v", e.TtfbMs, e.DurationMs, e.StartTime)
+	}
+	if !strings.Contains(e.Timing, `"dnsDone"`) || !strings.Contains(e.Timing, `"firstResponseByte"`) {
+		t.Errorf("Unexpected timing json %s", e.Timing)
+	}
+
+	// flows without a measured ttfb are not matched
+	results, err = svc.Search(`resp.ttfb.lt:500`)
+	if err != nil || len(results) != 1 || !strings.HasSuffix(results[0].URL, "/fast") {
+		t.Fatalf("Expected the fast flow, got %v %v", results, err)
+	}
+	if results, err = svc.Search(`resp.duration.gte:1000`); err != nil || len(results) != 3 {
+		t.Fatalf("Expected 3 results, got %v %v", results, err)
+	}
+}
+
+func TestService_Upstream(t *testing.T) {
+	svc, err := NewService(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer svc.Close()
+
+	for i, upstream := range []string{"socks5://127.0.0.1:1080", ""} {
+		path := "/upstream" + strconv.Itoa(i)
+		f := proxy.NewFlow()
+		f.ConnContext = &proxy.ConnContext{ClientConn: &proxy.ClientConn{}}
+		f.Request = &proxy.Request{Method: "GET", URL: &url.URL{Scheme: "https", Host: "upstream.example.com", Path: path}, Header: http.Header{}}
+		if upstream != "" {
+			f.Metadata["upstream"] = upstream
+		}
+		entry, err := NewFlowEntry(f)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if entry.Upstream != upstream {
+			t.Errorf("want entry upstream %q, got %q", upstream, entry.Upstream)
+		}
+		if err := svc.SaveEntry(entry, nil); err != nil {
+			t.Fatal(err)
+		}
+		results, err := svc.Search(`req.path.eq:"` + path + `"`)
+		if err != nil || len(results) != 1 {
+			t.Fatalf("Expected 1 result, got %v %v", results, err)
+		}
+		if results[0].Upstream != upstream {
+			t.Errorf("want stored upstream %q, got %q", upstream, results[0].Upstream)
+		}
+	}
+}
+
+func TestService_ClientCert(t *testing.T) {
+	svc, err := NewService(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer svc.Close()
+
+	f := proxy.NewFlow()
+	f.ConnContext = &proxy.ConnContext{ClientConn: &proxy.ClientConn{
+		PeerCertificates: []*x509.Certificate{{Subject: pkix.Name{CommonName: "test-client", Organization: []string{"Test Co"}}}},
+	}}
+	f.Request = &proxy.Request{Method: "GET", URL: &url.URL{Scheme: "https", Host: "mtls.example.com", Path: "/client-cert"}, Header: http.Header{}}
+	entry, err := NewFlowEntry(f)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if entry.ClientCert != "CN=test-client,O=Test Co" {
+		t.Errorf("unexpected entry client cert %q", entry.ClientCert)
+	}
+	if err := svc.SaveEntry(entry, nil); err != nil {
+		t.Fatal(err)
+	}
+	results, err := svc.Search(`req.path.eq:"/client-cert"`)
+	if err != nil || len(results) != 1 {
+		t.Fatalf("Expected 1 result, got %v %v", results, err)
+	}
+	if results[0].ClientCert != entry.ClientCert {
+		t.Errorf("want stored client cert %q, got %q", entry.ClientCert, results[0].ClientCert)
+	}
+}
+
+func TestService_GetToProxyFlow(t *testing.T) {
+	svc, err := NewService(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer svc.Close()
+
+	var gz bytes.Buffer
+	w := gzip.NewWriter(&gz)
+	w.Write([]byte("hello replay"))
+	w.Close()
+
+	start := time.Now().Add(-time.Second).UTC().Truncate(time.Millisecond)
+	f := proxy.NewFlow()
+	f.ReplayOf = uuid.NewV4()
+	f.ConnContext = &proxy.ConnContext{ClientConn: &proxy.ClientConn{Id: uuid.NewV4()}}
+	f.Request = &proxy.Request{
+		Method:  "POST",
+		URL:     &url.URL{Scheme: "https", Host: "replay.example.com", Path: "/replayed", RawQuery: "a=1"},
+		Proto:   "HTTP/1.1",
+		Header:  http.Header{"X-Test": []string{"1"}},
+		Body:    []byte("payload"),
+		Trailer: http.Header{"X-Checksum": []string{"abc"}},
+	}
+	f.Response = &proxy.Response{
+		StatusCode: 201,
+		Header:     http.Header{"Content-Encoding": []string{"gzip"}, "Content-Length": []string{strconv.Itoa(gz.Len())}},
+		Body:       gz.Bytes(),
+	}
+	f.Timing = proxy.FlowTiming{Start: start, ResponseComplete: start.Add(time.Second)}
+	f.Metadata["upstream"] = "http://upstream:3128"
+	f.Metadata["fault"] = "truncate after 100 bytes"
+	entry, err := NewFlowEntry(f)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if entry.ReplayOf != f.ReplayOf.String() {
+		t.Errorf("unexpected entry replay of %q", entry.ReplayOf)
+	}
+	if err := svc.SaveEntry(entry, nil); err != nil {
+		t.Fatal(err)
+	}
+
+	stored, err := svc.Get(f.Id.String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stored.ReplayOf != entry.ReplayOf || stored.Fault != "truncate after 100 bytes" {
+		t.Errorf("want stored replay of %q, got %q, fault %q", entry.ReplayOf, stored.ReplayOf, stored.Fault)
+	}
+	if _, err := svc.Get(uuid.NewV4().String()); !errors.Is(err, ErrFlowNotFound) {
+		t.Errorf("want ErrFlowNotFound, got %v", err)
+	}
+
+	restored, err := stored.ToProxyFlow()
+	if err != nil {
+		t.Fatal(err)
+	}
+	req := restored.Request
+	if restored.Id != f.Id || restored.ReplayOf != f.ReplayOf || req.Method != "POST" || req.URL.String() != f.Request.URL.String() ||
+		req.Header.Get("X-Test") != "1" || string(req.Body) != "payload" || req.Trailer.Get("X-Checksum") != "abc" {
+		t.Errorf("unexpected restored request %+v", req)
+	}
+	res := restored.Response
+	if res == nil || res.StatusCode != 201 || string(res.Body) != "hello replay" {
+		t.Fatalf("unexpected restored response %+v", res)
+	}
+	// the body is stored decoded
+	if res.Header.Get("Content-Encoding") != "" || res.Header.Get("Content-Length") != "12" {
+		t.Errorf("want headers of the decoded body, got %v", res.Header)
+	}
+	if !restored.Timing.Start.Equal(start) || restored.Timing.Duration() != time.Second {
+		t.Errorf("unexpected restored timing %+v", restored.Timing)
+	}
+	if restored.Metadata["upstream"] != "http://upstream:3128" || restored.Metadata["fault"] != "truncate after 100 bytes" {
+		t.Errorf("unexpected restored metadata %v", restored.Metadata)
+	}
+	select {
+	case <-restored.Done():
+	default:
+		t.Error("want the restored flow finished")
+	}
+}
@@ -0,0 +1,82 @@
+package storage
+
+import (
+	"errors"
+	"strings"
+	"time"
+
+	"github.com/retutils/gomitmproxy/proxy"
+)
+
+// ServerSentEventEntry represents a stored event of a text/event-stream response
+type ServerSentEventEntry struct {
+	FlowID    string    `json:"flow_id"`
+	EventID   string    `json:"event_id"`
+	Event     string    `json:"event"`
+	Data      string    `json:"data"`
+	Retry     int       `json:"retry"`
+	Timestamp time.Time `json:"timestamp"`
+}
+
+// NewServerSentEventEntry converts an event of a flow to a storage-ready ServerSentEventEntry
+func NewServerSentEventEntry(f *proxy.Flow, ev *proxy.ServerSentEvent) (*ServerSentEventEntry, error) {
+	if f == nil || ev == nil {
+		return nil, errors.New("invalid sse event: missing flow or event")
+	}
+	return &ServerSentEventEntry{
+		FlowID:    f.Id.String(),
+		EventID:   ev.Id,
+		Event:     ev.Event,
+		Data:      ev.Data,
+		Retry:     ev.Retry,
+		Timestamp: time.Now(),
+	}, nil
+}
+
+func (s *Service) SaveServerSentEvent(entry *ServerSentEventEntry) error {
+	_, err := s.db.Exec(`
+		INSERT INTO sse_events (flow_id, event_id, event, data, retry, timestamp)
+		VALUES (?, ?, ?, ?, ?, ?)
+	`, entry.FlowID, entry.EventID, entry.Event, entry.Data, entry.Retry, entry.Timestamp)
+	return err
+}
+
+// ListServerSentEvents returns the stored events of a flow in order
+func (s *Service) ListServerSentEvents(flowID string) ([]*ServerSentEventEntry, error) {
+	rows, err := s.db.Query(`
+		SELECT flow_id, event_id, event, data, retry, timestamp
+		FROM sse_events WHERE flow_id = ? ORDER BY timestamp
+	`, flowID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var results []*ServerSentEventEntry
+	for rows.Next() {
+		var e ServerSentEventEntry
+		if err := rows.Scan(&e.FlowID, &e.EventID, &e.Event, &e.Data, &e.Retry, &e.Timestamp); err != nil {
+			return nil, err
+		}
+		results = append(results, &e)
+	}
+	return results, rows.Err()
+}
+
+// IndexEventStream re-indexes an event stream flow with the data of its stored events as response body,
+// so the stream can be found with resp.body queries
+func (s *Service) IndexEventStream(entry *FlowEntry) error {
+	events, err := s.ListServerSentEvents(entry.ID)
+	if err != nil {
+		return err
+	}
+
+	data := make([]string, 0, len(events))
+	for _, ev := range events {
+		data = append(data, ev.Data)
+	}
+	doc := newIndexDoc(entry)
+	doc.ResBody = strings.Join(data, "\n")
+	doc.RespLen = len(doc.ResBody)
+	return s.index.Index(entry.ID, doc)
+}
@@ -0,0 +1,71 @@
+package storage
+
+import (
+	"errors"
+	"time"
+
+	"github.com/retutils/gomitmproxy/proxy"
+)
+
+// TcpFlowEntry represents a stored raw TCP stream
+type TcpFlowEntry struct {
+	ID          string    `json:"id"`
+	ConnID      string    `json:"conn_id"`
+	ClientAddr  string    `json:"client_addr"`
+	ServerAddr  string    `json:"server_addr"`
+	ClientBytes int64     `json:"client_bytes"`
+	ServerBytes int64     `json:"server_bytes"`
+	StartTime   time.Time `json:"start_time"`
+	EndTime     time.Time `json:"end_time"`
+}
+
+// NewTcpFlowEntry converts a proxy.TcpFlow to a storage-ready TcpFlowEntry
+func NewTcpFlowEntry(f *proxy.TcpFlow) (*TcpFlowEntry, error) {
+	if f == nil || f.ConnContext == nil {
+		return nil, errors.New("invalid tcp flow: missing connection context")
+	}
+	clientAddr := ""
+	if f.ConnContext.ClientConn != nil && f.ConnContext.ClientConn.Conn != nil {
+		clientAddr = f.ConnContext.ClientConn.Conn.RemoteAddr().String()
+	}
+	return &TcpFlowEntry{
+		ID:          f.Id.String(),
+		ConnID:      f.ConnContext.Id().String(),
+		ClientAddr:  clientAddr,
+		ServerAddr:  f.Address,
+		ClientBytes: f.ClientBytes.Load(),
+		ServerBytes: f.ServerBytes.Load(),
+		StartTime:   f.StartTime,
+		EndTime:     f.EndTime,
+	}, nil
+}
+
+func (s *Service) SaveTcpEntry(entry *TcpFlowEntry) error {
+	_, err := s.db.Exec(`
+		INSERT INTO tcp_flows (id, conn_id, client_addr, server_addr, client_bytes, server_bytes, start_time, end_time)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?)
+	`, entry.ID, entry.ConnID, entry.ClientAddr, entry.ServerAddr, entry.ClientBytes, entry.ServerBytes, entry.StartTime, entry.EndTime)
+	return err
+}
+
+// ListTcpEntries returns stored tcp streams, newest first
+func (s *Service) ListTcpEntries() ([]*TcpFlowEntry, error) {
+	rows, err := s.db.Query(`
+		SELECT id, conn_id, client_addr, server_addr, client_bytes, server_bytes, start_time, end_time
+		FROM tcp_flows ORDER BY start_time DESC
+	`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var results []*TcpFlowEntry
+	for rows.Next() {
+		var e TcpFlowEntry
+		if err := rows.Scan(&e.ID, &e.ConnID, &e.ClientAddr, &e.ServerAddr, &e.ClientBytes, &e.ServerBytes, &e.StartTime, &e.EndTime); err != nil {
+			return nil, err
+		}
+		results = append(results, &e)
+	}
+	return results, rows.Err()
+}
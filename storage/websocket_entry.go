@@ -0,0 +1,94 @@
+package storage
+
+import (
+	"database/sql"
+	"errors"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/retutils/gomitmproxy/httpql"
+	"github.com/retutils/gomitmproxy/proxy"
+)
+
+// WebSocketMessageEntry represents a stored websocket message
+type WebSocketMessageEntry struct {
+	FlowID    string    `json:"flow_id"`
+	Direction string    `json:"direction"` // sender of the message: client or server
+	Opcode    int       `json:"opcode"`
+	Timestamp time.Time `json:"timestamp"`
+	Payload   []byte    `json:"payload"`
+	Dropped   bool      `json:"dropped"` // the message was dropped by an addon and not forwarded
+}
+
+// NewWebSocketMessageEntry converts a message of a websocket flow to a storage-ready WebSocketMessageEntry
+func NewWebSocketMessageEntry(f *proxy.Flow, msg *proxy.WebSocketMessage) (*WebSocketMessageEntry, error) {
+	if f == nil || msg == nil {
+		return nil, errors.New("invalid websocket message: missing flow or message")
+	}
+	payload := make([]byte, len(msg.Data))
+	copy(payload, msg.Data)
+	return &WebSocketMessageEntry{
+		FlowID:    f.Id.String(),
+		Direction: httpql.WebSocketDirection(msg.FromClient),
+		Opcode:    msg.Type,
+		Timestamp: time.Now(),
+		Payload:   payload,
+		Dropped:   msg.Drop,
+	}, nil
+}
+
+func (s *Service) SaveWebSocketMessage(entry *WebSocketMessageEntry) error {
+	_, err := s.db.Exec(`
+		INSERT INTO websocket_messages (flow_id, direction, opcode, timestamp, payload, dropped)
+		VALUES (?, ?, ?, ?, ?, ?)
+	`, entry.FlowID, entry.Direction, entry.Opcode, entry.Timestamp, entry.Payload, entry.Dropped)
+	return err
+}
+
+// ListWebSocketMessages returns the stored messages of a websocket flow in order
+func (s *Service) ListWebSocketMessages(flowID string) ([]*WebSocketMessageEntry, error) {
+	rows, err := s.db.Query(`
+		SELECT flow_id, direction, opcode, timestamp, payload, dropped
+		FROM websocket_messages WHERE flow_id = ? ORDER BY timestamp
+	`, flowID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var results []*WebSocketMessageEntry
+	for rows.Next() {
+		var e WebSocketMessageEntry
+		var dropped sql.NullBool
+		if err := rows.Scan(&e.FlowID, &e.Direction, &e.Opcode, &e.Timestamp, &e.Payload, &dropped); err != nil {
+			return nil, err
+		}
+		e.Dropped = dropped.Bool
+		results = append(results, &e)
+	}
+	return results, rows.Err()
+}
+
+// IndexWebSocketSession re-indexes the handshake flow of a websocket session together with its stored messages,
+// so the session can be found with ws queries. Each field matches any message of the session on its own, the
+// direction of a payload is only kept by WsClientMsg and WsServerMsg.
+func (s *Service) IndexWebSocketSession(entry *FlowEntry) error {
+	messages, err := s.ListWebSocketMessages(entry.ID)
+	if err != nil {
+		return err
+	}
+
+	doc := newIndexDoc(entry)
+	for _, msg := range messages {
+		if msg.Opcode == websocket.TextMessage {
+			doc.WsMsg = append(doc.WsMsg, string(msg.Payload))
+			if msg.Direction == httpql.WebSocketDirection(true) {
+				doc.WsClientMsg = append(doc.WsClientMsg, string(msg.Payload))
+			} else {
+				doc.WsServerMsg = append(doc.WsServerMsg, string(msg.Payload))
+			}
+		}
+		doc.WsDirection = append(doc.WsDirection, msg.Direction)
+	}
+	return s.index.Index(entry.ID, doc)
+}
@@ -7,6 +7,8 @@ import GitHubLogo from './github-mark.svg'
 import Badge from 'react-bootstrap/Badge'
 
 import BreakPoint from './containers/BreakPoint'
+import NetworkConditions from './containers/NetworkConditions'
+import Addons from './containers/Addons'
 import FlowPreview from './containers/FlowPreview'
 import ViewFlow from './containers/ViewFlow'
 import Resizer from './components/Resizer'
@@ -137,18 +139,7 @@ class App extends React.Component<IProps, IState> {
         let flow = this.flowMgr.get(msg.id)
         if (!flow) {
           flow = new Flow(msg, this.connMgr)
-          flow.getConn()
-          this.flowMgr.add(flow)
-
-          let shouldScroll = false
-          if (this.tableBottomRef?.current && isInViewPort(this.tableBottomRef.current)) {
-            shouldScroll = true
-          }
-          this.setState({ flows: this.flowMgr.showList() }, () => {
-            if (shouldScroll) {
-              this.tableBottomRef?.current?.scrollIntoView({ behavior: 'auto' })
-            }
-          })
+          this.addFlow(flow)
         } else {
           flow.addRequest(msg)
           flow.getConn()
@@ -174,7 +165,50 @@ class App extends React.Component<IProps, IState> {
         flow.addResponseBody(msg)
         this.setState({ flows: this.state.flows })
       }
+      else if (msg.type === MessageType.TCP_START || msg.type === MessageType.TCP_END) {
+        const flow = this.flowMgr.get(msg.id)
+        if (!flow) {
+          this.addFlow(Flow.fromTcp(msg, this.connMgr))
+          return
+        }
+        flow.addTcp(msg)
+        this.setState({ flows: this.state.flows })
+      }
+      else if (msg.type === MessageType.SSE_EVENT) {
+        const flow = this.flowMgr.get(msg.id)
+        if (!flow) return
+        flow.addSseEvent(msg)
+        this.setState({ flows: this.state.flows })
+      }
+      else if (msg.type === MessageType.TIMING) {
+        const flow = this.flowMgr.get(msg.id)
+        if (!flow) return
+        flow.addTiming(msg)
+        this.setState({ flows: this.state.flows })
+      }
+      else if (msg.type === MessageType.KILLED) {
+        const flow = this.flowMgr.get(msg.id)
+        if (!flow) return
+        flow.killed = true
+        flow.waitIntercept = false
+        this.setState({ flows: this.state.flows })
+      }
+    }
+  }
+
+  addFlow(flow: Flow) {
+    flow.getConn()
+    this.flowMgr.add(flow)
+
+    let shouldScroll = false
+    if (this.tableBottomRef?.current && isInViewPort(this.tableBottomRef.current)) {
+      shouldScroll = true
     }
+    this.setState({ flows: this.flowMgr.showList() }, () => {
+      if (shouldScroll) {
+        this.tableBottomRef?.current?.scrollIntoView({ behavior: 'auto' })
+      }
+    })
   }
 
   wsSend(msg: string | ArrayBufferLike | Blob | ArrayBufferView) {
@@ -244,6 +278,14 @@ class App extends React.Component<IProps, IState> {
                 this.wsSend(msg)
               }} />
             </div>
+
+            <div style={{ marginRight: '10px' }}>
+              <NetworkConditions />
+            </div>
+
+            <div style={{ marginRight: '10px' }}>
+              <Addons />
+            </div>
           </div>
 
           <div style={{ display: 'flex', alignItems: 'center' }}>
@@ -0,0 +1,100 @@
+import React, { useState } from 'react'
+import Button from 'react-bootstrap/Button'
+import Modal from 'react-bootstrap/Modal'
+import Form from 'react-bootstrap/Form'
+import Table from 'react-bootstrap/Table'
+
+interface IAddon {
+  name: string
+  type: string
+  priority: number
+  enabled: boolean
+  failures: number
+  last_error?: string
+}
+
+const apiUrl = (path = '') => {
+  const host = process.env.NODE_ENV === 'development' ? 'localhost:9081' : new URL(document.URL).host
+  return `http://${host}/api/addons${path}`
+}
+
+function Addons() {
+  const [show, setShow] = useState(false)
+  const [addons, setAddons] = useState<IAddon[]>([])
+  const [error, setError] = useState('')
+
+  const load = () => {
+    fetch(apiUrl()).then(res => res.ok ? res.json() : res.text().then(text => { throw new Error(text) })).then(data => {
+      setAddons(data)
+      setError('')
+    }).catch(err => { setError(String(err)) })
+  }
+
+  const update = (name: string, change: Partial<IAddon>) => {
+    fetch(apiUrl(`/${encodeURIComponent(name)}`), { method: 'PATCH', body: JSON.stringify(change) }).then(res => {
+      if (!res.ok) return res.text().then(text => { setError(text) })
+      load()
+    }).catch(err => { setError(String(err)) })
+  }
+
+  const handleClose = () => setShow(false)
+  const handleShow = () => {
+    load()
+    setShow(true)
+  }
+
+  return (
+    <div>
+      <Button variant="primary" size="sm" onClick={handleShow}>Addons</Button>
+
+      <Modal show={show} size="lg" onHide={handleClose}>
+        <Modal.Header closeButton>
+          <Modal.Title>Addons</Modal.Title>
+        </Modal.Header>
+
+        <Modal.Body>
+          <Table size="sm">
+            <thead>
+              <tr>
+                <th>Enabled</th>
+                <th>Name</th>
+                <th>Priority</th>
+                <th>Failures</th>
+              </tr>
+            </thead>
+            <tbody>
+              {addons.map(addon => (
+                <tr key={addon.name}>
+                  <td>
+                    <Form.Check type="switch" id={`addon-${addon.name}`} checked={addon.enabled}
+                      onChange={() => { update(addon.name, { enabled: !addon.enabled }) }} />
+                  </td>
+                  <td>{addon.name}{addon.type !== addon.name && <Form.Text muted>{addon.type}</Form.Text>}</td>
+                  <td>
+                    <Form.Control type="number" size="sm" style={{ width: '100px' }} defaultValue={addon.priority}
+                      onBlur={(e: React.FocusEvent<HTMLInputElement>) => {
+                        const priority = parseInt(e.target.value, 10)
+                        if (!isNaN(priority) && priority !== addon.priority) update(addon.name, { priority })
+                      }} />
+                  </td>
+                  <td title={addon.last_error}>{addon.failures || ''}</td>
+                </tr>
+              ))}
+            </tbody>
+          </Table>
+          <Form.Text muted>Enabled addons run by ascending priority, a change applies to the next flows. Failures count the panics of an addon.</Form.Text>
+
+          {error && <div style={{ color: 'red' }}>{error}</div>}
+        </Modal.Body>
+
+        <Modal.Footer>
+          <Button variant="secondary" onClick={handleClose}>
+            Close
+          </Button>
+        </Modal.Footer>
+      </Modal>
+    </div>
+  )
+}
+
+export default Addons
@@ -0,0 +1,122 @@
+import React, { useEffect, useState } from 'react'
+import Button from 'react-bootstrap/Button'
+import Modal from 'react-bootstrap/Modal'
+import Form from 'react-bootstrap/Form'
+import Row from 'react-bootstrap/Row'
+import Col from 'react-bootstrap/Col'
+
+interface INetworkCondition {
+  latency: number
+  jitter: number
+  down: number
+  up: number
+  loss: number
+}
+
+interface INetworkRule {
+  hosts: string[] | null
+  clients: string[] | null
+  preset: string
+}
+
+const apiUrl = () => {
+  const host = process.env.NODE_ENV === 'development' ? 'localhost:9081' : new URL(document.URL).host
+  return `http://${host}/api/network`
+}
+
+const splitList = (value: string) => value.split(',').map(s => s.trim()).filter(s => s)
+
+function NetworkConditions() {
+  const [show, setShow] = useState(false)
+  const [presets, setPresets] = useState<Record<string, INetworkCondition>>({})
+  const [preset, setPreset] = useState('')
+  const [hosts, setHosts] = useState('')
+  const [clients, setClients] = useState('')
+  const [error, setError] = useState('')
+  const [active, setActive] = useState(false)
+
+  const variant = active ? 'success' : 'primary'
+
+  const handleClose = () => setShow(false)
+  const handleShow = () => setShow(true)
+  const handleSave = () => {
+    const rules: INetworkRule[] = []
+    if (preset) {
+      rules.push({ hosts: splitList(hosts), clients: splitList(clients), preset })
+    }
+    fetch(apiUrl(), { method: 'PUT', body: JSON.stringify(rules) }).then(res => {
+      if (!res.ok) return res.text().then(text => { setError(text) })
+      setError('')
+      setActive(rules.length ? true : false)
+      handleClose()
+    }).catch(err => { setError(String(err)) })
+  }
+
+  useEffect(() => {
+    fetch(apiUrl()).then(res => res.ok ? res.json() : null).then(data => {
+      if (!data) return
+      setPresets(data.presets)
+      const rule: INetworkRule | undefined = data.rules[0]
+      if (rule) {
+        setPreset(rule.preset)
+        setHosts((rule.hosts || []).join(', '))
+        setClients((rule.clients || []).join(', '))
+        setActive(true)
+      }
+    }).catch(() => {
+      // network conditions are not available
+    })
+  }, [])
+
+  const condition = presets[preset]
+
+  return (
+    <div>
+      <Button variant={variant} size="sm" onClick={handleShow}>Network{active && preset ? `: ${preset}` : ''}</Button>
+
+      <Modal show={show} onHide={handleClose}>
+        <Modal.Header closeButton>
+          <Modal.Title>Network Conditions</Modal.Title>
+        </Modal.Header>
+
+        <Modal.Body>
+          <Form.Group as={Row}>
+            <Form.Label column sm={2}>Preset</Form.Label>
+            <Col sm={10}>
+              <Form.Control as="select" value={preset} onChange={e => { setPreset(e.target.value) }}>
+                <option value="">No throttling</option>
+                {Object.keys(presets).sort().map(name => <option key={name}>{name}</option>)}
+              </Form.Control>
+              {condition && <Form.Text muted>
+                {condition.latency}ms latency, {condition.down || '∞'} / {condition.up || '∞'} kbit/s{condition.loss ? `, ${condition.loss * 100}% loss` : ''}
+              </Form.Text>}
+            </Col>
+          </Form.Group>
+
+          <Form.Group as={Row}>
+            <Form.Label column sm={2}>Hosts</Form.Label>
+            <Col sm={10}><Form.Control placeholder="all hosts, or e.g. *.example.com, api.example.com:8443" value={hosts} onChange={e => { setHosts(e.target.value) }} /></Col>
+          </Form.Group>
+
+          <Form.Group as={Row}>
+            <Form.Label column sm={2}>Clients</Form.Label>
+            <Col sm={10}><Form.Control placeholder="all clients, or e.g. 192.168.1.0/24" value={clients} onChange={e => { setClients(e.target.value) }} /></Col>
+          </Form.Group>
+
+          {error && <div style={{ color: 'red' }}>{error}</div>}
+        </Modal.Body>
+
+        <Modal.Footer>
+          <Button variant="secondary" onClick={handleClose}>
+            Close
+          </Button>
+          <Button variant="primary" onClick={handleSave}>
+            Save
+          </Button>
+        </Modal.Footer>
+      </Modal>
+    </div>
+  )
+}
+
+export default NetworkConditions
@@ -9,6 +9,7 @@ import type { Flow, IResponse } from '../utils/flow'
 import EditFlow from './EditFlow'
 import { useSize } from 'ahooks'
 import { ResizerItem } from '../components/ResizerItem'
+import { buildMessageEdit, buildMessageKill, SendMessageType } from '../utils/message'
 import { configViewFlowRequestBodyTab, configViewFlowResponseBodyLineBreak, configViewFlowTab, useConfig } from '../utils/config'
 
 interface Iprops {
@@ -113,6 +114,83 @@ function ViewFlow({ flow, onClose, onReRenderFlows, onMessage }: Iprops) {
     return <pre>{flow.hexviewResponseBody()}</pre>
   }
 
+  const sseEvents = () => {
+    if (!flow) return null
+
+    return (
+      <div>
+        {
+          flow.sseEvents.map((ev, index) => {
+            return (
+              <div className="header-block" key={flow.id + index}>
+                <p>{ev.event || 'message'}{ev.id ? ` #${ev.id}` : ''}{ev.retry ? ` (retry ${ev.retry} ms)` : ''}</p>
+                <div className="header-block-content" style={{ whiteSpace: responseBodyLineBreak ? 'pre-wrap' : 'pre' }}>
+                  {ev.data}
+                </div>
+              </div>
+            )
+          })
+        }
+      </div>
+    )
+  }
+
+  const timingPhaseNames: Record<string, string> = {
+    clientTls: 'Client TLS',
+    dns: 'DNS Lookup',
+    connect: 'TCP Connect',
+    serverTls: 'Server TLS',
+    request: 'Request Sent',
+    wait: 'Waiting (TTFB)',
+    response: 'Content Download',
+  }
+
+  const timing = () => {
+    if (!flow) return null
+    const flowTiming = flow.timing
+    if (!flowTiming) return <div style={{ color: 'gray' }}>{flow.tcp ? 'No timing for tcp streams' : 'Timing is sent when the flow is done'}</div>
+    if (!flowTiming.phases.length) return <div style={{ color: 'gray' }}>No timing</div>
+
+    const total = Math.max(...flowTiming.phases.map(phase => phase.start + phase.duration)) || 1
+
+    return (
+      <div>
+        <div className="header-block">
+          <p>Timing</p>
+          <div className="header-block-content">
+            <p>Started At: {new Date(flowTiming.start).toLocaleString()}</p>
+            <p>Connection Reused: {flowTiming.connReused ? 'true' : 'false'}</p>
+            <p>Total: {total.toFixed(2)} ms</p>
+          </div>
+        </div>
+        <div className="header-block">
+          <p>Waterfall</p>
+          <div className="header-block-content">
+            {
+              flowTiming.phases.map(phase => {
+                return (
+                  <div key={flow.id + phase.name} style={{ display: 'flex', alignItems: 'center', marginBottom: '4px' }}>
+                    <span style={{ width: '130px', flexShrink: 0 }}>{timingPhaseNames[phase.name] || phase.name}</span>
+                    <div style={{ flexGrow: 1, position: 'relative', height: '12px' }}>
+                      <div style={{
+                        position: 'absolute',
+                        left: `${phase.start / total * 100}%`,
+                        width: `${Math.max(phase.duration / total * 100, 0.5)}%`,
+                        height: '100%',
+                        backgroundColor: phase.name === 'wait' ? '#28a745' : phase.name === 'response' ? '#007bff' : '#fd7e14',
+                      }}></div>
+                    </div>
+                    <span style={{ width: '90px', flexShrink: 0, textAlign: 'right' }}>{phase.duration.toFixed(2)} ms</span>
+                  </div>
+                )
+              })
+            }
+          </div>
+        </div>
+      </div>
+    )
+  }
+
   const detail = () => {
     if (!flow) return null
 
@@ -126,6 +204,18 @@ function ViewFlow({ flow, onClose, onReRenderFlows, onMessage }: Iprops) {
             <p>Id: {flow.id}</p>
           </div>
         </div>
+        {
+          !flow.tcp ? null :
+            <div className="header-block">
+              <p>TCP Stream</p>
+              <div className="header-block-content">
+                <p>Address: {flow.tcp.address}</p>
+                <p>Bytes From Client: {flow.tcp.clientBytes}</p>
+                <p>Bytes From Server: {flow.tcp.serverBytes}</p>
+                <p>Status: {flow.tcp.endTime ? 'closed' : 'open'}</p>
+              </div>
+            </div>
+        }
         {
           !conn ? null :
             <>
@@ -137,6 +227,14 @@ function ViewFlow({ flow, onClose, onReRenderFlows, onMessage }: Iprops) {
                       <div className="header-block-content">
                         <p>Address: {conn.serverConn.address}</p>
                         <p>Resolved Address: {conn.serverConn.peername}</p>
+                        {
+                          !conn.serverConn.upstream ? null :
+                            <p>Upstream: {conn.serverConn.upstream}</p>
+                        }
+                        {
+                          !conn.serverConn.clientCert ? null :
+                            <p>Client Certificate: {conn.serverConn.clientCert}</p>
+                        }
                       </div>
                     </div>
                   </>
@@ -145,6 +243,10 @@ function ViewFlow({ flow, onClose, onReRenderFlows, onMessage }: Iprops) {
                 <p>Client Connection</p>
                 <div className="header-block-content">
                   <p>Address: {conn.clientConn.address}</p>
+                  {
+                    !conn.clientConn.clientCert ? null :
+                      <p>Client Certificate: {conn.clientConn.clientCert}</p>
+                  }
                 </div>
               </div>
               <div className="header-block">
@@ -227,12 +329,31 @@ function ViewFlow({ flow, onClose, onReRenderFlows, onMessage }: Iprops) {
 
         <div>{copyAsCurl()}</div>
 
+        {
+          flow.tcp ? null :
+            <div>
+              <Button size="sm" onClick={() => {
+                onMessage(buildMessageEdit(SendMessageType.REPLAY, flow))
+              }}>Replay</Button>
+            </div>
+        }
+
+        {
+          (flow.tcp || flow.killed || (flow.response && !flow.waitIntercept)) ? null :
+            <div>
+              <Button size="sm" variant="danger" onClick={() => {
+                onMessage(buildMessageKill(flow))
+              }}>Kill</Button>
+            </div>
+        }
+
         <div>
           <span className={flowTab === 'Detail' ? 'selected' : undefined} onClick={() => { setFlowTab('Detail') }}>Detail</span>
           <span className={flowTab === 'Headers' ? 'selected' : undefined} onClick={() => { setFlowTab('Headers') }}>Headers</span>
           <span className={flowTab === 'Preview' ? 'selected' : undefined} onClick={() => { setFlowTab('Preview') }}>Preview</span>
           <span className={flowTab === 'Response' ? 'selected' : undefined} onClick={() => { setFlowTab('Response') }}>Response</span>
           <span className={flowTab === 'Hexview' ? 'selected' : undefined} onClick={() => { setFlowTab('Hexview') }}>Hexview</span>
+          <span className={flowTab === 'Timing' ? 'selected' : undefined} onClick={() => { setFlowTab('Timing') }}>Timing</span>
         </div>
       </div>
 
@@ -245,7 +366,8 @@ function ViewFlow({ flow, onClose, onReRenderFlows, onMessage }: Iprops) {
                 <div className="header-block-content">
                   <p>Request URL: {request.url}</p>
                   <p>Request Method: {request.method}</p>
-                  <p>Status Code: {`${response.statusCode || '(pending)'}`}</p>
+                  {flow.replayOf ? <p>Replay Of: {flow.replayOf}</p> : null}
+                  <p>Status Code: {`${response.statusCode || (flow.killed ? '(killed)' : '(pending)')}`}</p>
                 </div>
               </div>
 
@@ -329,6 +451,7 @@ function ViewFlow({ flow, onClose, onReRenderFlows, onMessage }: Iprops) {
 
         {
           !(flowTab === 'Response') ? null :
+            flow.sseEvents.length ? sseEvents() :
             !(response.body && response.body.byteLength) ? <div style={{ color: 'gray' }}>No response</div> :
               !(flow.isTextResponse()) ? <div style={{ color: 'gray' }}>Not text response</div> :
                 <div>
@@ -358,6 +481,11 @@ function ViewFlow({ flow, onClose, onReRenderFlows, onMessage }: Iprops) {
             <div>{hexview()}</div>
         }
 
+        {
+          !(flowTab === 'Timing') ? null :
+            <div>{timing()}</div>
+        }
+
         {
           !(flowTab === 'Detail') ? null :
             <div>{detail()}</div>
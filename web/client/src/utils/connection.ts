@@ -3,11 +3,14 @@ export interface IConnection {
     id: string
     tls: boolean
     address: string
+    clientCert?: string
   }
   serverConn?: {
     id: string
     address: string
     peername: string
+    upstream?: string
+    clientCert?: string
   }
   intercept: boolean
   opening?: boolean
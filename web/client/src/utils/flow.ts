@@ -16,6 +16,7 @@ export interface IRequest {
 export interface IFlowRequest {
   connId: string
   request: IRequest
+  replayOf?: string
 }
 
 export interface IResponse {
@@ -24,6 +25,39 @@ export interface IResponse {
   body?: ArrayBuffer
 }
 
+// raw tcp stream of a tunnel which is neither http nor intercepted tls
+export interface ITcpFlow {
+  id: string
+  address: string
+  startTime: number
+  endTime?: number
+  clientBytes: number
+  serverBytes: number
+  connId?: string
+}
+
+// event of a text/event-stream response, the body of the stream is never sent
+export interface IServerSentEvent {
+  id: string
+  event: string
+  data: string
+  retry: number
+}
+
+// bar of the timing waterfall, in milliseconds from the start of the waterfall
+export interface ITimingPhase {
+  name: string
+  start: number
+  duration: number
+}
+
+// timing waterfall of a finished flow, the connection phases are only on the flow which opened the connection
+export interface ITiming {
+  start: string
+  connReused: boolean
+  phases: ITimingPhase[]
+}
+
 export interface IPreviewBody {
   type: 'image' | 'json' | 'binary' | 'x-json-stream'
   data: string | null
@@ -48,8 +82,13 @@ export class Flow {
   public id: string
   public connId!: string
   public waitIntercept!: boolean
+  public killed = false
+  public replayOf?: string
   public request!: IRequest
   public response: IResponse | null = null
+  public tcp: ITcpFlow | null = null
+  public sseEvents: IServerSentEvent[] = []
+  public timing: ITiming | null = null
 
   public url!: URL
   private path!: string
@@ -93,6 +132,30 @@ export class Flow {
     this.connMgr = connMgr
   }
 
+  // a tcp stream is shown as a flow with method TCP
+  public static fromTcp(msg: IMessage, connMgr: ConnectionManager): Flow {
+    const tcp = msg.content as ITcpFlow
+    const flowRequest: IFlowRequest = {
+      connId: tcp.connId || '',
+      request: { method: 'TCP', url: `tcp://${tcp.address}`, proto: 'TCP', header: {} },
+    }
+    const flow = new Flow({ type: MessageType.REQUEST, id: msg.id, waitIntercept: false, content: flowRequest }, connMgr)
+    return flow.addTcp(msg)
+  }
+
+  public addTcp(msg: IMessage): Flow {
+    this.tcp = msg.content as ITcpFlow
+    this.contentType = 'tcp'
+    this.startTime = this.tcp.startTime
+    this._size = this.tcp.clientBytes + this.tcp.serverBytes
+    this.size = getSize(this._size)
+    if (this.tcp.endTime) {
+      this.endTime = this.tcp.endTime
+      this.costTime = String(this.endTime - this.startTime) + ' ms'
+    }
+    return this
+  }
+
   public addRequest(msg: IMessage): Flow {
     this.status = MessageType.REQUEST
     this.waitIntercept = msg.waitIntercept
@@ -100,6 +163,7 @@ export class Flow {
     const flowRequestMsg = msg.content as IFlowRequest
     this.connId = flowRequestMsg.connId
     this.request = flowRequestMsg.request
+    this.replayOf = flowRequestMsg.replayOf
 
     let rawUrl = this.request.url
     if (rawUrl.startsWith('//')) rawUrl = 'http:' + rawUrl
@@ -140,6 +204,21 @@ export class Flow {
     return this
   }
 
+  public addTiming(msg: IMessage): Flow {
+    this.timing = msg.content as ITiming
+    return this
+  }
+
+  public addSseEvent(msg: IMessage): Flow {
+    const ev = msg.content as IServerSentEvent
+    this.sseEvents.push(ev)
+    if (!this.headerContentLengthExist) {
+      this._size += ev.data.length
+      this.size = getSize(this._size)
+    }
+    return this
+  }
+
   public addResponseBody(msg: IMessage): Flow {
     this.status = MessageType.RESPONSE_BODY
     this.waitIntercept = msg.waitIntercept
@@ -168,7 +247,7 @@ export class Flow {
       host: this.url.host,
       path: this.path,
       method: this.request.method,
-      statusCode: this.response ? String(this.response.statusCode) : '(pending)',
+      statusCode: this.tcp ? (this.tcp.endTime ? '(closed)' : '(open)') : this.response ? String(this.response.statusCode) : (this.killed ? '(killed)' : '(pending)'),
       size: this.size,
       costTime: this.costTime,
       contentType: this.contentType,
@@ -1,5 +1,5 @@
 import type { IConnection } from './connection'
-import type { Flow, IFlowRequest, IRequest, IResponse } from './flow'
+import type { Flow, IFlowRequest, IRequest, IResponse, IServerSentEvent, ITcpFlow, ITiming } from './flow'
 import { delHeader, hasHeader, setHeader } from './utils'
 
 const MESSAGE_VERSION = 2
@@ -11,6 +11,11 @@ export enum MessageType {
   REQUEST_BODY = 2,
   RESPONSE = 3,
   RESPONSE_BODY = 4,
+  TCP_START = 6,
+  TCP_END = 7,
+  SSE_EVENT = 8,
+  TIMING = 9,
+  KILLED = 10,
 }
 
 const allMessageBytes = [
@@ -20,16 +25,21 @@ const allMessageBytes = [
   MessageType.REQUEST_BODY,
   MessageType.RESPONSE,
   MessageType.RESPONSE_BODY,
+  MessageType.TCP_START,
+  MessageType.TCP_END,
+  MessageType.SSE_EVENT,
+  MessageType.TIMING,
+  MessageType.KILLED,
 ]
 
 export interface IMessage {
   type: MessageType
   id: string
   waitIntercept: boolean
-  content?: ArrayBuffer | IFlowRequest | IResponse | IConnection | number
+  content?: ArrayBuffer | IFlowRequest | IResponse | IConnection | ITcpFlow | IServerSentEvent | ITiming | number
 }
 
-// type: 0/1/2/3/4
+// type: 0/1/2/3/4/6/7/8/9/10
 // messageFlow
 // version 1 byte + type 1 byte + id 36 byte + waitIntercept 1 byte + content left bytes
 export const parseMessage = (data: ArrayBuffer): IMessage | null => {
@@ -75,10 +85,12 @@ export enum SendMessageType {
   CHANGE_RESPONSE = 12,
   DROP_REQUEST = 13,
   DROP_RESPONSE = 14,
+  KILL_FLOW = 16,
+  REPLAY = 17,
   CHANGE_BREAK_POINT_RULES = 21,
 }
 
-// type: 11/12/13/14
+// type: 11/12/13/14/17
 // messageEdit
 // version 1 byte + type 1 byte + id 36 byte + header len 4 byte + header content bytes + body len 4 byte + [body content bytes]
 export const buildMessageEdit = (messageType: SendMessageType, flow: Flow) => {
@@ -93,7 +105,7 @@ export const buildMessageEdit = (messageType: SendMessageType, flow: Flow) => {
   let header: Omit<IRequest, 'body'> | Omit<IResponse, 'body'>
   let body: ArrayBuffer | Uint8Array | undefined
 
-  if (messageType === SendMessageType.CHANGE_REQUEST) {
+  if (messageType === SendMessageType.CHANGE_REQUEST || messageType === SendMessageType.REPLAY) {
     ({ body, ...header } = flow.request)
   } else if (messageType === SendMessageType.CHANGE_RESPONSE) {
     ({ body, ...header } = flow.response as IResponse)
@@ -125,6 +137,17 @@ export const buildMessageEdit = (messageType: SendMessageType, flow: Flow) => {
   return view
 }
 
+// type: 16
+// messageKill
+// version 1 byte + type 1 byte + id 36 byte
+export const buildMessageKill = (flow: Flow) => {
+  const view = new Uint8Array(38)
+  view[0] = MESSAGE_VERSION
+  view[1] = SendMessageType.KILL_FLOW
+  view.set(new TextEncoder().encode(flow.id), 2)
+  return view
+}
+
 // type: 21
 // messageMeta
 // version 1 byte + type 1 byte + content left bytes
@@ -1,15 +1,22 @@
 package web
 
 import (
+	"bytes"
+	"errors"
 	"fmt"
+	"net/http"
 	"strings"
 	"sync"
 
 	"github.com/gorilla/websocket"
 	"github.com/retutils/gomitmproxy/proxy"
+	uuid "github.com/satori/go.uuid"
 	log "github.com/sirupsen/logrus"
 )
 
+// grpc bodies are shown decoded as json and are not re-encoded
+var errGrpcBodyEdit = errors.New("grpc body can not be changed, it is shown decoded")
+
 type breakPointRule struct {
 	Method string `json:"method"`
 	URL    string `json:"url"`
@@ -26,6 +33,10 @@ type concurrentConn struct {
 	waitChansMu sync.Mutex
 
 	breakPointRules []*breakPointRule
+
+	sendWebSocketFrame func(*messageWebSocketFrame) // handle "send frame" from web client
+	killFlow           func(uuid.UUID) bool         // handle "kill" from web client, false if the flow is not in progress
+	replay             func(*messageEdit)           // handle "replay" from web client
 }
 
 func newConn(c *websocket.Conn) *concurrentConn {
@@ -85,7 +96,9 @@ func (c *concurrentConn) writeMessageMayWait(msg *messageFlow, f *proxy.Flow) {
 	}
 
 	if msg.waitIntercept == 1 {
-		c.waitIntercept(f)
+		if err := c.waitIntercept(f); err != nil {
+			log.Errorf("web addon change flow %v: %v", f.Id, err)
+		}
 	}
 }
 
@@ -119,13 +132,25 @@ func (c *concurrentConn) readloop() {
 			continue
 		}
 
-		if msgEdit, ok := msg.(*messageEdit); ok {
+		if msgEdit, ok := msg.(*messageEdit); ok && msgEdit.mType == messageTypeReplay {
+			if c.replay != nil {
+				c.replay(msgEdit)
+			}
+		} else if msgEdit, ok := msg.(*messageEdit); ok {
 			ch := c.initWaitChan(msgEdit.id.String())
 			go func(m *messageEdit, ch chan<- interface{}) {
 				ch <- m
 			}(msgEdit, ch)
 		} else if msgMeta, ok := msg.(*messageMeta); ok {
 			c.breakPointRules = msgMeta.breakPointRules
+		} else if msgFrame, ok := msg.(*messageWebSocketFrame); ok {
+			if c.sendWebSocketFrame != nil {
+				c.sendWebSocketFrame(msgFrame)
+			}
+		} else if msgKill, ok := msg.(*messageKill); ok {
+			if c.killFlow != nil && !c.killFlow(msgKill.id) {
+				log.Warnf("web addon kill: no active flow %v", msgKill.id)
+			}
 		} else {
 			log.Warn("invalid message, skip")
 		}
@@ -179,28 +204,65 @@ func (c *concurrentConn) isIntercpt(f *proxy.Flow, mType messageType) bool {
 	return false
 }
 
-// 拦截
-func (c *concurrentConn) waitIntercept(f *proxy.Flow) {
+// 拦截, the flow is left unchanged if the change is rejected
+func (c *concurrentConn) waitIntercept(f *proxy.Flow) error {
 	ch := c.initWaitChan(f.Id.String())
-	msg := (<-ch).(*messageEdit)
+	var msg *messageEdit
+	select {
+	case m := <-ch:
+		msg = m.(*messageEdit)
+	case <-f.Killed():
+		// killed while intercepted, the flow is aborted when the addon returns
+		return nil
+	}
 
 	// drop
 	if msg.mType == messageTypeDropRequest || msg.mType == messageTypeDropResponse {
 		f.Response = &proxy.Response{
 			StatusCode: 502,
 		}
-		return
+		return nil
 	}
 
 	// change
 	if msg.mType == messageTypeChangeRequest {
+		// grpc bodies are shown decoded
+		if shown, err := f.DecodedGrpcRequest(); err == nil {
+			if err := keepGrpcBody(shown, msg.request.Body, f.Request.Header, msg.request.Header); err != nil {
+				return err
+			}
+			msg.request.Body = f.Request.Body
+		}
 		f.Request.Method = msg.request.Method
 		f.Request.URL = msg.request.URL
 		f.Request.Header = msg.request.Header
 		f.Request.Body = msg.request.Body
 	} else if msg.mType == messageTypeChangeResponse {
+		if shown, err := f.DecodedGrpcResponse(); err == nil {
+			if err := keepGrpcBody(shown, msg.response.Body, f.Response.Header, msg.response.Header); err != nil {
+				return err
+			}
+			msg.response.Body = f.Response.Body
+		}
 		f.Response.StatusCode = msg.response.StatusCode
 		f.Response.Header = msg.response.Header
 		f.Response.Body = msg.response.Body
 	}
+	return nil
+}
+
+// keepGrpcBody rejects a change of a grpc body shown decoded,
+// the headers which frame the original body are kept in the changed header
+func keepGrpcBody(shown []byte, body []byte, header, changed http.Header) error {
+	if !bytes.Equal(shown, body) {
+		return errGrpcBodyEdit
+	}
+	for _, key := range []string{"Content-Encoding", "Content-Length", "Transfer-Encoding"} {
+		if values, ok := header[key]; ok {
+			changed[key] = values
+		} else {
+			delete(changed, key)
+		}
+	}
+	return nil
 }
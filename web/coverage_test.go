@@ -213,3 +213,46 @@ func TestWebAddon_WaitIntercept_ChangeResponse(t *testing.T) {
 		t.Error("body not changed")
 	}
 }
+
+func TestWebAddon_WaitIntercept_ChangeGrpc(t *testing.T) {
+	c := newConn(nil)
+	body := []byte{0, 0, 0, 0, 2, 0x08, 1}
+	f := proxy.NewFlow()
+	f.Request = &proxy.Request{
+		Method: "POST",
+		URL:    &url.URL{Path: "/test.Greeter/SayHello"},
+		Header: http.Header{"Content-Type": {"application/grpc"}, "Content-Length": {"7"}},
+		Body:   body,
+	}
+	change := func(body string) error {
+		ch := c.initWaitChan(f.Id.String())
+		go func() {
+			ch <- &messageEdit{
+				mType: messageTypeChangeRequest,
+				request: &proxy.Request{
+					Method: "POST",
+					URL:    f.Request.URL,
+					Header: http.Header{"Content-Type": {"application/grpc"}, "Content-Length": {"9"}, "X-Test": {"foo"}},
+					Body:   []byte(body),
+				},
+			}
+		}()
+		return c.waitIntercept(f)
+	}
+
+	// the decoded body is shown, the headers can be changed as long as it is kept
+	if err := change(`[{"1":1}]`); err != nil {
+		t.Fatal(err)
+	}
+	if f.Request.Header.Get("X-Test") != "foo" || f.Request.Header.Get("Content-Length") != "7" || string(f.Request.Body) != string(body) {
+		t.Errorf("expected the header changed and the body kept, got %v %v", f.Request.Header, f.Request.Body)
+	}
+
+	f.Request.Header.Del("X-Test")
+	if err := change(`[{"1":2}]`); err != errGrpcBodyEdit {
+		t.Errorf("expected the body change rejected, got %v", err)
+	}
+	if f.Request.Header.Get("X-Test") != "" || string(f.Request.Body) != string(body) {
+		t.Error("expected the flow unchanged")
+	}
+}
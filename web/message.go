@@ -5,7 +5,9 @@ import (
 	"encoding/binary"
 	"encoding/json"
 	"errors"
+	"time"
 
+	"github.com/gorilla/websocket"
 	"github.com/retutils/gomitmproxy/proxy"
 	uuid "github.com/satori/go.uuid"
 	log "github.com/sirupsen/logrus"
@@ -36,14 +38,22 @@ func writeHeadBody(buf *bytes.Buffer, header interface{}, body []byte) {
 	buf.Write(body)
 }
 
-// type: 0/1/2/3/4/5
+// type: 0/1/2/3/4/5/6/7/8/9/10
 // messageFlow
 // version 1 byte + type 1 byte + id 36 byte + waitIntercept 1 byte + content left bytes
 
-// type: 11/12/13/14
+// type: 11/12/13/14/17
 // messageEdit
 // version 1 byte + type 1 byte + id 36 byte + header len 4 byte + header content bytes + body len 4 byte + [body content bytes]
 
+// type: 15
+// messageWebSocketFrame
+// version 1 byte + type 1 byte + id 36 byte + toClient 1 byte + opcode 1 byte + payload left bytes
+
+// type: 16
+// messageKill
+// version 1 byte + type 1 byte + id 36 byte
+
 // type: 21
 // messageMeta
 // version 1 byte + type 1 byte + content left bytes
@@ -59,12 +69,21 @@ const (
 	messageTypeRequestBody  messageType = 2
 	messageTypeResponse     messageType = 3
 	messageTypeResponseBody messageType = 4
+	messageTypeTcpStart     messageType = 6
+	messageTypeTcpEnd       messageType = 7
+	messageTypeSseEvent     messageType = 8
+	messageTypeTiming       messageType = 9
+	messageTypeKilled       messageType = 10
 
 	messageTypeChangeRequest  messageType = 11
 	messageTypeChangeResponse messageType = 12
 	messageTypeDropRequest    messageType = 13
 	messageTypeDropResponse   messageType = 14
 
+	messageTypeSendWebSocketFrame messageType = 15
+	messageTypeKillFlow           messageType = 16
+	messageTypeReplay             messageType = 17 // messageEdit of the request to replay, id is the flow replayed
+
 	messageTypeChangeBreakPointRules messageType = 21
 )
 
@@ -75,10 +94,17 @@ var allMessageTypes = []messageType{
 	messageTypeRequestBody,
 	messageTypeResponse,
 	messageTypeResponseBody,
+	messageTypeTcpStart,
+	messageTypeTcpEnd,
+	messageTypeSseEvent,
+	messageTypeTiming,
 	messageTypeChangeRequest,
 	messageTypeChangeResponse,
 	messageTypeDropRequest,
 	messageTypeDropResponse,
+	messageTypeSendWebSocketFrame,
+	messageTypeKillFlow,
+	messageTypeReplay,
 	messageTypeChangeBreakPointRules,
 }
 
@@ -115,8 +141,17 @@ func newMessageFlow(mType messageType, f *proxy.Flow) (*messageFlow, error) {
 		m := make(map[string]interface{})
 		m["request"] = f.Request
 		m["connId"] = f.ConnContext.Id().String()
+		if f.ReplayOf != uuid.Nil {
+			m["replayOf"] = f.ReplayOf.String()
+		}
 		content, err = json.Marshal(m)
 	case messageTypeRequestBody:
+		if f.Request.IsGrpc() {
+			// show grpc messages as json, fall back to the raw body
+			if content, err = f.DecodedGrpcRequest(); err == nil {
+				break
+			}
+		}
 		content, err = f.Request.DecodedBody()
 	case messageTypeResponse:
 		if f.Response == nil {
@@ -129,6 +164,11 @@ func newMessageFlow(mType messageType, f *proxy.Flow) (*messageFlow, error) {
 			err = errors.New("no response")
 			break
 		}
+		if f.Response.IsGrpc() {
+			if content, err = f.DecodedGrpcResponse(); err == nil {
+				break
+			}
+		}
 		content, err = f.Response.DecodedBody()
 	default:
 		err = errors.New("invalid message type")
@@ -145,6 +185,14 @@ func newMessageFlow(mType messageType, f *proxy.Flow) (*messageFlow, error) {
 	}, nil
 }
 
+// the flow was killed, id is the flow id
+func newMessageKilled(f *proxy.Flow) *messageFlow {
+	return &messageFlow{
+		mType: messageTypeKilled,
+		id:    f.Id,
+	}
+}
+
 func newMessageConnClose(connCtx *proxy.ConnContext) *messageFlow {
 	var buf bytes.Buffer
 	binary.Write(&buf, binary.BigEndian, connCtx.FlowCount.Load())
@@ -155,6 +203,87 @@ func newMessageConnClose(connCtx *proxy.ConnContext) *messageFlow {
 	}
 }
 
+func newMessageTcpFlow(mType messageType, f *proxy.TcpFlow) (*messageFlow, error) {
+	content, err := json.Marshal(f)
+	if err != nil {
+		return nil, err
+	}
+	return &messageFlow{
+		mType:   mType,
+		id:      f.Id,
+		content: content,
+	}, nil
+}
+
+// event of a text/event-stream response, id is the flow id
+func newMessageSseEvent(f *proxy.Flow, ev *proxy.ServerSentEvent) (*messageFlow, error) {
+	content, err := json.Marshal(ev)
+	if err != nil {
+		return nil, err
+	}
+	return &messageFlow{
+		mType:   messageTypeSseEvent,
+		id:      f.Id,
+		content: content,
+	}, nil
+}
+
+// bar of the timing waterfall of a flow, in milliseconds from the start of the waterfall
+type timingPhase struct {
+	Name     string  `json:"name"`
+	Start    float64 `json:"start"`
+	Duration float64 `json:"duration"`
+}
+
+// timing waterfall of a finished flow, the connection phases are only shown on the flow which opened the connection
+func newMessageTiming(f *proxy.Flow) (*messageFlow, error) {
+	ft := f.Timing
+	ct := f.ConnTiming()
+	origin := ft.Start
+	if !ft.ConnReused && !ct.ClientConnected.IsZero() {
+		origin = ct.ClientConnected
+	}
+
+	phases := make([]*timingPhase, 0)
+	addPhase := func(name string, start, end time.Time) {
+		if start.IsZero() || end.IsZero() {
+			return
+		}
+		phases = append(phases, &timingPhase{
+			Name:     name,
+			Start:    milliseconds(start.Sub(origin)),
+			Duration: milliseconds(end.Sub(start)),
+		})
+	}
+	if !ft.ConnReused {
+		addPhase("clientTls", ct.ClientTlsStart, ct.ClientTlsDone)
+		addPhase("dns", ct.DnsStart, ct.DnsDone)
+		addPhase("connect", ct.TcpConnectStart, ct.TcpConnectDone)
+		addPhase("serverTls", ct.ServerTlsStart, ct.ServerTlsDone)
+	}
+	addPhase("request", ft.Start, ft.RequestSent)
+	addPhase("wait", ft.RequestSent, ft.FirstResponseByte)
+	addPhase("response", ft.FirstResponseByte, ft.ResponseComplete)
+
+	content, err := json.Marshal(map[string]interface{}{
+		"start":      origin,
+		"connReused": ft.ConnReused,
+		"phases":     phases,
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &messageFlow{
+		mType:   messageTypeTiming,
+		id:      f.Id,
+		content: content,
+	}, nil
+}
+
+func milliseconds(d time.Duration) float64 {
+	return float64(d) / float64(time.Millisecond)
+}
+
 func (m *messageFlow) bytes() []byte {
 	buf := newBytesBuffer(m.mType)
 	buf.WriteString(m.id.String()) // len: 36
@@ -214,7 +343,7 @@ func parseMessageEdit(data []byte) *messageEdit {
 	}
 	bodyContent := data[42+hl+4:]
 
-	if mType == messageTypeChangeRequest {
+	if mType == messageTypeChangeRequest || mType == messageTypeReplay {
 		req := new(proxy.Request)
 		err := json.Unmarshal(headerContent, req)
 		if err != nil {
@@ -244,7 +373,7 @@ func (m *messageEdit) bytes() []byte {
 	buf := newBytesBuffer(m.mType)
 	buf.WriteString(m.id.String()) // len: 36
 
-	if m.mType == messageTypeChangeRequest {
+	if m.mType == messageTypeChangeRequest || m.mType == messageTypeReplay {
 		writeHeadBody(buf, m.request, m.request.Body)
 	} else if m.mType == messageTypeChangeResponse {
 		writeHeadBody(buf, m.response, m.response.Body)
@@ -253,6 +382,85 @@ func (m *messageEdit) bytes() []byte {
 	return buf.Bytes()
 }
 
+type messageWebSocketFrame struct {
+	mType    messageType
+	id       uuid.UUID // flow id of the websocket connection
+	toClient bool
+	opcode   int
+	payload  []byte
+}
+
+func parseMessageWebSocketFrame(data []byte) *messageWebSocketFrame {
+	// 2 + 36 + 1 + 1
+	if len(data) < 40 {
+		log.Warnf("parseMessageWebSocketFrame: len(data) %d < 40", len(data))
+		return nil
+	}
+
+	id, err := uuid.FromString(string(data[2:38]))
+	if err != nil {
+		log.Warnf("parseMessageWebSocketFrame: uuid error %v", err)
+		return nil
+	}
+
+	opcode := int(data[39])
+	if opcode != websocket.TextMessage && opcode != websocket.BinaryMessage {
+		log.Warnf("parseMessageWebSocketFrame: invalid opcode %v", opcode)
+		return nil
+	}
+
+	return &messageWebSocketFrame{
+		mType:    messageType(data[1]),
+		id:       id,
+		toClient: data[38] == 1,
+		opcode:   opcode,
+		payload:  data[40:],
+	}
+}
+
+func (m *messageWebSocketFrame) bytes() []byte {
+	buf := newBytesBuffer(m.mType)
+	buf.WriteString(m.id.String()) // len: 36
+	if m.toClient {
+		buf.WriteByte(1)
+	} else {
+		buf.WriteByte(0)
+	}
+	buf.WriteByte(byte(m.opcode))
+	buf.Write(m.payload)
+	return buf.Bytes()
+}
+
+type messageKill struct {
+	mType messageType
+	id    uuid.UUID // flow id
+}
+
+func parseMessageKill(data []byte) *messageKill {
+	// 2 + 36
+	if len(data) != 38 {
+		log.Warnf("parseMessageKill: len(data) %d != 38", len(data))
+		return nil
+	}
+
+	id, err := uuid.FromString(string(data[2:38]))
+	if err != nil {
+		log.Warnf("parseMessageKill: uuid error %v", err)
+		return nil
+	}
+
+	return &messageKill{
+		mType: messageType(data[1]),
+		id:    id,
+	}
+}
+
+func (m *messageKill) bytes() []byte {
+	buf := newBytesBuffer(m.mType)
+	buf.WriteString(m.id.String()) // len: 36
+	return buf.Bytes()
+}
+
 type messageMeta struct {
 	mType           messageType
 	breakPointRules []*breakPointRule
@@ -299,12 +507,24 @@ func parseMessage(data []byte) message {
 
 	mType := (messageType)(data[1])
 
-	if mType == messageTypeChangeRequest || mType == messageTypeChangeResponse || mType == messageTypeDropRequest || mType == messageTypeDropResponse {
+	if mType == messageTypeChangeRequest || mType == messageTypeChangeResponse || mType == messageTypeDropRequest || mType == messageTypeDropResponse || mType == messageTypeReplay {
 		msg := parseMessageEdit(data)
 		if msg == nil {
 			return nil
 		}
 		return msg
+	} else if mType == messageTypeSendWebSocketFrame {
+		msg := parseMessageWebSocketFrame(data)
+		if msg == nil {
+			return nil
+		}
+		return msg
+	} else if mType == messageTypeKillFlow {
+		msg := parseMessageKill(data)
+		if msg == nil {
+			return nil
+		}
+		return msg
 	} else if mType == messageTypeChangeBreakPointRules {
 		return parseMessageMeta(data)
 	} else {
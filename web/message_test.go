@@ -7,6 +7,7 @@ import (
 	"net"
 	"net/http"
 	"net/url"
+	"reflect"
 	"testing"
 	"time"
 
@@ -482,3 +483,205 @@ func TestParseMessageMeta_Error(t *testing.T) {
 	}
 }
 
+
+func TestMessageTcpFlow(t *testing.T) {
+	f := &proxy.TcpFlow{
+		Id:          uuid.NewV4(),
+		ConnContext: &proxy.ConnContext{ClientConn: &proxy.ClientConn{Id: uuid.NewV4()}},
+		Address:     "example.com:22",
+		StartTime:   time.Now(),
+	}
+	f.ClientBytes.Store(3)
+
+	msg, err := newMessageTcpFlow(messageTypeTcpEnd, f)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if msg.mType != messageTypeTcpEnd || msg.id != f.Id {
+		t.Errorf("unexpected message %v %v", msg.mType, msg.id)
+	}
+	var content map[string]interface{}
+	if err := json.Unmarshal(msg.content, &content); err != nil {
+		t.Fatal(err)
+	}
+	if content["address"] != "example.com:22" || content["clientBytes"] != float64(3) {
+		t.Errorf("unexpected content %v", content)
+	}
+}
+
+func TestMessageWebSocketFrame(t *testing.T) {
+	id := uuid.NewV4()
+	msg := &messageWebSocketFrame{
+		mType:    messageTypeSendWebSocketFrame,
+		id:       id,
+		toClient: true,
+		opcode:   1,
+		payload:  []byte("frame"),
+	}
+
+	parsed, ok := parseMessage(msg.bytes()).(*messageWebSocketFrame)
+	if !ok {
+		t.Fatal("expected messageWebSocketFrame")
+	}
+	if parsed.id != id || !parsed.toClient || parsed.opcode != 1 || string(parsed.payload) != "frame" {
+		t.Errorf("unexpected frame %+v", parsed)
+	}
+
+	// invalid opcode
+	data := msg.bytes()
+	data[39] = 8
+	if parseMessage(data) != nil {
+		t.Error("expected nil for close opcode")
+	}
+	// too short
+	if parseMessage(data[:39]) != nil {
+		t.Error("expected nil for short message")
+	}
+}
+
+func TestMessageSseEvent(t *testing.T) {
+	f := proxy.NewFlow()
+	msg, err := newMessageSseEvent(f, &proxy.ServerSentEvent{Id: "7", Event: "token", Data: "hi", Retry: 100})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if msg.mType != messageTypeSseEvent || msg.id != f.Id {
+		t.Errorf("unexpected message %v %v", msg.mType, msg.id)
+	}
+	var ev proxy.ServerSentEvent
+	if err := json.Unmarshal(msg.content, &ev); err != nil {
+		t.Fatal(err)
+	}
+	if ev.Id != "7" || ev.Event != "token" || ev.Data != "hi" || ev.Retry != 100 {
+		t.Errorf("unexpected content %+v", ev)
+	}
+}
+
+func TestMessageFlow_GrpcBody(t *testing.T) {
+	f := proxy.NewFlow()
+	f.Request = &proxy.Request{
+		Method: "POST",
+		URL:    &url.URL{Path: "/test.Greeter/SayHello"},
+		Header: http.Header{"Content-Type": {"application/grpc"}},
+		Body:   []byte{0, 0, 0, 0, 2, 0x08, 1},
+	}
+	msg, err := newMessageFlow(messageTypeRequestBody, f)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(msg.content) != `[{"1":1}]` {
+		t.Errorf("expected decoded grpc body, got %s", msg.content)
+	}
+
+	// invalid frame falls back to the raw body
+	f.Request.Body = []byte{1, 2}
+	msg, err = newMessageFlow(messageTypeRequestBody, f)
+	if err != nil || !bytes.Equal(msg.content, []byte{1, 2}) {
+		t.Errorf("expected raw body, got %v %v", msg.content, err)
+	}
+}
+
+func TestMessageTiming(t *testing.T) {
+	connected := time.Now()
+	f := proxy.NewFlow()
+	f.ConnContext = &proxy.ConnContext{}
+	f.ConnContext.Timing = proxy.ConnTiming{
+		ClientConnected: connected,
+		DnsStart:        connected.Add(10 * time.Millisecond),
+		DnsDone:         connected.Add(30 * time.Millisecond),
+	}
+	f.Timing = proxy.FlowTiming{
+		Start:             connected.Add(40 * time.Millisecond),
+		RequestSent:       connected.Add(50 * time.Millisecond),
+		FirstResponseByte: connected.Add(150 * time.Millisecond),
+		ResponseComplete:  connected.Add(160 * time.Millisecond),
+	}
+
+	phasesOf := func() []timingPhase {
+		msg, err := newMessageTiming(f)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if msg.mType != messageTypeTiming || msg.id != f.Id {
+			t.Errorf("unexpected message %v %v", msg.mType, msg.id)
+		}
+		var content struct {
+			Phases []timingPhase `json:"phases"`
+		}
+		if err := json.Unmarshal(msg.content, &content); err != nil {
+			t.Fatal(err)
+		}
+		return content.Phases
+	}
+
+	phases := phasesOf()
+	want := []timingPhase{
+		{Name: "dns", Start: 10, Duration: 20},
+		{Name: "request", Start: 40, Duration: 10},
+		{Name: "wait", Start: 50, Duration: 100},
+		{Name: "response", Start: 150, Duration: 10},
+	}
+	if !reflect.DeepEqual(phases, want) {
+		t.Errorf("unexpected phases %+v", phases)
+	}
+
+	// a reused connection starts at the flow
+	f.Timing.ConnReused = true
+	phases = phasesOf()
+	if len(phases) != 3 || phases[0].Name != "request" || phases[0].Start != 0 {
+		t.Errorf("unexpected phases %+v", phases)
+	}
+}
+
+func TestMessageKill(t *testing.T) {
+	id := uuid.NewV4()
+	msg := &messageKill{mType: messageTypeKillFlow, id: id}
+	parsed, ok := parseMessage(msg.bytes()).(*messageKill)
+	if !ok {
+		t.Fatal("expected messageKill")
+	}
+	if parsed.id != id {
+		t.Errorf("want id %v, got %v", id, parsed.id)
+	}
+
+	data := msg.bytes()
+	if parseMessage(data[:37]) != nil {
+		t.Error("expected nil for short message")
+	}
+	copy(data[2:], "not-a-uuid")
+	if parseMessage(data) != nil {
+		t.Error("expected nil for invalid id")
+	}
+
+	f := proxy.NewFlow()
+	killed := newMessageKilled(f).bytes()
+	if len(killed) != 39 || messageType(killed[1]) != messageTypeKilled || string(killed[2:38]) != f.Id.String() {
+		t.Errorf("unexpected killed message %q", killed)
+	}
+}
+
+func TestMessageReplay(t *testing.T) {
+	id := uuid.NewV4()
+	msg := &messageEdit{
+		mType: messageTypeReplay,
+		id:    id,
+		request: &proxy.Request{
+			Method: "POST",
+			URL:    &url.URL{Scheme: "https", Host: "example.com", Path: "/replay"},
+			Proto:  "HTTP/1.1",
+			Header: http.Header{"X-Test": []string{"1"}},
+			Body:   []byte("edited"),
+		},
+	}
+	parsed, ok := parseMessage(msg.bytes()).(*messageEdit)
+	if !ok {
+		t.Fatal("expected messageEdit")
+	}
+	if parsed.mType != messageTypeReplay || parsed.id != id {
+		t.Errorf("unexpected message %v %v", parsed.mType, parsed.id)
+	}
+	req := parsed.request
+	if req == nil || req.Method != "POST" || req.URL.String() != "https://example.com/replay" || req.Header.Get("X-Test") != "1" || string(req.Body) != "edited" {
+		t.Errorf("unexpected request %+v", req)
+	}
+}
@@ -2,6 +2,7 @@ package web
 
 import (
 	"embed"
+	"encoding/json"
 	"fmt"
 	"io/fs"
 	"net"
@@ -10,6 +11,7 @@ import (
 	
 	"github.com/gorilla/websocket"
 	"github.com/retutils/gomitmproxy/proxy"
+	uuid "github.com/satori/go.uuid"
 	log "github.com/sirupsen/logrus"
 )
 
@@ -19,6 +21,10 @@ var assets embed.FS
 type WebAddon struct {
 	proxy.BaseAddon
     Addr string // Listening address
+	// Proxy replays the requests the web client sends back, replay is not available if it is nil
+	Proxy *proxy.Proxy
+	// Network is changed by the web client, network conditions are not available if it is nil
+	Network *proxy.NetworkConditions
 
 	server   *http.Server
 	upgrader *websocket.Upgrader
@@ -27,12 +33,18 @@ type WebAddon struct {
 	connsMu sync.RWMutex
 
 	flowMessageState map[*proxy.Flow]messageType
+	flows            map[string]*proxy.Flow // flow id -> flow in progress
 	flowMu           sync.Mutex
+
+	wsSessions   map[string]*proxy.WebSocketSession // flow id -> active websocket session
+	wsSessionsMu sync.Mutex
 }
 
 func NewWebAddon(addr string) *WebAddon {
 	web := &WebAddon{
 		flowMessageState: make(map[*proxy.Flow]messageType),
+		flows:            make(map[string]*proxy.Flow),
+		wsSessions:       make(map[string]*proxy.WebSocketSession),
 	}
 
 	web.upgrader = &websocket.Upgrader{
@@ -43,6 +55,11 @@ func NewWebAddon(addr string) *WebAddon {
 
 	serverMux := new(http.ServeMux)
 	serverMux.HandleFunc("/echo", web.echo)
+	serverMux.HandleFunc("POST /api/flows/{id}/kill", web.kill)
+	serverMux.HandleFunc("GET /api/network", web.getNetwork)
+	serverMux.HandleFunc("PUT /api/network", web.setNetwork)
+	serverMux.HandleFunc("GET /api/addons", web.getAddons)
+	serverMux.HandleFunc("PATCH /api/addons/{name}", web.updateAddon)
 
 	fsys, err := fs.Sub(assets, "client/build")
 	if err != nil {
@@ -88,6 +105,9 @@ func (web *WebAddon) echo(w http.ResponseWriter, r *http.Request) {
 	}
 
 	conn := newConn(c)
+	conn.sendWebSocketFrame = web.sendWebSocketFrame
+	conn.killFlow = web.killFlow
+	conn.replay = web.replay
 	web.addConn(conn)
 	defer func() {
 		web.removeConn(conn)
@@ -156,14 +176,19 @@ func (web *WebAddon) sendFlowMayWait(f *proxy.Flow, msgFn func() (*messageFlow,
 func (web *WebAddon) Requestheaders(f *proxy.Flow) {
 	web.flowMu.Lock()
 	web.flowMessageState[f] = messageType(0)
+	web.flows[f.Id.String()] = f
 	web.flowMu.Unlock()
 
 	go func() {
 		<-f.Done()
 		web.sendMessageUntil(f, messageTypeResponseBody)
+		web.sendFlow(func() (*messageFlow, error) {
+			return newMessageTiming(f)
+		})
 
 		web.flowMu.Lock()
 		delete(web.flowMessageState, f)
+		delete(web.flows, f.Id.String())
 		web.flowMu.Unlock()
 	}()
 
@@ -206,6 +231,193 @@ func (web *WebAddon) Response(f *proxy.Flow) {
 	}
 }
 
+func (web *WebAddon) ServerSentEvent(f *proxy.Flow, ev *proxy.ServerSentEvent) {
+	// the response headers go first, the body of an event stream is never sent
+	web.sendMessageUntil(f, messageTypeResponse)
+	web.sendFlow(func() (*messageFlow, error) {
+		return newMessageSseEvent(f, ev)
+	})
+}
+
+func (web *WebAddon) TcpStart(f *proxy.TcpFlow) {
+	web.sendFlow(func() (*messageFlow, error) {
+		return newMessageTcpFlow(messageTypeTcpStart, f)
+	})
+}
+
+func (web *WebAddon) TcpEnd(f *proxy.TcpFlow) {
+	web.sendFlow(func() (*messageFlow, error) {
+		return newMessageTcpFlow(messageTypeTcpEnd, f)
+	})
+}
+
+func (web *WebAddon) WebsocketHandshake(f *proxy.Flow) {
+	if f.WebSocket == nil {
+		return
+	}
+	id := f.Id.String()
+	web.wsSessionsMu.Lock()
+	web.wsSessions[id] = f.WebSocket
+	web.wsSessionsMu.Unlock()
+
+	go func() {
+		<-f.Done()
+		web.wsSessionsMu.Lock()
+		delete(web.wsSessions, id)
+		web.wsSessionsMu.Unlock()
+	}()
+}
+
+func (web *WebAddon) sendWebSocketFrame(msg *messageWebSocketFrame) {
+	web.wsSessionsMu.Lock()
+	session := web.wsSessions[msg.id.String()]
+	web.wsSessionsMu.Unlock()
+	if session == nil {
+		log.Warnf("web addon send frame: no active websocket %v", msg.id)
+		return
+	}
+
+	var err error
+	if msg.toClient {
+		err = session.SendToClient(msg.opcode, msg.payload)
+	} else {
+		err = session.SendToServer(msg.opcode, msg.payload)
+	}
+	if err != nil {
+		log.Errorf("web addon send frame: %v", err)
+	}
+}
+
+func (web *WebAddon) FlowKilled(f *proxy.Flow) {
+	web.sendMessageUntil(f, messageTypeRequest)
+	web.sendFlow(func() (*messageFlow, error) {
+		return newMessageKilled(f), nil
+	})
+}
+
+// killFlow kills the flow of id, false if it is not in progress
+func (web *WebAddon) killFlow(id uuid.UUID) bool {
+	web.flowMu.Lock()
+	f := web.flows[id.String()]
+	web.flowMu.Unlock()
+	if f == nil {
+		return false
+	}
+	f.Kill()
+	return true
+}
+
+// replay the request of msg, the replay shows up as a new flow
+func (web *WebAddon) replay(msg *messageEdit) {
+	if web.Proxy == nil {
+		log.Warnf("web addon replay %v: no proxy set", msg.id)
+		return
+	}
+	f := proxy.NewFlow()
+	f.Id = msg.id
+	f.Request = msg.request
+	go func() {
+		if _, err := web.Proxy.Replay(f); err != nil {
+			log.Warnf("web addon replay: %v", err)
+		}
+	}()
+}
+
+// POST /api/flows/{id}/kill
+func (web *WebAddon) kill(w http.ResponseWriter, r *http.Request) {
+	id, err := uuid.FromString(r.PathValue("id"))
+	if err != nil {
+		http.Error(w, "invalid flow id", http.StatusBadRequest)
+		return
+	}
+	if !web.killFlow(id) {
+		http.Error(w, "no flow in progress", http.StatusNotFound)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// GET /api/network
+func (web *WebAddon) getNetwork(w http.ResponseWriter, r *http.Request) {
+	if web.Network == nil {
+		http.Error(w, "network conditions not available", http.StatusNotFound)
+		return
+	}
+	rules := web.Network.Rules()
+	if rules == nil {
+		rules = []*proxy.NetworkRule{}
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"presets": proxy.NetworkPresets,
+		"rules":   rules,
+	})
+}
+
+// PUT /api/network with a json array of proxy.NetworkRule
+func (web *WebAddon) setNetwork(w http.ResponseWriter, r *http.Request) {
+	if web.Network == nil {
+		http.Error(w, "network conditions not available", http.StatusNotFound)
+		return
+	}
+	var rules []*proxy.NetworkRule
+	if err := json.NewDecoder(r.Body).Decode(&rules); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if err := web.Network.SetRules(rules); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	log.Infof("web addon: network rules set %v", len(rules))
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (web *WebAddon) getAddons(w http.ResponseWriter, r *http.Request) {
+	if web.Proxy == nil {
+		http.Error(w, "addons not available", http.StatusNotFound)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(web.Proxy.Registry.List())
+}
+
+// PATCH /api/addons/{name} with a json object of enabled and priority, either may be left out
+func (web *WebAddon) updateAddon(w http.ResponseWriter, r *http.Request) {
+	if web.Proxy == nil {
+		http.Error(w, "addons not available", http.StatusNotFound)
+		return
+	}
+	var update struct {
+		Enabled  *bool `json:"enabled"`
+		Priority *int  `json:"priority"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&update); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	name := r.PathValue("name")
+	registry := web.Proxy.Registry
+	if registry.Get(name) == nil {
+		http.Error(w, fmt.Sprintf("addon %v not registered", name), http.StatusNotFound)
+		return
+	}
+	if update.Priority != nil {
+		if err := registry.SetPriority(name, *update.Priority); err != nil {
+			http.Error(w, err.Error(), http.StatusNotFound)
+			return
+		}
+	}
+	if update.Enabled != nil {
+		if err := registry.SetEnabled(name, *update.Enabled); err != nil {
+			http.Error(w, err.Error(), http.StatusNotFound)
+			return
+		}
+		log.Infof("web addon: addon %v enabled %v", name, *update.Enabled)
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
 func (web *WebAddon) ServerDisconnected(connCtx *proxy.ConnContext) {
 	web.forEachConn(func(c *concurrentConn) {
 		c.whenConnClose(connCtx)
@@ -1,8 +1,11 @@
 package web
 
 import (
+	"encoding/json"
 	"net/http"
+	"net/http/httptest"
 	"net/url"
+	"strings"
 	"sync"
 	"testing"
 	"time"
@@ -298,3 +301,242 @@ func TestWebAddon_DisconnectedClient(t *testing.T) {
     }
     webAddon.Requestheaders(&proxy.Flow{ConnContext: connCtx})
 }
+
+func TestWebAddon_Kill(t *testing.T) {
+	webAddon := NewWebAddon(":0")
+	webAddon.Start()
+	defer webAddon.Close()
+	time.Sleep(50 * time.Millisecond)
+
+	u := url.URL{Scheme: "ws", Host: webAddon.Addr, Path: "/echo"}
+	c, _, err := websocket.DefaultDialer.Dial(u.String(), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	time.Sleep(50 * time.Millisecond)
+
+	newFlow := func() *proxy.Flow {
+		f := proxy.NewFlow()
+		f.ConnContext = &proxy.ConnContext{
+			ClientConn: &proxy.ClientConn{Conn: &dummyConn{}, Id: uuid.NewV4()},
+		}
+		f.Request = &proxy.Request{
+			Method: "GET",
+			URL:    &url.URL{Scheme: "http", Host: "example.com", Path: "/"},
+			Header: make(http.Header),
+		}
+		webAddon.Requestheaders(f)
+		return f
+	}
+	kill := func(id string) int {
+		req := httptest.NewRequest("POST", "/api/flows/"+id+"/kill", nil)
+		rec := httptest.NewRecorder()
+		webAddon.server.Handler.ServeHTTP(rec, req)
+		return rec.Code
+	}
+
+	t.Run("rest", func(t *testing.T) {
+		f := newFlow()
+		defer f.Finish()
+		if code := kill(f.Id.String()); code != http.StatusNoContent {
+			t.Errorf("want 204, got %v", code)
+		}
+		if !f.IsKilled() {
+			t.Error("want flow killed")
+		}
+		if code := kill(uuid.NewV4().String()); code != http.StatusNotFound {
+			t.Errorf("unknown flow: want 404, got %v", code)
+		}
+		if code := kill("foo"); code != http.StatusBadRequest {
+			t.Errorf("invalid id: want 400, got %v", code)
+		}
+	})
+
+	t.Run("websocket", func(t *testing.T) {
+		f := newFlow()
+		defer f.Finish()
+		msg := &messageKill{mType: messageTypeKillFlow, id: f.Id}
+		if err := c.WriteMessage(websocket.BinaryMessage, msg.bytes()); err != nil {
+			t.Fatal(err)
+		}
+		select {
+		case <-f.Killed():
+		case <-time.After(time.Second):
+			t.Fatal("want flow killed")
+		}
+
+		// the killed flow is reported to the web client
+		webAddon.FlowKilled(f)
+		c.SetReadDeadline(time.Now().Add(time.Second))
+		for {
+			_, data, err := c.ReadMessage()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if messageType(data[1]) == messageTypeKilled {
+				if string(data[2:38]) != f.Id.String() {
+					t.Errorf("unexpected killed flow %s", data[2:38])
+				}
+				break
+			}
+		}
+	})
+
+	// finished flows can not be killed
+	f := newFlow()
+	f.Finish()
+	time.Sleep(50 * time.Millisecond)
+	if code := kill(f.Id.String()); code != http.StatusNotFound {
+		t.Errorf("finished flow: want 404, got %v", code)
+	}
+}
+
+func TestWebAddon_Replay(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("replayed"))
+	}))
+	defer server.Close()
+
+	p, err := proxy.NewProxy(&proxy.Options{Addr: ":0", StreamLargeBodies: 1024 * 1024})
+	if err != nil {
+		t.Fatal(err)
+	}
+	webAddon := NewWebAddon(":0")
+	webAddon.Proxy = p
+	p.AddAddon(webAddon)
+	webAddon.Start()
+	defer webAddon.Close()
+	time.Sleep(50 * time.Millisecond)
+
+	u := url.URL{Scheme: "ws", Host: webAddon.Addr, Path: "/echo"}
+	c, _, err := websocket.DefaultDialer.Dial(u.String(), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	time.Sleep(50 * time.Millisecond)
+
+	reqUrl, _ := url.Parse(server.URL + "/replay")
+	orig := uuid.NewV4()
+	msg := &messageEdit{
+		mType:   messageTypeReplay,
+		id:      orig,
+		request: &proxy.Request{Method: "GET", URL: reqUrl, Proto: "HTTP/1.1", Header: make(http.Header)},
+	}
+	if err := c.WriteMessage(websocket.BinaryMessage, msg.bytes()); err != nil {
+		t.Fatal(err)
+	}
+
+	// the replay shows up as a new flow linked to the original
+	c.SetReadDeadline(time.Now().Add(5 * time.Second))
+	for {
+		_, data, err := c.ReadMessage()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if messageType(data[1]) != messageTypeRequest {
+			continue
+		}
+		var content map[string]interface{}
+		if err := json.Unmarshal(data[39:], &content); err != nil {
+			t.Fatal(err)
+		}
+		if string(data[2:38]) == orig.String() || content["replayOf"] != orig.String() {
+			t.Errorf("want a new flow replaying %v, got %s %v", orig, data[2:38], content["replayOf"])
+		}
+		break
+	}
+}
+
+func TestWebAddon_Network(t *testing.T) {
+	webAddon := NewWebAddon(":0")
+	do := func(method, body string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, "/api/network", strings.NewReader(body))
+		rec := httptest.NewRecorder()
+		webAddon.server.Handler.ServeHTTP(rec, req)
+		return rec
+	}
+
+	if rec := do("GET", ""); rec.Code != http.StatusNotFound {
+		t.Errorf("want 404 without network conditions, got %v", rec.Code)
+	}
+	network, err := proxy.NewNetworkConditions(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	webAddon.Network = network
+
+	if rec := do("PUT", `[{"hosts": ["*.example.com"], "preset": "3g", "latency": 500}]`); rec.Code != http.StatusNoContent {
+		t.Fatalf("want 204, got %v %v", rec.Code, rec.Body)
+	}
+	if rules := network.Rules(); len(rules) != 1 || rules[0].Preset != "3g" || rules[0].Latency != 500 {
+		t.Errorf("unexpected rules %+v", rules)
+	}
+	for _, body := range []string{`{`, `[{"preset": "dialup"}]`} {
+		if rec := do("PUT", body); rec.Code != http.StatusBadRequest {
+			t.Errorf("want 400 for %v, got %v", body, rec.Code)
+		}
+	}
+
+	rec := do("GET", "")
+	var got struct {
+		Presets map[string]proxy.NetworkCondition `json:"presets"`
+		Rules   []*proxy.NetworkRule              `json:"rules"`
+	}
+	if err := json.Unmarshal(rec.Body.Bytes(), &got); err != nil {
+		t.Fatal(err)
+	}
+	if got.Presets["edge"].Down != 240 || len(got.Rules) != 1 || got.Rules[0].Hosts[0] != "*.example.com" {
+		t.Errorf("unexpected network %s", rec.Body)
+	}
+}
+
+func TestWebAddon_Addons(t *testing.T) {
+	webAddon := NewWebAddon(":0")
+	do := func(method, target, body string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, target, strings.NewReader(body))
+		rec := httptest.NewRecorder()
+		webAddon.server.Handler.ServeHTTP(rec, req)
+		return rec
+	}
+
+	if rec := do("GET", "/api/addons", ""); rec.Code != http.StatusNotFound {
+		t.Errorf("want 404 without a proxy, got %v", rec.Code)
+	}
+	p, err := proxy.NewProxy(&proxy.Options{Addr: ":0", StreamLargeBodies: 1024 * 1024})
+	if err != nil {
+		t.Fatal(err)
+	}
+	webAddon.Proxy = p
+	p.AddAddon(webAddon)
+	if err := p.Registry.Register("log", 10, &proxy.LogAddon{}); err != nil {
+		t.Fatal(err)
+	}
+
+	if rec := do("PATCH", "/api/addons/log", `{"enabled": false, "priority": -1}`); rec.Code != http.StatusNoContent {
+		t.Fatalf("want 204, got %v %v", rec.Code, rec.Body)
+	}
+	if len(p.Registry.Addons()) != 1 {
+		t.Errorf("want the log addon disabled, got %v", p.Registry.Addons())
+	}
+	if rec := do("PATCH", "/api/addons/dumper", `{"enabled": true}`); rec.Code != http.StatusNotFound {
+		t.Errorf("want 404 for an unknown addon, got %v", rec.Code)
+	}
+	if rec := do("PATCH", "/api/addons/log", `{`); rec.Code != http.StatusBadRequest {
+		t.Errorf("want 400 for a bad body, got %v", rec.Code)
+	}
+
+	rec := do("GET", "/api/addons", "")
+	var got []proxy.AddonInfo
+	if err := json.Unmarshal(rec.Body.Bytes(), &got); err != nil {
+		t.Fatal(err)
+	}
+	want := []proxy.AddonInfo{
+		{Name: "log", Type: "LogAddon", Priority: -1, Enabled: false},
+		{Name: "WebAddon", Type: "WebAddon", Priority: 0, Enabled: true},
+	}
+	if len(got) != 2 || got[0] != want[0] || got[1] != want[1] {
+		t.Errorf("want %+v, got %+v", want, got)
+	}
+}